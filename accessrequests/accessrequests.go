@@ -0,0 +1,158 @@
+package accessrequests
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/jsonconfig"
+)
+
+// Users without access to some data can ask for it rather than just
+// being refused. A request is for a group, e.g. ngs, or for a dataset in
+// one of the data modules, with a justification. Approvers are emailed
+// and an admin approves or denies it. Everything that happens to a
+// request is written to an audit log.
+
+const (
+	KindGroup   = "group"
+	KindDataset = "dataset"
+)
+
+var (
+	ErrNotRequestable  = errors.New("access to this cannot be requested")
+	ErrNoJustification = errors.New("please explain why you need access")
+	ErrTooLong         = errors.New("access cannot be granted for this long")
+)
+
+type GroupConfig struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// emailed about requests for this group instead of the
+	// default approvers
+	Approvers []string `json:"approvers"`
+	// longest membership that can be granted, 0 for no limit
+	MaxDays int `json:"maxDays"`
+}
+
+type Config struct {
+	// emailed about every request unless its group has approvers
+	Approvers []string `json:"approvers"`
+	// groups users may ask to join
+	Groups []GroupConfig `json:"groups"`
+	// modules whose datasets can be requested
+	DatasetModules []string `json:"datasetModules"`
+	// longest access that can be granted, 0 for no limit
+	MaxDays int `json:"maxDays"`
+	// shortest justification we accept
+	MinJustificationLength int `json:"minJustificationLength"`
+}
+
+var DefaultConfig = Config{
+	MinJustificationLength: 10,
+}
+
+type Policy struct {
+	Requests *RequestStore
+	Audit    *AuditLog
+	config   Config
+}
+
+func LoadConfig(file string) (*Config, error) {
+	config := DefaultConfig
+
+	err := jsonconfig.Load(file, &config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func NewPolicy(requests *RequestStore, audit *AuditLog, config Config) *Policy {
+	return &Policy{Requests: requests, Audit: audit, config: config}
+}
+
+func (policy *Policy) Config() Config {
+	return policy.config
+}
+
+func (policy *Policy) group(name string) (*GroupConfig, bool) {
+	for i := range policy.config.Groups {
+		if policy.config.Groups[i].Name == name {
+			return &policy.config.Groups[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// Check makes sure a new request is for something that can be requested
+func (policy *Policy) Check(req *Request) error {
+	if len(strings.TrimSpace(req.Justification)) < policy.config.MinJustificationLength {
+		return ErrNoJustification
+	}
+
+	switch req.Kind {
+	case KindGroup:
+		if _, ok := policy.group(req.Group); !ok {
+			return ErrNotRequestable
+		}
+	case KindDataset:
+		if req.Dataset == "" || !slices.Contains(policy.config.DatasetModules, req.Module) {
+			return ErrNotRequestable
+		}
+	default:
+		return ErrNotRequestable
+	}
+
+	if req.Days < 0 {
+		return ErrTooLong
+	}
+
+	return nil
+}
+
+// Approvers returns who to email about a request
+func (policy *Policy) Approvers(req *Request) []string {
+	approvers := policy.config.Approvers
+
+	if group, ok := policy.group(req.Group); ok && req.Kind == KindGroup && len(group.Approvers) > 0 {
+		approvers = group.Approvers
+	}
+
+	// addresses from unset env variables are empty
+	return slices.DeleteFunc(slices.Clone(approvers), func(approver string) bool {
+		return strings.TrimSpace(approver) == ""
+	})
+}
+
+// ExpiresAt works out when access granted now for a number of days
+// ends. No days means permanent unless there is a limit, in which case
+// access is for the limit.
+func (policy *Policy) ExpiresAt(req *Request, days int) (*time.Time, error) {
+	maxDays := policy.config.MaxDays
+
+	if group, ok := policy.group(req.Group); ok && req.Kind == KindGroup && group.MaxDays > 0 {
+		maxDays = group.MaxDays
+	}
+
+	if days < 0 || (maxDays > 0 && days > maxDays) {
+		return nil, fmt.Errorf("%w, at most %d days", ErrTooLong, maxDays)
+	}
+
+	if days == 0 {
+		days = maxDays
+	}
+
+	if days == 0 {
+		return nil, nil
+	}
+
+	t := time.Now().UTC().AddDate(0, 0, days)
+
+	return &t, nil
+}
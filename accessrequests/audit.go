@@ -0,0 +1,116 @@
+package accessrequests
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The audit log of access requests. Entries are never changed, only
+// the oldest are dropped once the log is full.
+
+const (
+	auditKey = "access:audit"
+
+	// entries kept
+	maxAuditEvents = 10000
+)
+
+const (
+	ActionRequested = "requested"
+	ActionCancelled = "cancelled"
+	ActionApproved  = "approved"
+	ActionDenied    = "denied"
+	ActionGranted   = "granted"
+	ActionNotified  = "notified"
+)
+
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"requestId"`
+	// the user who made the request
+	UserId string `json:"userId"`
+	// who did this, the user or an admin
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	Detail string `json:"detail,omitempty"`
+	IpAddr string `json:"ipAddr,omitempty"`
+}
+
+type AuditLog struct {
+	rdb *redis.Client
+}
+
+func NewAuditLog(rdb *redis.Client) *AuditLog {
+	return &AuditLog{rdb: rdb}
+}
+
+func (audit *AuditLog) Record(ctx context.Context, event *AuditEvent) error {
+	event.Time = time.Now().UTC()
+
+	data, err := json.Marshal(event)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = audit.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, auditKey, data)
+		pipe.LTrim(ctx, auditKey, 0, maxAuditEvents-1)
+		return nil
+	})
+
+	return err
+}
+
+// RecordAction records something that happened to a request
+func (audit *AuditLog) RecordAction(ctx context.Context, req *Request, actor string, action string, detail string, ipAddr string) error {
+	return audit.Record(ctx, &AuditEvent{RequestId: req.Id,
+		UserId: req.UserId,
+		Actor:  actor,
+		Action: action,
+		Detail: detail,
+		IpAddr: ipAddr})
+}
+
+// List returns audit events, newest first. If requestId is not empty
+// only the events of that request are returned.
+func (audit *AuditLog) List(ctx context.Context, requestId string, offset int, limit int) ([]*AuditEvent, error) {
+	var values []string
+	var err error
+
+	if requestId == "" {
+		values, err = audit.rdb.LRange(ctx, auditKey, int64(offset), int64(offset+limit-1)).Result()
+	} else {
+		// the events of a request are spread through the log
+		values, err = audit.rdb.LRange(ctx, auditKey, 0, -1).Result()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*AuditEvent, 0, len(values))
+
+	for _, v := range values {
+		var event AuditEvent
+
+		err = json.Unmarshal([]byte(v), &event)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if requestId == "" || event.RequestId == requestId {
+			ret = append(ret, &event)
+		}
+	}
+
+	if requestId != "" {
+		ret = ret[min(offset, len(ret)):min(offset+limit, len(ret))]
+	}
+
+	return ret, nil
+}
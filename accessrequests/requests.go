@@ -0,0 +1,333 @@
+package accessrequests
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	requestsKey           = "access:requests"
+	userRequestsKeyPrefix = "access:requests:user:"
+	// claimed by a pending request so a user cannot
+	// have two pending requests for the same thing
+	pendingKeyPrefix = "access:requests:pending:"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusApproved  = "approved"
+	StatusDenied    = "denied"
+	StatusCancelled = "cancelled"
+)
+
+var (
+	ErrRequestNotFound = errors.New("access request not found")
+	ErrRequestPending  = errors.New("you have already asked for this, your request is waiting to be reviewed")
+	ErrRequestDecided  = errors.New("access request has already been decided")
+)
+
+// deletes the pending key of a request only if it is still held by that
+// request, which is how a decision claims it
+var claimScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+type Request struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Id        string    `json:"id"`
+	UserId    string    `json:"userId"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	// group or dataset
+	Kind    string `json:"kind"`
+	Group   string `json:"group,omitempty"`
+	Module  string `json:"module,omitempty"`
+	Dataset string `json:"dataset,omitempty"`
+	// why the user needs access
+	Justification string `json:"justification"`
+	// how long access is wanted for, 0 for as long as allowed
+	Days      int        `json:"days"`
+	Status    string     `json:"status"`
+	DecidedAt *time.Time `json:"decidedAt,omitempty"`
+	DecidedBy string     `json:"decidedBy,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	// when granted access ends, if it does
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type RequestStore struct {
+	rdb *redis.Client
+}
+
+func NewRequestStore(rdb *redis.Client) *RequestStore {
+	return &RequestStore{rdb: rdb}
+}
+
+func userRequestsKey(userId string) string {
+	return userRequestsKeyPrefix + userId
+}
+
+func pendingKey(req *Request) string {
+	return pendingKeyPrefix + req.UserId + ":" + req.Kind + ":" + req.Group + ":" + req.Module + ":" + req.Dataset
+}
+
+func newRequestId() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (store *RequestStore) save(ctx context.Context, req *Request) error {
+	data, err := json.Marshal(req)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, requestsKey, req.Id, data)
+		pipe.SAdd(ctx, userRequestsKey(req.UserId), req.Id)
+		return nil
+	})
+
+	return err
+}
+
+// Create adds a pending request. A user cannot have two pending
+// requests for the same thing, which is enforced by claiming a key for
+// the pair so that two requests sent at once cannot both get in.
+func (store *RequestStore) Create(ctx context.Context, req *Request) error {
+	id, err := newRequestId()
+
+	if err != nil {
+		return err
+	}
+
+	ok, err := store.rdb.SetNX(ctx, pendingKey(req), id, 0).Result()
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrRequestPending
+	}
+
+	req.Id = id
+	req.CreatedAt = time.Now().UTC()
+	req.Status = StatusPending
+
+	err = store.save(ctx, req)
+
+	if err != nil {
+		store.rdb.Del(ctx, pendingKey(req))
+		return err
+	}
+
+	return nil
+}
+
+func (store *RequestStore) Get(ctx context.Context, id string) (*Request, error) {
+	data, err := store.rdb.HGet(ctx, requestsKey, id).Bytes()
+
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrRequestNotFound
+		}
+
+		return nil, err
+	}
+
+	var req Request
+
+	err = json.Unmarshal(data, &req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &req, nil
+}
+
+func sortRequests(list []*Request) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+}
+
+// List returns the requests with a status, or all of them if
+// status is empty, oldest first
+func (store *RequestStore) List(ctx context.Context, status string) ([]*Request, error) {
+	values, err := store.rdb.HGetAll(ctx, requestsKey).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Request, 0, len(values))
+
+	for _, v := range values {
+		var req Request
+
+		err = json.Unmarshal([]byte(v), &req)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if status == "" || req.Status == status {
+			ret = append(ret, &req)
+		}
+	}
+
+	sortRequests(ret)
+
+	return ret, nil
+}
+
+// ListForUser returns the requests a user has made, oldest first
+func (store *RequestStore) ListForUser(ctx context.Context, userId string) ([]*Request, error) {
+	ids, err := store.rdb.SMembers(ctx, userRequestsKey(userId)).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Request, 0, len(ids))
+
+	if len(ids) == 0 {
+		return ret, nil
+	}
+
+	values, err := store.rdb.HMGet(ctx, requestsKey, ids...).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range values {
+		s, ok := v.(string)
+
+		if !ok {
+			continue
+		}
+
+		var req Request
+
+		err = json.Unmarshal([]byte(s), &req)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &req)
+	}
+
+	sortRequests(ret)
+
+	return ret, nil
+}
+
+// Claim takes a pending request so it can be decided. Of admins
+// deciding at once, or an admin and the user cancelling, only one gets
+// it, so anything a decision grants must only be done once it has been
+// claimed. A claimed request must then be decided or unclaimed.
+func (store *RequestStore) Claim(ctx context.Context, id string) (*Request, error) {
+	req, err := store.Get(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Status != StatusPending {
+		return nil, ErrRequestDecided
+	}
+
+	n, err := claimScript.Run(ctx, store.rdb, []string{pendingKey(req)}, req.Id).Int()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if n == 0 {
+		return nil, ErrRequestDecided
+	}
+
+	return req, nil
+}
+
+// Unclaim puts back a claimed request that could not be decided, e.g.
+// because granting what it asked for failed, so it can be tried again
+func (store *RequestStore) Unclaim(ctx context.Context, req *Request) error {
+	return store.rdb.SetNX(ctx, pendingKey(req), req.Id, 0).Err()
+}
+
+// Decide records the outcome of a claimed request. The user can then
+// ask again.
+func (store *RequestStore) Decide(ctx context.Context,
+	req *Request,
+	status string,
+	decidedBy string,
+	reason string,
+	expiresAt *time.Time) error {
+	if req.Status != StatusPending {
+		return ErrRequestDecided
+	}
+
+	now := time.Now().UTC()
+
+	decided := *req
+	decided.Status = status
+	decided.DecidedAt = &now
+	decided.DecidedBy = decidedBy
+	decided.Reason = reason
+	decided.ExpiresAt = expiresAt
+
+	err := store.save(ctx, &decided)
+
+	if err != nil {
+		// it is still pending as far as anyone else can tell
+		store.Unclaim(ctx, req)
+		return err
+	}
+
+	*req = decided
+
+	return nil
+}
+
+// Clear removes the requests of a user, e.g. when the
+// account is deleted
+func (store *RequestStore) Clear(ctx context.Context, userId string) error {
+	list, err := store.ListForUser(ctx, userId)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, req := range list {
+			pipe.HDel(ctx, requestsKey, req.Id)
+			pipe.Del(ctx, pendingKey(req))
+		}
+
+		pipe.Del(ctx, userRequestsKey(userId))
+		return nil
+	})
+
+	return err
+}
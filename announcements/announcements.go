@@ -0,0 +1,478 @@
+package announcements
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Announcements and data releases broadcast to groups. Each is emailed
+// to the members of its groups who have not opted out and shown in the
+// app to members until it expires.
+
+const (
+	announcementsKey = "announcements"
+	// ids scored by when they were made
+	announcementsIndexKey = "announcements:index"
+	deliveryKeyPrefix     = "announcements:delivery:"
+	// held by the server emailing an announcement
+	leaseKeyPrefix = "announcements:lease:"
+
+	KindAnnouncement = "announcement"
+	KindRelease      = "release"
+
+	StatusSending = "sending"
+	StatusSent    = "sent"
+	// emailing ended early, the delivery counts show how far it got
+	StatusStopped = "stopped"
+	// only shown in the app
+	StatusPosted = "posted"
+
+	// how many of the latest announcements users can see
+	maxRecent = 100
+
+	// how long a server may go without saving its progress before
+	// another takes over emailing an announcement
+	leaseTtl = time.Minute
+)
+
+var (
+	ErrAnnouncementNotFound = errors.New("announcement not found")
+	ErrUnknownKind          = errors.New("kind must be announcement or release")
+	ErrNoTitle              = errors.New("an announcement needs a title")
+	ErrNoGroups             = errors.New("an announcement needs at least one group")
+
+	errLeaseLost = errors.New("lease on announcement lost")
+)
+
+// the lease is only renewed or given up by the server holding it, it
+// may have run out and been taken by another
+var renewScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+var releaseScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// Delivery counts how many emails an announcement has led to
+type Delivery struct {
+	// members of the groups with an email address
+	Recipients int64 `json:"recipients" redis:"recipients"`
+	// added to the outbox
+	Sent     int64 `json:"sent" redis:"sent"`
+	OptedOut int64 `json:"optedOut" redis:"optedOut"`
+	Failed   int64 `json:"failed" redis:"failed"`
+	// id of the last member emailed, where sending carries on from
+	Cursor string `json:"-" redis:"cursor"`
+}
+
+type Announcement struct {
+	CreatedAt time.Time `json:"createdAt"`
+	// when it stops being shown in the app, if it does
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	SentAt    *time.Time `json:"sentAt,omitempty"`
+	Delivery  *Delivery  `json:"delivery,omitempty"`
+	Id        string     `json:"id"`
+	// announcement or release
+	Kind      string   `json:"kind"`
+	Title     string   `json:"title"`
+	Body      string   `json:"body"`
+	LinkUrl   string   `json:"linkUrl,omitempty"`
+	Groups    []string `json:"groups"`
+	CreatedBy string   `json:"createdBy"`
+	Status    string   `json:"status"`
+}
+
+type AnnouncementStore struct {
+	rdb *redis.Client
+}
+
+func NewAnnouncementStore(rdb *redis.Client) *AnnouncementStore {
+	return &AnnouncementStore{rdb: rdb}
+}
+
+func deliveryKey(id string) string {
+	return deliveryKeyPrefix + id
+}
+
+func leaseKey(id string) string {
+	return leaseKeyPrefix + id
+}
+
+func newAnnouncementId() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Check makes sure an announcement can be sent and tidies it
+func Check(announcement *Announcement) error {
+	switch announcement.Kind {
+	case KindAnnouncement, KindRelease:
+	default:
+		return ErrUnknownKind
+	}
+
+	announcement.Title = strings.TrimSpace(announcement.Title)
+
+	if announcement.Title == "" {
+		return ErrNoTitle
+	}
+
+	var groups []string
+
+	for _, group := range announcement.Groups {
+		group = strings.TrimSpace(group)
+
+		if group != "" && !slices.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+
+	if len(groups) == 0 {
+		return ErrNoGroups
+	}
+
+	announcement.Groups = groups
+
+	return nil
+}
+
+// For returns whether an announcement is meant for someone in
+// some groups
+func (announcement *Announcement) For(groups []string) bool {
+	for _, group := range groups {
+		if slices.Contains(announcement.Groups, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// save writes an announcement, its delivery counts are kept apart
+func (store *AnnouncementStore) save(ctx context.Context, announcement *Announcement) error {
+	ret := *announcement
+	ret.Delivery = nil
+
+	b, err := json.Marshal(&ret)
+
+	if err != nil {
+		return err
+	}
+
+	return store.rdb.HSet(ctx, announcementsKey, announcement.Id, b).Err()
+}
+
+// Create saves a new announcement
+func (store *AnnouncementStore) Create(ctx context.Context, announcement *Announcement) error {
+	id, err := newAnnouncementId()
+
+	if err != nil {
+		return err
+	}
+
+	announcement.Id = id
+	announcement.CreatedAt = time.Now().UTC()
+
+	b, err := json.Marshal(announcement)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, announcementsKey, id, b)
+		pipe.ZAdd(ctx, announcementsIndexKey, redis.Z{Score: float64(announcement.CreatedAt.UnixMilli()), Member: id})
+		return nil
+	})
+
+	return err
+}
+
+// Get returns an announcement with its delivery counts
+func (store *AnnouncementStore) Get(ctx context.Context, id string) (*Announcement, error) {
+	list, err := store.load(ctx, []string{id})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(list) == 0 {
+		return nil, ErrAnnouncementNotFound
+	}
+
+	announcement := list[0]
+
+	announcement.Delivery, err = store.Delivery(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return announcement, nil
+}
+
+// List returns the announcements with their delivery counts,
+// newest first
+func (store *AnnouncementStore) List(ctx context.Context, offset int, limit int) ([]*Announcement, error) {
+	ids, err := store.rdb.ZRevRange(ctx, announcementsIndexKey, int64(offset), int64(offset+limit-1)).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := store.load(ctx, ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, announcement := range list {
+		announcement.Delivery, err = store.Delivery(ctx, announcement.Id)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return list, nil
+}
+
+// Recent returns the announcements for someone in some groups made
+// after a time and not yet expired, newest first
+func (store *AnnouncementStore) Recent(ctx context.Context, groups []string, since time.Time) ([]*Announcement, error) {
+	ids, err := store.rdb.ZRevRangeByScore(ctx, announcementsIndexKey, &redis.ZRangeBy{
+		Max:   "+inf",
+		Min:   "(" + formatScore(since),
+		Count: maxRecent}).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := store.load(ctx, ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return slices.DeleteFunc(list, func(announcement *Announcement) bool {
+		return !announcement.For(groups) ||
+			(announcement.ExpiresAt != nil && !announcement.ExpiresAt.After(now))
+	}), nil
+}
+
+// Delete removes an announcement from the app and stops it being
+// emailed to anyone it has not been sent to yet
+func (store *AnnouncementStore) Delete(ctx context.Context, id string) error {
+	n, err := store.rdb.HDel(ctx, announcementsKey, id).Result()
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrAnnouncementNotFound
+	}
+
+	_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, announcementsIndexKey, id)
+		pipe.Del(ctx, deliveryKey(id))
+		return nil
+	})
+
+	return err
+}
+
+// CreatedBy returns the announcements a user made, newest first
+func (store *AnnouncementStore) CreatedBy(ctx context.Context, userId string) ([]*Announcement, error) {
+	return store.filter(ctx, func(announcement *Announcement) bool {
+		return announcement.CreatedBy == userId
+	})
+}
+
+// sending returns the announcements still being emailed, newest first
+func (store *AnnouncementStore) sending(ctx context.Context) ([]*Announcement, error) {
+	return store.filter(ctx, func(announcement *Announcement) bool {
+		return announcement.Status == StatusSending
+	})
+}
+
+// filter returns the announcements that match, newest first
+func (store *AnnouncementStore) filter(ctx context.Context, match func(*Announcement) bool) ([]*Announcement, error) {
+	values, err := store.rdb.HGetAll(ctx, announcementsKey).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Announcement, 0, 10)
+
+	for _, v := range values {
+		var announcement Announcement
+
+		err = json.Unmarshal([]byte(v), &announcement)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if match(&announcement) {
+			ret = append(ret, &announcement)
+		}
+	}
+
+	slices.SortFunc(ret, func(a, b *Announcement) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return ret, nil
+}
+
+// ForgetCreator removes a user from the announcements they made, e.g.
+// when the account is deleted. The announcements themselves are kept
+// since they were sent to other people.
+func (store *AnnouncementStore) ForgetCreator(ctx context.Context, userId string) error {
+	list, err := store.CreatedBy(ctx, userId)
+
+	if err != nil {
+		return err
+	}
+
+	for _, announcement := range list {
+		announcement.CreatedBy = ""
+
+		err = store.save(ctx, announcement)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delivery returns how many emails an announcement has led to
+func (store *AnnouncementStore) Delivery(ctx context.Context, id string) (*Delivery, error) {
+	var delivery Delivery
+
+	err := store.rdb.HGetAll(ctx, deliveryKey(id)).Scan(&delivery)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// progress adds to the delivery counts of an announcement and records
+// the last member emailed
+func (store *AnnouncementStore) progress(ctx context.Context, id string, delivery *Delivery, cursor string) error {
+	_, err := store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		key := deliveryKey(id)
+		pipe.HIncrBy(ctx, key, "recipients", delivery.Recipients)
+		pipe.HIncrBy(ctx, key, "sent", delivery.Sent)
+		pipe.HIncrBy(ctx, key, "optedOut", delivery.OptedOut)
+		pipe.HIncrBy(ctx, key, "failed", delivery.Failed)
+		pipe.HSet(ctx, key, "cursor", cursor)
+		return nil
+	})
+
+	return err
+}
+
+// lease lets a server email an announcement. It returns false if
+// another server is doing so.
+func (store *AnnouncementStore) lease(ctx context.Context, id string) (string, bool, error) {
+	token, err := newAnnouncementId()
+
+	if err != nil {
+		return "", false, err
+	}
+
+	ok, err := store.rdb.SetNX(ctx, leaseKey(id), token, leaseTtl).Result()
+
+	if err != nil {
+		return "", false, err
+	}
+
+	return token, ok, nil
+}
+
+// renew extends a lease, it returns false if the lease was lost
+func (store *AnnouncementStore) renew(ctx context.Context, id string, token string) (bool, error) {
+	n, err := renewScript.Run(ctx, store.rdb, []string{leaseKey(id)}, token, leaseTtl.Milliseconds()).Int()
+
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (store *AnnouncementStore) release(ctx context.Context, id string, token string) error {
+	return releaseScript.Run(ctx, store.rdb, []string{leaseKey(id)}, token).Err()
+}
+
+func (store *AnnouncementStore) exists(ctx context.Context, id string) (bool, error) {
+	return store.rdb.HExists(ctx, announcementsKey, id).Result()
+}
+
+func (store *AnnouncementStore) load(ctx context.Context, ids []string) ([]*Announcement, error) {
+	if len(ids) == 0 {
+		return []*Announcement{}, nil
+	}
+
+	values, err := store.rdb.HMGet(ctx, announcementsKey, ids...).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Announcement, 0, len(values))
+
+	for _, value := range values {
+		s, ok := value.(string)
+
+		// deleted since the ids were read
+		if !ok {
+			continue
+		}
+
+		var announcement Announcement
+
+		err = json.Unmarshal([]byte(s), &announcement)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &announcement)
+	}
+
+	return ret, nil
+}
+
+func formatScore(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
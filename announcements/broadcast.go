@@ -0,0 +1,382 @@
+package announcements
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	"github.com/antonybholmes/go-edbserver-gin/notifications"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Emailing an announcement to everyone in its groups. The members are
+// read a page at a time in order of id and their emails are added to
+// the outbox in batches with a pause between them so a broadcast to a
+// large group does not flood it. After each batch the id of the last
+// member is saved with the delivery counts, and the server sending
+// holds a lease it renews. If the server stops, another carries on
+// from the last saved member once the lease runs out, so at most one
+// batch is emailed twice.
+
+const (
+	// members read from the database at a time
+	usersPage = 500
+
+	DefaultResumeInterval = time.Minute
+)
+
+type Throttle struct {
+	// emails queued before pausing
+	BatchSize int
+	Pause     time.Duration
+}
+
+var DefaultThrottle = Throttle{
+	BatchSize: 50,
+	Pause:     2 * time.Second,
+}
+
+// what is sent in the email payload
+type announcementData struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type recipient struct {
+	id    string
+	email string
+	name  string
+}
+
+// members of any of the groups with an email address, after an id.
+// Memberships that have ended but not been cleaned up yet do not count.
+const recipientsSql = `SELECT u.id::text, u.email, u.name
+	FROM users u
+	WHERE u.email <> '' AND u.id > $2::uuid AND EXISTS (
+		SELECT 1 FROM user_groups ug
+		JOIN groups g ON g.id = ug.group_id
+		WHERE ug.user_id = u.id AND g.name = ANY($1)
+		AND (ug.expires_at IS NULL OR ug.expires_at > now()))
+	ORDER BY u.id
+	LIMIT $3`
+
+// ids start after this one
+const firstCursor = "00000000-0000-0000-0000-000000000000"
+
+type Broadcaster struct {
+	Store    *AnnouncementStore
+	db       *pgxpool.Pool
+	throttle Throttle
+}
+
+func NewBroadcaster(store *AnnouncementStore, db *pgxpool.Pool, throttle Throttle) *Broadcaster {
+	return &Broadcaster{Store: store, db: db, throttle: throttle}
+}
+
+// Post saves an announcement so users see it in the app and, if email
+// is true, starts emailing it in the background
+func (broadcaster *Broadcaster) Post(ctx context.Context, announcement *Announcement, email bool) error {
+	err := Check(announcement)
+
+	if err != nil {
+		return err
+	}
+
+	if email {
+		announcement.Status = StatusSending
+	} else {
+		announcement.Status = StatusPosted
+	}
+
+	err = broadcaster.Store.Create(ctx, announcement)
+
+	if err != nil {
+		return err
+	}
+
+	if email {
+		// the request will be long gone before the emails are
+		go broadcaster.send(context.Background(), *announcement)
+	}
+
+	return nil
+}
+
+// Start carries on emailing announcements that a server stopped
+// sending, checking at every interval until the context is done
+func (broadcaster *Broadcaster) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			list, err := broadcaster.Store.sending(ctx)
+
+			if err != nil {
+				log.Error().Msgf("could not list announcements being sent: %v", err)
+				continue
+			}
+
+			// those still leased by the server sending them are skipped
+			for _, announcement := range list {
+				go broadcaster.send(ctx, *announcement)
+			}
+		}
+	}()
+}
+
+func (broadcaster *Broadcaster) send(ctx context.Context, announcement Announcement) {
+	token, ok, err := broadcaster.Store.lease(ctx, announcement.Id)
+
+	if err != nil {
+		log.Error().Msgf("could not lease announcement %s: %v", announcement.Id, err)
+		return
+	}
+
+	if !ok {
+		return
+	}
+
+	defer func() {
+		err := broadcaster.Store.release(context.WithoutCancel(ctx), announcement.Id, token)
+
+		if err != nil {
+			log.Warn().Msgf("could not release announcement %s: %v", announcement.Id, err)
+		}
+	}()
+
+	delivery, err := broadcaster.Send(ctx, &announcement, token)
+
+	if err == errLeaseLost {
+		log.Warn().Msgf("lost the lease on announcement %s, another server is sending it", announcement.Id)
+		return
+	}
+
+	status := StatusSent
+
+	if err != nil {
+		log.Error().Msgf("emailing announcement %s stopped: %v", announcement.Id, err)
+		status = StatusStopped
+	}
+
+	log.Info().Msgf("announcement %s sent to %d of %d, %d opted out, %d failed",
+		announcement.Id,
+		delivery.Sent,
+		delivery.Recipients,
+		delivery.OptedOut,
+		delivery.Failed)
+
+	err = broadcaster.finish(ctx, announcement.Id, status)
+
+	if err != nil {
+		log.Error().Msgf("could not update announcement %s: %v", announcement.Id, err)
+	}
+}
+
+// Send emails an announcement to the members of its groups who want
+// it, carrying on after the last member saved, and returns the delivery
+// counts of this run. Sending stops if the announcement is deleted or
+// the lease on it is lost.
+func (broadcaster *Broadcaster) Send(ctx context.Context, announcement *Announcement, token string) (*Delivery, error) {
+	emailType := emails.EmailQueueTypeAnnouncement
+	category := notifications.CategoryAnnouncements
+
+	if announcement.Kind == KindRelease {
+		emailType = emails.EmailQueueTypeDataRelease
+		category = notifications.CategoryReleases
+	}
+
+	linkUrl := announcement.LinkUrl
+
+	if linkUrl == "" {
+		linkUrl = consts.AppUrl
+	}
+
+	data, err := json.Marshal(&announcementData{Id: announcement.Id,
+		Title: announcement.Title,
+		Body:  announcement.Body})
+
+	if err != nil {
+		return &Delivery{}, err
+	}
+
+	saved, err := broadcaster.Store.Delivery(ctx, announcement.Id)
+
+	if err != nil {
+		return &Delivery{}, err
+	}
+
+	cursor := saved.Cursor
+
+	if cursor == "" {
+		cursor = firstCursor
+	} else {
+		log.Info().Msgf("resuming announcement %s after user %s", announcement.Id, cursor)
+	}
+
+	var total Delivery
+	// counts since they were last saved
+	var batch Delivery
+
+	// save the counts of the batch and how far it got, pause and check
+	// the announcement has not been deleted
+	flush := func(pause bool) (bool, error) {
+		err := broadcaster.Store.progress(ctx, announcement.Id, &batch, cursor)
+
+		if err != nil {
+			return false, err
+		}
+
+		batch = Delivery{}
+
+		ok, err := broadcaster.Store.renew(ctx, announcement.Id, token)
+
+		if err != nil {
+			return false, err
+		}
+
+		if !ok {
+			return false, errLeaseLost
+		}
+
+		if pause {
+			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
+			case <-time.After(broadcaster.throttle.Pause):
+			}
+		}
+
+		return broadcaster.Store.exists(ctx, announcement.Id)
+	}
+
+	for {
+		users, err := broadcaster.recipients(ctx, announcement.Groups, cursor)
+
+		if err != nil {
+			flush(false)
+			return &total, err
+		}
+
+		for _, user := range users {
+			cursor = user.id
+
+			total.Recipients++
+			batch.Recipients++
+
+			enabled, err := notifications.Enabled(ctx, user.id, category)
+
+			if err != nil {
+				log.Warn().Msgf("could not read notifications of %s: %v", user.id, err)
+				total.Failed++
+				batch.Failed++
+				continue
+			}
+
+			if !enabled {
+				total.OptedOut++
+				batch.OptedOut++
+				continue
+			}
+
+			email := mailserver.MailItem{Name: user.name,
+				To:        user.email,
+				EmailType: emailType,
+				LinkUrl:   linkUrl,
+				Payload:   &mailserver.Payload{DataType: "announcement", Data: string(data)}}
+
+			err = outbox.SendMail(ctx, &email)
+
+			if err != nil {
+				log.Warn().Msgf("could not queue announcement %s for %s: %v", announcement.Id, user.id, err)
+				total.Failed++
+				batch.Failed++
+			} else {
+				total.Sent++
+				batch.Sent++
+			}
+
+			if batch.Sent+batch.Failed >= int64(broadcaster.throttle.BatchSize) {
+				ok, err := flush(true)
+
+				if err != nil {
+					return &total, err
+				}
+
+				if !ok {
+					log.Info().Msgf("announcement %s was deleted, stopped emailing it", announcement.Id)
+					return &total, nil
+				}
+			}
+		}
+
+		if len(users) < usersPage {
+			break
+		}
+	}
+
+	_, err = flush(false)
+
+	return &total, err
+}
+
+// recipients returns the next page of members of some groups
+func (broadcaster *Broadcaster) recipients(ctx context.Context, groups []string, after string) ([]*recipient, error) {
+	rows, err := broadcaster.db.Query(ctx, recipientsSql, groups, after, usersPage)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]*recipient, 0, usersPage)
+
+	for rows.Next() {
+		var user recipient
+
+		err = rows.Scan(&user.id, &user.email, &user.name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &user)
+	}
+
+	return ret, rows.Err()
+}
+
+// finish records that emailing an announcement has ended, unless it
+// has been deleted
+func (broadcaster *Broadcaster) finish(ctx context.Context, id string, status string) error {
+	announcement, err := broadcaster.Store.Get(ctx, id)
+
+	if err == ErrAnnouncementNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	announcement.Status = status
+	announcement.SentAt = &now
+
+	return broadcaster.Store.save(ctx, announcement)
+}
@@ -0,0 +1,139 @@
+package confirmations
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// One time tokens that are emailed to a user to confirm an action on
+// their account, such as deleting it. Only a hash of the token is kept
+// so a redis dump does not leak anything that can confirm an action.
+
+const confirmationKeyPrefix = "confirm:"
+
+var (
+	ErrInvalidConfirmation = errors.New("confirmation link is invalid or has expired")
+)
+
+type Confirmation struct {
+	CreatedAt time.Time       `json:"createdAt"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Kind      string          `json:"kind"`
+	UserId    string          `json:"userId"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+type ConfirmationStore struct {
+	rdb *redis.Client
+}
+
+func NewConfirmationStore(rdb *redis.Client) *ConfirmationStore {
+	return &ConfirmationStore{rdb: rdb}
+}
+
+func confirmationKey(kind string, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return confirmationKeyPrefix + kind + ":" + hex.EncodeToString(sum[:])
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Create stores a confirmation of a kind for a user along with any
+// data needed to carry out the action and returns its token
+func (store *ConfirmationStore) Create(ctx context.Context, kind string, userId string, data any, ttl time.Duration) (string, *Confirmation, error) {
+	token, err := newToken()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now().UTC()
+
+	confirmation := Confirmation{CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		Kind:      kind,
+		UserId:    userId}
+
+	if data != nil {
+		confirmation.Data, err = json.Marshal(data)
+
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	b, err := json.Marshal(confirmation)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = store.rdb.Set(ctx, confirmationKey(kind, token), b, ttl).Err()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, &confirmation, nil
+}
+
+func (store *ConfirmationStore) get(ctx context.Context, cmd *redis.StringCmd) (*Confirmation, error) {
+	b, err := cmd.Bytes()
+
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrInvalidConfirmation
+		}
+
+		return nil, err
+	}
+
+	var confirmation Confirmation
+
+	err = json.Unmarshal(b, &confirmation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &confirmation, nil
+}
+
+// Get returns a confirmation without using it up
+func (store *ConfirmationStore) Get(ctx context.Context, kind string, token string) (*Confirmation, error) {
+	return store.get(ctx, store.rdb.Get(ctx, confirmationKey(kind, token)))
+}
+
+// Consume returns a confirmation and deletes it so the
+// link cannot be used twice
+func (store *ConfirmationStore) Consume(ctx context.Context, kind string, token string) (*Confirmation, error) {
+	return store.get(ctx, store.rdb.GetDel(ctx, confirmationKey(kind, token)))
+}
+
+// Delete removes a confirmation, e.g. when it is cancelled
+func (store *ConfirmationStore) Delete(ctx context.Context, kind string, token string) error {
+	return store.rdb.Del(ctx, confirmationKey(kind, token)).Err()
+}
+
+// Unmarshal decodes the data stored with the confirmation
+func (confirmation *Confirmation) Unmarshal(v any) error {
+	return json.Unmarshal(confirmation.Data, v)
+}
@@ -1,17 +1,13 @@
 package consts
 
 import (
-	"crypto/ecdsa"
-	"crypto/rsa"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/antonybholmes/go-sys"
 	"github.com/antonybholmes/go-sys/env"
-	"github.com/antonybholmes/go-sys/log"
 	"github.com/antonybholmes/go-web/auth"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
 const (
@@ -23,17 +19,23 @@ const (
 var (
 	AppUrl    string
 	AppDomain string
-	Version   sys.VersionInfo
+	// where this server is reached, for links to it in emails
+	ApiUrl  string
+	Version sys.VersionInfo
 
 	//JwtRsaPrivateKey *rsa.PrivateKey //[]byte
 	//JwtRsaPublicKey  *rsa.PublicKey  //[]byte
 
-	JwtES256PrivateKey *ecdsa.PrivateKey
-	JwtES256PublicKey  *ecdsa.PublicKey
+	//JwtES256PrivateKey *ecdsa.PrivateKey
+	//JwtES256PublicKey  *ecdsa.PublicKey
+
+	// directory of the ES256 key ring used to sign our tokens
+	JwtKeysDir string
+	// how long a rotated key is still accepted for verification
+	JwtKeyOverlap time.Duration
 
-	JwtAuth0RsaPublicKey *rsa.PublicKey
-	JwtClerkRsaPublicKey *rsa.PublicKey
-	SupabaseJwtSecretKey string
+	//JwtAuth0RsaPublicKey *rsa.PublicKey
+	//JwtClerkRsaPublicKey *rsa.PublicKey
 	SessionName          string
 	SessionKey           string
 	SessionEncryptionKey string
@@ -42,30 +44,62 @@ var (
 	RedisAddr     string
 	RedisPassword string
 
-	Auth0Audience   string
-	Auth0Domain     string
-	Auth0EmailClaim string
-	Auth0NameClaim  string
+	// the users database, shared with the user cache. Left empty, the
+	// standard PG* variables are used
+	DatabaseUrl string
+
+	// identity providers are configured in this file. Provider
+	// domains, audiences and secrets are read from the env by it
+	OIDCProvidersFile string
+
+	// services that may introspect and revoke tokens
+	TokenClientsFile string
+
+	// saml identity providers, e.g. universities, and our service provider
+	SAMLProvidersFile string
 
-	CognitoAudience string
-	CognitoDomain   string
+	// rules for new passwords including the breached password list
+	PasswordPolicyFile string
 
-	ClerkDomain   string
-	ClerkAudience string
+	// who may create an account
+	SignupPolicyFile string
 
-	SupabaseDomain   string
-	SupabaseAudience string
+	// where the data modules refer to datasets, for dataset grants
+	DatasetACLFile string
+
+	// who approves requests for access and what can be requested
+	AccessRequestsFile string
+
+	// which mail backend queues emails
+	MailConfigFile string
+
+	// largest workbook the xlsx utilities accept
+	XlsxMaxUploadBytes int64
 
 	PasswordlessTokenTtlMins time.Duration
 	AccessTokenTtlMins       time.Duration
 	OtpTokenTtlMins          time.Duration
 	ShortTtlMins             time.Duration
+	DeviceCodeTtlMins        time.Duration
+	SAMLRequestTtlMins       time.Duration
+	// how long before a group membership ends to warn the user
+	MembershipWarningMins time.Duration
 
 	UrlResetEmail    string
 	UrlResetPassword string
 	UrlVerifyEmail   string
-
-	SqsQueueUrl string
+	UrlVerifyDevice  string
+	UrlDeleteAccount string
+	UrlSignup        string
+	// where approvers review access requests
+	UrlAccessRequests string
+	// where the old address is sent to cancel an email change
+	UrlCancelEmailChange string
+	// the page unsubscribe links in emails open
+	UrlUnsubscribe string
+	// where mail clients post to unsubscribe in one click, not set
+	// without the api url
+	UrlOneClickUnsubscribe string
 
 	MotifsDB     string
 	WGSDB        string
@@ -94,15 +128,59 @@ func init() {
 
 	AppUrl = os.Getenv("APP_URL")
 	AppDomain = os.Getenv("APP_DOMAIN")
+	ApiUrl = os.Getenv("API_URL")
 	//Version = os.Getenv("VERSION")
 	//Updated = os.Getenv("UPDATED")
 
 	RedisAddr = os.Getenv("REDIS_ADDR")
 	RedisPassword = os.Getenv("REDIS_PASSWORD")
 
+	DatabaseUrl = os.Getenv("DATABASE_URL")
+
 	UrlResetEmail = os.Getenv("URL_RESET_EMAIL")
 	UrlResetPassword = os.Getenv("URL_RESET_PASSWORD")
 	UrlVerifyEmail = os.Getenv("URL_VERIFY_EMAIL")
+	UrlVerifyDevice = os.Getenv("URL_VERIFY_DEVICE")
+
+	if UrlVerifyDevice == "" {
+		UrlVerifyDevice = AppUrl + "/device"
+	}
+
+	UrlCancelEmailChange = os.Getenv("URL_CANCEL_EMAIL_CHANGE")
+
+	if UrlCancelEmailChange == "" {
+		UrlCancelEmailChange = AppUrl + "/account/email/cancel"
+	}
+
+	UrlUnsubscribe = os.Getenv("URL_UNSUBSCRIBE")
+
+	if UrlUnsubscribe == "" {
+		UrlUnsubscribe = AppUrl + "/notifications/unsubscribe"
+	}
+
+	UrlOneClickUnsubscribe = os.Getenv("URL_ONE_CLICK_UNSUBSCRIBE")
+
+	if UrlOneClickUnsubscribe == "" && ApiUrl != "" {
+		UrlOneClickUnsubscribe = ApiUrl + "/auth/notifications/unsubscribe"
+	}
+
+	UrlSignup = os.Getenv("URL_SIGNUP")
+
+	if UrlSignup == "" {
+		UrlSignup = AppUrl + "/signup"
+	}
+
+	UrlAccessRequests = os.Getenv("URL_ACCESS_REQUESTS")
+
+	if UrlAccessRequests == "" {
+		UrlAccessRequests = AppUrl + "/admin/access-requests"
+	}
+
+	UrlDeleteAccount = os.Getenv("URL_DELETE_ACCOUNT")
+
+	if UrlDeleteAccount == "" {
+		UrlDeleteAccount = AppUrl + "/account/delete"
+	}
 
 	//JWT_PRIVATE_KEY = []byte(os.Getenv("JWT_SECRET"))
 	//JWT_PUBLIC_KEY = []byte(os.Getenv("JWT_SECRET"))
@@ -114,23 +192,71 @@ func init() {
 	AccessTokenTtlMins = env.GetMin("ACCESS_TOKEN_TTL_MINS", auth.Ttl15Mins)
 	OtpTokenTtlMins = env.GetMin("OTP_TOKEN_TTL_MINS", auth.Ttl20Mins)
 	ShortTtlMins = env.GetMin("SHORT_TTL_MINS", auth.Ttl10Mins)
+	DeviceCodeTtlMins = env.GetMin("DEVICE_CODE_TTL_MINS", auth.Ttl10Mins)
+	SAMLRequestTtlMins = env.GetMin("SAML_REQUEST_TTL_MINS", auth.Ttl10Mins)
+	MembershipWarningMins = env.GetMin("MEMBERSHIP_WARNING_MINS", 7*24*time.Hour)
 
-	Auth0Audience = os.Getenv("AUTH0_AUDIENCE")
-	Auth0Domain = os.Getenv("AUTH0_DOMAIN")
-	Auth0EmailClaim = os.Getenv("AUTH0_EMAIL_CLAIM")
-	Auth0NameClaim = os.Getenv("AUTH0_NAME_CLAIM")
+	JwtKeysDir = os.Getenv("JWT_KEYS_DIR")
 
-	CognitoAudience = os.Getenv("COGNITO_CLIENT_ID")
-	CognitoDomain = os.Getenv("COGNITO_DOMAIN")
+	if JwtKeysDir == "" {
+		JwtKeysDir = "keys"
+	}
+
+	JwtKeyOverlap = env.GetMin("JWT_KEY_OVERLAP_MINS", 7*24*time.Hour)
+
+	OIDCProvidersFile = os.Getenv("OIDC_PROVIDERS_FILE")
+
+	if OIDCProvidersFile == "" {
+		OIDCProvidersFile = "config/oidc-providers.json"
+	}
 
-	ClerkDomain = os.Getenv("CLERK_DOMAIN")
-	ClerkAudience = os.Getenv("CLERK_AUDIENCE")
+	TokenClientsFile = os.Getenv("TOKEN_CLIENTS_FILE")
 
-	SupabaseDomain = os.Getenv("SUPABASE_DOMAIN")
-	SupabaseAudience = os.Getenv("SUPABASE_AUDIENCE")
-	SupabaseJwtSecretKey = os.Getenv("SUPABASE_JWT_SECRET_KEY")
+	if TokenClientsFile == "" {
+		TokenClientsFile = "config/token-clients.json"
+	}
+
+	SAMLProvidersFile = os.Getenv("SAML_PROVIDERS_FILE")
 
-	SqsQueueUrl = os.Getenv("SQS_QUEUE_URL")
+	if SAMLProvidersFile == "" {
+		SAMLProvidersFile = "config/saml-providers.json"
+	}
+
+	PasswordPolicyFile = os.Getenv("PASSWORD_POLICY_FILE")
+
+	if PasswordPolicyFile == "" {
+		PasswordPolicyFile = "config/password-policy.json"
+	}
+
+	SignupPolicyFile = os.Getenv("SIGNUP_POLICY_FILE")
+
+	if SignupPolicyFile == "" {
+		SignupPolicyFile = "config/signup-policy.json"
+	}
+
+	DatasetACLFile = os.Getenv("DATASET_ACL_FILE")
+
+	if DatasetACLFile == "" {
+		DatasetACLFile = "config/dataset-acl.json"
+	}
+
+	AccessRequestsFile = os.Getenv("ACCESS_REQUESTS_FILE")
+
+	if AccessRequestsFile == "" {
+		AccessRequestsFile = "config/access-requests.json"
+	}
+
+	MailConfigFile = os.Getenv("MAIL_CONFIG_FILE")
+
+	if MailConfigFile == "" {
+		MailConfigFile = "config/mail.json"
+	}
+
+	XlsxMaxUploadBytes = 50 << 20
+
+	if mb, err := strconv.ParseInt(os.Getenv("XLSX_MAX_UPLOAD_MB"), 10, 64); err == nil && mb > 0 {
+		XlsxMaxUploadBytes = mb << 20
+	}
 
 	MotifsDB = os.Getenv("MOTIFS_DB")
 	WGSDB = os.Getenv("WGS_DB")
@@ -166,51 +292,34 @@ func init() {
 	// }
 
 	//
-	// Load EC keys
+	// EC keys are loaded from the key ring in JWT_KEYS_DIR. The ring
+	// is created from jwt.es256.private.pem the first time it is used.
 	//
 
-	bytes, err := os.ReadFile("jwt.es256.private.pem")
-	if err != nil {
-		log.Fatal().Msgf("%s", err)
-	}
-
-	JwtES256PrivateKey, err = jwt.ParseECPrivateKeyFromPEM(bytes)
-	if err != nil {
-		log.Fatal().Msgf("%s", err)
-	}
-
-	bytes, err = os.ReadFile("jwt.es256.public.pem")
-	if err != nil {
-		log.Fatal().Msgf("%s", err)
-	}
+	// bytes, err := os.ReadFile("jwt.es256.private.pem")
+	// if err != nil {
+	// 	log.Fatal().Msgf("%s", err)
+	// }
 
-	JwtES256PublicKey, err = jwt.ParseECPublicKeyFromPEM(bytes)
-	if err != nil {
-		log.Fatal().Msgf("%s", err)
-	}
+	// JwtES256PrivateKey, err = jwt.ParseECPrivateKeyFromPEM(bytes)
+	// if err != nil {
+	// 	log.Fatal().Msgf("%s", err)
+	// }
 
 	//
-	// Keys for OAuth providers
+	// Keys for OAuth providers are fetched from their jwks
+	// endpoints, see config/oidc-providers.json
 	//
-	bytes, err = os.ReadFile("auth0.key.pub")
-	if err != nil {
-		log.Fatal().Msgf("%s", err)
-	}
 
-	JwtAuth0RsaPublicKey, err = jwt.ParseRSAPublicKeyFromPEM(bytes)
-	if err != nil {
-		log.Fatal().Msgf("%s", err)
-	}
-
-	bytes, err = os.ReadFile("clerk.key.pem")
-	if err != nil {
-		log.Fatal().Msgf("%s", err)
-	}
+	// bytes, err = os.ReadFile("auth0.key.pub")
+	// if err != nil {
+	// 	log.Fatal().Msgf("%s", err)
+	// }
 
-	JwtClerkRsaPublicKey, err = jwt.ParseRSAPublicKeyFromPEM(bytes)
-	if err != nil {
-		log.Fatal().Msgf("%s", err)
-	}
+	// JwtAuth0RsaPublicKey, err = jwt.ParseRSAPublicKeyFromPEM(bytes)
+	// if err != nil {
+	// 	log.Fatal().Msgf("%s", err)
+	// }
 
 	Version = sys.Must(sys.LoadVersionInfo("version.json"))
 }
@@ -0,0 +1,401 @@
+package datasetacl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/jsonconfig"
+	"github.com/redis/go-redis/v9"
+)
+
+// Dataset level access control for the data modules (gex, scrna, seqs,
+// beds and hubs). Routes are still gated by permissions such as
+// ngs:view, which see every open dataset of a module. A dataset can
+// additionally be granted to users or groups, which only ever adds
+// access, e.g. for a collaborator without ngs:view. An admin can mark a
+// dataset restricted, after which only the users and groups granted it,
+// and admins, can see it.
+
+const (
+	PrincipalUser  = "user"
+	PrincipalGroup = "group"
+
+	aclKeyPrefix = "acl:dataset:"
+	// index of the datasets that have grants
+	aclIndexKey = "acl:datasets"
+	// datasets only those granted them can see
+	restrictedKey = "acl:restricted"
+)
+
+var (
+	ErrDatasetNotGranted = errors.New("you do not have access to this dataset")
+	ErrUnknownModule     = errors.New("unknown module")
+	ErrInvalidPrincipal  = errors.New("principal must be a user or group")
+	ErrGrantNotFound     = errors.New("grant not found")
+)
+
+// ModuleConfig describes where a module refers to datasets
+type ModuleConfig struct {
+	Name string `json:"name"`
+	// permissions that can see every open dataset, e.g. ngs:view
+	FullPermissions []string `json:"fullPermissions"`
+	// permissions that see everything, restricted or not
+	AdminPermissions []string `json:"adminPermissions"`
+	// json body fields holding dataset ids, either a string, a list of
+	// strings or a list of objects with one of the id fields
+	BodyFields []string `json:"bodyFields"`
+	// fields identifying a dataset in listings and bodies
+	IdFields []string `json:"idFields"`
+	// routes, as registered, whose responses list datasets
+	ListRoutes []string `json:"listRoutes"`
+}
+
+type Config struct {
+	Modules []ModuleConfig `json:"modules"`
+}
+
+type Grant struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Module    string    `json:"module"`
+	Dataset   string    `json:"dataset"`
+	// user or group
+	Type string `json:"type"`
+	// user id or group name
+	Principal string `json:"principal"`
+}
+
+// Caller is who is asking for a dataset
+type Caller struct {
+	UserId      string
+	Groups      []string
+	Permissions []string
+}
+
+type ACL struct {
+	rdb     *redis.Client
+	modules map[string]*ModuleConfig
+}
+
+func LoadConfig(file string) (*Config, error) {
+	var config Config
+
+	err := jsonconfig.Load(file, &config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func NewACL(rdb *redis.Client, config *Config) *ACL {
+	acl := ACL{rdb: rdb, modules: make(map[string]*ModuleConfig)}
+
+	for _, mc := range config.Modules {
+		if len(mc.AdminPermissions) == 0 {
+			mc.AdminPermissions = []string{"*:*"}
+		}
+
+		if len(mc.IdFields) == 0 {
+			mc.IdFields = []string{"id", "publicId"}
+		}
+
+		acl.modules[mc.Name] = &mc
+	}
+
+	return &acl
+}
+
+func (acl *ACL) Module(name string) (*ModuleConfig, error) {
+	module, ok := acl.modules[name]
+
+	if !ok {
+		return nil, ErrUnknownModule
+	}
+
+	return module, nil
+}
+
+func aclKey(module string, dataset string) string {
+	return aclKeyPrefix + module + ":" + dataset
+}
+
+func grantField(principalType string, principal string) string {
+	return principalType + ":" + principal
+}
+
+func (acl *ACL) Grant(ctx context.Context, module string, dataset string, principalType string, principal string) (*Grant, error) {
+	if principalType != PrincipalUser && principalType != PrincipalGroup {
+		return nil, ErrInvalidPrincipal
+	}
+
+	if _, err := acl.Module(module); err != nil {
+		return nil, err
+	}
+
+	grant := Grant{CreatedAt: time.Now().UTC(),
+		Module:    module,
+		Dataset:   dataset,
+		Type:      principalType,
+		Principal: principal}
+
+	data, err := json.Marshal(grant)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = acl.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, aclKey(module, dataset), grantField(principalType, principal), data)
+		pipe.SAdd(ctx, aclIndexKey, datasetRef(module, dataset))
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &grant, nil
+}
+
+// Revoke removes a grant. It does not change whether the dataset is
+// restricted, so a restricted dataset left without grants is only
+// visible to admins.
+func (acl *ACL) Revoke(ctx context.Context, module string, dataset string, principalType string, principal string) error {
+	n, err := acl.rdb.HDel(ctx, aclKey(module, dataset), grantField(principalType, principal)).Result()
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrGrantNotFound
+	}
+
+	left, err := acl.rdb.HLen(ctx, aclKey(module, dataset)).Result()
+
+	if err != nil {
+		return err
+	}
+
+	if left == 0 {
+		return acl.rdb.SRem(ctx, aclIndexKey, datasetRef(module, dataset)).Err()
+	}
+
+	return nil
+}
+
+func datasetRef(module string, dataset string) string {
+	return module + ":" + dataset
+}
+
+// Restrict marks a dataset as only for those granted it, or
+// opens it again to everyone with full access to its module
+func (acl *ACL) Restrict(ctx context.Context, module string, dataset string, restricted bool) error {
+	if _, err := acl.Module(module); err != nil {
+		return err
+	}
+
+	if restricted {
+		return acl.rdb.SAdd(ctx, restrictedKey, datasetRef(module, dataset)).Err()
+	}
+
+	return acl.rdb.SRem(ctx, restrictedKey, datasetRef(module, dataset)).Err()
+}
+
+// IsRestricted returns whether a dataset is only for those granted it
+func (acl *ACL) IsRestricted(ctx context.Context, module string, dataset string) (bool, error) {
+	return acl.rdb.SIsMember(ctx, restrictedKey, datasetRef(module, dataset)).Result()
+}
+
+// Grants returns the grants of a dataset
+func (acl *ACL) Grants(ctx context.Context, module string, dataset string) ([]*Grant, error) {
+	values, err := acl.rdb.HGetAll(ctx, aclKey(module, dataset)).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Grant, 0, len(values))
+
+	for _, v := range values {
+		var grant Grant
+
+		err = json.Unmarshal([]byte(v), &grant)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &grant)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].CreatedAt.Before(ret[j].CreatedAt)
+	})
+
+	return ret, nil
+}
+
+// AllGrants returns every grant, optionally only those of a module
+func (acl *ACL) AllGrants(ctx context.Context, module string) ([]*Grant, error) {
+	datasets, err := acl.rdb.SMembers(ctx, aclIndexKey).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(datasets)
+
+	ret := make([]*Grant, 0, len(datasets))
+
+	for _, d := range datasets {
+		m, dataset, _ := strings.Cut(d, ":")
+
+		if module != "" && m != module {
+			continue
+		}
+
+		grants, err := acl.Grants(ctx, m, dataset)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, grants...)
+	}
+
+	return ret, nil
+}
+
+// UserGrants returns the grants made to a user
+func (acl *ACL) UserGrants(ctx context.Context, userId string) ([]*Grant, error) {
+	grants, err := acl.AllGrants(ctx, "")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(grants, func(grant *Grant) bool {
+		return grant.Type != PrincipalUser || grant.Principal != userId
+	}), nil
+}
+
+// RevokeUser removes every grant made to a user, e.g. when
+// the account is deleted
+func (acl *ACL) RevokeUser(ctx context.Context, userId string) error {
+	grants, err := acl.UserGrants(ctx, userId)
+
+	if err != nil {
+		return err
+	}
+
+	for _, grant := range grants {
+		err = acl.Revoke(ctx, grant.Module, grant.Dataset, PrincipalUser, userId)
+
+		if err != nil && !errors.Is(err, ErrGrantNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func hasAny(have []string, want []string) bool {
+	for _, w := range want {
+		if slices.Contains(have, w) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsAdmin reports whether the caller bypasses dataset checks in a module
+func (module *ModuleConfig) IsAdmin(caller *Caller) bool {
+	return hasAny(caller.Permissions, module.AdminPermissions)
+}
+
+// Allowed returns the datasets, of those given, the caller may use
+func (acl *ACL) Allowed(ctx context.Context, module *ModuleConfig, caller *Caller, datasets []string) (map[string]bool, error) {
+	ret := make(map[string]bool, len(datasets))
+
+	if len(datasets) == 0 {
+		return ret, nil
+	}
+
+	if module.IsAdmin(caller) {
+		for _, dataset := range datasets {
+			ret[dataset] = true
+		}
+
+		return ret, nil
+	}
+
+	full := hasAny(caller.Permissions, module.FullPermissions)
+
+	principals := []string{grantField(PrincipalUser, caller.UserId)}
+
+	for _, group := range caller.Groups {
+		principals = append(principals, grantField(PrincipalGroup, group))
+	}
+
+	// check every dataset in one round trip
+	pipe := acl.rdb.Pipeline()
+
+	restricted := make([]*redis.BoolCmd, len(datasets))
+	granted := make([]*redis.SliceCmd, len(datasets))
+
+	for i, dataset := range datasets {
+		restricted[i] = pipe.SIsMember(ctx, restrictedKey, datasetRef(module.Name, dataset))
+		granted[i] = pipe.HMGet(ctx, aclKey(module.Name, dataset), principals...)
+	}
+
+	_, err := pipe.Exec(ctx)
+
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	for i, dataset := range datasets {
+		// open datasets are for those with full access
+		// and grants add to that
+		if !restricted[i].Val() && full {
+			ret[dataset] = true
+			continue
+		}
+
+		for _, v := range granted[i].Val() {
+			if v != nil {
+				ret[dataset] = true
+				break
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// Check returns ErrDatasetNotGranted unless the caller may use
+// every one of the datasets
+func (acl *ACL) Check(ctx context.Context, module *ModuleConfig, caller *Caller, datasets []string) error {
+	allowed, err := acl.Allowed(ctx, module, caller, datasets)
+
+	if err != nil {
+		return err
+	}
+
+	for _, dataset := range datasets {
+		if !allowed[dataset] {
+			return fmt.Errorf("%w: %s", ErrDatasetNotGranted, dataset)
+		}
+	}
+
+	return nil
+}
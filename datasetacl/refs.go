@@ -0,0 +1,99 @@
+package datasetacl
+
+// Finding dataset ids in request bodies and responses, which come from
+// the module packages so are treated as generic json.
+
+func (module *ModuleConfig) idOf(v any) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, x != ""
+	case map[string]any:
+		for _, field := range module.IdFields {
+			if s, ok := x[field].(string); ok && s != "" {
+				return s, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// BodyDatasets returns the dataset ids a json body refers to
+func (module *ModuleConfig) BodyDatasets(body map[string]any) []string {
+	var ret []string
+
+	for _, field := range module.BodyFields {
+		switch v := body[field].(type) {
+		case []any:
+			for _, item := range v {
+				if id, ok := module.idOf(item); ok {
+					ret = append(ret, id)
+				}
+			}
+		default:
+			if id, ok := module.idOf(v); ok {
+				ret = append(ret, id)
+			}
+		}
+	}
+
+	return ret
+}
+
+// ListedDatasets returns the ids of the datasets in a listing. Objects
+// with an id are datasets, anything else is searched, e.g. a listing
+// grouped by technology.
+func (module *ModuleConfig) ListedDatasets(v any) []string {
+	var ret []string
+
+	switch x := v.(type) {
+	case []any:
+		for _, item := range x {
+			ret = append(ret, module.ListedDatasets(item)...)
+		}
+	case map[string]any:
+		if id, ok := module.idOf(x); ok {
+			return []string{id}
+		}
+
+		for _, child := range x {
+			ret = append(ret, module.ListedDatasets(child)...)
+		}
+	}
+
+	return ret
+}
+
+// FilterListing removes the datasets that are not allowed
+// from a listing
+func (module *ModuleConfig) FilterListing(v any, allowed map[string]bool) any {
+	switch x := v.(type) {
+	case []any:
+		ret := make([]any, 0, len(x))
+
+		for _, item := range x {
+			if m, ok := item.(map[string]any); ok {
+				if id, ok := module.idOf(m); ok && !allowed[id] {
+					continue
+				}
+			}
+
+			ret = append(ret, module.FilterListing(item, allowed))
+		}
+
+		return ret
+	case map[string]any:
+		// datasets are kept whole
+		if _, ok := module.idOf(x); ok {
+			return x
+		}
+
+		for k, child := range x {
+			x[k] = module.FilterListing(child, allowed)
+		}
+
+		return x
+	default:
+		return v
+	}
+}
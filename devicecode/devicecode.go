@@ -0,0 +1,424 @@
+package devicecode
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Storage for the RFC 8628 device authorization grant. A client such as
+// a CLI asks for a device code and shows the user a short user code. The
+// user approves the code from a signed in browser and the client polls
+// until the grant is approved, denied or expires.
+
+const (
+	DefaultTTL = 10 * time.Minute
+	// seconds between polls
+	DefaultInterval = 5
+
+	// RFC 8628 section 6.1 recommends excluding vowels
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+
+	// max device codes an ip address can request per hour
+	MaxCodesPerHour = 20
+
+	// max user codes a user can try to approve or deny per hour
+	// before we stop looking codes up for them
+	MaxUserCodeAttemptsPerHour = 10
+
+	// max user codes a user can look up per hour to see what is
+	// asking for access, kept apart so looking does not use up
+	// approval attempts
+	MaxUserCodeLookupsPerHour = 60
+
+	deviceKeyPrefix    = "device:code:"
+	userCodeKeyPrefix  = "device:user:"
+	rateLimitKeyPrefix = "device:limit:"
+)
+
+type Status string
+
+const (
+	StatusPending  Status = "pending"
+	StatusApproved Status = "approved"
+	StatusDenied   Status = "denied"
+	// tokens have been issued so the grant cannot be used again
+	StatusUsed Status = "used"
+)
+
+// errors are the error codes defined in RFC 8628 section 3.5 so
+// they can be returned to clients as is
+var (
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	ErrSlowDown             = errors.New("slow_down")
+	ErrAccessDenied         = errors.New("access_denied")
+	ErrExpiredToken         = errors.New("expired_token")
+	ErrInvalidGrant         = errors.New("invalid_grant")
+	ErrInvalidUserCode      = errors.New("invalid or expired user code")
+	ErrRateLimited          = errors.New("too many requests, please try again later")
+)
+
+type Grant struct {
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	LastPollAt time.Time `json:"lastPollAt"`
+	UserCode   string    `json:"userCode"`
+	ClientId   string    `json:"clientId"`
+	IpAddr     string    `json:"ipAddr"`
+	Device     string    `json:"device"`
+	Status     Status    `json:"status"`
+	// set once a user approves the grant
+	UserId string `json:"userId,omitempty"`
+	// seconds the client must wait between polls
+	Interval int `json:"interval"`
+	key      string
+}
+
+type DeviceCodeStore struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+func NewDeviceCodeStore(rdb *redis.Client, ttl time.Duration) *DeviceCodeStore {
+	return &DeviceCodeStore{rdb: rdb, ttl: ttl}
+}
+
+func (store *DeviceCodeStore) TTL() time.Duration {
+	return store.ttl
+}
+
+// device codes are only stored hashed so a redis dump does not leak
+// anything that can be exchanged for tokens
+func hashDeviceCode(deviceCode string) string {
+	sum := sha256.Sum256([]byte(deviceCode))
+	return hex.EncodeToString(sum[:])
+}
+
+func newDeviceCode() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func newUserCode() (string, error) {
+	var sb strings.Builder
+
+	for i := range userCodeLength {
+		if i == userCodeLength/2 {
+			sb.WriteByte('-')
+		}
+
+		index, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+
+		if err != nil {
+			return "", err
+		}
+
+		sb.WriteByte(userCodeAlphabet[index.Int64()])
+	}
+
+	return sb.String(), nil
+}
+
+// NormalizeUserCode makes user entry forgiving of case,
+// spaces and a missing dash
+func NormalizeUserCode(userCode string) string {
+	var sb strings.Builder
+
+	for _, r := range strings.ToUpper(userCode) {
+		if strings.ContainsRune(userCodeAlphabet, r) {
+			sb.WriteRune(r)
+		}
+	}
+
+	s := sb.String()
+
+	if len(s) != userCodeLength {
+		return s
+	}
+
+	return s[:userCodeLength/2] + "-" + s[userCodeLength/2:]
+}
+
+// allow increments a counter for a key in a fixed window
+// and reports whether the limit has been exceeded
+func (store *DeviceCodeStore) allow(ctx context.Context, key string, limit int64, window time.Duration) (bool, error) {
+	key = rateLimitKeyPrefix + key
+
+	n, err := store.rdb.Incr(ctx, key).Result()
+
+	if err != nil {
+		return false, err
+	}
+
+	if n == 1 {
+		store.rdb.Expire(ctx, key, window)
+	}
+
+	return n <= limit, nil
+}
+
+// Create starts a new grant and returns the device code the client
+// will poll with. Only the hash of the device code is stored.
+func (store *DeviceCodeStore) Create(ctx context.Context, clientId string, ipAddr string, device string) (string, *Grant, error) {
+	ok, err := store.allow(ctx, "ip:"+ipAddr, MaxCodesPerHour, time.Hour)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !ok {
+		return "", nil, ErrRateLimited
+	}
+
+	deviceCode, err := newDeviceCode()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now().UTC()
+
+	grant := Grant{ClientId: clientId,
+		IpAddr:    ipAddr,
+		Device:    device,
+		Status:    StatusPending,
+		CreatedAt: now,
+		ExpiresAt: now.Add(store.ttl),
+		Interval:  DefaultInterval,
+		key:       hashDeviceCode(deviceCode)}
+
+	// user codes are short so retry on the unlikely event of a clash
+	for range 5 {
+		grant.UserCode, err = newUserCode()
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		ok, err = store.rdb.SetNX(ctx, userCodeKeyPrefix+grant.UserCode, grant.key, store.ttl).Result()
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		if ok {
+			break
+		}
+	}
+
+	if !ok {
+		return "", nil, fmt.Errorf("could not create a unique user code")
+	}
+
+	err = store.save(ctx, &grant)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return deviceCode, &grant, nil
+}
+
+func (store *DeviceCodeStore) save(ctx context.Context, grant *Grant) error {
+	data, err := json.Marshal(grant)
+
+	if err != nil {
+		return err
+	}
+
+	// keep the grant for its remaining lifetime only
+	ttl := time.Until(grant.ExpiresAt)
+
+	if ttl <= 0 {
+		return ErrExpiredToken
+	}
+
+	return store.rdb.Set(ctx, deviceKeyPrefix+grant.key, data, ttl).Err()
+}
+
+func (store *DeviceCodeStore) load(ctx context.Context, key string) (*Grant, error) {
+	data, err := store.rdb.Get(ctx, deviceKeyPrefix+key).Bytes()
+
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrExpiredToken
+		}
+
+		return nil, err
+	}
+
+	var grant Grant
+
+	err = json.Unmarshal(data, &grant)
+
+	if err != nil {
+		return nil, err
+	}
+
+	grant.key = key
+
+	return &grant, nil
+}
+
+// Lookup finds a pending grant so the user can see what is asking for
+// access. Lookups are rate limited per user to stop codes being guessed.
+func (store *DeviceCodeStore) Lookup(ctx context.Context, userId string, userCode string) (*Grant, error) {
+	ok, err := store.allow(ctx, "lookup:"+userId, MaxUserCodeLookupsPerHour, time.Hour)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrRateLimited
+	}
+
+	return store.find(ctx, userCode)
+}
+
+// FindByUserCode finds a pending grant the user is about to approve or
+// deny. Attempts are rate limited per user to stop codes being guessed.
+func (store *DeviceCodeStore) FindByUserCode(ctx context.Context, userId string, userCode string) (*Grant, error) {
+	ok, err := store.allow(ctx, "user:"+userId, MaxUserCodeAttemptsPerHour, time.Hour)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrRateLimited
+	}
+
+	return store.find(ctx, userCode)
+}
+
+func (store *DeviceCodeStore) find(ctx context.Context, userCode string) (*Grant, error) {
+	key, err := store.rdb.Get(ctx, userCodeKeyPrefix+NormalizeUserCode(userCode)).Result()
+
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrInvalidUserCode
+		}
+
+		return nil, err
+	}
+
+	grant, err := store.load(ctx, key)
+
+	if err != nil {
+		return nil, ErrInvalidUserCode
+	}
+
+	if grant.Status != StatusPending {
+		return nil, ErrInvalidUserCode
+	}
+
+	return grant, nil
+}
+
+// Decide approves or denies a pending grant on behalf of a user. The
+// user code is removed so it cannot be approved twice.
+func (store *DeviceCodeStore) Decide(ctx context.Context, grant *Grant, userId string, approve bool) error {
+	if approve {
+		grant.Status = StatusApproved
+		grant.UserId = userId
+	} else {
+		grant.Status = StatusDenied
+	}
+
+	err := store.save(ctx, grant)
+
+	if err != nil {
+		return err
+	}
+
+	return store.rdb.Del(ctx, userCodeKeyPrefix+grant.UserCode).Err()
+}
+
+// Poll is called by the client with its device code. It returns the
+// approved grant once, after which the device code is spent. Otherwise
+// it returns one of the RFC 8628 errors. Only the client the code was
+// issued to can poll with it.
+func (store *DeviceCodeStore) Poll(ctx context.Context, deviceCode string, clientId string) (*Grant, error) {
+	grant, err := store.load(ctx, hashDeviceCode(deviceCode))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if grant.ClientId != clientId {
+		return nil, ErrInvalidGrant
+	}
+
+	now := time.Now().UTC()
+
+	// clients polling faster than the interval are told to back off and
+	// must use a longer interval from then on (section 3.5)
+	if grant.Status == StatusPending && now.Sub(grant.LastPollAt) < time.Duration(grant.Interval)*time.Second {
+		grant.Interval += DefaultInterval
+		grant.LastPollAt = now
+		store.save(ctx, grant)
+		return nil, ErrSlowDown
+	}
+
+	grant.LastPollAt = now
+
+	switch grant.Status {
+	case StatusPending:
+		err = store.save(ctx, grant)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, ErrAuthorizationPending
+	case StatusDenied:
+		store.rdb.Del(ctx, deviceKeyPrefix+grant.key)
+		return nil, ErrAccessDenied
+	case StatusApproved:
+		// spend the code atomically so two pollers cannot both get tokens
+		grant.Status = StatusUsed
+
+		data, err := json.Marshal(grant)
+
+		if err != nil {
+			return nil, err
+		}
+
+		old, err := store.rdb.SetArgs(ctx, deviceKeyPrefix+grant.key, data, redis.SetArgs{KeepTTL: true, Get: true}).Result()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var prev Grant
+
+		err = json.Unmarshal([]byte(old), &prev)
+
+		if err != nil || prev.Status != StatusApproved {
+			return nil, ErrExpiredToken
+		}
+
+		return grant, nil
+	default:
+		return nil, ErrExpiredToken
+	}
+}
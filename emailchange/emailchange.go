@@ -0,0 +1,220 @@
+package emailchange
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Pending email address changes. A change is only applied once the new
+// address has been confirmed, and until then the old address can cancel
+// it, so a stolen session cannot quietly take over an account by moving
+// its email somewhere else. A user has at most one pending change.
+
+const (
+	pendingKeyPrefix = "emailchange:user:"
+	cancelKeyPrefix  = "emailchange:cancel:"
+)
+
+var (
+	ErrNoPendingChange = errors.New("no pending email change or it has expired")
+	ErrEmailMismatch   = errors.New("email address does not match the pending change")
+)
+
+type PendingChange struct {
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	UserId    string    `json:"userId"`
+	OldEmail  string    `json:"oldEmail"`
+	NewEmail  string    `json:"newEmail"`
+	// emailed to the old address so the owner can stop the change
+	CancelToken string `json:"cancelToken"`
+}
+
+type EmailChangeStore struct {
+	rdb *redis.Client
+}
+
+func NewEmailChangeStore(rdb *redis.Client) *EmailChangeStore {
+	return &EmailChangeStore{rdb: rdb}
+}
+
+func pendingKey(userId string) string {
+	return pendingKeyPrefix + userId
+}
+
+func cancelKey(token string) string {
+	return cancelKeyPrefix + token
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Create records a pending change, replacing any the user already has
+func (store *EmailChangeStore) Create(ctx context.Context, userId string, oldEmail string, newEmail string, ttl time.Duration) (*PendingChange, error) {
+	token, err := newToken()
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	change := PendingChange{CreatedAt: now,
+		ExpiresAt:   now.Add(ttl),
+		UserId:      userId,
+		OldEmail:    oldEmail,
+		NewEmail:    newEmail,
+		CancelToken: token}
+
+	data, err := json.Marshal(change)
+
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := store.Get(ctx, userId)
+
+	if err != nil && !errors.Is(err, ErrNoPendingChange) {
+		return nil, err
+	}
+
+	_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if previous != nil {
+			pipe.Del(ctx, cancelKey(previous.CancelToken))
+		}
+
+		pipe.Set(ctx, pendingKey(userId), data, ttl)
+		pipe.Set(ctx, cancelKey(token), userId, ttl)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &change, nil
+}
+
+// Get returns the pending change of a user
+func (store *EmailChangeStore) Get(ctx context.Context, userId string) (*PendingChange, error) {
+	data, err := store.rdb.Get(ctx, pendingKey(userId)).Bytes()
+
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrNoPendingChange
+		}
+
+		return nil, err
+	}
+
+	var change PendingChange
+
+	err = json.Unmarshal(data, &change)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &change, nil
+}
+
+func (store *EmailChangeStore) remove(ctx context.Context, change *PendingChange) error {
+	return store.rdb.Del(ctx, pendingKey(change.UserId), cancelKey(change.CancelToken)).Err()
+}
+
+// Confirm returns the pending change of a user once the new address
+// has been confirmed. The address confirmed must be the one the change
+// was made for, so an old confirmation link cannot apply a different
+// address. The change stays pending until Complete is called, so that
+// if applying it fails the link can be used again.
+func (store *EmailChangeStore) Confirm(ctx context.Context, userId string, newEmail string) (*PendingChange, error) {
+	change, err := store.Get(ctx, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(change.NewEmail, newEmail) {
+		return nil, ErrEmailMismatch
+	}
+
+	return change, nil
+}
+
+// Complete removes a change once it has been applied. A change made
+// since it was confirmed is left alone.
+func (store *EmailChangeStore) Complete(ctx context.Context, change *PendingChange) error {
+	key := pendingKey(change.UserId)
+
+	return store.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := store.Get(ctx, change.UserId)
+
+		if err != nil {
+			// already gone, e.g. it expired
+			if errors.Is(err, ErrNoPendingChange) {
+				return nil
+			}
+
+			return err
+		}
+
+		if current.CancelToken != change.CancelToken {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key, cancelKey(change.CancelToken))
+			return nil
+		})
+
+		return err
+	}, key)
+}
+
+// Cancel removes a pending change using the token sent to the old address
+func (store *EmailChangeStore) Cancel(ctx context.Context, token string) (*PendingChange, error) {
+	userId, err := store.rdb.Get(ctx, cancelKey(token)).Result()
+
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrNoPendingChange
+		}
+
+		return nil, err
+	}
+
+	change, err := store.Get(ctx, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// a stale token from a change that has since been replaced
+	if change.CancelToken != token {
+		return nil, ErrNoPendingChange
+	}
+
+	err = store.remove(ctx, change)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return change, nil
+}
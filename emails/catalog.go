@@ -0,0 +1,213 @@
+package emails
+
+import (
+	"fmt"
+
+	edbconsts "github.com/antonybholmes/go-edbmailserver/consts"
+	edbmail "github.com/antonybholmes/go-edbmailserver/mail"
+	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/signinguard"
+	"github.com/antonybholmes/go-edbserver-gin/signuppolicy"
+	mailserver "github.com/antonybholmes/go-mailserver"
+)
+
+// Every email type this server sends, with the sample data used to
+// preview it. Links and lifetimes are read from the config when asked
+// for so they match what users are sent. Emails the mail server defines
+// have the subjects it sends them with.
+
+type EmailType struct {
+	Type        string `json:"type"`
+	Subject     string `json:"subject"`
+	Description string `json:"description"`
+	// what is sent in the payload, if anything
+	DataType string `json:"dataType,omitempty"`
+	LinkUrl  string `json:"linkUrl,omitempty"`
+	// query parameter of the link the payload goes in
+	LinkParam string `json:"linkParam,omitempty"`
+	// how long the link or code lasts
+	TTL string `json:"ttl,omitempty"`
+}
+
+// sample payloads by data type
+var sampleData = map[string]string{
+	"jwt":            "eyJhbGciOiJFUzI1NiIsInR5cCI6IkpXVCJ9.sample.signature",
+	"code":           "123456",
+	"token":          "sample-token",
+	"ip":             "192.0.2.10",
+	"device":         "Firefox on Linux from 192.0.2.10 at 19 Oct 2026 09:30 UTC",
+	"membership":     `{"group":"ngs"}`,
+	"access-request": `{"id":"sample","name":"Sample User","email":"sample@example.com","kind":"group","group":"ngs","justification":"Analysing the lab's sequencing runs","days":90,"status":"pending"}`,
+	"announcement":   `{"id":"sample","title":"New gene expression data","body":"gex-20261019.db is now available in the Gene Expression module."}`,
+}
+
+func minutes(mins float64) string {
+	return fmt.Sprintf("%d minutes", int(mins))
+}
+
+// Types lists the email types
+func Types() []*EmailType {
+	short := minutes(consts.ShortTtlMins.Minutes())
+
+	return []*EmailType{
+		{Type: edbmail.EmailQueueTypeVerify,
+			Subject:     "Email Address Verification",
+			Description: "Sent on sign up with a link to verify the address",
+			DataType:    "jwt",
+			LinkUrl:     consts.UrlVerifyEmail,
+			LinkParam:   "jwt",
+			TTL:         short},
+		{Type: edbmail.EmailQueueTypeVerified,
+			Subject:     "Email Address Verified",
+			Description: "Sent once the address has been verified"},
+		{Type: edbmail.EmailQueueTypePasswordless,
+			Subject:     "Passwordless Sign In",
+			Description: "Sent to sign in by email without a password",
+			DataType:    "code",
+			TTL:         minutes(consts.PasswordlessTokenTtlMins.Minutes())},
+		{Type: edbmail.EmailQueueTypeOTP,
+			Subject:     fmt.Sprintf("%s One-Time Passcode", edbconsts.ProductName),
+			Description: "Sent with a code to confirm the address",
+			DataType:    "code",
+			TTL:         short},
+		{Type: edbmail.EmailQueueTypePasswordReset,
+			Subject:     "Password Reset",
+			Description: "Sent with a link to choose a new password",
+			DataType:    "jwt",
+			LinkUrl:     consts.UrlResetPassword,
+			LinkParam:   "jwt",
+			TTL:         short},
+		{Type: edbmail.EmailQueueTypePasswordUpdated,
+			Subject:     "Password Updated",
+			Description: "Sent after the password is changed"},
+		{Type: edbmail.EmailQueueTypeAccountCreated,
+			Subject:     "Account Created",
+			Description: "Sent when an admin creates an account",
+			LinkUrl:     consts.AppUrl},
+		{Type: edbmail.EmailQueueTypeAccountUpdated,
+			Subject:     "Account Updated",
+			Description: "Sent after the name or username is changed"},
+		{Type: edbmail.EmailQueueTypeEmailReset,
+			Subject:     "Email Reset",
+			Description: "Sent to the new address with a link to confirm the change",
+			DataType:    "jwt",
+			LinkUrl:     consts.UrlResetEmail,
+			LinkParam:   "jwt",
+			TTL:         short},
+		{Type: edbmail.EmailQueueTypeEmailUpdated,
+			Subject:     "Email Updated",
+			Description: "Sent once the email address has changed"},
+		{Type: EmailQueueTypeEmailChangeRequested,
+			Subject:     "Your email address is changing",
+			Description: "Sent to the old address with a link to cancel the change",
+			DataType:    "token",
+			LinkUrl:     consts.UrlCancelEmailChange,
+			LinkParam:   "token",
+			TTL:         short},
+		{Type: EmailQueueTypeAccountLocked,
+			Subject:     "Your account has been locked",
+			Description: "Sent when too many wrong passwords lock the account",
+			DataType:    "ip",
+			TTL:         minutes(signinguard.DefaultConfig.Lockout.Minutes())},
+		{Type: EmailQueueTypeNewSignIn,
+			Subject:     "New sign in to your account",
+			Description: "Sent when the user signs in from a new device",
+			DataType:    "device"},
+		{Type: EmailQueueTypeAccountDeletionConfirm,
+			Subject:     "Confirm deleting your account",
+			Description: "Sent with a link to confirm deleting the account",
+			DataType:    "token",
+			LinkUrl:     consts.UrlDeleteAccount,
+			LinkParam:   "token",
+			TTL:         short},
+		{Type: EmailQueueTypeAccountDeleted,
+			Subject:     "Your account has been deleted",
+			Description: "Sent once the account is deleted"},
+		{Type: EmailQueueTypeSignupPending,
+			Subject:     "Your sign up is waiting for approval",
+			Description: "Sent when a sign up needs an admin to approve it"},
+		{Type: EmailQueueTypeSignupApproved,
+			Subject:     "Your sign up has been approved",
+			Description: "Sent when an admin approves a sign up",
+			LinkUrl:     consts.AppUrl},
+		{Type: EmailQueueTypeSignupRejected,
+			Subject:     "Your sign up was not approved",
+			Description: "Sent when an admin rejects a sign up"},
+		{Type: EmailQueueTypeSignupInvite,
+			Subject:     "You have been invited to sign up",
+			Description: "Sent with an invite to create an account",
+			DataType:    "token",
+			LinkUrl:     consts.UrlSignup,
+			LinkParam:   "invite",
+			TTL:         fmt.Sprintf("%d hours", signuppolicy.DefaultConfig.InviteTtlHours)},
+		{Type: EmailQueueTypeAccessRequested,
+			Subject:     "Access has been requested",
+			Description: "Sent to approvers when a user asks for access",
+			DataType:    "access-request",
+			LinkUrl:     consts.UrlAccessRequests},
+		{Type: EmailQueueTypeAccessApproved,
+			Subject:     "Your access request has been approved",
+			Description: "Sent when an approver grants access",
+			LinkUrl:     consts.AppUrl},
+		{Type: EmailQueueTypeAccessDenied,
+			Subject:     "Your access request was not approved",
+			Description: "Sent when an approver denies access",
+			LinkUrl:     consts.AppUrl},
+		{Type: EmailQueueTypeMembershipExpiring,
+			Subject:     "Your group membership is ending soon",
+			Description: "Sent some days before a time limited membership ends",
+			DataType:    "membership",
+			LinkUrl:     consts.AppUrl,
+			TTL:         fmt.Sprintf("%d days", int(consts.MembershipWarningMins.Hours()/24))},
+		{Type: EmailQueueTypeMembershipExpired,
+			Subject:     "Your group membership has ended",
+			Description: "Sent when a time limited membership ends",
+			DataType:    "membership",
+			LinkUrl:     consts.AppUrl},
+		{Type: EmailQueueTypeAnnouncement,
+			Subject:     "News from " + consts.Name,
+			Description: "Sent when an admin broadcasts an announcement to groups",
+			DataType:    "announcement",
+			LinkUrl:     consts.AppUrl},
+		{Type: EmailQueueTypeDataRelease,
+			Subject:     "New data is available",
+			Description: "Sent when an admin announces a new dataset or database to groups",
+			DataType:    "announcement",
+			LinkUrl:     consts.AppUrl},
+	}
+}
+
+// FindType returns an email type by name
+func FindType(emailType string) (*EmailType, bool) {
+	for _, t := range Types() {
+		if t.Type == emailType {
+			return t, true
+		}
+	}
+
+	return nil, false
+}
+
+// Subject returns the subject line of an email type
+func Subject(emailType string) string {
+	if t, ok := FindType(emailType); ok {
+		return t.Subject
+	}
+
+	return "Message from " + consts.Name
+}
+
+// Sample makes an email of this type filled with sample data
+func (t *EmailType) Sample(name string, to string) *mailserver.MailItem {
+	email := mailserver.MailItem{Name: name,
+		To:        to,
+		EmailType: t.Type,
+		LinkUrl:   t.LinkUrl,
+		TTL:       t.TTL}
+
+	if t.DataType != "" {
+		email.Payload = &mailserver.Payload{DataType: t.DataType, Data: sampleData[t.DataType]}
+	}
+
+	return &email
+}
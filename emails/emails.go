@@ -0,0 +1,22 @@
+package emails
+
+// Email types sent by this server in addition to those defined in
+// go-edbmailserver. The mail server needs a matching template for each.
+const (
+	EmailQueueTypeAccountLocked          = "account-locked"
+	EmailQueueTypeAccountDeletionConfirm = "account-deletion-confirm"
+	EmailQueueTypeAccountDeleted         = "account-deleted"
+	EmailQueueTypeEmailChangeRequested   = "email-change-requested"
+	EmailQueueTypeNewSignIn              = "new-sign-in"
+	EmailQueueTypeSignupPending          = "signup-pending"
+	EmailQueueTypeSignupApproved         = "signup-approved"
+	EmailQueueTypeSignupRejected         = "signup-rejected"
+	EmailQueueTypeSignupInvite           = "signup-invite"
+	EmailQueueTypeAccessRequested        = "access-requested"
+	EmailQueueTypeAccessApproved         = "access-approved"
+	EmailQueueTypeAccessDenied           = "access-denied"
+	EmailQueueTypeMembershipExpiring     = "membership-expiring"
+	EmailQueueTypeMembershipExpired      = "membership-expired"
+	EmailQueueTypeAnnouncement           = "announcement"
+	EmailQueueTypeDataRelease            = "data-release"
+)
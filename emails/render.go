@@ -0,0 +1,265 @@
+package emails
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/mail"
+	"net/url"
+	"path"
+	"strings"
+
+	edbconsts "github.com/antonybholmes/go-edbmailserver/consts"
+	edbmail "github.com/antonybholmes/go-edbmailserver/mail"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// Emails are rendered from the templates of go-edbmailserver, copied
+// into templates/email, the same way the mail server renders them, so
+// previews and emails sent over SMTP look like those from the mail
+// server. The emails only this server sends have templates there in
+// the same style. Keep the copies in step with the mail server.
+
+//go:embed templates
+var templateFiles embed.FS
+
+const templateDir = "templates/email"
+
+var ErrNoTemplate = errors.New("no template for email type")
+
+// templates of the emails only this server sends
+var templateNames = map[string]string{
+	EmailQueueTypeAccountLocked:          "account/locked.html",
+	EmailQueueTypeAccountDeletionConfirm: "account/deletion-confirm.html",
+	EmailQueueTypeAccountDeleted:         "account/deleted.html",
+	EmailQueueTypeEmailChangeRequested:   "email/change-requested.html",
+	EmailQueueTypeNewSignIn:              "account/new-sign-in.html",
+	EmailQueueTypeSignupPending:          "signup/pending.html",
+	EmailQueueTypeSignupApproved:         "signup/approved.html",
+	EmailQueueTypeSignupRejected:         "signup/rejected.html",
+	EmailQueueTypeSignupInvite:           "signup/invite.html",
+	EmailQueueTypeAccessRequested:        "access/requested.html",
+	EmailQueueTypeAccessApproved:         "access/approved.html",
+	EmailQueueTypeAccessDenied:           "access/denied.html",
+	EmailQueueTypeMembershipExpiring:     "membership/expiring.html",
+	EmailQueueTypeMembershipExpired:      "membership/expired.html",
+	EmailQueueTypeAnnouncement:           "announcement/announcement.html",
+	EmailQueueTypeDataRelease:            "announcement/data-release.html",
+}
+
+// payloads sent as json, decoded so templates can use their fields
+var jsonDataTypes = map[string]bool{"access-request": true,
+	"announcement": true,
+	"membership":   true,
+	DataTypeLinks:  true}
+
+type Rendered struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+}
+
+// what the templates are filled with, the mail server's body plus
+// what only this server's emails use
+type emailBody struct {
+	edbmail.EmailBody
+	Details     map[string]any
+	Unsubscribe string
+	// how long something lasts that is not a link or code, such as a
+	// membership or a lockout
+	TTL string
+}
+
+// templateFor returns the template of an email and the url its link is
+// made from, chosen the way the mail server chooses them
+func templateFor(email *mailserver.MailItem) (string, string, error) {
+	switch email.EmailType {
+	case edbmail.EmailQueueTypeVerify:
+		if email.Mode == "api" {
+			return "verify/api.html", edbconsts.UrlVerifyEmail, nil
+		}
+
+		return "verify/web.html", edbconsts.UrlVerifyEmail, nil
+	case edbmail.EmailQueueTypeVerified:
+		return "verify/verified.html", "", nil
+	case edbmail.EmailQueueTypePasswordless:
+		if email.Mode == "api" {
+			return "passwordless/api.html", edbconsts.UrlSignIn, nil
+		}
+
+		return "passwordless/web.html", edbconsts.UrlSignIn, nil
+	case edbmail.EmailQueueTypePasswordReset:
+		if email.LinkUrl != "" {
+			return "password/reset/web.html", email.LinkUrl, nil
+		}
+
+		return "password/reset/api.html", "", nil
+	case edbmail.EmailQueueTypePasswordUpdated:
+		if email.LinkUrl != "" {
+			return "password/switch-to-passwordless.html", email.LinkUrl, nil
+		}
+
+		return "password/updated.html", "", nil
+	case edbmail.EmailQueueTypeEmailReset:
+		if email.LinkUrl != "" {
+			return "email/reset/web.html", email.LinkUrl, nil
+		}
+
+		return "email/reset/api.html", "", nil
+	case edbmail.EmailQueueTypeEmailUpdated:
+		return "email/updated.html", email.LinkUrl, nil
+	case edbmail.EmailQueueTypeAccountCreated:
+		return "account/created.html", email.LinkUrl, nil
+	case edbmail.EmailQueueTypeAccountUpdated:
+		return "account/updated.html", email.LinkUrl, nil
+	case edbmail.EmailQueueTypeOTP:
+		return "otp/otp.html", "", nil
+	}
+
+	name, ok := templateNames[email.EmailType]
+
+	if !ok {
+		return "", "", ErrNoTemplate
+	}
+
+	return name, email.LinkUrl, nil
+}
+
+// linkParam returns the query parameter the payload of an email goes
+// in, if it is sent as part of the link
+func linkParam(email *mailserver.MailItem) string {
+	if t, ok := FindType(email.EmailType); ok && t.LinkParam != "" {
+		return t.LinkParam
+	}
+
+	// as the mail server does
+	if email.Payload != nil && email.Payload.DataType == "jwt" {
+		return edbmail.JwtParam
+	}
+
+	return ""
+}
+
+// Link returns the link the recipient of an email follows, with its
+// token added, the same way the mail server builds it
+func Link(email *mailserver.MailItem) (string, error) {
+	_, linkUrl, err := templateFor(email)
+
+	if err != nil {
+		return "", err
+	}
+
+	return link(email, linkUrl)
+}
+
+func link(email *mailserver.MailItem, linkUrl string) (string, error) {
+	if linkUrl == "" {
+		if email.Payload != nil && email.Payload.DataType == "link" {
+			return email.Payload.Data, nil
+		}
+
+		return "", nil
+	}
+
+	ret, err := url.Parse(linkUrl)
+
+	if err != nil {
+		return "", err
+	}
+
+	if param := linkParam(email); param != "" && email.Payload != nil && email.Payload.Data != "" {
+		query := ret.Query()
+		query.Set(param, email.Payload.Data)
+		ret.RawQuery = query.Encode()
+	}
+
+	return ret.String(), nil
+}
+
+// firstName greets the recipient by their first name, or the start of
+// their address if there is no name
+func firstName(email *mailserver.MailItem) string {
+	name := email.Name
+
+	if name == "" {
+		address, err := mail.ParseAddress(email.To)
+
+		if err != nil {
+			return "there"
+		}
+
+		name = cases.Title(language.English).String(strings.Split(address.Address, "@")[0])
+	}
+
+	return strings.Split(name, " ")[0]
+}
+
+// Render renders an email as html from its template. Emails the
+// recipient can opt out of have the unsubscribe link in their payload.
+func Render(email *mailserver.MailItem, subject string) (*Rendered, error) {
+	file, linkUrl, err := templateFor(email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := template.ParseFS(templateFiles,
+		path.Join(templateDir, file),
+		path.Join(templateDir, "footer.html"),
+		path.Join(templateDir, "unsubscribe.html"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	href, err := link(email, linkUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	body := emailBody{EmailBody: edbmail.EmailBody{Name: firstName(email),
+		Payload:    email.Payload,
+		Link:       href,
+		From:       edbconsts.AppName,
+		DoNotReply: edbconsts.TextDoNotReply}}
+
+	body.Unsubscribe, _ = UnsubscribeLinks(email)
+
+	if email.Payload != nil && jsonDataTypes[email.Payload.DataType] {
+		err = json.Unmarshal([]byte(email.Payload.Data), &body.Details)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// only a link or code is valid for a time, the lifetimes of this
+	// server's other emails are part of what they say
+	if _, ok := templateNames[email.EmailType]; ok && linkParam(email) == "" {
+		body.TTL = email.TTL
+	} else if email.TTL != "" {
+		contentType := "token"
+
+		if href != "" {
+			contentType = "link"
+		} else if email.Payload != nil && email.Payload.DataType != "jwt" {
+			contentType = email.Payload.DataType
+		}
+
+		body.TimeSensitive = &edbmail.TimeSensitive{ContentType: contentType, Time: email.TTL}
+	}
+
+	var html bytes.Buffer
+
+	err = t.ExecuteTemplate(&html, "layout", body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Rendered{Subject: subject, HTML: html.String()}, nil
+}
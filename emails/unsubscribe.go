@@ -0,0 +1,83 @@
+package emails
+
+import (
+	"encoding/json"
+	"errors"
+
+	mailserver "github.com/antonybholmes/go-mailserver"
+)
+
+// Emails the recipient can opt out of carry the links to do so in their
+// payload, so they reach the mail server whichever queue it reads and
+// are in the outbox with the rest of the email. Their payloads are json
+// objects the links are added to. Emails with nothing else to say get a
+// payload of just the links.
+
+const (
+	unsubscribeUrlKey         = "unsubscribeUrl"
+	oneClickUnsubscribeUrlKey = "oneClickUnsubscribeUrl"
+
+	// the data type of a payload that only has the links
+	DataTypeLinks = "links"
+)
+
+var ErrPayloadNotJson = errors.New("unsubscribe links can only be added to json payloads")
+
+// SetUnsubscribeLinks adds the page that asks the recipient to stop
+// emails like this one, and where mail clients post to do it in one
+// click if there is one, to the payload of an email
+func SetUnsubscribeLinks(email *mailserver.MailItem, page string, oneClick string) error {
+	if email.Payload == nil {
+		email.Payload = &mailserver.Payload{DataType: DataTypeLinks, Data: "{}"}
+	}
+
+	if !jsonDataTypes[email.Payload.DataType] {
+		return ErrPayloadNotJson
+	}
+
+	var data map[string]any
+
+	err := json.Unmarshal([]byte(email.Payload.Data), &data)
+
+	if err != nil {
+		return err
+	}
+
+	if data == nil {
+		data = map[string]any{}
+	}
+
+	data[unsubscribeUrlKey] = page
+
+	if oneClick != "" {
+		data[oneClickUnsubscribeUrlKey] = oneClick
+	}
+
+	b, err := json.Marshal(data)
+
+	if err != nil {
+		return err
+	}
+
+	email.Payload.Data = string(b)
+
+	return nil
+}
+
+// UnsubscribeLinks returns the links added to an email, empty if the
+// recipient cannot opt out of it
+func UnsubscribeLinks(email *mailserver.MailItem) (string, string) {
+	if email.Payload == nil || !jsonDataTypes[email.Payload.DataType] {
+		return "", ""
+	}
+
+	var links struct {
+		Page     string `json:"unsubscribeUrl"`
+		OneClick string `json:"oneClickUnsubscribeUrl"`
+	}
+
+	// a payload that is not an object has no links
+	json.Unmarshal([]byte(email.Payload.Data), &links)
+
+	return links.Page, links.OneClick
+}
@@ -0,0 +1,340 @@
+package identities
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Links between users and the identities they sign in with at each
+// provider, kept in the user_auth_providers table. Identities are
+// matched on the subject the provider issues, which is stable, rather
+// than on email which users can change at the provider. An identity a
+// user unlinks is kept, marked as unlinked, so that signing in with it
+// again is refused rather than quietly linking it back to the account.
+
+const (
+	// sign in methods that are not external providers
+	ProviderPassword = "edb"
+	ProviderEmailOTP = "email_otp"
+
+	// postgres error code for a unique constraint violation
+	uniqueViolation = "23505"
+)
+
+var (
+	ErrIdentityNotFound      = errors.New("identity not found")
+	ErrIdentityUnlinked      = errors.New("identity has been unlinked from its account")
+	ErrIdentityLinked        = errors.New("identity is already linked to another account")
+	ErrLastSignInMethod      = errors.New("cannot unlink the last sign in method")
+	ErrProviderAlreadyLinked = errors.New("a different account at this provider is already linked")
+	ErrPasswordNotUnlinkable = errors.New("a password cannot be unlinked")
+)
+
+type Identity struct {
+	LinkedAt   time.Time `json:"linkedAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	// registry name of the provider, e.g. auth0
+	Provider string `json:"provider"`
+	// upstream provider, e.g. google when signing in via auth0
+	AuthProvider string `json:"authProvider"`
+	Subject      string `json:"subject"`
+	Email        string `json:"email"`
+	// groups the provider says the user belongs to, e.g. from saml
+	Groups []string `json:"groups,omitempty"`
+}
+
+type IdentityStore struct {
+	db *pgxpool.Pool
+}
+
+func NewIdentityStore(db *pgxpool.Pool) *IdentityStore {
+	return &IdentityStore{db: db}
+}
+
+const findSql = `SELECT uap.user_id, uap.unlinked_at IS NOT NULL
+	FROM user_auth_providers uap
+	JOIN auth_providers ap ON ap.id = uap.auth_provider_id
+	WHERE ap.name = $1 AND uap.subject = $2`
+
+// providers are added to auth_providers the first time a user links
+// one since they come from config rather than the schema
+const providerIdSql = `WITH ins AS (
+		INSERT INTO auth_providers (name) VALUES ($1)
+		ON CONFLICT (name) DO NOTHING
+		RETURNING id)
+	SELECT id FROM ins
+	UNION ALL
+	SELECT id FROM auth_providers WHERE name = $1
+	LIMIT 1`
+
+const subjectOwnerSql = `SELECT user_id, unlinked_at IS NOT NULL
+	FROM user_auth_providers
+	WHERE auth_provider_id = $1 AND subject = $2
+	FOR UPDATE`
+
+const currentSql = `SELECT subject, unlinked_at IS NOT NULL
+	FROM user_auth_providers
+	WHERE user_id = $1 AND auth_provider_id = $2
+	FOR UPDATE`
+
+const deleteSql = `DELETE FROM user_auth_providers WHERE user_id = $1 AND auth_provider_id = $2`
+
+// keep when the identity was linked unless it is being restored or
+// replaced by a different subject
+const upsertSql = `INSERT INTO user_auth_providers
+	(user_id, auth_provider_id, subject, email, upstream, groups)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (user_id, auth_provider_id) DO UPDATE SET
+		linked_at = CASE
+			WHEN user_auth_providers.unlinked_at IS NULL AND user_auth_providers.subject = excluded.subject
+			THEN user_auth_providers.linked_at
+			ELSE now() END,
+		subject = excluded.subject,
+		email = excluded.email,
+		upstream = excluded.upstream,
+		groups = excluded.groups,
+		last_used_at = now(),
+		unlinked_at = NULL`
+
+const listSql = `SELECT ap.name, uap.upstream, uap.subject, uap.email, uap.groups, uap.linked_at, uap.last_used_at
+	FROM user_auth_providers uap
+	JOIN auth_providers ap ON ap.id = uap.auth_provider_id
+	WHERE uap.user_id = $1 AND uap.unlinked_at IS NULL
+	ORDER BY uap.linked_at`
+
+const lockUserSql = `SELECT password <> '' FROM users WHERE id = $1 FOR UPDATE`
+
+// other ways the user can sign in besides the password
+const otherMethodsSql = `SELECT COUNT(*)
+	FROM user_auth_providers uap
+	JOIN auth_providers ap ON ap.id = uap.auth_provider_id
+	WHERE uap.user_id = $1 AND uap.unlinked_at IS NULL AND ap.name <> $2 AND ap.name <> $3`
+
+const unlinkSql = `UPDATE user_auth_providers uap SET unlinked_at = now()
+	FROM auth_providers ap
+	WHERE ap.id = uap.auth_provider_id AND uap.user_id = $1 AND ap.name = $2 AND uap.unlinked_at IS NULL`
+
+const unlinkAllSql = `DELETE FROM user_auth_providers WHERE user_id = $1`
+
+// Find returns the id of the user an identity is linked to. If the
+// user unlinked it, the id is returned with ErrIdentityUnlinked.
+func (store *IdentityStore) Find(ctx context.Context, provider string, subject string) (string, error) {
+	var userId string
+	var unlinked bool
+
+	err := store.db.QueryRow(ctx, findSql, provider, subject).Scan(&userId, &unlinked)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", ErrIdentityNotFound
+		}
+
+		return "", err
+	}
+
+	if unlinked {
+		return userId, ErrIdentityUnlinked
+	}
+
+	return userId, nil
+}
+
+// Link records that a user can sign in with an identity, including
+// one they previously unlinked, since linking is something the user
+// asks for. A user has at most one identity per provider.
+func (store *IdentityStore) Link(ctx context.Context, userId string, identity *Identity) error {
+	return store.link(ctx, userId, identity, true)
+}
+
+// Used records that a user signed in with an identity, linking it if
+// it is new. Unlike Link, an identity the user unlinked from the
+// provider is not linked back and ErrIdentityUnlinked is returned.
+func (store *IdentityStore) Used(ctx context.Context, userId string, identity *Identity) error {
+	return store.link(ctx, userId, identity, false)
+}
+
+func (store *IdentityStore) link(ctx context.Context, userId string, identity *Identity, restore bool) error {
+	tx, err := store.db.Begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	var providerId string
+
+	err = tx.QueryRow(ctx, providerIdSql, identity.Provider).Scan(&providerId)
+
+	if err != nil {
+		return err
+	}
+
+	var owner string
+	var unlinked bool
+
+	err = tx.QueryRow(ctx, subjectOwnerSql, providerId, identity.Subject).Scan(&owner, &unlinked)
+
+	switch {
+	case err == nil && owner != userId && !unlinked:
+		return ErrIdentityLinked
+	case err == nil && owner != userId:
+		if !restore {
+			return ErrIdentityUnlinked
+		}
+
+		// the other account gave the identity up, so it can
+		// move to this one
+		_, err = tx.Exec(ctx, deleteSql, owner, providerId)
+
+		if err != nil {
+			return err
+		}
+	case err != nil && !errors.Is(err, pgx.ErrNoRows):
+		return err
+	}
+
+	var subject string
+
+	err = tx.QueryRow(ctx, currentSql, userId, providerId).Scan(&subject, &unlinked)
+
+	switch {
+	case err == nil && unlinked && !restore:
+		return ErrIdentityUnlinked
+	// rows written when the account was created have no subject
+	case err == nil && !unlinked && subject != "" && subject != identity.Subject:
+		return ErrProviderAlreadyLinked
+	case err != nil && !errors.Is(err, pgx.ErrNoRows):
+		return err
+	}
+
+	groups := identity.Groups
+
+	if groups == nil {
+		groups = []string{}
+	}
+
+	_, err = tx.Exec(ctx, upsertSql,
+		userId,
+		providerId,
+		identity.Subject,
+		identity.Email,
+		identity.AuthProvider,
+		groups)
+
+	if err != nil {
+		var pgErr *pgconn.PgError
+
+		// someone else claimed the subject in the meantime
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return ErrIdentityLinked
+		}
+
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// List returns the identities linked to a user, oldest first
+func (store *IdentityStore) List(ctx context.Context, userId string) ([]*Identity, error) {
+	rows, err := store.db.Query(ctx, listSql, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]*Identity, 0, 5)
+
+	for rows.Next() {
+		var identity Identity
+
+		err = rows.Scan(&identity.Provider,
+			&identity.AuthProvider,
+			&identity.Subject,
+			&identity.Email,
+			&identity.Groups,
+			&identity.LinkedAt,
+			&identity.LastUsedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &identity)
+	}
+
+	return ret, rows.Err()
+}
+
+// Unlink removes an identity from a user provided they have another way
+// to sign in, either a password or another identity. The user row is
+// locked so that two unlinks at once cannot both pass the check.
+func (store *IdentityStore) Unlink(ctx context.Context, userId string, provider string) error {
+	if provider == ProviderPassword {
+		return ErrPasswordNotUnlinkable
+	}
+
+	tx, err := store.db.Begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	var hasPassword bool
+
+	err = tx.QueryRow(ctx, lockUserSql, userId).Scan(&hasPassword)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrIdentityNotFound
+		}
+
+		return err
+	}
+
+	var n int
+
+	err = tx.QueryRow(ctx, otherMethodsSql, userId, provider, ProviderPassword).Scan(&n)
+
+	if err != nil {
+		return err
+	}
+
+	if hasPassword {
+		n++
+	}
+
+	if n == 0 {
+		return ErrLastSignInMethod
+	}
+
+	tag, err := tx.Exec(ctx, unlinkSql, userId, provider)
+
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrIdentityNotFound
+	}
+
+	return tx.Commit(ctx)
+}
+
+// UnlinkAll removes every identity of a user, including unlinked ones,
+// e.g. when the account is deleted
+func (store *IdentityStore) UnlinkAll(ctx context.Context, userId string) error {
+	_, err := store.db.Exec(ctx, unlinkAllSql, userId)
+
+	return err
+}
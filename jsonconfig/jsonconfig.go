@@ -0,0 +1,74 @@
+package jsonconfig
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+)
+
+// Config files are json where string values can reference environment
+// variables as ${NAME} so secrets and per deployment settings stay out
+// of the file. Variables are expanded after the json is parsed, so a
+// value containing quotes or a $ is taken as it is and cannot change
+// the structure of the file.
+
+// Load reads a json file into config, which should be a pointer and can
+// already hold defaults for anything the file leaves out
+func Load(file string, config any) error {
+	bytes, err := os.ReadFile(file)
+
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(bytes, config)
+
+	if err != nil {
+		return err
+	}
+
+	expand(reflect.ValueOf(config))
+
+	return nil
+}
+
+// expand replaces environment variables in every string reachable
+// from v
+func expand(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			expand(v.Elem())
+		}
+	case reflect.Interface:
+		// what an interface holds cannot be set in place
+		if !v.IsNil() && v.CanSet() {
+			e := reflect.New(v.Elem().Type()).Elem()
+			e.Set(v.Elem())
+			expand(e)
+			v.Set(e)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				expand(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range v.Len() {
+			expand(v.Index(i))
+		}
+	case reflect.Map:
+		// nor can map values
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			expand(e)
+			v.SetMapIndex(k, e)
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(os.ExpandEnv(v.String()))
+		}
+	}
+}
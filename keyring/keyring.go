@@ -0,0 +1,590 @@
+package keyring
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A key ring holds one ES256 signing key and any number of older keys
+// that are still accepted for verification until they retire. Keys are
+// kept as pem files in a directory along with a manifest so that all
+// server instances sharing the directory see the same keys. Each key is
+// identified by its RFC 7638 thumbprint which is used as the kid header.
+
+const (
+	ManifestFile = "keys.json"
+
+	// held by the instance rotating the keys
+	lockFile = "keys.lock"
+
+	// a lock older than this was left by an instance that died
+	lockStale = 30 * time.Second
+
+	// how long to wait for another instance to finish rotating
+	lockTimeout = 10 * time.Second
+
+	// how often instances pick up keys rotated by another instance
+	DefaultReloadInterval = time.Minute
+
+	// typ of access and other tokens used with the api
+	defaultType = "JWT"
+)
+
+var (
+	ErrNoSigningKey     = errors.New("no signing key")
+	ErrUnknownKid       = errors.New("unknown key id")
+	ErrUnexpectedMethod = errors.New("unexpected signing method")
+	ErrNoLegacyKey      = errors.New("no key ring and no private key to create it from")
+	ErrLocked           = errors.New("keys are being rotated by another instance")
+	ErrUnexpectedType   = errors.New("unexpected token type")
+)
+
+type Key struct {
+	PrivateKey *ecdsa.PrivateKey `json:"-"`
+	PublicKey  *ecdsa.PublicKey  `json:"-"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	// when the key stops being accepted, nil for the signing key
+	RetireAt *time.Time `json:"retireAt,omitempty"`
+	Kid      string     `json:"kid"`
+}
+
+type manifest struct {
+	Signing string `json:"signing"`
+	Keys    []*Key `json:"keys"`
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+type KeyRing struct {
+	signing *Key
+	keys    map[string]*Key
+	dir     string
+	mu      sync.RWMutex
+}
+
+// Load reads the key ring from dir. If the directory has no manifest,
+// the ring is created from the legacy single key pem file so existing
+// deployments keep their key and live tokens remain valid. It is an
+// error for both to be missing.
+func Load(dir string, legacyPrivateKeyFile string) (*KeyRing, error) {
+	ring := &KeyRing{dir: dir, keys: make(map[string]*Key)}
+
+	_, err := os.Stat(filepath.Join(dir, ManifestFile))
+
+	if errors.Is(err, os.ErrNotExist) {
+		err = ring.bootstrap(legacyPrivateKeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return ring, nil
+	}
+
+	err = ring.Reload()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ring, nil
+}
+
+func (ring *KeyRing) bootstrap(legacyPrivateKeyFile string) error {
+	var privateKey *ecdsa.PrivateKey
+
+	bytes, err := os.ReadFile(legacyPrivateKeyFile)
+
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %s", ErrNoLegacyKey, legacyPrivateKeyFile)
+		}
+
+		return err
+	}
+
+	privateKey, err = jwt.ParseECPrivateKeyFromPEM(bytes)
+
+	if err != nil {
+		return err
+	}
+
+	key, err := newKey(privateKey)
+
+	if err != nil {
+		return err
+	}
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	ring.keys[key.Kid] = key
+	ring.signing = key
+
+	return ring.save()
+}
+
+func newKey(privateKey *ecdsa.PrivateKey) (*Key, error) {
+	kid, err := Thumbprint(&privateKey.PublicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{Kid: kid,
+		PrivateKey: privateKey,
+		PublicKey:  &privateKey.PublicKey,
+		CreatedAt:  time.Now().UTC()}, nil
+}
+
+func (ring *KeyRing) keyFile(kid string) string {
+	return filepath.Join(ring.dir, fmt.Sprintf("%s.private.pem", kid))
+}
+
+// Reload reads the manifest and keys from disk, replacing what is
+// held in memory.
+func (ring *KeyRing) Reload() error {
+	bytes, err := os.ReadFile(filepath.Join(ring.dir, ManifestFile))
+
+	if err != nil {
+		return err
+	}
+
+	var m manifest
+
+	err = json.Unmarshal(bytes, &m)
+
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*Key)
+
+	for _, key := range m.Keys {
+		bytes, err := os.ReadFile(ring.keyFile(key.Kid))
+
+		if err != nil {
+			return err
+		}
+
+		key.PrivateKey, err = jwt.ParseECPrivateKeyFromPEM(bytes)
+
+		if err != nil {
+			return err
+		}
+
+		key.PublicKey = &key.PrivateKey.PublicKey
+
+		keys[key.Kid] = key
+	}
+
+	signing, ok := keys[m.Signing]
+
+	if !ok {
+		return ErrNoSigningKey
+	}
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	ring.keys = keys
+	ring.signing = signing
+
+	return nil
+}
+
+// Watch reloads the ring periodically until the context is done so
+// that rotations performed by other instances are picked up
+func (ring *KeyRing) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := ring.Reload()
+
+				// keep the keys we have, they are still valid
+				if err != nil {
+					log.Warn().Msgf("could not reload keys from %s: %v", ring.dir, err)
+				}
+			}
+		}
+	}()
+}
+
+// save writes any new key files and the manifest. The manifest is
+// written to a temp file and renamed so readers never see a partial
+// file. Caller must hold the lock.
+func (ring *KeyRing) save() error {
+	err := os.MkdirAll(ring.dir, 0700)
+
+	if err != nil {
+		return err
+	}
+
+	m := manifest{Signing: ring.signing.Kid, Keys: make([]*Key, 0, len(ring.keys))}
+
+	for _, key := range ring.keys {
+		file := ring.keyFile(key.Kid)
+
+		_, err := os.Stat(file)
+
+		if errors.Is(err, os.ErrNotExist) {
+			der, err := x509.MarshalECPrivateKey(key.PrivateKey)
+
+			if err != nil {
+				return err
+			}
+
+			err = os.WriteFile(file,
+				pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+				0600)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		m.Keys = append(m.Keys, key)
+	}
+
+	bytes, err := json.MarshalIndent(&m, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(ring.dir, ManifestFile+".tmp")
+
+	err = os.WriteFile(tmp, bytes, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(ring.dir, ManifestFile))
+}
+
+// lock stops two instances sharing the directory rotating at the same
+// time. It returns a function to release the lock.
+func (ring *KeyRing) lock() (func(), error) {
+	err := os.MkdirAll(ring.dir, 0700)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file := filepath.Join(ring.dir, lockFile)
+	deadline := time.Now().Add(lockTimeout)
+
+	for {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+
+		if err == nil {
+			f.Close()
+
+			return func() {
+				os.Remove(file)
+			}, nil
+		}
+
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		info, err := os.Stat(file)
+
+		if err == nil && time.Since(info.ModTime()) > lockStale {
+			os.Remove(file)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrLocked
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Rotate creates a new signing key. The current signing key remains
+// valid for verification for the overlap duration, which should be at
+// least as long as the longest lived token it has signed. Keys whose
+// overlap has passed are removed. Instances sharing the directory take
+// turns and each starts from the keys on disk so no rotation is lost.
+func (ring *KeyRing) Rotate(overlap time.Duration) (*Key, error) {
+	unlock, err := ring.lock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer unlock()
+
+	err = ring.Reload()
+
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := newKey(privateKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	if ring.signing != nil {
+		retireAt := now.Add(overlap)
+		ring.signing.RetireAt = &retireAt
+	}
+
+	for kid, k := range ring.keys {
+		if k.RetireAt != nil && k.RetireAt.Before(now) {
+			delete(ring.keys, kid)
+			os.Remove(ring.keyFile(kid))
+		}
+	}
+
+	ring.keys[key.Kid] = key
+	ring.signing = key
+
+	err = ring.save()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Keys returns the keys that are currently accepted
+func (ring *KeyRing) Keys() []*Key {
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+
+	now := time.Now()
+
+	ret := make([]*Key, 0, len(ring.keys))
+
+	for _, key := range ring.keys {
+		if key.RetireAt == nil || key.RetireAt.After(now) {
+			ret = append(ret, key)
+		}
+	}
+
+	return ret
+}
+
+func (ring *KeyRing) SigningKey() (*Key, error) {
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+
+	if ring.signing == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	return ring.signing, nil
+}
+
+// SignToken signs claims with the current signing key and sets the
+// kid header so verifiers know which key to use
+func (ring *KeyRing) SignToken(claims jwt.Claims) (string, error) {
+	return ring.SignTypedToken(claims, defaultType)
+}
+
+// SignTypedToken signs claims like SignToken with a typ header, e.g.
+// for tokens in emails. Keyfunc rejects them so they can only be used
+// where a TypedKeyfunc for their type checks them (RFC 8725 3.11).
+func (ring *KeyRing) SignTypedToken(claims jwt.Claims, typ string) (string, error) {
+	key, err := ring.SigningKey()
+
+	if err != nil {
+		return "", err
+	}
+
+	t := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	t.Header["kid"] = key.Kid
+	t.Header["typ"] = typ
+
+	return t.SignedString(key.PrivateKey)
+}
+
+// Keyfunc picks the verification key for a token using its kid header.
+// Tokens issued before kids were added have no header and are checked
+// against every key that is still accepted, so they last through the
+// overlap of a rotation like any other token. Typed tokens are not
+// accepted.
+func (ring *KeyRing) Keyfunc(t *jwt.Token) (any, error) {
+	if typ, ok := t.Header["typ"].(string); ok && !strings.EqualFold(typ, defaultType) {
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedType, typ)
+	}
+
+	return ring.keyfunc(t)
+}
+
+// TypedKeyfunc is Keyfunc for tokens signed with SignTypedToken for
+// a type, it accepts no others
+func (ring *KeyRing) TypedKeyfunc(typ string) jwt.Keyfunc {
+	return func(t *jwt.Token) (any, error) {
+		if header, _ := t.Header["typ"].(string); header != typ {
+			return nil, fmt.Errorf("%w: %v", ErrUnexpectedType, t.Header["typ"])
+		}
+
+		return ring.keyfunc(t)
+	}
+}
+
+func (ring *KeyRing) keyfunc(t *jwt.Token) (any, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodECDSA); !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnexpectedMethod, t.Header["alg"])
+	}
+
+	kid, _ := t.Header["kid"].(string)
+
+	if kid == "" {
+		keys := ring.Keys()
+
+		if len(keys) == 0 {
+			return nil, ErrNoSigningKey
+		}
+
+		set := jwt.VerificationKeySet{Keys: make([]jwt.VerificationKey, 0, len(keys))}
+
+		for _, key := range keys {
+			set.Keys = append(set.Keys, key.PublicKey)
+		}
+
+		return set, nil
+	}
+
+	for _, key := range ring.Keys() {
+		if key.Kid == kid {
+			return key.PublicKey, nil
+		}
+	}
+
+	return nil, ErrUnknownKid
+}
+
+// JWKS returns the public keys that are currently accepted
+// in JSON Web Key Set form
+func (ring *KeyRing) JWKS() (*JWKSet, error) {
+	keys := ring.Keys()
+
+	ret := JWKSet{Keys: make([]JWK, 0, len(keys))}
+
+	for _, key := range keys {
+		jwk, err := NewJWK(key.PublicKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret.Keys = append(ret.Keys, *jwk)
+	}
+
+	return &ret, nil
+}
+
+func NewJWK(publicKey *ecdsa.PublicKey) (*JWK, error) {
+	x, y, err := coords(publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := Thumbprint(publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWK{Kty: "EC",
+		Crv: "P-256",
+		X:   x,
+		Y:   y,
+		Kid: kid,
+		Use: "sig",
+		Alg: "ES256"}, nil
+}
+
+// base64url encoded x and y coordinates of a P-256 key
+func coords(publicKey *ecdsa.PublicKey) (string, string, error) {
+	pub, err := publicKey.ECDH()
+
+	if err != nil {
+		return "", "", err
+	}
+
+	// uncompressed point is 0x04 || x || y
+	b := pub.Bytes()
+
+	if len(b) != 65 {
+		return "", "", fmt.Errorf("unsupported curve")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b[1:33]),
+		base64.RawURLEncoding.EncodeToString(b[33:]),
+		nil
+}
+
+// Thumbprint returns the RFC 7638 JWK thumbprint of a key
+func Thumbprint(publicKey *ecdsa.PublicKey) (string, error) {
+	x, y, err := coords(publicKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	// members must be in lexical order with no whitespace
+	s := fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, x, y)
+
+	sum := sha256.Sum256([]byte(s))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
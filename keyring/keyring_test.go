@@ -0,0 +1,100 @@
+package keyring
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testRing(t *testing.T) *KeyRing {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(privateKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "jwt.es256.private.pem")
+
+	err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ring, err := Load(dir, file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ring
+}
+
+func testClaims() *jwt.RegisteredClaims {
+	return &jwt.RegisteredClaims{Subject: "user",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}
+}
+
+func TestKeyfunc(t *testing.T) {
+	ring := testRing(t)
+
+	token, err := ring.SignToken(testClaims())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = jwt.Parse(token, ring.Keyfunc)
+
+	if err != nil {
+		t.Fatalf("untyped token: %v", err)
+	}
+
+	// a token of another type is not accepted as one for the api
+	_, err = jwt.Parse(token, ring.TypedKeyfunc("unsubscribe+jwt"))
+
+	if !errors.Is(err, ErrUnexpectedType) {
+		t.Fatalf("got %v, want %v", err, ErrUnexpectedType)
+	}
+}
+
+func TestTypedKeyfunc(t *testing.T) {
+	ring := testRing(t)
+
+	token, err := ring.SignTypedToken(testClaims(), "unsubscribe+jwt")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = jwt.Parse(token, ring.TypedKeyfunc("unsubscribe+jwt"))
+
+	if err != nil {
+		t.Fatalf("typed token: %v", err)
+	}
+
+	for name, keyfunc := range map[string]jwt.Keyfunc{"default": ring.Keyfunc,
+		"other type": ring.TypedKeyfunc("invite+jwt")} {
+		_, err = jwt.Parse(token, keyfunc)
+
+		if !errors.Is(err, ErrUnexpectedType) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrUnexpectedType)
+		}
+	}
+}
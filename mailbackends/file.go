@@ -0,0 +1,106 @@
+package mailbackends
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	mailserver "github.com/antonybholmes/go-mailserver"
+)
+
+// Writes each email as a json file in an outbox directory so another
+// process, or a developer, can pick them up. Files are written under
+// a temporary name and renamed so readers never see half an email.
+
+var ErrNoOutbox = errors.New("outbox directory is not set")
+
+type FileBackend struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewFileBackend(config FileConfig) (*FileBackend, error) {
+	if config.Dir == "" {
+		return nil, ErrNoOutbox
+	}
+
+	err := os.MkdirAll(config.Dir, 0o750)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileBackend{dir: config.Dir}, nil
+}
+
+func (backend *FileBackend) Name() string {
+	return BackendFile
+}
+
+func (backend *FileBackend) Dir() string {
+	return backend.dir
+}
+
+func (backend *FileBackend) SendMail(email *mailserver.MailItem) error {
+	data, err := json.MarshalIndent(email, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	// time ordered names so the outbox reads in the order sent
+	name := fmt.Sprintf("%s-%s.json", time.Now().UTC().Format("20060102T150405.000000000"), randomSuffix())
+
+	return backend.write(name, data)
+}
+
+// Health checks the directory can still be written to
+func (backend *FileBackend) Health(ctx context.Context) error {
+	return backend.write(".health", []byte(time.Now().UTC().Format(time.RFC3339)))
+}
+
+func (backend *FileBackend) write(name string, data []byte) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	tmp, err := os.CreateTemp(backend.dir, ".tmp-*")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), filepath.Join(backend.dir, name))
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+func randomSuffix() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,144 @@
+package mailbackends
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/jsonconfig"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/redis/go-redis/v9"
+)
+
+// Where queued emails go. The mail server normally picks them up from
+// SQS, but deployments without SQS can use a redis stream, kafka, send
+// directly over SMTP or write them to an outbox directory. The memory
+// backend keeps them for tests. The backend is chosen in the config.
+
+const (
+	BackendSQS    = "sqs"
+	BackendRedis  = "redis"
+	BackendKafka  = "kafka"
+	BackendSMTP   = "smtp"
+	BackendFile   = "file"
+	BackendMemory = "memory"
+
+	// how long a health check may take
+	healthTimeout = 5 * time.Second
+)
+
+// Backend is a mail queue that can say whether it is working
+type Backend interface {
+	Name() string
+	SendMail(email *mailserver.MailItem) error
+	// Health returns nil if mail can be sent
+	Health(ctx context.Context) error
+}
+
+type SQSConfig struct {
+	QueueUrl string `json:"queueUrl"`
+}
+
+type KafkaConfig struct {
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+}
+
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	// the password is read from this env variable
+	PasswordEnv string `json:"passwordEnv"`
+	From        string `json:"from"`
+	// starttls, tls or none
+	TLS string `json:"tls"`
+	// subjects by email type, overriding those in the emails package
+	Subjects map[string]string `json:"subjects"`
+}
+
+type FileConfig struct {
+	Dir string `json:"dir"`
+}
+
+type MemoryConfig struct {
+	// emails kept, the oldest are dropped
+	Size int `json:"size"`
+}
+
+type Config struct {
+	Backend string       `json:"backend"`
+	SQS     SQSConfig    `json:"sqs"`
+	Kafka   KafkaConfig  `json:"kafka"`
+	SMTP    SMTPConfig   `json:"smtp"`
+	File    FileConfig   `json:"file"`
+	Memory  MemoryConfig `json:"memory"`
+}
+
+var DefaultConfig = Config{
+	Backend: BackendSQS,
+	Kafka:   KafkaConfig{Topic: mailserver.QUEUE_EMAIL_CHANNEL},
+	SMTP:    SMTPConfig{Port: 587, TLS: TLSStartTLS},
+	File:    FileConfig{Dir: "data/mail/outbox"},
+	Memory:  MemoryConfig{Size: 1000},
+}
+
+type HealthResp struct {
+	Backend string `json:"backend"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+func LoadConfig(file string) (*Config, error) {
+	config := DefaultConfig
+
+	err := jsonconfig.Load(file, &config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// an unset env variable means the default
+	if config.Backend == "" {
+		config.Backend = DefaultConfig.Backend
+	}
+
+	return &config, nil
+}
+
+// NewBackend creates the backend chosen in the config
+func NewBackend(ctx context.Context, config *Config, rdb *redis.Client) (Backend, error) {
+	switch config.Backend {
+	case BackendSQS:
+		return NewSQSBackend(ctx, config.SQS)
+	case BackendRedis:
+		return NewRedisBackend(rdb), nil
+	case BackendKafka:
+		return NewKafkaBackend(config.Kafka)
+	case BackendSMTP:
+		return NewSMTPBackend(config.SMTP)
+	case BackendFile:
+		return NewFileBackend(config.File)
+	case BackendMemory:
+		return NewMemoryBackend(config.Memory), nil
+	default:
+		return nil, fmt.Errorf("unknown mail backend %s", config.Backend)
+	}
+}
+
+// CheckHealth runs the health check of a backend with a time limit
+func CheckHealth(ctx context.Context, backend Backend) *HealthResp {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	resp := HealthResp{Backend: backend.Name(), Healthy: true}
+
+	err := backend.Health(ctx)
+
+	if err != nil {
+		resp.Healthy = false
+		resp.Error = err.Error()
+	}
+
+	return &resp
+}
@@ -0,0 +1,67 @@
+package mailbackends
+
+import (
+	"context"
+	"sync"
+
+	mailserver "github.com/antonybholmes/go-mailserver"
+)
+
+// Keeps emails in memory so tests can check what was sent. Only the
+// most recent emails are kept.
+
+type MemoryBackend struct {
+	items []*mailserver.MailItem
+	size  int
+	mu    sync.Mutex
+}
+
+func NewMemoryBackend(config MemoryConfig) *MemoryBackend {
+	size := config.Size
+
+	if size <= 0 {
+		size = DefaultConfig.Memory.Size
+	}
+
+	return &MemoryBackend{size: size}
+}
+
+func (backend *MemoryBackend) Name() string {
+	return BackendMemory
+}
+
+func (backend *MemoryBackend) SendMail(email *mailserver.MailItem) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	backend.items = append(backend.items, email)
+
+	if len(backend.items) > backend.size {
+		backend.items = backend.items[len(backend.items)-backend.size:]
+	}
+
+	return nil
+}
+
+func (backend *MemoryBackend) Health(ctx context.Context) error {
+	return nil
+}
+
+// Items returns the emails sent, oldest first
+func (backend *MemoryBackend) Items() []*mailserver.MailItem {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	ret := make([]*mailserver.MailItem, len(backend.items))
+	copy(ret, backend.items)
+
+	return ret
+}
+
+// Clear forgets the emails sent
+func (backend *MemoryBackend) Clear() {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	backend.items = nil
+}
@@ -0,0 +1,143 @@
+package mailbackends
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// The backends the mail server reads from. Sending uses the queues of
+// the mail server library so messages are in the format it expects,
+// we add the health checks.
+
+var (
+	ErrNoQueueUrl = errors.New("sqs queue url is not set")
+	ErrNoBrokers  = errors.New("no kafka brokers are configured")
+)
+
+// the queues in the mail server library
+type mailQueue interface {
+	SendMail(email *mailserver.MailItem) error
+}
+
+type SQSBackend struct {
+	queue    mailQueue
+	client   *sqs.Client
+	queueUrl string
+}
+
+func NewSQSBackend(ctx context.Context, config SQSConfig) (*SQSBackend, error) {
+	if config.QueueUrl == "" {
+		return nil, ErrNoQueueUrl
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQSBackend{queue: mailserver.NewSqsEmailQueue(config.QueueUrl),
+		client:   sqs.NewFromConfig(cfg),
+		queueUrl: config.QueueUrl}, nil
+}
+
+func (backend *SQSBackend) Name() string {
+	return BackendSQS
+}
+
+// SendMail queues an email. Its unsubscribe links, if the recipient
+// can opt out of it, are already in its payload.
+func (backend *SQSBackend) SendMail(email *mailserver.MailItem) error {
+	return backend.queue.SendMail(email)
+}
+
+// Health checks the queue exists and we are allowed to see it
+func (backend *SQSBackend) Health(ctx context.Context) error {
+	_, err := backend.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(backend.queueUrl),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameApproximateNumberOfMessages},
+	})
+
+	return err
+}
+
+type RedisBackend struct {
+	queue mailQueue
+	rdb   *redis.Client
+}
+
+func NewRedisBackend(rdb *redis.Client) *RedisBackend {
+	return &RedisBackend{queue: mailserver.NewRedisEmailQueue(rdb), rdb: rdb}
+}
+
+func (backend *RedisBackend) Name() string {
+	return BackendRedis
+}
+
+func (backend *RedisBackend) SendMail(email *mailserver.MailItem) error {
+	return backend.queue.SendMail(email)
+}
+
+func (backend *RedisBackend) Health(ctx context.Context) error {
+	return backend.rdb.Ping(ctx).Err()
+}
+
+type KafkaBackend struct {
+	queue   mailQueue
+	brokers []string
+}
+
+func NewKafkaBackend(config KafkaConfig) (*KafkaBackend, error) {
+	if len(config.Brokers) == 0 {
+		return nil, ErrNoBrokers
+	}
+
+	topic := config.Topic
+
+	if topic == "" {
+		topic = mailserver.QUEUE_EMAIL_CHANNEL
+	}
+
+	writer := kafka.NewWriter(kafka.WriterConfig{
+		Brokers:  config.Brokers,
+		Topic:    topic,
+		Balancer: &kafka.LeastBytes{},
+	})
+
+	return &KafkaBackend{queue: mailserver.NewKafkaEmailPublisher(writer),
+		brokers: config.Brokers}, nil
+}
+
+func (backend *KafkaBackend) Name() string {
+	return BackendKafka
+}
+
+func (backend *KafkaBackend) SendMail(email *mailserver.MailItem) error {
+	return backend.queue.SendMail(email)
+}
+
+// Health checks at least one broker can be reached
+func (backend *KafkaBackend) Health(ctx context.Context) error {
+	var errs []error
+
+	for _, broker := range backend.brokers {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+
+		if err == nil {
+			return conn.Close()
+		}
+
+		errs = append(errs, &net.OpError{Op: "dial", Net: "tcp", Err: err})
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,277 @@
+package mailbackends
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	mailserver "github.com/antonybholmes/go-mailserver"
+)
+
+// Sends emails straight to an SMTP server, for sites without the mail
+// server. The emails are rendered from the mail server's templates by
+// the emails package, so they look the same as those it sends.
+
+const (
+	TLSStartTLS = "starttls"
+	TLSImplicit = "tls"
+	TLSNone     = "none"
+
+	smtpTimeout = 30 * time.Second
+)
+
+var (
+	ErrNoSMTPHost = errors.New("smtp host is not set")
+	ErrNoSMTPFrom = errors.New("smtp from address is not set")
+	ErrSMTPTLS    = errors.New("smtp tls must be starttls, tls or none")
+)
+
+type SMTPBackend struct {
+	config   SMTPConfig
+	from     *mail.Address
+	password string
+}
+
+func NewSMTPBackend(config SMTPConfig) (*SMTPBackend, error) {
+	if config.Host == "" {
+		return nil, ErrNoSMTPHost
+	}
+
+	if config.From == "" {
+		return nil, ErrNoSMTPFrom
+	}
+
+	from, err := mail.ParseAddress(config.From)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.TLS {
+	case "":
+		config.TLS = TLSStartTLS
+	case TLSStartTLS, TLSImplicit, TLSNone:
+	default:
+		return nil, ErrSMTPTLS
+	}
+
+	var password string
+
+	if config.PasswordEnv != "" {
+		password = os.Getenv(config.PasswordEnv)
+	}
+
+	return &SMTPBackend{config: config, from: from, password: password}, nil
+}
+
+func (backend *SMTPBackend) Name() string {
+	return BackendSMTP
+}
+
+func (backend *SMTPBackend) SendMail(email *mailserver.MailItem) error {
+	to, err := mail.ParseAddress(email.To)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), smtpTimeout)
+	defer cancel()
+
+	client, err := backend.connect(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	if backend.config.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", backend.config.Username, backend.password, backend.config.Host))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(backend.from.Address)
+
+	if err != nil {
+		return err
+	}
+
+	err = client.Rcpt(to.Address)
+
+	if err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+
+	if err != nil {
+		return err
+	}
+
+	message, err := backend.message(email, to)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(message)
+
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// Health checks the server answers and, if used, TLS works
+func (backend *SMTPBackend) Health(ctx context.Context) error {
+	client, err := backend.connect(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	return client.Quit()
+}
+
+func (backend *SMTPBackend) connect(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(backend.config.Host, strconv.Itoa(backend.config.Port))
+
+	tlsConfig := &tls.Config{ServerName: backend.config.Host}
+
+	var conn net.Conn
+	var err error
+
+	if backend.config.TLS == TLSImplicit {
+		dialer := tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the whole conversation must finish in time
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, backend.config.Host)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if backend.config.TLS == TLSStartTLS {
+		err = client.StartTLS(tlsConfig)
+
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+func (backend *SMTPBackend) subject(email *mailserver.MailItem) string {
+	if subject, ok := backend.config.Subjects[email.EmailType]; ok {
+		return subject
+	}
+
+	return emails.Subject(email.EmailType)
+}
+
+// message renders the email as html with its headers
+func (backend *SMTPBackend) message(email *mailserver.MailItem, to *mail.Address) ([]byte, error) {
+	if email.Name != "" {
+		to = &mail.Address{Name: email.Name, Address: to.Address}
+	}
+
+	rendered, err := emails.Render(email, backend.subject(email))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+
+	qw := quotedprintable.NewWriter(&body)
+
+	_, err = qw.Write([]byte(rendered.HTML))
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = qw.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: %s\r\n", backend.from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(rendered.Subject)))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", messageId(), backend.config.Host)
+
+	// mail clients post to the server to unsubscribe without
+	// showing the page (RFC 8058)
+	if _, oneClick := emails.UnsubscribeLinks(email); oneClick != "" {
+		fmt.Fprintf(&buf, "List-Unsubscribe: <%s>\r\n", oneClick)
+		buf.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	}
+
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	buf.WriteString("\r\n")
+	buf.Write(body.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+// headerValue stops a value starting new headers
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+func messageId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
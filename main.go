@@ -12,24 +12,42 @@ import (
 	"github.com/antonybholmes/go-dna/dnadb"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 
+	"github.com/antonybholmes/go-edbserver-gin/accessrequests"
+	"github.com/antonybholmes/go-edbserver-gin/announcements"
+	"github.com/antonybholmes/go-edbserver-gin/confirmations"
 	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/datasetacl"
+	"github.com/antonybholmes/go-edbserver-gin/devicecode"
+	"github.com/antonybholmes/go-edbserver-gin/emailchange"
+	"github.com/antonybholmes/go-edbserver-gin/identities"
+	"github.com/antonybholmes/go-edbserver-gin/keyring"
+	"github.com/antonybholmes/go-edbserver-gin/mailbackends"
+	"github.com/antonybholmes/go-edbserver-gin/memberships"
+	"github.com/antonybholmes/go-edbserver-gin/notifications"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	"github.com/antonybholmes/go-edbserver-gin/passwordpolicy"
+	"github.com/antonybholmes/go-edbserver-gin/revocation"
 	adminroutes "github.com/antonybholmes/go-edbserver-gin/routes/admin"
 	authenticationroutes "github.com/antonybholmes/go-edbserver-gin/routes/authentication"
 	sessionroutes "github.com/antonybholmes/go-edbserver-gin/routes/session"
+	"github.com/antonybholmes/go-edbserver-gin/saml"
+	"github.com/antonybholmes/go-edbserver-gin/sessionstore"
+	"github.com/antonybholmes/go-edbserver-gin/signinguard"
+	"github.com/antonybholmes/go-edbserver-gin/signinhistory"
+	"github.com/antonybholmes/go-edbserver-gin/signuppolicy"
 
 	"github.com/antonybholmes/go-edbserver-gin/routes/modules"
 	"github.com/antonybholmes/go-hubs/hubdb"
-	mailserver "github.com/antonybholmes/go-mailserver"
 	"github.com/antonybholmes/go-sys/log"
 	"github.com/antonybholmes/go-web"
 	"github.com/antonybholmes/go-web/access"
 	"github.com/antonybholmes/go-web/auth"
-	"github.com/antonybholmes/go-web/auth/token"
 	"github.com/antonybholmes/go-web/auth/token/tokengen"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 
 	"github.com/antonybholmes/go-web/middleware"
@@ -43,6 +61,7 @@ import (
 	"github.com/antonybholmes/go-pathway/pathwaydb"
 	"github.com/antonybholmes/go-scrna/scrnadb"
 	"github.com/antonybholmes/go-seqs/seqdb"
+	"github.com/antonybholmes/go-sys"
 	"github.com/antonybholmes/go-sys/env"
 	"github.com/antonybholmes/go-wgs/wgsdb"
 	_ "github.com/mattn/go-sqlite3"
@@ -70,8 +89,11 @@ var (
 	store cookie.Store
 
 	rdb *redis.Client
+	db  *pgxpool.Pool
 
 	re *access.RuleEngine
+
+	keyRing *keyring.KeyRing
 )
 
 // func initLogger() {
@@ -161,21 +183,15 @@ func init() {
 		DB:       0, // use default DB
 	})
 
-	//queue.Init(mailserver.NewRedisEmailQueue(rdb))
-
-	mailqueue.InitMailQueue(mailserver.NewSqsEmailQueue(consts.SqsQueueUrl))
+	// connects lazily so this does not wait for the database
+	db = sys.Must(pgxpool.New(context.Background(), consts.DatabaseUrl))
 
 	re = access.NewRuleEngine()
 
 	re.LoadRules("config/access-rules.json")
 
-	// writer := kafka.NewWriter(kafka.WriterConfig{
-	// 	Brokers:  []string{"localhost:9094"}, // Kafka broker
-	// 	Topic:    mailserver.QUEUE_EMAIL_CHANNEL, // Topic name
-	// 	Balancer: &kafka.LeastBytes{},        // Balancer (optional)
-	// })
-
-	// queue.Init(mailserver.NewKafkaEmailPublisher(writer))
+	// signing keys, created from the original single key on first run
+	keyRing = sys.Must(keyring.Load(consts.JwtKeysDir, "jwt.es256.private.pem"))
 
 }
 
@@ -187,7 +203,15 @@ func main() {
 	//consts.Init()
 
 	//tokengen.Init(token.NewRSATokenSigner(consts.JwtRsaPrivateKey))
-	tokengen.Init(token.NewES256TokenSigner(consts.JwtES256PrivateKey))
+	//tokengen.Init(token.NewES256TokenSigner(consts.JwtES256PrivateKey))
+
+	// sign with the current key of the ring, adding a kid header. This
+	// and NewJwtClaimsParser below need the go-web change described in
+	// the README.
+	tokengen.Init(keyRing)
+
+	// pick up keys rotated by other instances
+	keyRing.Watch(context.Background(), keyring.DefaultReloadInterval)
 
 	//env.Load()
 
@@ -206,13 +230,38 @@ func main() {
 
 	// all subsequent middleware is reliant on this to function
 	//claimsParser := middleware.NewUserJWTParser(middleware.NewJwtClaimsRSAParser(consts.JwtRsaPublicKey))
-	claimsParser := middleware.NewUserJWTParser(middleware.NewJwtClaimsES256Parser(consts.JwtES256PublicKey))
+	//claimsParser := middleware.NewUserJWTParser(middleware.NewJwtClaimsES256Parser(consts.JwtES256PublicKey))
+
+	// verify with any key in the ring that has not retired
+	claimsParser := middleware.NewUserJWTParser(middleware.NewJwtClaimsParser(keyRing.Keyfunc))
+
+	// tokens revoked before they expire are refused everywhere
+	revocations := revocation.NewRevocationStore(rdb)
 
-	jwtUserMiddleWare := middleware.UserJWTMiddleware(claimsParser)
+	// tokens can also be limited to some routes by their audience,
+	// which applies to every route that takes a token
+	jwtUserMiddleWare := authenticationroutes.NotRevokedMiddleware(revocations,
+		authenticationroutes.AudienceMiddleware(middleware.UserJWTMiddleware(claimsParser)))
 
 	//accessTokenMiddleware := middleware.JwtIsAccessTokenMiddleware()
 
-	rulesMiddleware := middleware.RulesMiddleware(claimsParser, re)
+	rulesMiddleware := authenticationroutes.NotRevokedMiddleware(revocations,
+		authenticationroutes.AudienceMiddleware(middleware.RulesMiddleware(claimsParser, re)))
+
+	// services such as the file server that may introspect and
+	// revoke tokens
+	tokenClientsConfig, err := revocation.LoadClientsConfig(consts.TokenClientsFile)
+
+	if err != nil {
+		log.Error().Msgf("failed to load token clients: %v", err)
+		tokenClientsConfig = &revocation.ClientsConfig{}
+	}
+
+	tokenClients := revocation.NewClientRegistry(tokenClientsConfig)
+
+	for id, err := range tokenClients.Disabled {
+		log.Warn().Msgf("token client %s disabled: %v", id, err)
+	}
 
 	updateTokenMiddleware := middleware.JwtIsUpdateTokenMiddleware()
 
@@ -220,6 +269,142 @@ func main() {
 
 	otp := auth.NewDefaultOTP(rdb)
 
+	// server side record of sessions so they can be listed and revoked
+	sessionStore := sessionstore.NewSessionStore(rdb)
+
+	// pending device authorization grants for cli sign in
+	deviceCodes := devicecode.NewDeviceCodeStore(rdb, consts.DeviceCodeTtlMins)
+
+	// saml requests waiting for the identity provider to respond
+	samlRequests := saml.NewRequestStore(rdb, consts.SAMLRequestTtlMins)
+
+	// which provider identities each user can sign in with
+	identityStore := identities.NewIdentityStore(db)
+
+	// where emails are queued for the mail server, or sent directly
+	mailConfig, err := mailbackends.LoadConfig(consts.MailConfigFile)
+
+	if err != nil {
+		log.Error().Msgf("failed to load mail config: %v", err)
+		mailConfig = &mailbackends.DefaultConfig
+	}
+
+	mailBackend, err := mailbackends.NewBackend(context.Background(), mailConfig, rdb)
+
+	if err != nil {
+		// emails quietly piling up somewhere nobody reads them is
+		// worse than not starting
+		log.Fatal().Msgf("failed to create mail backend %s: %v", mailConfig.Backend, err)
+	}
+
+	mailqueue.InitMailQueue(mailBackend)
+
+	// which kinds of email users want, checked when emails are queued
+	preferences := notifications.NewPreferences(rdb, keyRing, consts.UrlUnsubscribe, consts.UrlOneClickUnsubscribe)
+
+	notifications.Init(preferences)
+
+	// emails are kept until the backend accepts them and retried
+	// if it is down
+	outboxStore := outbox.NewOutboxStore(db, outbox.DefaultRetryConfig)
+
+	outbox.Init(outboxStore)
+
+	outbox.NewDispatcher(outboxStore, rdb).Start(context.Background(), outbox.DefaultDispatchInterval)
+
+	// news and data releases emailed to groups a batch at a time
+	broadcaster := announcements.NewBroadcaster(announcements.NewAnnouncementStore(rdb), db, announcements.DefaultThrottle)
+
+	// carry on with announcements a server stopped emailing
+	broadcaster.Start(context.Background(), announcements.DefaultResumeInterval)
+
+	go func() {
+		health := mailbackends.CheckHealth(context.Background(), mailBackend)
+
+		if health.Healthy {
+			log.Info().Msgf("mail backend %s is healthy", health.Backend)
+		} else {
+			log.Warn().Msgf("mail backend %s is not healthy: %s", health.Backend, health.Error)
+		}
+	}()
+
+	// slows down and locks out password guessing
+	signInGuard := signinguard.NewGuard(rdb, signinguard.DefaultConfig)
+
+	// every sign in attempt and the devices each user signs in from
+	signInHistory := signinhistory.NewHistoryStore(rdb)
+
+	// rules for new passwords. Fall back to the defaults rather
+	// than refusing to start if the config is missing
+	passwordConfig, err := passwordpolicy.LoadConfig(consts.PasswordPolicyFile)
+
+	if err != nil {
+		log.Error().Msgf("failed to load password policy: %v", err)
+		passwordConfig = &passwordpolicy.DefaultConfig
+	}
+
+	passwordPolicy, err := passwordpolicy.NewPolicy(*passwordConfig, passwordpolicy.NewHistoryStore(rdb))
+
+	if err != nil {
+		log.Fatal().Msgf("failed to load breached passwords: %v", err)
+	}
+
+	passwordpolicy.Init(passwordPolicy)
+
+	// who may create an account and how bots are kept out
+	signupConfig, err := signuppolicy.LoadConfig(consts.SignupPolicyFile)
+
+	if err != nil {
+		log.Error().Msgf("failed to load signup policy: %v", err)
+		signupConfig = &signuppolicy.DefaultConfig
+	}
+
+	signupPolicy := signuppolicy.NewPolicy(rdb, db, *signupConfig)
+
+	botVerifier, err := signuppolicy.NewBotVerifier(signupConfig.BotCheck)
+
+	if err != nil {
+		log.Fatal().Msgf("failed to create bot check: %v", err)
+	}
+
+	// datasets in the data modules that are shared with some users
+	// or groups only
+	datasetACLConfig, err := datasetacl.LoadConfig(consts.DatasetACLFile)
+
+	if err != nil {
+		log.Error().Msgf("failed to load dataset access config: %v", err)
+		datasetACLConfig = &datasetacl.Config{}
+	}
+
+	datasetACL := datasetacl.NewACL(rdb, datasetACLConfig)
+
+	// when time limited group memberships end. Ended memberships are
+	// removed before tokens are issued and by a daily clean up
+	membershipExpiries := memberships.NewExpiryStore(db)
+
+	memberships.Init(membershipExpiries)
+
+	memberships.NewJob(membershipExpiries, rdb, consts.MembershipWarningMins, consts.AppUrl).
+		Start(context.Background(), memberships.DefaultJobInterval)
+
+	// users asking for access to groups and datasets
+	accessConfig, err := accessrequests.LoadConfig(consts.AccessRequestsFile)
+
+	if err != nil {
+		log.Error().Msgf("failed to load access request config: %v", err)
+		accessConfig = &accessrequests.DefaultConfig
+	}
+
+	accessPolicy := accessrequests.NewPolicy(accessrequests.NewRequestStore(rdb),
+		accessrequests.NewAuditLog(rdb),
+		*accessConfig)
+
+	// emailed links confirming changes to an account
+	confirmationStore := confirmations.NewConfirmationStore(rdb)
+
+	// email changes waiting for the new address to be confirmed
+	emailChanges := emailchange.NewEmailChangeStore(rdb)
+
 	// Setup tracer provider
 	tp, err := initTracerProvider()
 	if err != nil {
@@ -283,23 +468,73 @@ func main() {
 			IpAddr: c.ClientIP()})
 	})
 
+	// public keys so other services can verify our tokens
+	r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		jwks, err := keyRing.JWKS()
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, jwks)
+	})
+
 	//
 	// Routes
 	//
 
-	adminroutes.RegisterRoutes(r, rulesMiddleware)
-
-	authenticationroutes.RegisterRoutes(r, jwtUserMiddleWare, updateTokenMiddleware)
+	adminroutes.RegisterRoutes(r,
+		rulesMiddleware,
+		sessionStore,
+		keyRing,
+		signInHistory,
+		signupPolicy,
+		datasetACL,
+		accessPolicy,
+		membershipExpiries,
+		mailBackend,
+		outboxStore,
+		broadcaster)
+
+	authenticationroutes.RegisterRoutes(r,
+		signInGuard,
+		signInHistory,
+		emailChanges,
+		signupPolicy,
+		botVerifier,
+		keyRing,
+		revocations,
+		tokenClients,
+		preferences,
+		jwtUserMiddleWare,
+		updateTokenMiddleware)
 
 	sessionroutes.RegisterRoutes(r,
 		otp,
+		sessionStore,
+		deviceCodes,
+		samlRequests,
+		identityStore,
+		signInGuard,
+		signInHistory,
+		signupPolicy,
+		botVerifier,
+		confirmationStore,
+		accessPolicy,
+		preferences,
+		broadcaster.Store,
+		datasetACL,
 		jwtUserMiddleWare)
 
 	//
 	// Deal with logins where we want a session
 	//
 
-	modules.RegisterRoutes(r, rulesMiddleware)
+	modules.RegisterRoutes(r,
+		rulesMiddleware,
+		modules.NewDatasetAccess(datasetACL, keyRing.Keyfunc))
 
 	//
 	// Util routes
@@ -311,6 +546,7 @@ func main() {
 	xlsxGroup := utilsGroup.Group("/xlsx")
 	xlsxGroup.POST("/sheets", utilsroutes.XlsxSheetsRoute)
 	xlsxGroup.POST("/to/:format", utilsroutes.XlsxToRoute)
+	xlsxGroup.POST("/from/:format", utilsroutes.XlsxFromRoute)
 
 	utilsGroup.GET("/passwords/hash", utilsroutes.HashedPasswordRoute)
 	utilsGroup.GET("/randkey", utilsroutes.RandomKeyRoute)
@@ -0,0 +1,158 @@
+package memberships
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// When memberships end is kept with the membership itself, in the
+// expires_at column of user_groups, so that it goes when the user
+// leaves the group and cannot outlive it.
+
+type Membership struct {
+	UserId    string    `json:"userId"`
+	Group     string    `json:"group"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type ExpiryStore struct {
+	db *pgxpool.Pool
+}
+
+func NewExpiryStore(db *pgxpool.Pool) *ExpiryStore {
+	return &ExpiryStore{db: db}
+}
+
+// changing when a membership ends means the user is warned again
+// before the new time
+const setExpirySql = `UPDATE user_groups ug SET expires_at = $3, expiry_warned_at = NULL
+	FROM groups g
+	WHERE g.id = ug.group_id AND ug.user_id = $1 AND g.name = $2`
+
+const expiriesSql = `SELECT g.name, ug.expires_at
+	FROM user_groups ug
+	JOIN groups g ON g.id = ug.group_id
+	WHERE ug.user_id = $1 AND ug.expires_at IS NOT NULL`
+
+const listSql = `SELECT ug.user_id, g.name, ug.expires_at
+	FROM user_groups ug
+	JOIN groups g ON g.id = ug.group_id
+	WHERE ug.expires_at IS NOT NULL
+	ORDER BY ug.expires_at`
+
+const warnedSql = `SELECT ug.expiry_warned_at IS NOT NULL
+	FROM user_groups ug
+	JOIN groups g ON g.id = ug.group_id
+	WHERE ug.user_id = $1 AND g.name = $2`
+
+const setWarnedSql = `UPDATE user_groups ug SET expiry_warned_at = now()
+	FROM groups g
+	WHERE g.id = ug.group_id AND ug.user_id = $1 AND g.name = $2`
+
+const clearSql = `UPDATE user_groups SET expires_at = NULL, expiry_warned_at = NULL
+	WHERE user_id = $1 AND expires_at IS NOT NULL`
+
+// SetExpiry records when a membership ends. A nil time makes the
+// membership permanent. It does nothing if the user is not in the
+// group.
+func (store *ExpiryStore) SetExpiry(ctx context.Context, userId string, group string, expiresAt *time.Time) error {
+	var t *time.Time
+
+	if expiresAt != nil {
+		utc := expiresAt.UTC()
+		t = &utc
+	}
+
+	_, err := store.db.Exec(ctx, setExpirySql, userId, group, t)
+
+	return err
+}
+
+// Expiries returns when each of the time limited memberships
+// of a user end
+func (store *ExpiryStore) Expiries(ctx context.Context, userId string) (map[string]time.Time, error) {
+	rows, err := store.db.Query(ctx, expiriesSql, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make(map[string]time.Time)
+
+	for rows.Next() {
+		var group string
+		var expiresAt time.Time
+
+		err = rows.Scan(&group, &expiresAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret[group] = expiresAt
+	}
+
+	return ret, rows.Err()
+}
+
+// List returns every time limited membership, soonest to end first
+func (store *ExpiryStore) List(ctx context.Context) ([]*Membership, error) {
+	rows, err := store.db.Query(ctx, listSql)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]*Membership, 0, 10)
+
+	for rows.Next() {
+		var membership Membership
+
+		err = rows.Scan(&membership.UserId, &membership.Group, &membership.ExpiresAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &membership)
+	}
+
+	return ret, rows.Err()
+}
+
+// Warned reports whether the user has been told their
+// membership is about to end
+func (store *ExpiryStore) Warned(ctx context.Context, userId string, group string) (bool, error) {
+	var warned bool
+
+	err := store.db.QueryRow(ctx, warnedSql, userId, group).Scan(&warned)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+
+	return warned, err
+}
+
+// SetWarned records the user was warned, in the transaction that
+// queues the warning so it is neither lost nor sent twice
+func (store *ExpiryStore) SetWarned(ctx context.Context, tx pgx.Tx, userId string, group string) error {
+	_, err := tx.Exec(ctx, setWarnedSql, userId, group)
+
+	return err
+}
+
+// Clear makes every membership of a user permanent
+func (store *ExpiryStore) Clear(ctx context.Context, userId string) error {
+	_, err := store.db.Exec(ctx, clearSql, userId)
+
+	return err
+}
@@ -0,0 +1,194 @@
+package memberships
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web/auth"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// The daily clean up of memberships. Ended memberships are removed and
+// users are warned some days before theirs end. Every server runs the
+// job but a lock in redis means only one does the work each day.
+
+const (
+	jobLockKey = "user:groups:job"
+
+	DefaultJobInterval = 24 * time.Hour
+)
+
+type Job struct {
+	store *ExpiryStore
+	// for the lock
+	rdb *redis.Client
+	// how long before a membership ends to warn the user
+	warning time.Duration
+	linkUrl string
+}
+
+func NewJob(store *ExpiryStore, rdb *redis.Client, warning time.Duration, linkUrl string) *Job {
+	return &Job{store: store, rdb: rdb, warning: warning, linkUrl: linkUrl}
+}
+
+// Start runs the job now and then at every interval until the
+// context is done
+func (job *Job) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			job.runOnce(ctx, interval)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (job *Job) runOnce(ctx context.Context, interval time.Duration) {
+	// another server has already done the work for this interval
+	ok, err := job.rdb.SetNX(ctx, jobLockKey, time.Now().Unix(), interval-time.Minute).Result()
+
+	if err != nil {
+		log.Error().Msgf("membership job could not take lock: %v", err)
+		return
+	}
+
+	if !ok {
+		return
+	}
+
+	removed, warned, err := job.Run(ctx)
+
+	if err != nil {
+		log.Error().Msgf("membership job failed: %v", err)
+		return
+	}
+
+	log.Info().Msgf("membership job removed %d memberships and warned about %d", removed, warned)
+}
+
+// Run removes ended memberships and warns about those ending soon
+func (job *Job) Run(ctx context.Context) (int, int, error) {
+	list, err := job.store.List(ctx)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now()
+
+	removed := 0
+	warned := 0
+
+	for _, membership := range list {
+		if membership.ExpiresAt.After(now.Add(job.warning)) {
+			// sorted so none of the rest need anything doing
+			break
+		}
+
+		authUser, err := userdbcache.FindUserById(membership.UserId)
+
+		if err != nil {
+			log.Warn().Msgf("membership of unknown user %s: %v", membership.UserId, err)
+			continue
+		}
+
+		if !membership.ExpiresAt.After(now) {
+			err = RemoveGroups(ctx, job.store, authUser, []string{membership.Group})
+
+			if err != nil {
+				log.Error().Msgf("could not remove %s from %s: %v", authUser.Id, membership.Group, err)
+				continue
+			}
+
+			job.sendEmail(ctx, authUser, membership, emails.EmailQueueTypeMembershipExpired)
+
+			log.Info().Msgf("membership of %s in %s ended", authUser.Id, membership.Group)
+
+			removed++
+			continue
+		}
+
+		ok, err := job.store.Warned(ctx, membership.UserId, membership.Group)
+
+		if err != nil || ok {
+			continue
+		}
+
+		err = job.warn(ctx, authUser, membership)
+
+		if err != nil {
+			log.Warn().Msgf("could not warn %s about %s ending: %v", membership.UserId, membership.Group, err)
+			continue
+		}
+
+		warned++
+	}
+
+	return removed, warned, nil
+}
+
+// warn queues the warning that a membership is ending and records
+// that it was sent in one transaction
+func (job *Job) warn(ctx context.Context, authUser *auth.AuthUser, membership *Membership) error {
+	tx, err := job.store.db.Begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	err = job.store.SetWarned(ctx, tx, membership.UserId, membership.Group)
+
+	if err != nil {
+		return err
+	}
+
+	err = outbox.SendMailTx(ctx, tx, job.email(authUser, membership, emails.EmailQueueTypeMembershipExpiring))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (job *Job) email(authUser *auth.AuthUser, membership *Membership, emailType string) *mailserver.MailItem {
+	// json so the unsubscribe links can be added, a string always encodes
+	data, _ := json.Marshal(map[string]string{"group": membership.Group})
+
+	email := mailserver.MailItem{Name: authUser.Name,
+		To:        authUser.Email,
+		EmailType: emailType,
+		LinkUrl:   job.linkUrl,
+		Payload:   &mailserver.Payload{DataType: "membership", Data: string(data)}}
+
+	if left := time.Until(membership.ExpiresAt); left > 0 {
+		email.TTL = fmt.Sprintf("%d days", int(left.Hours()/24)+1)
+	}
+
+	return &email
+}
+
+func (job *Job) sendEmail(ctx context.Context, authUser *auth.AuthUser, membership *Membership, emailType string) {
+	err := outbox.SendMail(ctx, job.email(authUser, membership, emailType))
+
+	if err != nil {
+		log.Warn().Msgf("could not send %s email: %v", emailType, err)
+	}
+}
@@ -0,0 +1,137 @@
+package memberships
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/antonybholmes/go-web/auth"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+)
+
+// Group memberships that only last for a while, e.g. for students and
+// external collaborators. The groups themselves live in the user
+// database along with when a membership ends, and here we take the
+// user out of the group once it has.
+
+var defaultStore *ExpiryStore
+
+func Init(store *ExpiryStore) {
+	defaultStore = store
+}
+
+// SetGroups sets the groups of a user outright, e.g. when an admin
+// edits the user. Every membership they are left with is permanent,
+// time limits are put back through the membership routes.
+func SetGroups(ctx context.Context, authUser *auth.AuthUser, groups []string) error {
+	err := userdbcache.SetUserGroups(authUser, groups, true)
+
+	if err != nil || defaultStore == nil {
+		return err
+	}
+
+	return defaultStore.Clear(ctx, authUser.Id)
+}
+
+// GroupNames returns the names of the groups a user is in. The user is
+// read as json since groups may be names or objects.
+func GroupNames(authUser *auth.AuthUser) []string {
+	b, err := json.Marshal(authUser)
+
+	if err != nil {
+		return nil
+	}
+
+	var user struct {
+		Groups []any `json:"groups"`
+	}
+
+	err = json.Unmarshal(b, &user)
+
+	if err != nil {
+		return nil
+	}
+
+	var ret []string
+
+	for _, group := range user.Groups {
+		switch g := group.(type) {
+		case string:
+			ret = append(ret, g)
+		case map[string]any:
+			if name, ok := g["name"].(string); ok {
+				ret = append(ret, name)
+			}
+		}
+	}
+
+	return ret
+}
+
+// RemoveGroups takes a user out of some groups. When those memberships
+// were due to end goes with them, but is cleared anyway in case the
+// user had already left a group.
+func RemoveGroups(ctx context.Context, store *ExpiryStore, authUser *auth.AuthUser, groups []string) error {
+	current := GroupNames(authUser)
+
+	remaining := slices.DeleteFunc(slices.Clone(current), func(group string) bool {
+		return slices.Contains(groups, group)
+	})
+
+	if len(remaining) != len(current) {
+		err := userdbcache.SetUserGroups(authUser, remaining, true)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, group := range groups {
+		err := store.SetExpiry(ctx, authUser.Id, group, nil)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Enforce removes the memberships of a user that have ended and
+// returns the user as they are now. It is called before issuing
+// tokens so ended memberships never make it into a token, even if
+// the daily clean up has not run yet.
+func Enforce(ctx context.Context, authUser *auth.AuthUser) (*auth.AuthUser, error) {
+	if defaultStore == nil {
+		return authUser, nil
+	}
+
+	expiries, err := defaultStore.Expiries(ctx, authUser.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	var ended []string
+
+	for group, expiresAt := range expiries {
+		if !expiresAt.After(now) {
+			ended = append(ended, group)
+		}
+	}
+
+	if len(ended) == 0 {
+		return authUser, nil
+	}
+
+	err = RemoveGroups(ctx, defaultStore, authUser, ended)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return userdbcache.FindUserById(authUser.Id)
+}
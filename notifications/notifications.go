@@ -0,0 +1,369 @@
+package notifications
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// Which emails users want. Emails are grouped in categories users can
+// turn off, except security emails such as password resets, sign in
+// codes and account changes, which are always sent. Preferences are
+// checked when an email is queued.
+
+const (
+	CategorySecurity      = "security"
+	CategoryMemberships   = "memberships"
+	CategoryAccess        = "access"
+	CategoryAnnouncements = "announcements"
+	CategoryReleases      = "releases"
+
+	unsubscribeAudience = "unsubscribe"
+	// typ of unsubscribe tokens, so they are not accepted as any other
+	UnsubscribeTokenType = "unsubscribe+jwt"
+
+	// how long an unsubscribe link in an email works
+	UnsubscribeTokenTtl = 90 * 24 * time.Hour
+)
+
+var (
+	ErrUnknownCategory   = errors.New("unknown notification category")
+	ErrMandatoryCategory = errors.New("security emails cannot be turned off")
+	ErrInvalidToken      = errors.New("invalid unsubscribe link")
+)
+
+type Category struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Mandatory   bool   `json:"mandatory"`
+}
+
+var Categories = []*Category{
+	{Name: CategorySecurity,
+		Description: "Sign in codes, password resets and changes to your account",
+		Mandatory:   true},
+	{Name: CategoryMemberships,
+		Description: "Reminders before a group membership ends"},
+	{Name: CategoryAccess,
+		Description: "Updates on access requests"},
+	{Name: CategoryAnnouncements,
+		Description: "News about the service"},
+	{Name: CategoryReleases,
+		Description: "New datasets and data releases"},
+}
+
+// the category of each email type users can turn off, all others
+// are security emails
+var typeCategories = map[string]string{
+	emails.EmailQueueTypeMembershipExpiring: CategoryMemberships,
+	emails.EmailQueueTypeMembershipExpired:  CategoryMemberships,
+	emails.EmailQueueTypeAccessRequested:    CategoryAccess,
+	emails.EmailQueueTypeAccessApproved:     CategoryAccess,
+	emails.EmailQueueTypeAccessDenied:       CategoryAccess,
+	emails.EmailQueueTypeAnnouncement:       CategoryAnnouncements,
+	emails.EmailQueueTypeDataRelease:        CategoryReleases,
+}
+
+var defaultPreferences *Preferences
+
+func Init(prefs *Preferences) {
+	defaultPreferences = prefs
+}
+
+// Allowed returns whether the recipient of an email wants it. Without
+// preferences every email is sent.
+func Allowed(ctx context.Context, email *mailserver.MailItem) (bool, error) {
+	if defaultPreferences == nil {
+		return true, nil
+	}
+
+	return defaultPreferences.Allowed(ctx, email)
+}
+
+// Enabled returns whether a user wants emails in a category. Without
+// preferences every category is on.
+func Enabled(ctx context.Context, userId string, category string) (bool, error) {
+	if defaultPreferences == nil {
+		return true, nil
+	}
+
+	return defaultPreferences.Enabled(ctx, userId, category)
+}
+
+// AddUnsubscribeLinks adds the links the recipient of an email can use
+// to stop emails like it, if they can. Without preferences there are
+// none.
+func AddUnsubscribeLinks(email *mailserver.MailItem) error {
+	if defaultPreferences == nil {
+		return nil
+	}
+
+	return defaultPreferences.AddUnsubscribeLinks(email)
+}
+
+// Forget removes the preferences of a user, e.g. when the account
+// is deleted
+func Forget(ctx context.Context, userId string) error {
+	if defaultPreferences == nil {
+		return nil
+	}
+
+	return defaultPreferences.Forget(ctx, userId)
+}
+
+// CategoryOf returns the category of an email type
+func CategoryOf(emailType string) string {
+	if category, ok := typeCategories[emailType]; ok {
+		return category
+	}
+
+	return CategorySecurity
+}
+
+// FindCategory returns a category by name
+func FindCategory(name string) (*Category, error) {
+	i := slices.IndexFunc(Categories, func(category *Category) bool {
+		return category.Name == name
+	})
+
+	if i == -1 {
+		return nil, ErrUnknownCategory
+	}
+
+	return Categories[i], nil
+}
+
+// Signer signs and checks unsubscribe tokens, e.g. the key ring. They
+// are typed so they cannot be used as access tokens.
+type Signer interface {
+	SignTypedToken(claims jwt.Claims, typ string) (string, error)
+	TypedKeyfunc(typ string) jwt.Keyfunc
+}
+
+type UnsubscribeClaims struct {
+	jwt.RegisteredClaims
+	Category string `json:"category"`
+}
+
+type CategoryPreference struct {
+	*Category
+	Enabled bool `json:"enabled"`
+}
+
+type Preferences struct {
+	rdb    *redis.Client
+	signer Signer
+	// the page an unsubscribe link opens
+	unsubscribeUrl string
+	// the unsubscribe route of this server
+	oneClickUrl string
+}
+
+func NewPreferences(rdb *redis.Client, signer Signer, unsubscribeUrl string, oneClickUrl string) *Preferences {
+	return &Preferences{rdb: rdb, signer: signer, unsubscribeUrl: unsubscribeUrl, oneClickUrl: oneClickUrl}
+}
+
+func preferencesKey(userId string) string {
+	return fmt.Sprintf("user:notifications:%s", userId)
+}
+
+// Get returns whether each category is on for a user. Categories are
+// on until the user turns them off.
+func (prefs *Preferences) Get(ctx context.Context, userId string) ([]*CategoryPreference, error) {
+	values, err := prefs.rdb.HGetAll(ctx, preferencesKey(userId)).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*CategoryPreference, 0, len(Categories))
+
+	for _, category := range Categories {
+		enabled := true
+
+		if value, ok := values[category.Name]; ok && !category.Mandatory {
+			enabled, _ = strconv.ParseBool(value)
+		}
+
+		ret = append(ret, &CategoryPreference{Category: category, Enabled: enabled})
+	}
+
+	return ret, nil
+}
+
+// Enabled returns whether a user wants emails in a category
+func (prefs *Preferences) Enabled(ctx context.Context, userId string, name string) (bool, error) {
+	category, err := FindCategory(name)
+
+	if err != nil {
+		return false, err
+	}
+
+	if category.Mandatory {
+		return true, nil
+	}
+
+	value, err := prefs.rdb.HGet(ctx, preferencesKey(userId), name).Result()
+
+	if err == redis.Nil {
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return strconv.ParseBool(value)
+}
+
+// Set turns categories on or off for a user
+func (prefs *Preferences) Set(ctx context.Context, userId string, enabled map[string]bool) error {
+	values := make(map[string]any, len(enabled))
+
+	for name, on := range enabled {
+		category, err := FindCategory(name)
+
+		if err != nil {
+			return err
+		}
+
+		if category.Mandatory {
+			if !on {
+				return ErrMandatoryCategory
+			}
+
+			continue
+		}
+
+		values[name] = strconv.FormatBool(on)
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	return prefs.rdb.HSet(ctx, preferencesKey(userId), values).Err()
+}
+
+func (prefs *Preferences) Forget(ctx context.Context, userId string) error {
+	return prefs.rdb.Del(ctx, preferencesKey(userId)).Err()
+}
+
+// UnsubscribeToken makes a signed token that turns a category off
+// for a user without them signing in
+func (prefs *Preferences) UnsubscribeToken(userId string, category string) (string, error) {
+	now := time.Now()
+
+	claims := UnsubscribeClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: userId,
+		Audience:  jwt.ClaimStrings{unsubscribeAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(UnsubscribeTokenTtl))},
+		Category: category}
+
+	return prefs.signer.SignTypedToken(&claims, UnsubscribeTokenType)
+}
+
+// ParseUnsubscribeToken checks a token and returns who it is for and
+// the category it turns off
+func (prefs *Preferences) ParseUnsubscribeToken(token string) (*UnsubscribeClaims, error) {
+	var claims UnsubscribeClaims
+
+	_, err := jwt.ParseWithClaims(token,
+		&claims,
+		prefs.signer.TypedKeyfunc(UnsubscribeTokenType),
+		jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}),
+		jwt.WithAudience(unsubscribeAudience),
+		jwt.WithExpirationRequired())
+
+	if err != nil || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+
+	category, err := FindCategory(claims.Category)
+
+	if err != nil || category.Mandatory {
+		return nil, ErrInvalidToken
+	}
+
+	return &claims, nil
+}
+
+// Unsubscribe turns off the category in a token
+func (prefs *Preferences) Unsubscribe(ctx context.Context, token string) (*UnsubscribeClaims, error) {
+	claims, err := prefs.ParseUnsubscribeToken(token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = prefs.Set(ctx, claims.Subject, map[string]bool{claims.Category: false})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// Allowed returns whether an email should be sent. Emails to addresses
+// without an account, e.g. invites, are always sent.
+func (prefs *Preferences) Allowed(ctx context.Context, email *mailserver.MailItem) (bool, error) {
+	category := CategoryOf(email.EmailType)
+
+	if category == CategorySecurity {
+		return true, nil
+	}
+
+	authUser, err := userdbcache.FindUserByUsername(email.To)
+
+	if err != nil {
+		return true, nil
+	}
+
+	return prefs.Enabled(ctx, authUser.Id, category)
+}
+
+// AddUnsubscribeLinks adds links that turn off the category of an
+// email for its recipient to its payload. Security emails and emails
+// to addresses without an account are left as they are.
+func (prefs *Preferences) AddUnsubscribeLinks(email *mailserver.MailItem) error {
+	category := CategoryOf(email.EmailType)
+
+	if category == CategorySecurity {
+		return nil
+	}
+
+	authUser, err := userdbcache.FindUserByUsername(email.To)
+
+	if err != nil {
+		return nil
+	}
+
+	token, err := prefs.UnsubscribeToken(authUser.Id, category)
+
+	if err != nil {
+		return err
+	}
+
+	query := "?" + url.Values{"token": {token}}.Encode()
+
+	// where mail clients post to unsubscribe in one click (RFC 8058),
+	// none if the server url is not set
+	var oneClick string
+
+	if prefs.oneClickUrl != "" {
+		oneClick = prefs.oneClickUrl + query
+	}
+
+	return emails.SetUnsubscribeLinks(email, prefs.unsubscribeUrl+query, oneClick)
+}
@@ -0,0 +1,263 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// don't hammer a provider when tokens arrive with unknown kids
+const minRefreshInterval = time.Minute
+
+var (
+	ErrUnknownKid = errors.New("unknown key id")
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// keySet caches the public keys of a provider and refetches them when
+// a token is signed with a key we have not seen, i.e. after the
+// provider has rotated its keys
+type keySet struct {
+	fetchedAt time.Time
+	client    *http.Client
+	keys      map[string]any
+	// closed when a fetch in progress finishes
+	fetching chan struct{}
+	uri      string
+	mu       sync.Mutex
+}
+
+func newKeySet(client *http.Client, uri string) *keySet {
+	return &keySet{client: client, uri: uri, keys: make(map[string]any)}
+}
+
+func (ks *keySet) refresh(ctx context.Context) error {
+	keys, err := ks.fetch(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.keys = keys
+	ks.fetchedAt = time.Now()
+
+	return nil
+}
+
+// fetch downloads the keys, it must not be called with the lock held
+// so verifying tokens signed with known keys never waits on the network
+func (ks *keySet) fetch(ctx context.Context) (map[string]any, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.uri, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ks.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching jwks %s: %s", ks.uri, resp.Status)
+	}
+
+	var set jwkSet
+
+	err = json.NewDecoder(resp.Body).Decode(&set)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]any)
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+
+		// skip key types we do not understand rather than failing
+		if err != nil {
+			continue
+		}
+
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+// key returns the key with an id, refetching the keys if it is unknown.
+// Only one fetch runs at a time, others needing a key wait for it.
+func (ks *keySet) key(ctx context.Context, kid string) (any, error) {
+	ks.mu.Lock()
+
+	key, ok := ks.keys[kid]
+
+	if ok {
+		ks.mu.Unlock()
+		return key, nil
+	}
+
+	done := ks.fetching
+
+	if done == nil {
+		if time.Since(ks.fetchedAt) < minRefreshInterval {
+			ks.mu.Unlock()
+			return nil, ErrUnknownKid
+		}
+
+		done = make(chan struct{})
+		ks.fetching = done
+		ks.mu.Unlock()
+
+		keys, err := ks.fetch(ctx)
+
+		ks.mu.Lock()
+
+		if err == nil {
+			ks.keys = keys
+		}
+
+		// a provider that is down is not retried on every token either
+		ks.fetchedAt = time.Now()
+		ks.fetching = nil
+		close(done)
+
+		key, ok = ks.keys[kid]
+		ks.mu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ks.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		ks.mu.Lock()
+		key, ok = ks.keys[kid]
+		ks.mu.Unlock()
+	}
+
+	if !ok {
+		return nil, ErrUnknownKid
+	}
+
+	return key, nil
+}
+
+func (ks *keySet) keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return ks.key(ctx, kid)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(k.E)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+
+		if err != nil {
+			return nil, err
+		}
+
+		size := (curve.Params().BitSize + 7) / 8
+
+		if len(x) > size || len(y) > size {
+			return nil, fmt.Errorf("invalid ec key")
+		}
+
+		// uncompressed point is 0x04 || x || y with fixed width coordinates
+		point := make([]byte, 1+2*size)
+		point[0] = 4
+		copy(point[1+size-len(x):1+size], x)
+		copy(point[1+2*size-len(y):], y)
+
+		return ecdsa.ParseUncompressedPublicKey(curve, point)
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
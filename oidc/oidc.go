@@ -0,0 +1,398 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/jsonconfig"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A registry of the identity providers users can sign in with. Providers
+// are described in a json config file rather than code so that adding
+// one, or changing which claims hold the email address, does not need a
+// new build. Providers that cannot be discovered at startup are disabled
+// rather than stopping the server.
+
+const (
+	ProviderTypeOIDC = "oidc"
+	// shared secret signed tokens, e.g. Supabase
+	ProviderTypeHMAC = "hmac"
+
+	discoveryPath = "/.well-known/openid-configuration"
+)
+
+var (
+	ErrUnknownProvider  = errors.New("unknown or disabled provider")
+	ErrMissingEmail     = errors.New("token does not contain an email address")
+	ErrInvalidIssuer    = errors.New("invalid token issuer")
+	ErrIssuerNotSet     = errors.New("issuer is not set")
+	ErrInvalidAudience  = errors.New("invalid token audience")
+	ErrUnexpectedMethod = errors.New("unexpected signing method")
+)
+
+// ClaimMapping lists, for each user field, the claims to read in order
+// of preference. Nested claims use dots, e.g. user_metadata.full_name.
+type ClaimMapping struct {
+	Email   []string `json:"email"`
+	Name    []string `json:"name"`
+	Picture []string `json:"picture"`
+}
+
+// ProviderRule names the auth provider recorded for the user when a
+// claim contains a value, e.g. auth0 subjects starting google-oauth2|
+// are recorded as google
+type ProviderRule struct {
+	Claim    string `json:"claim"`
+	Contains string `json:"contains"`
+	Provider string `json:"provider"`
+}
+
+// Values can reference environment variables as ${NAME} so
+// secrets and per deployment domains stay out of the file
+type ProviderConfig struct {
+	Name      string         `json:"name"`
+	Type      string         `json:"type"`
+	Issuer    string         `json:"issuer"`
+	Audience  string         `json:"audience"`
+	SecretEnv string         `json:"secretEnv"`
+	Claims    ClaimMapping   `json:"claims"`
+	Rules     []ProviderRule `json:"rules"`
+	// auth provider recorded when no rule matches, defaults to name
+	DefaultProvider string `json:"defaultProvider"`
+	Disabled        bool   `json:"disabled"`
+}
+
+type Config struct {
+	Providers []ProviderConfig `json:"providers"`
+}
+
+// Identity is the user information extracted from a verified token
+type Identity struct {
+	Claims jwt.MapClaims
+	// name of the registry entry that verified the token
+	Provider string
+	// auth provider to record against the user, e.g. google
+	AuthProvider string
+	Subject      string
+	Email        string
+	Name         string
+	Picture      string
+}
+
+type Provider struct {
+	keys   *keySet
+	secret []byte
+	config ProviderConfig
+	issuer string
+}
+
+type Registry struct {
+	providers map[string]*Provider
+	// providers that could not be set up and why
+	Disabled map[string]error
+}
+
+func LoadConfig(file string) (*Config, error) {
+	var config Config
+
+	err := jsonconfig.Load(file, &config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// NewRegistry sets up each provider in the config. A provider that
+// fails, e.g. because discovery is unreachable or it is missing config,
+// is recorded in Disabled and the rest are still usable. Callers should
+// not start with a provider disabled by ErrIssuerNotSet.
+func NewRegistry(ctx context.Context, config *Config) *Registry {
+	registry := Registry{providers: make(map[string]*Provider),
+		Disabled: make(map[string]error)}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for _, pc := range config.Providers {
+		if pc.Disabled {
+			registry.Disabled[pc.Name] = fmt.Errorf("disabled in config")
+			continue
+		}
+
+		provider, err := newProvider(ctx, client, pc)
+
+		if err != nil {
+			registry.Disabled[pc.Name] = err
+			continue
+		}
+
+		registry.providers[pc.Name] = provider
+	}
+
+	return &registry
+}
+
+func (registry *Registry) Provider(name string) (*Provider, error) {
+	provider, ok := registry.providers[name]
+
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	return provider, nil
+}
+
+// Names of the providers that are enabled
+func (registry *Registry) Names() []string {
+	ret := make([]string, 0, len(registry.providers))
+
+	for name := range registry.providers {
+		ret = append(ret, name)
+	}
+
+	return ret
+}
+
+func normalizeIssuer(issuer string) string {
+	if issuer != "" && !strings.HasPrefix(issuer, "http://") && !strings.HasPrefix(issuer, "https://") {
+		issuer = "https://" + issuer
+	}
+
+	return issuer
+}
+
+func newProvider(ctx context.Context, client *http.Client, pc ProviderConfig) (*Provider, error) {
+	if pc.Name == "" {
+		return nil, fmt.Errorf("provider has no name")
+	}
+
+	if pc.DefaultProvider == "" {
+		pc.DefaultProvider = pc.Name
+	}
+
+	if len(pc.Claims.Email) == 0 {
+		pc.Claims.Email = []string{"email"}
+	}
+
+	if len(pc.Claims.Name) == 0 {
+		pc.Claims.Name = []string{"name"}
+	}
+
+	if len(pc.Claims.Picture) == 0 {
+		pc.Claims.Picture = []string{"picture"}
+	}
+
+	provider := Provider{config: pc, issuer: normalizeIssuer(pc.Issuer)}
+
+	// every token must say who issued it and who it is for, whatever
+	// signed it
+	if provider.issuer == "" {
+		// a provider set up apart from its issuer, e.g. when its issuer
+		// variable is new, is a mistake rather than one not in use
+		if pc.Audience != "" || (pc.SecretEnv != "" && os.Getenv(pc.SecretEnv) != "") {
+			return nil, ErrIssuerNotSet
+		}
+
+		return nil, fmt.Errorf("no issuer")
+	}
+
+	if pc.Audience == "" {
+		return nil, fmt.Errorf("no audience")
+	}
+
+	switch pc.Type {
+	case ProviderTypeHMAC:
+		secret := os.Getenv(pc.SecretEnv)
+
+		if secret == "" {
+			return nil, fmt.Errorf("secret %s is not set", pc.SecretEnv)
+		}
+
+		provider.secret = []byte(secret)
+	case ProviderTypeOIDC, "":
+		jwksUri, issuer, err := discover(ctx, client, provider.issuer)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// the discovery document is authoritative for the exact issuer
+		// string, e.g. with or without a trailing slash
+		provider.issuer = issuer
+		provider.keys = newKeySet(client, jwksUri)
+
+		err = provider.keys.refresh(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown provider type %s", pc.Type)
+	}
+
+	return &provider, nil
+}
+
+func discover(ctx context.Context, client *http.Client, issuer string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx,
+		http.MethodGet,
+		strings.TrimSuffix(issuer, "/")+discoveryPath,
+		nil)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("discovery for %s: %s", issuer, resp.Status)
+	}
+
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JwksUri string `json:"jwks_uri"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if doc.JwksUri == "" {
+		return "", "", fmt.Errorf("discovery for %s has no jwks_uri", issuer)
+	}
+
+	if doc.Issuer == "" {
+		doc.Issuer = issuer
+	}
+
+	return doc.JwksUri, doc.Issuer, nil
+}
+
+func (provider *Provider) Name() string {
+	return provider.config.Name
+}
+
+// Verify checks the signature, issuer, audience and expiry of a token
+// and maps its claims to an identity. If the token was signed by the
+// provider but is not acceptable, e.g. it has expired, the identity is
+// returned along with the error so the failure can be put down to the
+// account it was for.
+func (provider *Provider) Verify(ctx context.Context, tokenString string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+
+	var keyfunc jwt.Keyfunc
+	var methods []string
+
+	if provider.secret != nil {
+		secret := provider.secret
+		keyfunc = func(t *jwt.Token) (any, error) { return secret, nil }
+		methods = []string{"HS256", "HS384", "HS512"}
+	} else {
+		keyfunc = provider.keys.keyfunc(ctx)
+		methods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256"}
+	}
+
+	_, err := jwt.ParseWithClaims(tokenString,
+		claims,
+		keyfunc,
+		jwt.WithValidMethods(methods),
+		jwt.WithIssuer(provider.issuer),
+		jwt.WithAudience(provider.config.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second))
+
+	// claims are only checked once the signature has been, so
+	// if they are what failed we know who the token is for
+	if err != nil && !errors.Is(err, jwt.ErrTokenInvalidClaims) {
+		return nil, err
+	}
+
+	identity := Identity{Claims: claims,
+		Provider: provider.config.Name,
+		Email:    claimString(claims, provider.config.Claims.Email),
+		Name:     claimString(claims, provider.config.Claims.Name),
+		Picture:  claimString(claims, provider.config.Claims.Picture),
+	}
+
+	identity.Subject, _ = claims.GetSubject()
+
+	if err != nil {
+		return &identity, err
+	}
+
+	if identity.Email == "" {
+		return &identity, ErrMissingEmail
+	}
+
+	identity.AuthProvider = provider.authProvider(claims)
+
+	return &identity, nil
+}
+
+func (provider *Provider) authProvider(claims jwt.MapClaims) string {
+	for _, rule := range provider.config.Rules {
+		claim := rule.Claim
+
+		if claim == "" {
+			claim = "sub"
+		}
+
+		if strings.Contains(claimString(claims, []string{claim}), rule.Contains) {
+			return rule.Provider
+		}
+	}
+
+	return provider.config.DefaultProvider
+}
+
+// claimString returns the first non empty string claim from a
+// list of possibly nested claim names
+func claimString(claims jwt.MapClaims, names []string) string {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+
+		// namespaced claims such as https://example.org/email contain dots
+		// so try the full name before treating it as a path
+		if s, ok := claims[name].(string); ok && s != "" {
+			return s
+		}
+
+		var v any = map[string]any(claims)
+
+		for part := range strings.SplitSeq(name, ".") {
+			m, ok := v.(map[string]any)
+
+			if !ok {
+				v = nil
+				break
+			}
+
+			v = m[part]
+		}
+
+		if s, ok := v.(string); ok && s != "" {
+			return s
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,306 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeIssuer is a local OIDC provider serving discovery and its keys
+type fakeIssuer struct {
+	server *httptest.Server
+	keys   map[string]*rsa.PrivateKey
+	// number of times the keys were fetched
+	fetches atomic.Int32
+	mu      sync.Mutex
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	issuer := &fakeIssuer{keys: make(map[string]*rsa.PrivateKey)}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(discoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.server.URL,
+			"jwks_uri": issuer.server.URL + "/jwks"})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		issuer.fetches.Add(1)
+
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+
+		var set jwkSet
+
+		for kid, key := range issuer.keys {
+			set.Keys = append(set.Keys, jwk{Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())})
+		}
+
+		json.NewEncoder(w).Encode(set)
+	})
+
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	issuer.addKey(t, "key1")
+
+	return issuer
+}
+
+func (issuer *fakeIssuer) addKey(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+
+	issuer.keys[kid] = key
+}
+
+func (issuer *fakeIssuer) sign(t *testing.T, kid string, claims jwt.MapClaims) string {
+	issuer.mu.Lock()
+	key := issuer.keys[kid]
+	issuer.mu.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+
+	s, err := token.SignedString(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func claims(issuer string, audience string) jwt.MapClaims {
+	return jwt.MapClaims{"iss": issuer,
+		"aud":   audience,
+		"sub":   "google-oauth2|123",
+		"email": "user@example.org",
+		"user_metadata": map[string]any{
+			"full_name": "Test User",
+		},
+		"exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func newTestProvider(t *testing.T, pc ProviderConfig) *Provider {
+	registry := NewRegistry(context.Background(), &Config{Providers: []ProviderConfig{pc}})
+
+	provider, err := registry.Provider(pc.Name)
+
+	if err != nil {
+		t.Fatalf("provider disabled: %v", registry.Disabled[pc.Name])
+	}
+
+	return provider
+}
+
+func TestVerifyOIDC(t *testing.T) {
+	issuer := newFakeIssuer(t)
+
+	provider := newTestProvider(t, ProviderConfig{Name: "test",
+		Issuer:   issuer.server.URL,
+		Audience: "edb",
+		Claims:   ClaimMapping{Name: []string{"user_metadata.full_name"}},
+		Rules:    []ProviderRule{{Claim: "sub", Contains: "google", Provider: "google"}}})
+
+	identity, err := provider.Verify(context.Background(), issuer.sign(t, "key1", claims(issuer.server.URL, "edb")))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.Email != "user@example.org" || identity.Name != "Test User" || identity.AuthProvider != "google" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+
+	expired := claims(issuer.server.URL, "edb")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+
+	noEmail := claims(issuer.server.URL, "edb")
+	delete(noEmail, "email")
+
+	tests := map[string]struct {
+		claims jwt.MapClaims
+		err    error
+	}{
+		"wrong issuer":   {claims("https://evil.example.org", "edb"), jwt.ErrTokenInvalidIssuer},
+		"wrong audience": {claims(issuer.server.URL, "other"), jwt.ErrTokenInvalidAudience},
+		"expired":        {expired, jwt.ErrTokenExpired},
+		"no email":       {noEmail, ErrMissingEmail},
+	}
+
+	for name, test := range tests {
+		_, err := provider.Verify(context.Background(), issuer.sign(t, "key1", test.claims))
+
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", name, err, test.err)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	issuer := newFakeIssuer(t)
+
+	provider := newTestProvider(t, ProviderConfig{Name: "test", Issuer: issuer.server.URL, Audience: "edb"})
+
+	// a recent fetch is not repeated for an unknown kid
+	issuer.addKey(t, "key2")
+
+	_, err := provider.Verify(context.Background(), issuer.sign(t, "key2", claims(issuer.server.URL, "edb")))
+
+	if !errors.Is(err, ErrUnknownKid) {
+		t.Fatalf("got %v, want %v", err, ErrUnknownKid)
+	}
+
+	// once the keys are old enough, concurrent tokens signed with the
+	// new key share one fetch
+	provider.keys.mu.Lock()
+	provider.keys.fetchedAt = time.Now().Add(-2 * minRefreshInterval)
+	provider.keys.mu.Unlock()
+
+	fetches := issuer.fetches.Load()
+
+	var wg sync.WaitGroup
+
+	for range 10 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := provider.Verify(context.Background(), issuer.sign(t, "key2", claims(issuer.server.URL, "edb")))
+
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := issuer.fetches.Load() - fetches; n != 1 {
+		t.Fatalf("keys fetched %d times", n)
+	}
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	t.Setenv("TEST_HMAC_SECRET", "secret")
+
+	pc := ProviderConfig{Name: "supabase",
+		Type:      ProviderTypeHMAC,
+		SecretEnv: "TEST_HMAC_SECRET",
+		Issuer:    "https://project.supabase.co/auth/v1",
+		Audience:  "authenticated"}
+
+	provider := newTestProvider(t, pc)
+
+	sign := func(claims jwt.MapClaims) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	_, err := provider.Verify(context.Background(), sign(claims(pc.Issuer, pc.Audience)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = provider.Verify(context.Background(), sign(claims("https://other.supabase.co/auth/v1", pc.Audience)))
+
+	if !errors.Is(err, jwt.ErrTokenInvalidIssuer) {
+		t.Fatalf("got %v, want %v", err, jwt.ErrTokenInvalidIssuer)
+	}
+
+	_, err = provider.Verify(context.Background(), sign(claims(pc.Issuer, "anon")))
+
+	if !errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		t.Fatalf("got %v, want %v", err, jwt.ErrTokenInvalidAudience)
+	}
+
+	// without both the provider is disabled rather than accepting
+	// any token signed with the secret
+	for _, pc := range []ProviderConfig{{Name: "a", Type: ProviderTypeHMAC, SecretEnv: "TEST_HMAC_SECRET", Audience: "authenticated"},
+		{Name: "b", Type: ProviderTypeHMAC, SecretEnv: "TEST_HMAC_SECRET", Issuer: pc.Issuer}} {
+		registry := NewRegistry(context.Background(), &Config{Providers: []ProviderConfig{pc}})
+
+		if registry.Disabled[pc.Name] == nil {
+			t.Errorf("%s should be disabled", pc.Name)
+		}
+	}
+
+	// one missing only its issuer is reported so the server does not
+	// start, one not set up at all is just disabled
+	registry := NewRegistry(context.Background(), &Config{Providers: []ProviderConfig{{Name: "a", Type: ProviderTypeHMAC, SecretEnv: "TEST_HMAC_SECRET", Audience: "authenticated"},
+		{Name: "b", Type: ProviderTypeHMAC, SecretEnv: "TEST_UNSET_SECRET"}}})
+
+	if !errors.Is(registry.Disabled["a"], ErrIssuerNotSet) {
+		t.Errorf("got %v, want %v", registry.Disabled["a"], ErrIssuerNotSet)
+	}
+
+	if registry.Disabled["b"] == nil || errors.Is(registry.Disabled["b"], ErrIssuerNotSet) {
+		t.Errorf("b should be disabled without stopping the server, got %v", registry.Disabled["b"])
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	// a value that would break the json if it was expanded in the text
+	t.Setenv("TEST_AUDIENCE", `edb", "disabled": true, "x": "$HOME`)
+	t.Setenv("TEST_DOMAIN", "example.org")
+
+	file := filepath.Join(t.TempDir(), "providers.json")
+
+	err := os.WriteFile(file, []byte(`{"providers": [{"name": "test",
+		"issuer": "${TEST_DOMAIN}",
+		"audience": "${TEST_AUDIENCE}",
+		"claims": {"email": ["${TEST_DOMAIN}/email", "email"]}}]}`), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc := config.Providers[0]
+
+	if pc.Audience != os.Getenv("TEST_AUDIENCE") || pc.Disabled {
+		t.Fatalf("audience was not taken as it is: %+v", pc)
+	}
+
+	if pc.Issuer != "example.org" || pc.Claims.Email[0] != "example.org/email" {
+		t.Fatalf("values were not expanded: %+v", pc)
+	}
+}
@@ -0,0 +1,134 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/redis/go-redis/v9"
+)
+
+// The dispatcher sends the emails in the outbox whose time has come.
+// Every server runs one. A lock in redis means only one at a time
+// polls, and messages are leased as they are picked up so that even
+// if the lock runs out two servers never send the same email.
+
+const (
+	dispatchLockKey = "outbox:dispatch"
+
+	DefaultDispatchInterval = 10 * time.Second
+
+	// emails tried each time the dispatcher runs
+	dispatchBatchSize = 100
+)
+
+// deletes the lock only if it is still ours, it may have expired
+// and been taken by another server while we were sending
+var unlockScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+type Dispatcher struct {
+	store *OutboxStore
+	rdb   *redis.Client
+}
+
+func NewDispatcher(store *OutboxStore, rdb *redis.Client) *Dispatcher {
+	return &Dispatcher{store: store, rdb: rdb}
+}
+
+// Start runs the dispatcher at every interval, or sooner when an email
+// is added, until the context is done
+func (dispatcher *Dispatcher) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-dispatcher.store.wake:
+			}
+
+			dispatcher.runOnce(ctx)
+		}
+	}()
+}
+
+func (dispatcher *Dispatcher) runOnce(ctx context.Context) {
+	token, err := newId()
+
+	if err != nil {
+		log.Error().Msgf("outbox dispatcher could not make lock token: %v", err)
+		return
+	}
+
+	ok, err := dispatcher.rdb.SetNX(ctx, dispatchLockKey, token, dispatcher.store.config.Lease).Result()
+
+	if err != nil {
+		log.Error().Msgf("outbox dispatcher could not take lock: %v", err)
+		return
+	}
+
+	if !ok {
+		return
+	}
+
+	defer func() {
+		err := unlockScript.Run(context.WithoutCancel(ctx), dispatcher.rdb, []string{dispatchLockKey}, token).Err()
+
+		if err != nil {
+			log.Warn().Msgf("outbox dispatcher could not release lock: %v", err)
+		}
+	}()
+
+	sent, failed, err := dispatcher.Run(ctx)
+
+	if err != nil {
+		log.Error().Msgf("outbox dispatcher failed: %v", err)
+		return
+	}
+
+	if sent > 0 || failed > 0 {
+		log.Info().Msgf("outbox dispatcher sent %d emails, %d failed", sent, failed)
+	}
+}
+
+// Run tries the emails that are due and returns how many were sent
+// and how many could not be
+func (dispatcher *Dispatcher) Run(ctx context.Context) (int, int, error) {
+	messages, err := dispatcher.store.Due(ctx, dispatchBatchSize)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sent := 0
+	failed := 0
+
+	for _, message := range messages {
+		err = dispatcher.store.Attempt(ctx, message)
+
+		if err != nil {
+			failed++
+
+			if message.Status == StatusFailed {
+				log.Error().Msgf("gave up sending %s email %s after %d attempts: %v",
+					message.Email.EmailType,
+					message.Id,
+					message.Attempts,
+					err)
+			}
+
+			continue
+		}
+
+		sent++
+	}
+
+	return sent, failed, nil
+}
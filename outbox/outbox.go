@@ -0,0 +1,438 @@
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/notifications"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/antonybholmes/go-mailserver/mailqueue"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Emails are written to the outbox table before the user is told to
+// check their inbox. The dispatcher hands them to the mail queue and
+// retries with backoff if it is down. Emails that keep failing are kept
+// as failed so an admin can see and resend them.
+//
+// Only changes this server makes in its own transactions, such as the
+// membership job, write their emails in the same transaction with
+// SendMailTx. Users are changed through the user database of go-web,
+// which commits on its own, so the handlers write the email just after
+// the change. If the server stops between the two, or the email cannot
+// be written, the change stands without its email.
+
+const (
+	StatusPending = "pending"
+	StatusFailed  = "failed"
+	// sent messages are removed, this is only reported
+	StatusSent = "sent"
+)
+
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrInvalidStatus   = errors.New("status must be pending or failed")
+)
+
+type RetryConfig struct {
+	// tries before an email is marked as failed
+	MaxAttempts int
+	// wait after the first failure, doubling after each one
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// how long a send may take before someone else tries it
+	Lease time.Duration
+}
+
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts: 8,
+	BaseDelay:   30 * time.Second,
+	MaxDelay:    time.Hour,
+	Lease:       time.Minute,
+}
+
+type Message struct {
+	Email         *mailserver.MailItem `json:"email"`
+	CreatedAt     time.Time            `json:"createdAt"`
+	NextAttemptAt time.Time            `json:"nextAttemptAt"`
+	FailedAt      *time.Time           `json:"failedAt,omitempty"`
+	Id            string               `json:"id"`
+	Status        string               `json:"status"`
+	LastError     string               `json:"lastError,omitempty"`
+	Attempts      int                  `json:"attempts"`
+}
+
+// Querier runs a statement, either on the pool or in a transaction
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+type OutboxStore struct {
+	db     *pgxpool.Pool
+	config RetryConfig
+	// tells the dispatcher there is something to send
+	wake chan struct{}
+}
+
+func NewOutboxStore(db *pgxpool.Pool, config RetryConfig) *OutboxStore {
+	return &OutboxStore{db: db, config: config, wake: make(chan struct{}, 1)}
+}
+
+var defaultStore *OutboxStore
+
+func Init(store *OutboxStore) {
+	defaultStore = store
+}
+
+const messageColumns = `id, email, status, attempts, last_error, next_attempt_at, failed_at, created_at`
+
+const insertSql = `INSERT INTO outbox
+	(id, email, status, attempts, next_attempt_at, created_at)
+	VALUES ($1, $2, $3, 0, $4, $5)`
+
+// messages are leased by moving their next attempt past the time it
+// should take to send them. Rows another server is leasing are skipped.
+const dueSql = `UPDATE outbox SET next_attempt_at = $3
+	WHERE id IN (
+		SELECT id FROM outbox
+		WHERE status = 'pending' AND next_attempt_at <= $1
+		ORDER BY next_attempt_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED)
+	RETURNING ` + messageColumns
+
+// only a message that nobody has changed since it was tried is updated,
+// so a deleted or resent message is not overwritten
+const failedAttemptSql = `UPDATE outbox SET
+		status = $3, attempts = $4, last_error = $5, next_attempt_at = $6, failed_at = $7
+	WHERE id = $1 AND attempts = $2`
+
+const deleteSql = `DELETE FROM outbox WHERE id = $1`
+
+const listSql = `SELECT ` + messageColumns + ` FROM outbox
+	WHERE status = $1
+	ORDER BY COALESCE(failed_at, next_attempt_at), id
+	OFFSET $2 LIMIT $3`
+
+const countsSql = `SELECT status, COUNT(*) FROM outbox GROUP BY status`
+
+const getSql = `SELECT ` + messageColumns + ` FROM outbox WHERE id = $1`
+
+const resendSql = `UPDATE outbox SET
+		status = 'pending', attempts = 0, last_error = '', failed_at = NULL, next_attempt_at = $2
+	WHERE id = $1
+	RETURNING ` + messageColumns
+
+// SendMail queues an email in the outbox. An error means the email was
+// not saved, so the caller should not say it is on its way. Emails the
+// recipient has opted out of are dropped, the others get the links to
+// opt out here, before they reach any mail backend. Without an outbox
+// emails go straight to the mail queue.
+func SendMail(ctx context.Context, email *mailserver.MailItem) error {
+	if defaultStore == nil {
+		return send(ctx, email)
+	}
+
+	return SendMailTx(ctx, defaultStore.db, email)
+}
+
+// SendMailTx queues an email as part of a transaction, so it is only
+// sent if the change it tells the user about is committed
+func SendMailTx(ctx context.Context, q Querier, email *mailserver.MailItem) error {
+	if defaultStore == nil {
+		return send(ctx, email)
+	}
+
+	allowed, err := notifications.Allowed(ctx, email)
+
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		log.Debug().Msgf("%s email not sent, the recipient has opted out", email.EmailType)
+		return nil
+	}
+
+	err = notifications.AddUnsubscribeLinks(email)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = defaultStore.Add(ctx, q, email)
+
+	return err
+}
+
+// send hands an email to the mail queue when there is no outbox
+func send(ctx context.Context, email *mailserver.MailItem) error {
+	allowed, err := notifications.Allowed(ctx, email)
+
+	if err != nil || !allowed {
+		return err
+	}
+
+	err = notifications.AddUnsubscribeLinks(email)
+
+	if err != nil {
+		return err
+	}
+
+	return mailqueue.SendMail(email)
+}
+
+// Add saves an email as pending, ready for the dispatcher
+func (store *OutboxStore) Add(ctx context.Context, q Querier, email *mailserver.MailItem) (*Message, error) {
+	id, err := newId()
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	message := Message{Id: id,
+		Email:         email,
+		Status:        StatusPending,
+		CreatedAt:     now,
+		NextAttemptAt: now}
+
+	_, err = q.Exec(ctx, insertSql, message.Id, b, message.Status, message.NextAttemptAt, message.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// if this is in a transaction that has not committed yet, the
+	// dispatcher will find the message on a later run
+	store.Notify()
+
+	return &message, nil
+}
+
+// Notify wakes the dispatcher of this server
+func (store *OutboxStore) Notify() {
+	select {
+	case store.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Attempt sends a message and records the outcome. Sent messages are
+// removed, others are retried later or marked as failed.
+func (store *OutboxStore) Attempt(ctx context.Context, message *Message) error {
+	err := mailqueue.SendMail(message.Email)
+
+	if err == nil {
+		message.Status = StatusSent
+
+		_, err = store.db.Exec(ctx, deleteSql, message.Id)
+
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	attempts := message.Attempts
+
+	message.Attempts++
+	message.LastError = err.Error()
+
+	if message.Attempts >= store.config.MaxAttempts {
+		message.Status = StatusFailed
+		message.FailedAt = &now
+	} else {
+		message.Status = StatusPending
+		message.NextAttemptAt = now.Add(store.backoff(message.Attempts))
+	}
+
+	_, saveErr := store.db.Exec(ctx, failedAttemptSql,
+		message.Id,
+		attempts,
+		message.Status,
+		message.Attempts,
+		message.LastError,
+		message.NextAttemptAt,
+		message.FailedAt)
+
+	if saveErr != nil {
+		return saveErr
+	}
+
+	return err
+}
+
+// Due returns the pending messages whose time to try has come and
+// leases them so they are not picked up again while being sent
+func (store *OutboxStore) Due(ctx context.Context, limit int) ([]*Message, error) {
+	now := time.Now().UTC()
+
+	rows, err := store.db.Query(ctx, dueSql, now, limit, now.Add(store.config.Lease))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanMessages(rows)
+}
+
+// List returns messages with a status, oldest first
+func (store *OutboxStore) List(ctx context.Context, status string, offset int, limit int) ([]*Message, error) {
+	if status != StatusPending && status != StatusFailed {
+		return nil, ErrInvalidStatus
+	}
+
+	rows, err := store.db.Query(ctx, listSql, status, offset, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanMessages(rows)
+}
+
+// Counts returns how many messages have each status
+func (store *OutboxStore) Counts(ctx context.Context) (map[string]int64, error) {
+	rows, err := store.db.Query(ctx, countsSql)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := map[string]int64{StatusPending: 0, StatusFailed: 0}
+
+	for rows.Next() {
+		var status string
+		var n int64
+
+		err = rows.Scan(&status, &n)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret[status] = n
+	}
+
+	return ret, rows.Err()
+}
+
+func (store *OutboxStore) Get(ctx context.Context, id string) (*Message, error) {
+	return scanMessage(store.db.QueryRow(ctx, getSql, id))
+}
+
+// Resend gives a message a fresh set of attempts and has the
+// dispatcher try it now
+func (store *OutboxStore) Resend(ctx context.Context, id string) (*Message, error) {
+	message, err := scanMessage(store.db.QueryRow(ctx, resendSql, id, time.Now().UTC()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	store.Notify()
+
+	return message, nil
+}
+
+// Delete drops a message without sending it
+func (store *OutboxStore) Delete(ctx context.Context, id string) error {
+	tag, err := store.db.Exec(ctx, deleteSql, id)
+
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+func scanMessage(row pgx.Row) (*Message, error) {
+	var message Message
+	var email []byte
+
+	err := row.Scan(&message.Id,
+		&email,
+		&message.Status,
+		&message.Attempts,
+		&message.LastError,
+		&message.NextAttemptAt,
+		&message.FailedAt,
+		&message.CreatedAt)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrMessageNotFound
+		}
+
+		return nil, err
+	}
+
+	err = json.Unmarshal(email, &message.Email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+func scanMessages(rows pgx.Rows) ([]*Message, error) {
+	defer rows.Close()
+
+	messages := make([]*Message, 0, 10)
+
+	for rows.Next() {
+		message, err := scanMessage(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+func (store *OutboxStore) backoff(attempts int) time.Duration {
+	delay := float64(store.config.BaseDelay) * math.Pow(2, float64(attempts-1))
+
+	if delay > float64(store.config.MaxDelay) {
+		return store.config.MaxDelay
+	}
+
+	return time.Duration(delay)
+}
+
+func newId() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
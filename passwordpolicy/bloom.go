@@ -0,0 +1,140 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"os"
+	"strings"
+)
+
+// A bloom filter of the sha1 hashes of breached passwords. It keeps even
+// very large lists, such as the Have I Been Pwned corpus, small enough
+// to hold in memory at the cost of rare false positives, which only mean
+// a user has to pick a different password.
+
+// probability of rejecting a password that was never breached
+const falsePositiveRate = 0.001
+
+type Bloom struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+func NewBloom(n int) *Bloom {
+	n = max(n, 1)
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+
+	return &Bloom{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// the sha1 is already uniform so we derive the k indexes from two
+// halves of it rather than hashing again
+func (bloom *Bloom) indexes(sum []byte, f func(i uint64) bool) bool {
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16])
+
+	for i := range bloom.k {
+		if !f((h1 + i*h2) % bloom.m) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (bloom *Bloom) AddHash(sum []byte) {
+	bloom.indexes(sum, func(i uint64) bool {
+		bloom.bits[i/64] |= 1 << (i % 64)
+		return true
+	})
+}
+
+func (bloom *Bloom) ContainsHash(sum []byte) bool {
+	return bloom.indexes(sum, func(i uint64) bool {
+		return bloom.bits[i/64]&(1<<(i%64)) != 0
+	})
+}
+
+func (bloom *Bloom) ContainsPassword(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	return bloom.ContainsHash(sum[:])
+}
+
+// parseLine accepts either a plain password or a hex sha1 hash,
+// optionally followed by a breach count as in the pwned passwords
+// downloads, e.g. 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493
+func parseLine(line string) ([]byte, bool) {
+	line = strings.TrimRight(line, "\r")
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, false
+	}
+
+	hash, _, _ := strings.Cut(line, ":")
+
+	if len(hash) == 2*sha1.Size {
+		sum, err := hex.DecodeString(hash)
+
+		if err == nil {
+			return sum, true
+		}
+	}
+
+	sum := sha1.Sum([]byte(line))
+
+	return sum[:], true
+}
+
+// LoadBloom builds a filter from a file with one password or sha1 hash
+// per line. The file is read twice, first to size the filter.
+func LoadBloom(file string) (*Bloom, error) {
+	n := 0
+
+	err := scanLines(file, func(line string) {
+		if _, ok := parseLine(line); ok {
+			n++
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	bloom := NewBloom(n)
+
+	err = scanLines(file, func(line string) {
+		if sum, ok := parseLine(line); ok {
+			bloom.AddHash(sum)
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bloom, nil
+}
+
+func scanLines(file string, f func(line string)) error {
+	fh, err := os.Open(file)
+
+	if err != nil {
+		return err
+	}
+
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+
+	for scanner.Scan() {
+		f(scanner.Text())
+	}
+
+	return scanner.Err()
+}
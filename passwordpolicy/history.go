@@ -0,0 +1,70 @@
+package passwordpolicy
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Salted hashes of each user's recent passwords, newest first, so they
+// cannot simply switch back to an old one.
+
+const historyKeyPrefix = "password:history:"
+
+type HistoryStore struct {
+	rdb *redis.Client
+}
+
+func NewHistoryStore(rdb *redis.Client) *HistoryStore {
+	return &HistoryStore{rdb: rdb}
+}
+
+func historyKey(userId string) string {
+	return historyKeyPrefix + userId
+}
+
+// Contains reports whether the password matches one of the
+// user's last n passwords
+func (store *HistoryStore) Contains(ctx context.Context, userId string, password string, n int) (bool, error) {
+	hashes, err := store.rdb.LRange(ctx, historyKey(userId), 0, int64(n-1)).Result()
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Add records a new password and forgets any beyond the last n
+func (store *HistoryStore) Add(ctx context.Context, userId string, password string, n int) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+
+	if err != nil {
+		return err
+	}
+
+	return store.AddHash(ctx, userId, string(hash), n)
+}
+
+// AddHash records a password that is already hashed
+func (store *HistoryStore) AddHash(ctx context.Context, userId string, hash string, n int) error {
+	_, err := store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, historyKey(userId), hash)
+		pipe.LTrim(ctx, historyKey(userId), 0, int64(n-1))
+		return nil
+	})
+
+	return err
+}
+
+// Clear removes a user's history, e.g. when the account is deleted
+func (store *HistoryStore) Clear(ctx context.Context, userId string) error {
+	return store.rdb.Del(ctx, historyKey(userId)).Err()
+}
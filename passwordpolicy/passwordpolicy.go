@@ -0,0 +1,301 @@
+package passwordpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/antonybholmes/go-edbserver-gin/jsonconfig"
+)
+
+// Rules a new password must follow. The policy is read from a json file
+// so each deployment can tighten it without a new build. Passwords are
+// also checked against a bundled list of the most common breached
+// passwords, held locally so no part of a password ever leaves the
+// server, and against the user's recent passwords. If a range api is
+// configured they are then checked against the full pwned passwords
+// corpus without revealing them.
+
+var (
+	ErrBreachedPassword = errors.New("password has appeared in a data breach, please choose another")
+	ErrPasswordReused   = errors.New("password has been used recently, please choose another")
+)
+
+type Config struct {
+	MinLength int `json:"minLength"`
+	MaxLength int `json:"maxLength"`
+	// number of character classes (lower, upper, digit, symbol) needed
+	MinClasses    int  `json:"minClasses"`
+	RequireLower  bool `json:"requireLower"`
+	RequireUpper  bool `json:"requireUpper"`
+	RequireDigit  bool `json:"requireDigit"`
+	RequireSymbol bool `json:"requireSymbol"`
+	// reject passwords containing the username or email
+	BlockUserInfo bool `json:"blockUserInfo"`
+	// how many previous passwords cannot be reused, 0 to disable
+	History int `json:"history"`
+	// file of breached passwords or their sha1 hashes, one per line
+	BreachedFile string `json:"breachedFile"`
+	// pwned passwords range api, empty to only check the file
+	BreachedRangeUrl string `json:"breachedRangeUrl"`
+}
+
+var DefaultConfig = Config{
+	MinLength:     8,
+	MaxLength:     128,
+	BlockUserInfo: true,
+	History:       5,
+}
+
+// PolicyError lists every rule a password broke so the user
+// can fix them all at once
+type PolicyError struct {
+	Reasons []string
+}
+
+func (e *PolicyError) Error() string {
+	return "password does not meet criteria: " + strings.Join(e.Reasons, ", ")
+}
+
+type Policy struct {
+	breached *Bloom
+	pwned    *RangeChecker
+	history  *HistoryStore
+	config   Config
+}
+
+func LoadConfig(file string) (*Config, error) {
+	config := DefaultConfig
+
+	err := jsonconfig.Load(file, &config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// NewPolicy loads the breached password list named in the config. The
+// history store may be nil, in which case reuse is not checked.
+func NewPolicy(config Config, history *HistoryStore) (*Policy, error) {
+	policy := Policy{config: config, history: history}
+
+	if config.BreachedFile != "" {
+		breached, err := LoadBloom(config.BreachedFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		policy.breached = breached
+	}
+
+	if config.BreachedRangeUrl != "" {
+		policy.pwned = NewRangeChecker(config.BreachedRangeUrl)
+	}
+
+	return &policy, nil
+}
+
+func (policy *Policy) Config() Config {
+	return policy.config
+}
+
+func classes(password string) (lower bool, upper bool, digit bool, symbol bool) {
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	return
+}
+
+// CheckRules applies the length, character class and user info rules.
+// User info is anything identifying the user such as their username,
+// name or email address.
+func (policy *Policy) CheckRules(password string, userInfo ...string) error {
+	config := policy.config
+
+	var reasons []string
+
+	n := utf8.RuneCountInString(password)
+
+	if n < config.MinLength {
+		reasons = append(reasons, fmt.Sprintf("must be at least %d characters", config.MinLength))
+	}
+
+	if config.MaxLength > 0 && n > config.MaxLength {
+		reasons = append(reasons, fmt.Sprintf("must be at most %d characters", config.MaxLength))
+	}
+
+	lower, upper, digit, symbol := classes(password)
+
+	if config.RequireLower && !lower {
+		reasons = append(reasons, "must contain a lowercase letter")
+	}
+
+	if config.RequireUpper && !upper {
+		reasons = append(reasons, "must contain an uppercase letter")
+	}
+
+	if config.RequireDigit && !digit {
+		reasons = append(reasons, "must contain a digit")
+	}
+
+	if config.RequireSymbol && !symbol {
+		reasons = append(reasons, "must contain a symbol")
+	}
+
+	count := 0
+
+	for _, ok := range []bool{lower, upper, digit, symbol} {
+		if ok {
+			count++
+		}
+	}
+
+	if count < config.MinClasses {
+		reasons = append(reasons, fmt.Sprintf("must contain at least %d of lowercase, uppercase, digits and symbols", config.MinClasses))
+	}
+
+	if config.BlockUserInfo && containsUserInfo(password, userInfo) {
+		reasons = append(reasons, "must not contain your username or email address")
+	}
+
+	if len(reasons) > 0 {
+		return &PolicyError{Reasons: reasons}
+	}
+
+	return nil
+}
+
+func containsUserInfo(password string, userInfo []string) bool {
+	p := strings.ToLower(password)
+
+	for _, info := range userInfo {
+		// only the local part of an email is worth checking
+		info, _, _ = strings.Cut(info, "@")
+
+		for part := range strings.FieldsFuncSeq(strings.ToLower(info), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			// very short names would block too many passwords
+			if len(part) >= 3 && strings.Contains(p, part) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// IsBreached reports whether the password is in the breached list
+func (policy *Policy) IsBreached(password string) bool {
+	return policy.breached != nil && policy.breached.ContainsPassword(password)
+}
+
+// Check applies every rule to a new password. The user id may be empty,
+// e.g. on signup, in which case the history is skipped. The range api is
+// checked last, so if it returns ErrRangeUnavailable the password has
+// passed every other rule.
+func (policy *Policy) Check(ctx context.Context, userId string, password string, userInfo ...string) error {
+	err := policy.CheckRules(password, userInfo...)
+
+	if err != nil {
+		return err
+	}
+
+	if policy.IsBreached(password) {
+		return ErrBreachedPassword
+	}
+
+	if userId != "" && policy.history != nil && policy.config.History > 0 {
+		used, err := policy.history.Contains(ctx, userId, password, policy.config.History)
+
+		if err != nil {
+			return err
+		}
+
+		if used {
+			return ErrPasswordReused
+		}
+	}
+
+	if policy.pwned != nil {
+		breached, err := policy.pwned.IsBreached(ctx, password)
+
+		if err != nil {
+			return err
+		}
+
+		if breached {
+			return ErrBreachedPassword
+		}
+	}
+
+	return nil
+}
+
+// Remember adds a password to the user's history once it has been set
+func (policy *Policy) Remember(ctx context.Context, userId string, password string) error {
+	if policy.history == nil || policy.config.History < 1 || password == "" {
+		return nil
+	}
+
+	return policy.history.Add(ctx, userId, password, policy.config.History)
+}
+
+// RememberHash adds a password that was kept hashed,
+// e.g. from a signup, to the user's history
+func (policy *Policy) RememberHash(ctx context.Context, userId string, hash string) error {
+	if policy.history == nil || policy.config.History < 1 || hash == "" {
+		return nil
+	}
+
+	return policy.history.AddHash(ctx, userId, hash, policy.config.History)
+}
+
+// Forget removes the user's password history
+func (policy *Policy) Forget(ctx context.Context, userId string) error {
+	if policy.history == nil {
+		return nil
+	}
+
+	return policy.history.Clear(ctx, userId)
+}
+
+// the policy used by the route handlers, in the same way as
+// the mail queue, so that every handler applies the same rules
+var defaultPolicy = &Policy{config: DefaultConfig}
+
+func Init(policy *Policy) {
+	defaultPolicy = policy
+}
+
+func Check(ctx context.Context, userId string, password string, userInfo ...string) error {
+	return defaultPolicy.Check(ctx, userId, password, userInfo...)
+}
+
+func Remember(ctx context.Context, userId string, password string) error {
+	return defaultPolicy.Remember(ctx, userId, password)
+}
+
+func RememberHash(ctx context.Context, userId string, hash string) error {
+	return defaultPolicy.RememberHash(ctx, userId, hash)
+}
+
+func Forget(ctx context.Context, userId string) error {
+	return defaultPolicy.Forget(ctx, userId)
+}
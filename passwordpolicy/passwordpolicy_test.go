@@ -0,0 +1,105 @@
+package passwordpolicy
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBundledList(t *testing.T) {
+	bloom, err := LoadBloom("../config/breached-passwords.txt")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, password := range []string{"password", "123456", "dragon", "trustno1"} {
+		if !bloom.ContainsPassword(password) {
+			t.Errorf("%s should be breached", password)
+		}
+	}
+
+	// comments are not passwords
+	if bloom.ContainsPassword("# The most common passwords from public breaches, most common first.") {
+		t.Error("comment was added to the list")
+	}
+}
+
+// a range api that knows one password and pads with a decoy
+func rangeServer(t *testing.T, password string) *httptest.Server {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := strings.TrimPrefix(r.URL.Path, "/range/")
+
+		if len(prefix) != rangePrefixLen {
+			t.Errorf("sent %s, want only a %d character prefix", prefix, rangePrefixLen)
+		}
+
+		if prefix == hash[:rangePrefixLen] {
+			fmt.Fprintf(w, "%s:12\r\n", hash[rangePrefixLen:])
+		}
+
+		fmt.Fprintf(w, "%s:0\r\n", strings.Repeat("0", 35))
+	}))
+}
+
+func TestRangeChecker(t *testing.T) {
+	server := rangeServer(t, "correct horse battery staple")
+	defer server.Close()
+
+	checker := NewRangeChecker(server.URL + "/range")
+
+	breached, err := checker.IsBreached(context.Background(), "correct horse battery staple")
+
+	if err != nil || !breached {
+		t.Fatalf("got %v %v, want breached", breached, err)
+	}
+
+	breached, err = checker.IsBreached(context.Background(), "not in any breach at all")
+
+	if err != nil || breached {
+		t.Fatalf("got %v %v, want not breached", breached, err)
+	}
+}
+
+func TestRangeUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	policy, err := NewPolicy(Config{MinLength: 1, BreachedRangeUrl: server.URL + "/range/"}, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = policy.Check(context.Background(), "", "not in any breach at all")
+
+	if !errors.Is(err, ErrRangeUnavailable) {
+		t.Fatalf("got %v, want %v", err, ErrRangeUnavailable)
+	}
+
+	// the bundled list is still checked first
+	policy.breached = NewBloom(1)
+	policy.breached.AddHash(sha1Sum("hunter2"))
+
+	err = policy.Check(context.Background(), "", "hunter2")
+
+	if !errors.Is(err, ErrBreachedPassword) {
+		t.Fatalf("got %v, want %v", err, ErrBreachedPassword)
+	}
+}
+
+func sha1Sum(password string) []byte {
+	sum := sha1.Sum([]byte(password))
+	return sum[:]
+}
@@ -0,0 +1,84 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Checks passwords against the full Have I Been Pwned corpus using its
+// range api. Only the first five characters of the sha1 hash of the
+// password are sent. The api returns the rest of every breached hash
+// starting with them and the match is made here (k-anonymity), so what
+// is sent says nothing useful about the password.
+
+const rangePrefixLen = 5
+
+var ErrRangeUnavailable = errors.New("breached password range api is unavailable")
+
+type RangeChecker struct {
+	client *http.Client
+	url    string
+}
+
+// NewRangeChecker checks passwords with a range api at a url that the
+// hash prefix is appended to, e.g. https://api.pwnedpasswords.com/range/
+func NewRangeChecker(url string) *RangeChecker {
+	return &RangeChecker{client: &http.Client{Timeout: 5 * time.Second},
+		url: strings.TrimSuffix(url, "/") + "/"}
+}
+
+// IsBreached reports whether the password is in the corpus. Errors
+// wrap ErrRangeUnavailable.
+func (checker *RangeChecker) IsBreached(ctx context.Context, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:rangePrefixLen], hash[rangePrefixLen:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checker.url+prefix, nil)
+
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrRangeUnavailable, err)
+	}
+
+	// pads the response with decoys so its size does not give away the
+	// prefix either
+	req.Header.Set("Add-Padding", "true")
+
+	resp, err := checker.client.Do(req)
+
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrRangeUnavailable, err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%w: %s", ErrRangeUnavailable, resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+
+	for scanner.Scan() {
+		// lines are SUFFIX:COUNT, decoys have a count of 0
+		s, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+
+		if strings.EqualFold(s, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+
+	err = scanner.Err()
+
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrRangeUnavailable, err)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,82 @@
+package revocation
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/antonybholmes/go-edbserver-gin/jsonconfig"
+)
+
+// Services that may introspect and revoke tokens, e.g. the file server.
+// Clients authenticate with an id and a secret. Secrets are read from
+// environment variables so they stay out of the config file.
+
+var (
+	ErrInvalidClient = errors.New("invalid client credentials")
+)
+
+type ClientConfig struct {
+	Id        string `json:"id"`
+	SecretEnv string `json:"secretEnv"`
+	Disabled  bool   `json:"disabled"`
+}
+
+type ClientsConfig struct {
+	Clients []ClientConfig `json:"clients"`
+}
+
+type ClientRegistry struct {
+	secrets map[string][]byte
+	// clients that could not be set up and why
+	Disabled map[string]error
+}
+
+func LoadClientsConfig(file string) (*ClientsConfig, error) {
+	var config ClientsConfig
+
+	err := jsonconfig.Load(file, &config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// NewClientRegistry sets up the clients in the config. A client
+// without a secret is disabled rather than stopping the server.
+func NewClientRegistry(config *ClientsConfig) *ClientRegistry {
+	registry := ClientRegistry{secrets: make(map[string][]byte),
+		Disabled: make(map[string]error)}
+
+	for _, cc := range config.Clients {
+		if cc.Disabled {
+			registry.Disabled[cc.Id] = fmt.Errorf("disabled in config")
+			continue
+		}
+
+		secret := os.Getenv(cc.SecretEnv)
+
+		if secret == "" {
+			registry.Disabled[cc.Id] = fmt.Errorf("secret %s is not set", cc.SecretEnv)
+			continue
+		}
+
+		registry.secrets[cc.Id] = []byte(secret)
+	}
+
+	return &registry
+}
+
+// Authenticate checks a client id and secret
+func (registry *ClientRegistry) Authenticate(id string, secret string) error {
+	expected, ok := registry.secrets[id]
+
+	if !ok || subtle.ConstantTimeCompare(expected, []byte(secret)) != 1 {
+		return ErrInvalidClient
+	}
+
+	return nil
+}
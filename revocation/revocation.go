@@ -0,0 +1,52 @@
+package revocation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Tokens that were revoked before they expired. Tokens are stored by
+// hash so the store can be checked before a token is even parsed, and
+// each entry only lives until the token would have expired anyway.
+
+const revokedKeyPrefix = "token:revoked:"
+
+type RevocationStore struct {
+	rdb *redis.Client
+}
+
+func NewRevocationStore(rdb *redis.Client) *RevocationStore {
+	return &RevocationStore{rdb: rdb}
+}
+
+func revokedKey(token string) string {
+	h := sha256.Sum256([]byte(token))
+
+	return revokedKeyPrefix + hex.EncodeToString(h[:])
+}
+
+// Revoke records that a token is no longer valid. Tokens that
+// have already expired are ignored.
+func (store *RevocationStore) Revoke(ctx context.Context, token string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+
+	if ttl <= 0 {
+		return nil
+	}
+
+	return store.rdb.Set(ctx, revokedKey(token), time.Now().UTC().Format(time.RFC3339), ttl).Err()
+}
+
+func (store *RevocationStore) IsRevoked(ctx context.Context, token string) (bool, error) {
+	n, err := store.rdb.Exists(ctx, revokedKey(token)).Result()
+
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
@@ -0,0 +1,313 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/accessrequests"
+	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/datasetacl"
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	"github.com/antonybholmes/go-edbserver-gin/memberships"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+	"github.com/antonybholmes/go-web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+type AccessRoutes struct {
+	Policy   *accessrequests.Policy
+	Expiries *memberships.ExpiryStore
+	ACL      *datasetacl.ACL
+}
+
+type AccessRequestsReq struct {
+	Status string `form:"status"`
+}
+
+type AccessAuditReq struct {
+	RequestId string `form:"requestId"`
+	Offset    int    `form:"offset"`
+	Records   int    `form:"records"`
+}
+
+type AccessDecisionReq struct {
+	// how long to grant access for, 0 for as long as allowed
+	Days   int    `json:"days"`
+	Reason string `json:"reason"`
+}
+
+func NewAccessRoutes(policy *accessrequests.Policy,
+	expiries *memberships.ExpiryStore,
+	acl *datasetacl.ACL) *AccessRoutes {
+	return &AccessRoutes{Policy: policy, Expiries: expiries, ACL: acl}
+}
+
+func accessErrorResp(c *gin.Context, err error) {
+	if errors.Is(err, accessrequests.ErrRequestNotFound) ||
+		errors.Is(err, accessrequests.ErrRequestDecided) ||
+		errors.Is(err, accessrequests.ErrTooLong) ||
+		errors.Is(err, datasetacl.ErrUnknownModule) {
+		web.BadReqResp(c, err)
+	} else {
+		c.Error(err)
+	}
+}
+
+// adminId is the id of the admin making a decision, for the audit log
+func adminId(c *gin.Context) string {
+	user, err := middleware.GetJwtUser(c)
+
+	if err != nil {
+		return "admin"
+	}
+
+	return user.Subject
+}
+
+func (accessRoutes *AccessRoutes) audit(c *gin.Context, req *accessrequests.Request, action string, detail string) {
+	err := accessRoutes.Policy.Audit.RecordAction(c, req, adminId(c), action, detail, c.ClientIP())
+
+	if err != nil {
+		log.Error().Msgf("could not audit access request %s %s: %v", req.Id, action, err)
+	}
+}
+
+// List access requests, by default those waiting for review
+func (accessRoutes *AccessRoutes) AccessRequestsRoute(c *gin.Context) {
+	req := AccessRequestsReq{Status: accessrequests.StatusPending}
+
+	err := c.ShouldBindQuery(&req)
+
+	if err != nil {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	// all is every status
+	if req.Status == "all" {
+		req.Status = ""
+	}
+
+	list, err := accessRoutes.Policy.Requests.List(c, req.Status)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", list)
+}
+
+// The audit log of access requests, newest first
+func (accessRoutes *AccessRoutes) AccessAuditRoute(c *gin.Context) {
+	req := AccessAuditReq{Records: 100}
+
+	err := c.ShouldBindQuery(&req)
+
+	if err != nil || req.Offset < 0 || req.Records < 1 {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	list, err := accessRoutes.Policy.Audit.List(c, req.RequestId, req.Offset, req.Records)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", list)
+}
+
+// grantGroup adds the user to the group they asked for. A time limit
+// is not put on someone who is already a permanent member.
+func (accessRoutes *AccessRoutes) grantGroup(c *gin.Context, authUser *auth.AuthUser, group string, expiresAt *time.Time) error {
+	groups := memberships.GroupNames(authUser)
+
+	if slices.Contains(groups, group) {
+		expiries, err := accessRoutes.Expiries.Expiries(c, authUser.Id)
+
+		if err != nil {
+			return err
+		}
+
+		if _, ok := expiries[group]; !ok {
+			return nil
+		}
+	} else {
+		err := userdbcache.SetUserGroups(authUser, append(groups, group), true)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return accessRoutes.Expiries.SetExpiry(c, authUser.Id, group, expiresAt)
+}
+
+// grantDataset grants a dataset to the user whether or not it is
+// restricted, since a grant only adds access. Dataset grants last
+// until they are revoked.
+func (accessRoutes *AccessRoutes) grantDataset(c *gin.Context, authUser *auth.AuthUser, module string, dataset string) error {
+	_, err := accessRoutes.ACL.Grant(c, module, dataset, datasetacl.PrincipalUser, authUser.Id)
+
+	return err
+}
+
+// Approve a request, which adds the user to the group or grants them
+// the dataset they asked for
+func (accessRoutes *AccessRoutes) ApproveAccessRoute(c *gin.Context) {
+	var decision AccessDecisionReq
+
+	err := c.ShouldBindJSON(&decision)
+
+	if err != nil {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	// only one admin can decide a request, and access is only granted
+	// once this one has it
+	req, err := accessRoutes.Policy.Requests.Claim(c, c.Param("id"))
+
+	if err != nil {
+		accessErrorResp(c, err)
+		return
+	}
+
+	authUser, err := userdbcache.FindUserById(req.UserId)
+
+	if err != nil {
+		accessRoutes.unclaim(c, req)
+		web.BadReqResp(c, err)
+		return
+	}
+
+	// admins can shorten what was asked for, if nothing is given
+	// the user gets what they asked for
+	days := decision.Days
+
+	if days == 0 {
+		days = req.Days
+	}
+
+	var expiresAt *time.Time
+	var granted string
+
+	switch req.Kind {
+	case accessrequests.KindGroup:
+		expiresAt, err = accessRoutes.Policy.ExpiresAt(req, days)
+
+		if err == nil {
+			err = accessRoutes.grantGroup(c, authUser, req.Group, expiresAt)
+		}
+
+		granted = "group " + req.Group
+	default:
+		err = accessRoutes.grantDataset(c, authUser, req.Module, req.Dataset)
+
+		granted = fmt.Sprintf("dataset %s/%s", req.Module, req.Dataset)
+	}
+
+	if err != nil {
+		accessRoutes.unclaim(c, req)
+		accessErrorResp(c, err)
+		return
+	}
+
+	if expiresAt != nil {
+		granted += " until " + expiresAt.Format(time.RFC3339)
+	}
+
+	err = accessRoutes.Policy.Requests.Decide(c,
+		req,
+		accessrequests.StatusApproved,
+		adminId(c),
+		decision.Reason,
+		expiresAt)
+
+	if err != nil {
+		accessErrorResp(c, err)
+		return
+	}
+
+	accessRoutes.audit(c, req, accessrequests.ActionApproved, decision.Reason)
+	accessRoutes.audit(c, req, accessrequests.ActionGranted, granted)
+
+	sendAccessEmail(c, authUser, emails.EmailQueueTypeAccessApproved)
+
+	log.Info().Msgf("access request %s approved, %s granted to %s", req.Id, granted, authUser.Id)
+
+	web.MakeDataResp(c, "access request approved", req)
+}
+
+// Deny a request and let the user know
+func (accessRoutes *AccessRoutes) DenyAccessRoute(c *gin.Context) {
+	var decision AccessDecisionReq
+
+	err := c.ShouldBindJSON(&decision)
+
+	if err != nil {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	req, err := accessRoutes.Policy.Requests.Claim(c, c.Param("id"))
+
+	if err != nil {
+		accessErrorResp(c, err)
+		return
+	}
+
+	err = accessRoutes.Policy.Requests.Decide(c,
+		req,
+		accessrequests.StatusDenied,
+		adminId(c),
+		decision.Reason,
+		nil)
+
+	if err != nil {
+		accessErrorResp(c, err)
+		return
+	}
+
+	accessRoutes.audit(c, req, accessrequests.ActionDenied, decision.Reason)
+
+	authUser, err := userdbcache.FindUserById(req.UserId)
+
+	if err == nil {
+		sendAccessEmail(c, authUser, emails.EmailQueueTypeAccessDenied)
+	}
+
+	web.MakeDataResp(c, "access request denied", req)
+}
+
+// unclaim puts back a request that could not be approved so it can be
+// decided again
+func (accessRoutes *AccessRoutes) unclaim(c *gin.Context, req *accessrequests.Request) {
+	err := accessRoutes.Policy.Requests.Unclaim(c, req)
+
+	if err != nil {
+		log.Error().Msgf("could not put back access request %s: %v", req.Id, err)
+	}
+}
+
+func sendAccessEmail(c *gin.Context, authUser *auth.AuthUser, emailType string) {
+	email := mailserver.MailItem{Name: authUser.Name,
+		To:        authUser.Email,
+		EmailType: emailType,
+		LinkUrl:   consts.AppUrl}
+
+	err := outbox.SendMail(c, &email)
+
+	if err != nil {
+		log.Warn().Msgf("could not send %s email: %v", emailType, err)
+	}
+}
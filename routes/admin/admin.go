@@ -3,8 +3,10 @@ package admin
 import (
 	edbmail "github.com/antonybholmes/go-edbmailserver/mail"
 	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/memberships"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	"github.com/antonybholmes/go-edbserver-gin/routes/authentication"
 	mailserver "github.com/antonybholmes/go-mailserver"
-	"github.com/antonybholmes/go-mailserver/mailqueue"
 	"github.com/antonybholmes/go-web"
 	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
 	"github.com/antonybholmes/go-web/middleware"
@@ -106,6 +108,15 @@ func UpdateUserRoute(c *gin.Context) {
 
 		authUser := validator.AuthUser
 
+		if validator.UserBodyReq.Password != "" && !authentication.CheckNewPassword(c,
+			authUser.Id,
+			validator.UserBodyReq.Password,
+			validator.UserBodyReq.Username,
+			validator.UserBodyReq.Name,
+			validator.Address.Address) {
+			return
+		}
+
 		err := userdbcache.SetUserInfo(authUser,
 			validator.UserBodyReq.Username,
 			validator.UserBodyReq.Name,
@@ -145,12 +156,12 @@ func UpdateUserRoute(c *gin.Context) {
 
 				return
 			}
+
+			authentication.RememberPassword(c, authUser.Id, validator.UserBodyReq.Password)
 		}
 
-		// set roles
-		err = userdbcache.SetUserGroups(authUser,
-			validator.UserBodyReq.Groups,
-			true)
+		// set roles, which also ends any time limits on them
+		err = memberships.SetGroups(c, authUser, validator.UserBodyReq.Groups)
 
 		if err != nil {
 			c.Error(err)
@@ -165,6 +176,15 @@ func AddUserRoute(c *gin.Context) {
 
 	middleware.NewValidator(c).CheckUsernameIsWellFormed().CheckEmailIsWellFormed().Success(func(validator *middleware.Validator) {
 
+		if validator.UserBodyReq.Password != "" && !authentication.CheckNewPassword(c,
+			"",
+			validator.UserBodyReq.Password,
+			validator.UserBodyReq.Username,
+			validator.UserBodyReq.Name,
+			validator.Address.Address) {
+			return
+		}
+
 		// assume email is not verified
 		authUser, err := userdbcache.CreateUser(
 			validator.Address,
@@ -181,6 +201,8 @@ func AddUserRoute(c *gin.Context) {
 			return
 		}
 
+		authentication.RememberPassword(c, authUser.Id, validator.UserBodyReq.Password)
+
 		// tell user their account was created
 		//go SendAccountCreatedEmail(authUser, validator.Address)
 
@@ -189,7 +211,12 @@ func AddUserRoute(c *gin.Context) {
 			To:        authUser.Email,
 			EmailType: edbmail.EmailQueueTypeAccountCreated,
 			LinkUrl:   consts.AppUrl}
-		mailqueue.SendMail(&email)
+		err = outbox.SendMail(c, &email)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
 
 		web.MakeOkResp(c, "account created email sent")
 	})
@@ -0,0 +1,140 @@
+package admin
+
+import (
+	"errors"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/announcements"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/gin-gonic/gin"
+)
+
+var ErrInvalidDays = errors.New("days cannot be negative")
+
+type AnnouncementsRoutes struct {
+	Broadcaster *announcements.Broadcaster
+}
+
+type AnnouncementReq struct {
+	// announcement or release
+	Kind    string   `json:"kind"`
+	Title   string   `json:"title"`
+	Body    string   `json:"body"`
+	LinkUrl string   `json:"linkUrl"`
+	Groups  []string `json:"groups"`
+	// how many days it is shown in the app, 0 for as long as it is kept
+	Days int `json:"days"`
+	// only show it in the app
+	NoEmail bool `json:"noEmail"`
+}
+
+type AnnouncementsReq struct {
+	Offset  int `form:"offset"`
+	Records int `form:"records"`
+}
+
+func NewAnnouncementsRoutes(broadcaster *announcements.Broadcaster) *AnnouncementsRoutes {
+	return &AnnouncementsRoutes{Broadcaster: broadcaster}
+}
+
+func announcementErrorResp(c *gin.Context, err error) {
+	if errors.Is(err, announcements.ErrAnnouncementNotFound) ||
+		errors.Is(err, announcements.ErrUnknownKind) ||
+		errors.Is(err, announcements.ErrNoTitle) ||
+		errors.Is(err, announcements.ErrNoGroups) {
+		web.BadReqResp(c, err)
+	} else {
+		c.Error(err)
+	}
+}
+
+// List announcements with how many emails each led to, newest first
+func (announcementsRoutes *AnnouncementsRoutes) AnnouncementsRoute(c *gin.Context) {
+	req := AnnouncementsReq{Records: 100}
+
+	err := c.ShouldBindQuery(&req)
+
+	if err != nil || req.Offset < 0 || req.Records < 1 {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	list, err := announcementsRoutes.Broadcaster.Store.List(c, req.Offset, req.Records)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", list)
+}
+
+// An announcement and how far emailing it has got
+func (announcementsRoutes *AnnouncementsRoutes) AnnouncementRoute(c *gin.Context) {
+	announcement, err := announcementsRoutes.Broadcaster.Store.Get(c, c.Param("id"))
+
+	if err != nil {
+		announcementErrorResp(c, err)
+		return
+	}
+
+	web.MakeDataResp(c, "", announcement)
+}
+
+// Post an announcement to groups. It is shown in the app and emailed
+// in the background to members who have not opted out.
+func (announcementsRoutes *AnnouncementsRoutes) CreateAnnouncementRoute(c *gin.Context) {
+	var req AnnouncementReq
+
+	err := c.ShouldBindJSON(&req)
+
+	if err != nil {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	if req.Days < 0 {
+		web.BadReqResp(c, ErrInvalidDays)
+		return
+	}
+
+	announcement := announcements.Announcement{Kind: req.Kind,
+		Title:     req.Title,
+		Body:      req.Body,
+		LinkUrl:   req.LinkUrl,
+		Groups:    req.Groups,
+		CreatedBy: adminId(c)}
+
+	if req.Days > 0 {
+		expiresAt := time.Now().UTC().AddDate(0, 0, req.Days)
+		announcement.ExpiresAt = &expiresAt
+	}
+
+	err = announcementsRoutes.Broadcaster.Post(c, &announcement, !req.NoEmail)
+
+	if err != nil {
+		announcementErrorResp(c, err)
+		return
+	}
+
+	log.Info().Msgf("%s posted %s %s to %v", announcement.CreatedBy, announcement.Kind, announcement.Id, announcement.Groups)
+
+	web.MakeDataResp(c, "announcement posted", &announcement)
+}
+
+// Remove an announcement from the app and stop emailing it
+func (announcementsRoutes *AnnouncementsRoutes) DeleteAnnouncementRoute(c *gin.Context) {
+	id := c.Param("id")
+
+	err := announcementsRoutes.Broadcaster.Store.Delete(c, id)
+
+	if err != nil {
+		announcementErrorResp(c, err)
+		return
+	}
+
+	log.Info().Msgf("%s deleted announcement %s", adminId(c), id)
+
+	web.MakeOkResp(c, "announcement deleted")
+}
@@ -0,0 +1,146 @@
+package admin
+
+import (
+	"errors"
+
+	"github.com/antonybholmes/go-edbserver-gin/datasetacl"
+	"github.com/antonybholmes/go-web"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+	"github.com/gin-gonic/gin"
+)
+
+type DatasetsRoutes struct {
+	ACL *datasetacl.ACL
+}
+
+type DatasetGrantReq struct {
+	// user or group
+	Type string `json:"type"`
+	// user id or group name
+	Principal string `json:"principal"`
+}
+
+type DatasetAccessResp struct {
+	Grants []*datasetacl.Grant `json:"grants"`
+	// only those granted the dataset can see it
+	Restricted bool `json:"restricted"`
+}
+
+func NewDatasetsRoutes(acl *datasetacl.ACL) *DatasetsRoutes {
+	return &DatasetsRoutes{ACL: acl}
+}
+
+func datasetACLErrorResp(c *gin.Context, err error) {
+	if errors.Is(err, datasetacl.ErrUnknownModule) ||
+		errors.Is(err, datasetacl.ErrInvalidPrincipal) ||
+		errors.Is(err, datasetacl.ErrGrantNotFound) {
+		web.BadReqResp(c, err)
+	} else {
+		c.Error(err)
+	}
+}
+
+// List every dataset grant, optionally for one module
+func (datasetsRoutes *DatasetsRoutes) GrantsRoute(c *gin.Context) {
+	grants, err := datasetsRoutes.ACL.AllGrants(c, c.Query("module"))
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", grants)
+}
+
+// List who a dataset is granted to and whether it is restricted to
+// them. An open dataset is also seen by everyone with full access to
+// the module.
+func (datasetsRoutes *DatasetsRoutes) DatasetGrantsRoute(c *gin.Context) {
+	grants, err := datasetsRoutes.ACL.Grants(c, c.Param("module"), c.Param("dataset"))
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	restricted, err := datasetsRoutes.ACL.IsRestricted(c, c.Param("module"), c.Param("dataset"))
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", &DatasetAccessResp{Grants: grants, Restricted: restricted})
+}
+
+// Grant a dataset to a user or group in addition to whoever
+// can already see it
+func (datasetsRoutes *DatasetsRoutes) GrantDatasetRoute(c *gin.Context) {
+	var req DatasetGrantReq
+
+	err := c.ShouldBindJSON(&req)
+
+	if err != nil || req.Principal == "" {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	if req.Type == datasetacl.PrincipalUser {
+		// make sure the user exists so grants are not made to typos
+		_, err = userdbcache.FindUserById(req.Principal)
+
+		if err != nil {
+			web.BadReqResp(c, err)
+			return
+		}
+	}
+
+	grant, err := datasetsRoutes.ACL.Grant(c, c.Param("module"), c.Param("dataset"), req.Type, req.Principal)
+
+	if err != nil {
+		datasetACLErrorResp(c, err)
+		return
+	}
+
+	web.MakeDataResp(c, "", grant)
+}
+
+// Remove a grant
+func (datasetsRoutes *DatasetsRoutes) RevokeDatasetRoute(c *gin.Context) {
+	err := datasetsRoutes.ACL.Revoke(c,
+		c.Param("module"),
+		c.Param("dataset"),
+		c.Param("type"),
+		c.Param("principal"))
+
+	if err != nil {
+		datasetACLErrorResp(c, err)
+		return
+	}
+
+	web.MakeOkResp(c, "grant revoked")
+}
+
+// Restrict a dataset to those it is granted to
+func (datasetsRoutes *DatasetsRoutes) RestrictDatasetRoute(c *gin.Context) {
+	err := datasetsRoutes.ACL.Restrict(c, c.Param("module"), c.Param("dataset"), true)
+
+	if err != nil {
+		datasetACLErrorResp(c, err)
+		return
+	}
+
+	web.MakeOkResp(c, "dataset restricted")
+}
+
+// Open a restricted dataset to everyone with full access to its module
+func (datasetsRoutes *DatasetsRoutes) UnrestrictDatasetRoute(c *gin.Context) {
+	err := datasetsRoutes.ACL.Restrict(c, c.Param("module"), c.Param("dataset"), false)
+
+	if err != nil {
+		datasetACLErrorResp(c, err)
+		return
+	}
+
+	web.MakeOkResp(c, "dataset opened")
+}
@@ -0,0 +1,77 @@
+package admin
+
+import (
+	"errors"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/keyring"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/gin-gonic/gin"
+)
+
+type KeysRoutes struct {
+	KeyRing *keyring.KeyRing
+}
+
+type RotateKeysReq struct {
+	// how long the old key is still accepted, defaults to JWT_KEY_OVERLAP_MINS
+	OverlapMins int `json:"overlapMins"`
+}
+
+type KeysResp struct {
+	Signing string         `json:"signing"`
+	Keys    []*keyring.Key `json:"keys"`
+}
+
+func NewKeysRoutes(keyRing *keyring.KeyRing) *KeysRoutes {
+	return &KeysRoutes{KeyRing: keyRing}
+}
+
+func (keysRoutes *KeysRoutes) makeKeysResp(c *gin.Context, msg string) {
+	key, err := keysRoutes.KeyRing.SigningKey()
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, msg, &KeysResp{Signing: key.Kid, Keys: keysRoutes.KeyRing.Keys()})
+}
+
+// List the ids of the signing and verification keys
+func (keysRoutes *KeysRoutes) KeysRoute(c *gin.Context) {
+	keysRoutes.makeKeysResp(c, "")
+}
+
+// Create a new signing key. The previous key is still accepted
+// for the overlap period so live tokens are not invalidated.
+func (keysRoutes *KeysRoutes) RotateKeysRoute(c *gin.Context) {
+	var req RotateKeysReq
+
+	// body is optional
+	c.ShouldBindJSON(&req)
+
+	overlap := consts.JwtKeyOverlap
+
+	if req.OverlapMins > 0 {
+		overlap = time.Duration(req.OverlapMins) * time.Minute
+	}
+
+	key, err := keysRoutes.KeyRing.Rotate(overlap)
+
+	if err != nil {
+		if errors.Is(err, keyring.ErrLocked) {
+			web.BadReqResp(c, err)
+		} else {
+			c.Error(err)
+		}
+
+		return
+	}
+
+	log.Info().Msgf("rotated signing key to %s with overlap %v", key.Kid, overlap)
+
+	keysRoutes.makeKeysResp(c, "signing key rotated")
+}
@@ -0,0 +1,172 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+
+	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	"github.com/antonybholmes/go-edbserver-gin/mailbackends"
+	"github.com/antonybholmes/go-edbserver-gin/notifications"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/antonybholmes/go-mailserver/mailqueue"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/gin-gonic/gin"
+)
+
+const sampleName = "Sample User"
+
+var ErrUnknownEmailType = errors.New("unknown email type")
+
+type MailRoutes struct {
+	Backend mailbackends.Backend
+}
+
+// Data to fill an email with instead of the samples
+type MailPreviewReq struct {
+	Name    string `json:"name"`
+	To      string `json:"to"`
+	LinkUrl string `json:"linkUrl"`
+	TTL     string `json:"ttl"`
+	Data    string `json:"data"`
+}
+
+type MailPreviewResp struct {
+	Type     *emails.EmailType    `json:"type"`
+	Email    *mailserver.MailItem `json:"email"`
+	Rendered *emails.Rendered     `json:"rendered"`
+}
+
+func NewMailRoutes(backend mailbackends.Backend) *MailRoutes {
+	return &MailRoutes{Backend: backend}
+}
+
+// Which backend emails are queued on and whether it is working
+func (mailRoutes *MailRoutes) MailHealthRoute(c *gin.Context) {
+	web.MakeDataResp(c, "", mailbackends.CheckHealth(c, mailRoutes.Backend))
+}
+
+// List the email types the server sends
+func (mailRoutes *MailRoutes) MailTemplatesRoute(c *gin.Context) {
+	web.MakeDataResp(c, "", emails.Types())
+}
+
+// sampleEmail makes an email of the type in the path, filled with the
+// data in the body or samples. If this fails the response has been
+// written and false is returned.
+func sampleEmail(c *gin.Context) (*emails.EmailType, *mailserver.MailItem, bool) {
+	emailType, ok := emails.FindType(c.Param("type"))
+
+	if !ok {
+		web.BadReqResp(c, ErrUnknownEmailType)
+		return nil, nil, false
+	}
+
+	var req MailPreviewReq
+
+	// the body is optional, without one the samples are used
+	if c.Request.ContentLength > 0 {
+		err := c.ShouldBindJSON(&req)
+
+		if err != nil {
+			web.BadReqResp(c, web.ErrInvalidBody)
+			return nil, nil, false
+		}
+	}
+
+	if req.Name == "" {
+		req.Name = sampleName
+	}
+
+	email := emailType.Sample(req.Name, req.To)
+
+	if req.LinkUrl != "" {
+		email.LinkUrl = req.LinkUrl
+	}
+
+	if req.TTL != "" {
+		email.TTL = req.TTL
+	}
+
+	if req.Data != "" && email.Payload != nil {
+		email.Payload.Data = req.Data
+	}
+
+	return emailType, email, true
+}
+
+// Render an email type with sample or supplied data from the mail
+// server's templates. Use format=html to get the page on its own.
+func (mailRoutes *MailRoutes) PreviewMailRoute(c *gin.Context) {
+	emailType, email, ok := sampleEmail(c)
+
+	if !ok {
+		return
+	}
+
+	// the link users get is signed for them, a placeholder does here
+	if notifications.CategoryOf(emailType.Type) != notifications.CategorySecurity {
+		err := emails.SetUnsubscribeLinks(email, consts.UrlUnsubscribe+"?token=sample", "")
+
+		if err != nil {
+			web.BadReqResp(c, err)
+			return
+		}
+	}
+
+	rendered, err := emails.Render(email, emailType.Subject)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if c.Query("format") == "html" {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(rendered.HTML))
+		return
+	}
+
+	web.MakeDataResp(c, "", &MailPreviewResp{Type: emailType, Email: email, Rendered: rendered})
+}
+
+// Send an email type with sample or supplied data to any address
+// through the mail backend, to check it arrives and how it looks
+func (mailRoutes *MailRoutes) TestSendMailRoute(c *gin.Context) {
+	emailType, email, ok := sampleEmail(c)
+
+	if !ok {
+		return
+	}
+
+	address, err := mail.ParseAddress(email.To)
+
+	if err != nil {
+		web.BadReqResp(c, err)
+		return
+	}
+
+	email.To = address.Address
+
+	// as users would get it if the address has an account
+	err = notifications.AddUnsubscribeLinks(email)
+
+	if err != nil {
+		web.BadReqResp(c, err)
+		return
+	}
+
+	// straight to the backend, not the outbox, so a failure is
+	// reported rather than retried
+	err = mailqueue.SendMail(email)
+
+	if err != nil {
+		web.InternalErrorResp(c, err)
+		return
+	}
+
+	log.Info().Msgf("%s sent a test %s email to %s", adminId(c), emailType.Type, email.To)
+
+	web.MakeDataResp(c, "test email sent", email)
+}
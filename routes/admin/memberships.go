@@ -0,0 +1,147 @@
+package admin
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/memberships"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrNotGroupMember = errors.New("user is not in this group")
+	ErrNoExpiry       = errors.New("give a number of days or when the membership ends")
+	ErrExpiryInPast   = errors.New("membership cannot end in the past")
+)
+
+type MembershipsRoutes struct {
+	Expiries *memberships.ExpiryStore
+}
+
+type MembershipExpiryReq struct {
+	// extend by this many days from when the membership would
+	// have ended, or from now if it has no end
+	Days int `json:"days"`
+	// or end the membership at this time
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+func NewMembershipsRoutes(expiries *memberships.ExpiryStore) *MembershipsRoutes {
+	return &MembershipsRoutes{Expiries: expiries}
+}
+
+// List every time limited membership, soonest to end first
+func (membershipsRoutes *MembershipsRoutes) MembershipsRoute(c *gin.Context) {
+	list, err := membershipsRoutes.Expiries.List(c)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", list)
+}
+
+// List when the time limited memberships of a user end
+func (membershipsRoutes *MembershipsRoutes) UserMembershipsRoute(c *gin.Context) {
+	expiries, err := membershipsRoutes.Expiries.Expiries(c, c.Param("id"))
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", expiries)
+}
+
+// Set when a membership ends, either by extending it or giving a time.
+// This can also put a time limit on a permanent membership.
+func (membershipsRoutes *MembershipsRoutes) ExtendMembershipRoute(c *gin.Context) {
+	var req MembershipExpiryReq
+
+	err := c.ShouldBindJSON(&req)
+
+	if err != nil || req.Days < 0 {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	if req.Days == 0 && req.ExpiresAt == nil {
+		web.BadReqResp(c, ErrNoExpiry)
+		return
+	}
+
+	userId := c.Param("id")
+	group := c.Param("group")
+
+	authUser, err := userdbcache.FindUserById(userId)
+
+	if err != nil {
+		web.BadReqResp(c, err)
+		return
+	}
+
+	if !slices.Contains(memberships.GroupNames(authUser), group) {
+		web.BadReqResp(c, ErrNotGroupMember)
+		return
+	}
+
+	expiresAt := req.ExpiresAt
+
+	if expiresAt == nil {
+		expiries, err := membershipsRoutes.Expiries.Expiries(c, userId)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		from := time.Now().UTC()
+
+		if current, ok := expiries[group]; ok && current.After(from) {
+			from = current
+		}
+
+		t := from.AddDate(0, 0, req.Days)
+		expiresAt = &t
+	}
+
+	if !expiresAt.After(time.Now()) {
+		web.BadReqResp(c, ErrExpiryInPast)
+		return
+	}
+
+	err = membershipsRoutes.Expiries.SetExpiry(c, userId, group, expiresAt)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	log.Info().Msgf("membership of %s in %s now ends %s", userId, group, expiresAt.Format(time.RFC3339))
+
+	web.MakeDataResp(c, "membership updated", &memberships.Membership{UserId: userId,
+		Group:     group,
+		ExpiresAt: *expiresAt})
+}
+
+// Make a time limited membership permanent
+func (membershipsRoutes *MembershipsRoutes) MakeMembershipPermanentRoute(c *gin.Context) {
+	userId := c.Param("id")
+	group := c.Param("group")
+
+	err := membershipsRoutes.Expiries.SetExpiry(c, userId, group, nil)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	log.Info().Msgf("membership of %s in %s made permanent", userId, group)
+
+	web.MakeOkResp(c, "membership is now permanent")
+}
@@ -0,0 +1,115 @@
+package admin
+
+import (
+	"errors"
+
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/gin-gonic/gin"
+)
+
+type OutboxRoutes struct {
+	Outbox *outbox.OutboxStore
+}
+
+type OutboxReq struct {
+	Status  string `form:"status"`
+	Offset  int    `form:"offset"`
+	Records int    `form:"records"`
+}
+
+type OutboxResp struct {
+	Counts   map[string]int64  `json:"counts"`
+	Messages []*outbox.Message `json:"messages"`
+}
+
+func NewOutboxRoutes(store *outbox.OutboxStore) *OutboxRoutes {
+	return &OutboxRoutes{Outbox: store}
+}
+
+// redact hides codes and links that would let whoever reads them
+// sign in as the recipient
+func redact(message *outbox.Message) *outbox.Message {
+	if message.Email == nil || message.Email.Payload == nil || message.Email.Payload.Data == "" {
+		return message
+	}
+
+	ret := *message
+	email := *message.Email
+	email.Payload = &mailserver.Payload{DataType: message.Email.Payload.DataType, Data: "[redacted]"}
+	ret.Email = &email
+
+	return &ret
+}
+
+func outboxErrorResp(c *gin.Context, err error) {
+	if errors.Is(err, outbox.ErrMessageNotFound) || errors.Is(err, outbox.ErrInvalidStatus) {
+		web.BadReqResp(c, err)
+	} else {
+		c.Error(err)
+	}
+}
+
+// List emails waiting to be sent or that could not be, oldest first
+func (outboxRoutes *OutboxRoutes) OutboxRoute(c *gin.Context) {
+	req := OutboxReq{Status: outbox.StatusFailed, Records: 100}
+
+	err := c.ShouldBindQuery(&req)
+
+	if err != nil || req.Offset < 0 || req.Records < 1 {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	messages, err := outboxRoutes.Outbox.List(c, req.Status, req.Offset, req.Records)
+
+	if err != nil {
+		outboxErrorResp(c, err)
+		return
+	}
+
+	counts, err := outboxRoutes.Outbox.Counts(c)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	for i, message := range messages {
+		messages[i] = redact(message)
+	}
+
+	web.MakeDataResp(c, "", &OutboxResp{Counts: counts, Messages: messages})
+}
+
+// Have an email tried again now with a fresh set of attempts
+func (outboxRoutes *OutboxRoutes) ResendOutboxRoute(c *gin.Context) {
+	message, err := outboxRoutes.Outbox.Resend(c, c.Param("id"))
+
+	if err != nil {
+		outboxErrorResp(c, err)
+		return
+	}
+
+	log.Info().Msgf("%s queued %s email %s to be resent", adminId(c), message.Email.EmailType, message.Id)
+
+	web.MakeDataResp(c, "", redact(message))
+}
+
+// Drop an email so it is never sent
+func (outboxRoutes *OutboxRoutes) DeleteOutboxRoute(c *gin.Context) {
+	id := c.Param("id")
+
+	err := outboxRoutes.Outbox.Delete(c, id)
+
+	if err != nil {
+		outboxErrorResp(c, err)
+		return
+	}
+
+	log.Info().Msgf("%s deleted outbox email %s", adminId(c), id)
+
+	web.MakeOkResp(c, "email deleted")
+}
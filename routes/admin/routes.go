@@ -1,10 +1,31 @@
 package admin
 
 import (
+	"github.com/antonybholmes/go-edbserver-gin/accessrequests"
+	"github.com/antonybholmes/go-edbserver-gin/announcements"
+	"github.com/antonybholmes/go-edbserver-gin/datasetacl"
+	"github.com/antonybholmes/go-edbserver-gin/keyring"
+	"github.com/antonybholmes/go-edbserver-gin/mailbackends"
+	"github.com/antonybholmes/go-edbserver-gin/memberships"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	"github.com/antonybholmes/go-edbserver-gin/sessionstore"
+	"github.com/antonybholmes/go-edbserver-gin/signinhistory"
+	"github.com/antonybholmes/go-edbserver-gin/signuppolicy"
 	"github.com/gin-gonic/gin"
 )
 
-func RegisterRoutes(r *gin.Engine, rulesMiddleware gin.HandlerFunc) {
+func RegisterRoutes(r *gin.Engine,
+	rulesMiddleware gin.HandlerFunc,
+	sessionStore *sessionstore.SessionStore,
+	keyRing *keyring.KeyRing,
+	signInHistory *signinhistory.HistoryStore,
+	signupPolicy *signuppolicy.Policy,
+	datasetACL *datasetacl.ACL,
+	accessPolicy *accessrequests.Policy,
+	membershipExpiries *memberships.ExpiryStore,
+	mailBackend mailbackends.Backend,
+	outboxStore *outbox.OutboxStore,
+	broadcaster *announcements.Broadcaster) {
 	adminGroup := r.Group("/admin",
 		rulesMiddleware,
 		//jwtUserMiddleWare,
@@ -15,6 +36,75 @@ func RegisterRoutes(r *gin.Engine, rulesMiddleware gin.HandlerFunc) {
 	adminGroup.GET("/roles", RolesRoute)
 	adminGroup.GET("/groups", GroupsRoute)
 
+	keysRoutes := NewKeysRoutes(keyRing)
+
+	adminKeysGroup := adminGroup.Group("/keys")
+	adminKeysGroup.GET("", keysRoutes.KeysRoute)
+	adminKeysGroup.POST("/rotate", keysRoutes.RotateKeysRoute)
+
+	// signups waiting for approval and invites to sign up
+	signupsRoutes := NewSignupsRoutes(signupPolicy)
+
+	adminSignupsGroup := adminGroup.Group("/signups")
+	adminSignupsGroup.GET("", signupsRoutes.SignupsRoute)
+	adminSignupsGroup.POST("/:id/approve", signupsRoutes.ApproveSignupRoute)
+	adminSignupsGroup.POST("/:id/reject", signupsRoutes.RejectSignupRoute)
+	adminSignupsGroup.GET("/invites", signupsRoutes.InvitesRoute)
+	adminSignupsGroup.POST("/invites", signupsRoutes.CreateInviteRoute)
+	adminSignupsGroup.DELETE("/invites/:token", signupsRoutes.RevokeInviteRoute)
+
+	// who datasets in the data modules are shared with
+	datasetsRoutes := NewDatasetsRoutes(datasetACL)
+
+	adminDatasetsGroup := adminGroup.Group("/datasets/acl")
+	adminDatasetsGroup.GET("", datasetsRoutes.GrantsRoute)
+	adminDatasetsGroup.GET("/:module/:dataset", datasetsRoutes.DatasetGrantsRoute)
+	adminDatasetsGroup.POST("/:module/:dataset", datasetsRoutes.GrantDatasetRoute)
+	adminDatasetsGroup.DELETE("/:module/:dataset/:type/:principal", datasetsRoutes.RevokeDatasetRoute)
+	adminDatasetsGroup.PUT("/:module/:dataset/restricted", datasetsRoutes.RestrictDatasetRoute)
+	adminDatasetsGroup.DELETE("/:module/:dataset/restricted", datasetsRoutes.UnrestrictDatasetRoute)
+
+	// users asking for access to groups and datasets
+	accessRoutes := NewAccessRoutes(accessPolicy, membershipExpiries, datasetACL)
+
+	adminAccessGroup := adminGroup.Group("/access-requests")
+	adminAccessGroup.GET("", accessRoutes.AccessRequestsRoute)
+	adminAccessGroup.GET("/audit", accessRoutes.AccessAuditRoute)
+	adminAccessGroup.POST("/:id/approve", accessRoutes.ApproveAccessRoute)
+	adminAccessGroup.POST("/:id/deny", accessRoutes.DenyAccessRoute)
+
+	// group memberships that end
+	membershipsRoutes := NewMembershipsRoutes(membershipExpiries)
+
+	adminGroup.GET("/memberships", membershipsRoutes.MembershipsRoute)
+
+	// where emails go
+	mailRoutes := NewMailRoutes(mailBackend)
+
+	adminGroup.GET("/mail/health", mailRoutes.MailHealthRoute)
+
+	adminMailTemplatesGroup := adminGroup.Group("/mail/templates")
+	adminMailTemplatesGroup.GET("", mailRoutes.MailTemplatesRoute)
+	adminMailTemplatesGroup.POST("/:type/preview", mailRoutes.PreviewMailRoute)
+	adminMailTemplatesGroup.POST("/:type/send", mailRoutes.TestSendMailRoute)
+
+	// emails waiting to be sent or that could not be
+	outboxRoutes := NewOutboxRoutes(outboxStore)
+
+	adminOutboxGroup := adminGroup.Group("/mail/outbox")
+	adminOutboxGroup.GET("", outboxRoutes.OutboxRoute)
+	adminOutboxGroup.POST("/:id/resend", outboxRoutes.ResendOutboxRoute)
+	adminOutboxGroup.DELETE("/:id", outboxRoutes.DeleteOutboxRoute)
+
+	// news and data releases emailed to groups
+	announcementsRoutes := NewAnnouncementsRoutes(broadcaster)
+
+	adminAnnouncementsGroup := adminGroup.Group("/announcements")
+	adminAnnouncementsGroup.GET("", announcementsRoutes.AnnouncementsRoute)
+	adminAnnouncementsGroup.POST("", announcementsRoutes.CreateAnnouncementRoute)
+	adminAnnouncementsGroup.GET("/:id", announcementsRoutes.AnnouncementRoute)
+	adminAnnouncementsGroup.DELETE("/:id", announcementsRoutes.DeleteAnnouncementRoute)
+
 	adminUsersGroup := adminGroup.Group("/users")
 
 	adminUsersGroup.POST("", UsersRoute)
@@ -22,4 +112,17 @@ func RegisterRoutes(r *gin.Engine, rulesMiddleware gin.HandlerFunc) {
 	adminUsersGroup.POST("/update", UpdateUserRoute)
 	adminUsersGroup.POST("/add", AddUserRoute)
 	adminUsersGroup.DELETE("/:id/delete", DeleteUserRoute)
+
+	sessionsRoutes := NewSessionsRoutes(sessionStore)
+
+	adminUsersGroup.GET("/:id/sessions", sessionsRoutes.UserSessionsRoute)
+	adminUsersGroup.DELETE("/:id/sessions/revoke", sessionsRoutes.RevokeUserSessionsRoute)
+
+	signInsRoutes := NewSignInsRoutes(signInHistory)
+
+	adminUsersGroup.GET("/:id/signins", signInsRoutes.UserSignInsRoute)
+
+	adminUsersGroup.GET("/:id/memberships", membershipsRoutes.UserMembershipsRoute)
+	adminUsersGroup.POST("/:id/memberships/:group/expiry", membershipsRoutes.ExtendMembershipRoute)
+	adminUsersGroup.DELETE("/:id/memberships/:group/expiry", membershipsRoutes.MakeMembershipPermanentRoute)
 }
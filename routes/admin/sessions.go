@@ -0,0 +1,47 @@
+package admin
+
+import (
+	"github.com/antonybholmes/go-edbserver-gin/sessionstore"
+	"github.com/antonybholmes/go-web"
+	"github.com/gin-gonic/gin"
+)
+
+type SessionsRoutes struct {
+	Store *sessionstore.SessionStore
+}
+
+type RevokedSessionsResp struct {
+	Revoked int `json:"revoked"`
+}
+
+func NewSessionsRoutes(store *sessionstore.SessionStore) *SessionsRoutes {
+	return &SessionsRoutes{Store: store}
+}
+
+// List the active sessions of a user
+func (sessionsRoutes *SessionsRoutes) UserSessionsRoute(c *gin.Context) {
+	userId := c.Param("id")
+
+	list, err := sessionsRoutes.Store.List(c, userId)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", list)
+}
+
+// Sign a user out of every session, e.g. if their account is compromised
+func (sessionsRoutes *SessionsRoutes) RevokeUserSessionsRoute(c *gin.Context) {
+	userId := c.Param("id")
+
+	n, err := sessionsRoutes.Store.RevokeAll(c, userId, "")
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "user sessions revoked", &RevokedSessionsResp{Revoked: n})
+}
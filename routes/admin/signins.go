@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"github.com/antonybholmes/go-edbserver-gin/signinhistory"
+	"github.com/antonybholmes/go-web"
+	"github.com/gin-gonic/gin"
+)
+
+type SignInsRoutes struct {
+	History *signinhistory.HistoryStore
+}
+
+type SignInHistoryReq struct {
+	Offset  int `form:"offset"`
+	Records int `form:"records"`
+}
+
+func NewSignInsRoutes(history *signinhistory.HistoryStore) *SignInsRoutes {
+	return &SignInsRoutes{History: history}
+}
+
+// List the recent sign ins to a user's account, successful
+// or not, newest first
+func (signInsRoutes *SignInsRoutes) UserSignInsRoute(c *gin.Context) {
+	userId := c.Param("id")
+
+	req := SignInHistoryReq{Records: 50}
+
+	err := c.ShouldBindQuery(&req)
+
+	if err != nil || req.Offset < 0 || req.Records < 1 {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	list, err := signInsRoutes.History.List(c, userId, req.Offset, req.Records)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", list)
+}
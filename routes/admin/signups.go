@@ -0,0 +1,249 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	"github.com/antonybholmes/go-edbserver-gin/identities"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	"github.com/antonybholmes/go-edbserver-gin/passwordpolicy"
+	"github.com/antonybholmes/go-edbserver-gin/signuppolicy"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth"
+	"github.com/antonybholmes/go-web/auth/token/tokengen"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type SignupsRoutes struct {
+	Policy *signuppolicy.Policy
+}
+
+type InviteReq struct {
+	Email string `json:"email"`
+}
+
+func NewSignupsRoutes(policy *signuppolicy.Policy) *SignupsRoutes {
+	return &SignupsRoutes{Policy: policy}
+}
+
+func signupErrorResp(c *gin.Context, err error) {
+	if errors.Is(err, signuppolicy.ErrSignupNotFound) {
+		web.BadReqResp(c, err)
+	} else {
+		c.Error(err)
+	}
+}
+
+func sendSignupEmail(c *gin.Context, email *mailserver.MailItem) {
+	err := outbox.SendMail(c, email)
+
+	if err != nil {
+		log.Warn().Msgf("could not send %s email: %v", email.EmailType, err)
+	}
+}
+
+// List the signups waiting for approval
+func (signupsRoutes *SignupsRoutes) SignupsRoute(c *gin.Context) {
+	list, err := signupsRoutes.Policy.Queue.List(c)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", list)
+}
+
+// Create the account of a pending signup and let the user know
+func (signupsRoutes *SignupsRoutes) ApproveSignupRoute(c *gin.Context) {
+	signup, err := signupsRoutes.Policy.Queue.Get(c, c.Param("id"))
+
+	if err != nil {
+		signupErrorResp(c, err)
+		return
+	}
+
+	address, err := mail.ParseAddress(signup.Email)
+
+	if err != nil {
+		web.BadReqResp(c, err)
+		return
+	}
+
+	var authUser *auth.AuthUser
+
+	email := mailserver.MailItem{
+		Name:      signup.Name,
+		To:        signup.Email,
+		EmailType: emails.EmailQueueTypeSignupApproved,
+		LinkUrl:   consts.AppUrl}
+
+	if signup.AuthProvider == identities.ProviderPassword {
+		// the user still has to prove they own the address. The
+		// password they chose, if any, is set once the account exists
+		authUser, err = userdbcache.CreateUser(address,
+			signup.Username,
+			"",
+			signup.Name,
+			signup.PictureUrl,
+			false,
+			identities.ProviderPassword,
+			false)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		// the password they chose when they signed up
+		if signup.PasswordHash != "" {
+			err = signupsRoutes.Policy.SetPasswordHash(c, authUser.Id, signup.PasswordHash)
+
+			if err != nil {
+				c.Error(err)
+				return
+			}
+
+			err = passwordpolicy.RememberHash(c, authUser.Id, signup.PasswordHash)
+
+			if err != nil {
+				log.Warn().Msgf("could not record password history for %s: %v", authUser.Id, err)
+			}
+		}
+
+		token, err := tokengen.MakeVerifyEmailToken(c, authUser, jwt.ClaimStrings{"verify-email"}, consts.AppUrl)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		email.Payload = &mailserver.Payload{DataType: "jwt", Data: token}
+		email.TTL = fmt.Sprintf("%d minutes", int(consts.ShortTtlMins.Minutes()))
+		email.LinkUrl = consts.UrlVerifyEmail
+	} else {
+		// the identity provider has already verified the address
+		authUser, err = userdbcache.CreateUserFromOAuth2(address,
+			signup.Name,
+			signup.PictureUrl,
+			signup.AuthProvider)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+	}
+
+	err = signupsRoutes.Policy.Queue.Remove(c, signup.Id)
+
+	if err != nil {
+		log.Warn().Msgf("could not remove approved signup %s: %v", signup.Id, err)
+	}
+
+	sendSignupEmail(c, &email)
+
+	log.Info().Msgf("signup %s approved as user %s", signup.Id, authUser.Id)
+
+	web.MakeOkResp(c, "signup approved")
+}
+
+// Reject a pending signup and let the user know
+func (signupsRoutes *SignupsRoutes) RejectSignupRoute(c *gin.Context) {
+	signup, err := signupsRoutes.Policy.Queue.Get(c, c.Param("id"))
+
+	if err != nil {
+		signupErrorResp(c, err)
+		return
+	}
+
+	err = signupsRoutes.Policy.Queue.Remove(c, signup.Id)
+
+	if err != nil {
+		signupErrorResp(c, err)
+		return
+	}
+
+	sendSignupEmail(c, &mailserver.MailItem{
+		Name:      signup.Name,
+		To:        signup.Email,
+		EmailType: emails.EmailQueueTypeSignupRejected})
+
+	web.MakeOkResp(c, "signup rejected")
+}
+
+// List the invites that have not been used
+func (signupsRoutes *SignupsRoutes) InvitesRoute(c *gin.Context) {
+	list, err := signupsRoutes.Policy.Invites.List(c)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", list)
+}
+
+// Invite an email address to sign up
+func (signupsRoutes *SignupsRoutes) CreateInviteRoute(c *gin.Context) {
+	var req InviteReq
+
+	err := c.ShouldBindJSON(&req)
+
+	if err != nil {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	address, err := mail.ParseAddress(req.Email)
+
+	if err != nil {
+		web.BadReqResp(c, err)
+		return
+	}
+
+	ttl := time.Duration(signupsRoutes.Policy.Config().InviteTtlHours) * time.Hour
+
+	invite, err := signupsRoutes.Policy.Invites.Create(c, address.Address, ttl)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	email := mailserver.MailItem{
+		Name:      address.Address,
+		To:        address.Address,
+		Payload:   &mailserver.Payload{DataType: "token", Data: invite.Token},
+		EmailType: emails.EmailQueueTypeSignupInvite,
+		TTL:       fmt.Sprintf("%d hours", signupsRoutes.Policy.Config().InviteTtlHours),
+		LinkUrl:   consts.UrlSignup}
+
+	err = outbox.SendMail(c, &email)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", invite)
+}
+
+// Withdraw an invite
+func (signupsRoutes *SignupsRoutes) RevokeInviteRoute(c *gin.Context) {
+	err := signupsRoutes.Policy.Invites.Revoke(c, c.Param("token"))
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeOkResp(c, "invite revoked")
+}
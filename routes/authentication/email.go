@@ -1,13 +1,18 @@
 package authentication
 
 import (
+	"errors"
 	"fmt"
 
 	"net/mail"
 
 	edbmail "github.com/antonybholmes/go-edbmailserver/mail"
 	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/emailchange"
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
 	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/antonybholmes/go-sys/log"
 	"github.com/antonybholmes/go-web"
 	"github.com/antonybholmes/go-web/auth"
 	"github.com/antonybholmes/go-web/auth/token"
@@ -16,18 +21,53 @@ import (
 	"github.com/antonybholmes/go-web/middleware"
 	"github.com/golang-jwt/jwt/v5"
 
-	"github.com/antonybholmes/go-mailserver/mailqueue"
 	"github.com/gin-gonic/gin"
 )
 
-// Start passwordless login by sending an email
-func SendResetEmailEmailRoute(c *gin.Context) {
+var (
+	ErrEmailInUse = auth.NewAccountError("email address is already in use")
+)
+
+type EmailRoutes struct {
+	Changes *emailchange.EmailChangeStore
+}
+
+func NewEmailRoutes(changes *emailchange.EmailChangeStore) *EmailRoutes {
+	return &EmailRoutes{Changes: changes}
+}
+
+type CancelEmailChangeReq struct {
+	Token string `json:"token"`
+}
+
+// Start changing the user's email. The link to confirm goes to the new
+// address, to prove it works, and the old address is told about the
+// change and given a link to cancel it.
+func (emailRoutes *EmailRoutes) SendResetEmailEmailRoute(c *gin.Context) {
 	middleware.NewValidator(c).ParseSignInRequestBody().LoadAuthUserFromToken().Success(func(validator *middleware.Validator) {
 		authUser := validator.AuthUser
 		req := validator.UserBodyReq
 
 		newEmail, err := mail.ParseAddress(req.Email)
 
+		if err != nil {
+			web.BadReqResp(c, err)
+			return
+		}
+
+		existing, err := userdbcache.FindUserByUsername(newEmail.Address)
+
+		if err == nil && existing.Id != authUser.Id {
+			web.BadReqResp(c, ErrEmailInUse)
+			return
+		}
+
+		change, err := emailRoutes.Changes.Create(c,
+			authUser.Id,
+			authUser.Email,
+			newEmail.Address,
+			consts.ShortTtlMins)
+
 		if err != nil {
 			c.Error(err)
 			return
@@ -56,29 +96,52 @@ func SendResetEmailEmailRoute(c *gin.Context) {
 		// 	req.CallbackUrl,
 		// 	req.VisitUrl)
 
+		ttl := fmt.Sprintf("%d minutes", int(consts.ShortTtlMins.Minutes()))
+
 		email := mailserver.MailItem{
 			Name:      authUser.Name,
-			To:        authUser.Email,
+			To:        newEmail.Address,
 			Payload:   &mailserver.Payload{DataType: "jwt", Data: otpToken},
 			EmailType: edbmail.EmailQueueTypeEmailReset,
-			TTL:       fmt.Sprintf("%d minutes", int(consts.ShortTtlMins.Minutes())),
+			TTL:       ttl,
 			LinkUrl:   consts.UrlResetEmail,
 		}
-		mailqueue.SendMail(&email)
 
-		//if err != nil {
-		//	return web.ErrorReq(err)
-		//}
+		err = outbox.SendMail(c, &email)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
 
-		web.MakeOkResp(c, "check your email for a change email link")
+		email = mailserver.MailItem{
+			Name:      authUser.Name,
+			To:        authUser.Email,
+			Payload:   &mailserver.Payload{DataType: "token", Data: change.CancelToken},
+			EmailType: emails.EmailQueueTypeEmailChangeRequested,
+			TTL:       ttl,
+			LinkUrl:   consts.UrlCancelEmailChange,
+		}
+
+		err = outbox.SendMail(c, &email)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeOkResp(c, "check your new email address for a link to confirm the change")
 	})
 }
 
-func UpdateEmailRoute(c *gin.Context) {
+// Apply a pending change once the user follows the link
+// sent to the new address
+func (emailRoutes *EmailRoutes) UpdateEmailRoute(c *gin.Context) {
 	middleware.NewValidator(c).CheckEmailIsWellFormed().LoadAuthUserFromToken().Success(func(validator *middleware.Validator) {
 
 		if validator.Claims.Type != token.TokenTypeChangeEmail {
 			auth.WrongTokenTypeReq(c)
+			return
 		}
 
 		err := auth.CheckOTPValid(validator.AuthUser,
@@ -92,6 +155,21 @@ func UpdateEmailRoute(c *gin.Context) {
 		authUser := validator.AuthUser
 		id := authUser.Id
 
+		// the change must still be pending, i.e. not cancelled or
+		// expired, and for the address that was confirmed
+		change, err := emailRoutes.Changes.Confirm(c, id, validator.Address.Address)
+
+		if err != nil {
+			if errors.Is(err, emailchange.ErrNoPendingChange) ||
+				errors.Is(err, emailchange.ErrEmailMismatch) {
+				web.BadReqResp(c, err)
+			} else {
+				c.Error(err)
+			}
+
+			return
+		}
+
 		err = userdbcache.SetEmailAddress(authUser,
 			validator.Address,
 			false)
@@ -101,6 +179,14 @@ func UpdateEmailRoute(c *gin.Context) {
 			return
 		}
 
+		// only now is the change done with, so a failed update
+		// can be retried with the same link
+		err = emailRoutes.Changes.Complete(c, change)
+
+		if err != nil {
+			log.Warn().Msgf("could not remove pending email change of %s: %v", id, err)
+		}
+
 		authUser, err = userdbcache.FindUserById(id)
 
 		if err != nil {
@@ -110,12 +196,47 @@ func UpdateEmailRoute(c *gin.Context) {
 
 		//return SendEmailChangedEmail(c, authUser)
 
-		email := mailserver.MailItem{
-			Name:      authUser.Name,
-			To:        authUser.Email,
-			EmailType: edbmail.EmailQueueTypeEmailUpdated}
-		mailqueue.SendMail(&email)
+		// tell both addresses so the owner notices if it was not them
+		for _, to := range []string{authUser.Email, change.OldEmail} {
+			email := mailserver.MailItem{
+				Name:      authUser.Name,
+				To:        to,
+				EmailType: edbmail.EmailQueueTypeEmailUpdated}
+
+			err = outbox.SendMail(c, &email)
+
+			if err != nil {
+				log.Warn().Msgf("could not send email updated email: %v", err)
+			}
+		}
 
 		web.MakeOkResp(c, "email updated confirmation email sent")
 	})
 }
+
+// Cancel a pending change using the link sent to the old address.
+// The token is the proof so the user does not need to be signed in.
+func (emailRoutes *EmailRoutes) CancelEmailChangeRoute(c *gin.Context) {
+	var req CancelEmailChangeReq
+
+	err := c.ShouldBindJSON(&req)
+
+	if err != nil || req.Token == "" {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	_, err = emailRoutes.Changes.Cancel(c, req.Token)
+
+	if err != nil {
+		if errors.Is(err, emailchange.ErrNoPendingChange) {
+			web.BadReqResp(c, err)
+		} else {
+			c.Error(err)
+		}
+
+		return
+	}
+
+	web.MakeOkResp(c, "email change cancelled")
+}
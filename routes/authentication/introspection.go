@@ -0,0 +1,263 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/revocation"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Token introspection (RFC 7662) so other services can check a token is
+// still active, and revocation (RFC 7009) so tokens can be withdrawn
+// before they expire. Responses use the shapes from the RFCs rather
+// than our usual data wrapper so standard clients can read them.
+
+var (
+	ErrTokenRevoked     = errors.New("token has been revoked")
+	ErrNotTokenOwner    = errors.New("token was not issued to you")
+	ErrClientAuthNeeded = errors.New("client authentication required")
+	ErrMissingToken     = errors.New("token is required")
+	ErrNoTokenSubject   = errors.New("token has no subject")
+)
+
+type TokenRoutes struct {
+	Revocations *revocation.RevocationStore
+	Clients     *revocation.ClientRegistry
+	keyfunc     jwt.Keyfunc
+}
+
+type IntrospectionResp struct {
+	Active      bool     `json:"active"`
+	Subject     string   `json:"sub,omitempty"`
+	Audience    []string `json:"aud,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	// the permissions as a space separated list, as the RFC expects
+	Scope     string `json:"scope,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	Id        string `json:"jti,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+}
+
+func NewTokenRoutes(revocations *revocation.RevocationStore,
+	clients *revocation.ClientRegistry,
+	keyfunc jwt.Keyfunc) *TokenRoutes {
+	return &TokenRoutes{Revocations: revocations, Clients: clients, keyfunc: keyfunc}
+}
+
+func bearerToken(c *gin.Context) string {
+	tokenString, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+	return strings.TrimSpace(tokenString)
+}
+
+// NotRevokedMiddleware rejects revoked tokens before handing over to
+// the middleware that validates them
+func NotRevokedMiddleware(revocations *revocation.RevocationStore, next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := bearerToken(c)
+
+		if tokenString != "" {
+			revoked, err := revocations.IsRevoked(c, tokenString)
+
+			if err != nil {
+				c.Error(err)
+				c.Abort()
+				return
+			}
+
+			if revoked {
+				web.UnauthorizedResp(c, ErrTokenRevoked)
+				c.Abort()
+				return
+			}
+		}
+
+		next(c)
+	}
+}
+
+// parse verifies a token we issued and that it has not been revoked
+func (tokenRoutes *TokenRoutes) parse(c *gin.Context, tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+
+	_, err := jwt.ParseWithClaims(tokenString,
+		claims,
+		tokenRoutes.keyfunc,
+		jwt.WithValidMethods([]string{"ES256"}),
+		jwt.WithExpirationRequired())
+
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := tokenRoutes.Revocations.IsRevoked(c, tokenString)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	return claims, nil
+}
+
+// authenticateClient checks the http basic credentials of the
+// calling service
+func (tokenRoutes *TokenRoutes) authenticateClient(c *gin.Context) bool {
+	id, secret, ok := c.Request.BasicAuth()
+
+	if ok && tokenRoutes.Clients.Authenticate(id, secret) == nil {
+		return true
+	}
+
+	c.Header("WWW-Authenticate", `Basic realm="tokens"`)
+	web.UnauthorizedResp(c, revocation.ErrInvalidClient)
+
+	return false
+}
+
+func numericDate(claims jwt.MapClaims, name string) int64 {
+	if v, ok := claims[name].(float64); ok {
+		return int64(v)
+	}
+
+	return 0
+}
+
+func permissionsClaim(claims jwt.MapClaims) []string {
+	var ret []string
+
+	if values, ok := claims["permissions"].([]any); ok {
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+	}
+
+	return ret
+}
+
+// Tell a service whether a token is active and what it grants
+func (tokenRoutes *TokenRoutes) IntrospectRoute(c *gin.Context) {
+	if !tokenRoutes.authenticateClient(c) {
+		return
+	}
+
+	tokenString := c.PostForm("token")
+
+	if tokenString == "" {
+		web.BadReqResp(c, ErrMissingToken)
+		return
+	}
+
+	claims, err := tokenRoutes.parse(c, tokenString)
+
+	if err != nil {
+		// the RFC does not say why a token is inactive
+		log.Debug().Msgf("introspected token is not active: %v", err)
+		c.JSON(http.StatusOK, IntrospectionResp{Active: false})
+		return
+	}
+
+	resp := IntrospectionResp{Active: true,
+		Permissions: permissionsClaim(claims),
+		ExpiresAt:   numericDate(claims, "exp"),
+		IssuedAt:    numericDate(claims, "iat"),
+		NotBefore:   numericDate(claims, "nbf")}
+
+	resp.Subject, _ = claims.GetSubject()
+	resp.Audience, _ = claims.GetAudience()
+	resp.Issuer, _ = claims.GetIssuer()
+	resp.Id, _ = claims["jti"].(string)
+	resp.TokenType, _ = claims["type"].(string)
+	resp.Scope = strings.Join(resp.Permissions, " ")
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// Revoke a token. Services authenticate as a client and can revoke any
+// token, users send their own token as a bearer and can only revoke
+// tokens issued to them.
+func (tokenRoutes *TokenRoutes) RevokeRoute(c *gin.Context) {
+	var callerId string
+
+	if _, _, ok := c.Request.BasicAuth(); ok {
+		if !tokenRoutes.authenticateClient(c) {
+			return
+		}
+	} else {
+		callerToken := bearerToken(c)
+
+		if callerToken == "" {
+			web.UnauthorizedResp(c, ErrClientAuthNeeded)
+			return
+		}
+
+		callerClaims, err := tokenRoutes.parse(c, callerToken)
+
+		if err != nil {
+			web.UnauthorizedResp(c, err)
+			return
+		}
+
+		callerId, _ = callerClaims.GetSubject()
+
+		if callerId == "" {
+			web.UnauthorizedResp(c, ErrNoTokenSubject)
+			return
+		}
+	}
+
+	tokenString := c.PostForm("token")
+
+	if tokenString == "" {
+		web.BadReqResp(c, ErrMissingToken)
+		return
+	}
+
+	claims, err := tokenRoutes.parse(c, tokenString)
+
+	// invalid, expired and already revoked tokens need no revoking,
+	// which the RFC treats as success
+	if err != nil {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if callerId != "" {
+		if sub, _ := claims.GetSubject(); sub != callerId {
+			web.ForbiddenResp(c, ErrNotTokenOwner)
+			return
+		}
+	}
+
+	exp, err := claims.GetExpirationTime()
+
+	if err != nil || exp == nil {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	err = tokenRoutes.Revocations.Revoke(c, tokenString, exp.Time)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	log.Info().Msgf("token for %v revoked, it would have expired %s", claims["sub"], exp.Time.Format(time.RFC3339))
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,33 @@
+package authentication
+
+import (
+	"slices"
+
+	"github.com/antonybholmes/go-edbserver-gin/memberships"
+	"github.com/antonybholmes/go-web/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// EnforceMemberships takes the user out of groups whose membership
+// has ended before a token is made for them. If this fails the
+// response has been written and false is returned.
+func EnforceMemberships(c *gin.Context, authUser *auth.AuthUser) (*auth.AuthUser, bool) {
+	authUser, err := memberships.Enforce(c, authUser)
+
+	if err != nil {
+		c.Error(err)
+		return nil, false
+	}
+
+	return authUser, true
+}
+
+// currentPermissions keeps the permissions of a token the user
+// still has, e.g. after a membership has ended
+func currentPermissions(authUser *auth.AuthUser, permissions []string) []string {
+	roles := auth.GetRolesFromUser(authUser)
+
+	return slices.DeleteFunc(slices.Clone(permissions), func(permission string) bool {
+		return !slices.Contains(roles, permission)
+	})
+}
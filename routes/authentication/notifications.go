@@ -0,0 +1,78 @@
+package authentication
+
+import (
+	"errors"
+
+	"github.com/antonybholmes/go-edbserver-gin/notifications"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/gin-gonic/gin"
+)
+
+// Unsubscribe links in emails work without signing in. The token in
+// the link says who it is for and which kind of email to stop.
+
+type UnsubscribeRoutes struct {
+	Preferences *notifications.Preferences
+}
+
+type UnsubscribeResp struct {
+	Category *notifications.Category `json:"category"`
+}
+
+func NewUnsubscribeRoutes(prefs *notifications.Preferences) *UnsubscribeRoutes {
+	return &UnsubscribeRoutes{Preferences: prefs}
+}
+
+func unsubscribeToken(c *gin.Context) string {
+	if token := c.Query("token"); token != "" {
+		return token
+	}
+
+	return c.PostForm("token")
+}
+
+func unsubscribeErrorResp(c *gin.Context, err error) {
+	if errors.Is(err, notifications.ErrInvalidToken) {
+		web.BadReqResp(c, err)
+	} else {
+		c.Error(err)
+	}
+}
+
+// Which kind of email a link stops, so it can be shown before the
+// user confirms. This does not unsubscribe since mail scanners
+// follow links.
+func (unsubscribeRoutes *UnsubscribeRoutes) UnsubscribeInfoRoute(c *gin.Context) {
+	claims, err := unsubscribeRoutes.Preferences.ParseUnsubscribeToken(unsubscribeToken(c))
+
+	if err != nil {
+		unsubscribeErrorResp(c, err)
+		return
+	}
+
+	category, err := notifications.FindCategory(claims.Category)
+
+	if err != nil {
+		unsubscribeErrorResp(c, err)
+		return
+	}
+
+	web.MakeDataResp(c, "", &UnsubscribeResp{Category: category})
+}
+
+// Stop a kind of email in one click, from the page or from the
+// List-Unsubscribe header of the email, which mail clients post to with
+// the token in the url
+func (unsubscribeRoutes *UnsubscribeRoutes) UnsubscribeRoute(c *gin.Context) {
+	claims, err := unsubscribeRoutes.Preferences.Unsubscribe(c, unsubscribeToken(c))
+
+	if err != nil {
+		unsubscribeErrorResp(c, err)
+		return
+	}
+
+	log.Info().Msgf("user %s unsubscribed from %s emails", claims.Subject, claims.Category)
+
+	web.MakeOkResp(c, "you will no longer get these emails")
+}
@@ -5,8 +5,8 @@ import (
 	"math"
 
 	edbmail "github.com/antonybholmes/go-edbmailserver/mail"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
 	mailserver "github.com/antonybholmes/go-mailserver"
-	"github.com/antonybholmes/go-mailserver/mailqueue"
 	"github.com/antonybholmes/go-web"
 	"github.com/antonybholmes/go-web/auth"
 	"github.com/antonybholmes/go-web/middleware"
@@ -59,7 +59,7 @@ func (otpr *OTPRoutes) Email6DigitOTPRoute(c *gin.Context) {
 		TTL:       fmt.Sprintf("%d minutes", mins),
 		EmailType: edbmail.EmailQueueTypeOTP,
 	}
-	err = mailqueue.SendMail(&email)
+	err = outbox.SendMail(c, &email)
 
 	if err != nil {
 		log.Debug().Msgf("error sending email %v", err)
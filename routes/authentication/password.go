@@ -5,8 +5,8 @@ import (
 
 	edbmail "github.com/antonybholmes/go-edbmailserver/mail"
 	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
 	mailserver "github.com/antonybholmes/go-mailserver"
-	"github.com/antonybholmes/go-mailserver/mailqueue"
 	"github.com/antonybholmes/go-web"
 	"github.com/antonybholmes/go-web/auth"
 	"github.com/antonybholmes/go-web/auth/token"
@@ -56,11 +56,12 @@ func SendResetPasswordFromUsernameEmailRoute(c *gin.Context) {
 			EmailType: edbmail.EmailQueueTypePasswordReset,
 			TTL:       fmt.Sprintf("%d minutes", int(consts.ShortTtlMins.Minutes())),
 			LinkUrl:   consts.UrlResetPassword}
-		mailqueue.SendMail(&email)
+		err = outbox.SendMail(c, &email)
 
-		//if err != nil {
-		//	return web.ErrorReq(err)
-		//}
+		if err != nil {
+			c.Error(err)
+			return
+		}
 
 		web.MakeOkResp(c, "check your email for a password reset link")
 	})
@@ -83,6 +84,14 @@ func UpdatePasswordRoute(c *gin.Context) {
 			return
 		}
 
+		if !CheckNewPassword(c,
+			authUser.Id,
+			validator.UserBodyReq.Password,
+			authUser.Name,
+			authUser.Email) {
+			return
+		}
+
 		_, err = userdbcache.SetPassword(authUser, validator.UserBodyReq.Password, false)
 
 		if err != nil {
@@ -90,13 +99,20 @@ func UpdatePasswordRoute(c *gin.Context) {
 			return
 		}
 
+		RememberPassword(c, authUser.Id, validator.UserBodyReq.Password)
+
 		//return SendPasswordEmail(c, validator.AuthUser, validator.Req.Password)
 
 		email := mailserver.MailItem{
 			Name:      authUser.Name,
 			To:        authUser.Email,
 			EmailType: edbmail.EmailQueueTypePasswordUpdated}
-		mailqueue.SendMail(&email)
+		err = outbox.SendMail(c, &email)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
 
 		web.MakeOkResp(c, "password updated confirmation email sent")
 	})
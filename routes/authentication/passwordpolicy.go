@@ -0,0 +1,49 @@
+package authentication
+
+import (
+	"errors"
+
+	"github.com/antonybholmes/go-edbserver-gin/passwordpolicy"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/gin-gonic/gin"
+)
+
+// CheckNewPassword applies the password policy to a password a user is
+// about to set. If it returns false a response has already been written.
+func CheckNewPassword(c *gin.Context, userId string, password string, userInfo ...string) bool {
+	err := passwordpolicy.Check(c, userId, password, userInfo...)
+
+	// the bundled list has been checked so an outage of the range api
+	// should not stop users setting passwords
+	if errors.Is(err, passwordpolicy.ErrRangeUnavailable) {
+		log.Warn().Msgf("could not check password against breaches: %v", err)
+		return true
+	}
+
+	if err != nil {
+		var policyErr *passwordpolicy.PolicyError
+
+		if errors.As(err, &policyErr) ||
+			errors.Is(err, passwordpolicy.ErrBreachedPassword) ||
+			errors.Is(err, passwordpolicy.ErrPasswordReused) {
+			web.BadReqResp(c, err)
+		} else {
+			c.Error(err)
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// RememberPassword adds a password that has just been set to the user's
+// history. It is best effort since the password has already changed.
+func RememberPassword(c *gin.Context, userId string, password string) {
+	err := passwordpolicy.Remember(c, userId, password)
+
+	if err != nil {
+		log.Warn().Msgf("could not record password history for %s: %v", userId, err)
+	}
+}
@@ -1,13 +1,35 @@
 package authentication
 
 import (
+	"github.com/antonybholmes/go-edbserver-gin/emailchange"
+	"github.com/antonybholmes/go-edbserver-gin/keyring"
+	"github.com/antonybholmes/go-edbserver-gin/notifications"
+	"github.com/antonybholmes/go-edbserver-gin/revocation"
+	"github.com/antonybholmes/go-edbserver-gin/signinguard"
+	"github.com/antonybholmes/go-edbserver-gin/signinhistory"
+	"github.com/antonybholmes/go-edbserver-gin/signuppolicy"
 	"github.com/antonybholmes/go-web/middleware"
 	"github.com/gin-gonic/gin"
 )
 
-func RegisterRoutes(r *gin.Engine, jwtUserMiddleWare gin.HandlerFunc, updateTokenMiddleware gin.HandlerFunc) {
+func RegisterRoutes(r *gin.Engine,
+	signInGuard *signinguard.Guard,
+	signInHistory *signinhistory.HistoryStore,
+	emailChanges *emailchange.EmailChangeStore,
+	signupPolicy *signuppolicy.Policy,
+	botVerifier signuppolicy.BotVerifier,
+	keyRing *keyring.KeyRing,
+	revocations *revocation.RevocationStore,
+	tokenClients *revocation.ClientRegistry,
+	preferences *notifications.Preferences,
+	jwtUserMiddleWare gin.HandlerFunc,
+	updateTokenMiddleware gin.HandlerFunc) {
+	signupRoutes := NewSignupRoutes(signupPolicy, botVerifier)
+
 	// Allow users to sign up for an account
-	r.POST("/signup", SignupRoute)
+	r.POST("/signup",
+		signupRoutes.BotCheckMiddleware(),
+		signupRoutes.SignupRoute)
 
 	authGroup := r.Group("/auth")
 
@@ -16,7 +38,11 @@ func RegisterRoutes(r *gin.Engine, jwtUserMiddleWare gin.HandlerFunc, updateToke
 	// 	jwtAuth0UserMiddleware,
 	// 	auth0routes.ValidateAuth0TokenRoute)
 
-	authGroup.POST("/signin", UsernamePasswordSignInRoute)
+	signInRoutes := NewSignInRoutes(signInGuard, signInHistory)
+
+	authGroup.POST("/signin", signInRoutes.UsernamePasswordSignInRoute)
+
+	emailRoutes := NewEmailRoutes(emailChanges)
 
 	emailGroup := authGroup.Group("/email")
 
@@ -26,15 +52,20 @@ func RegisterRoutes(r *gin.Engine, jwtUserMiddleWare gin.HandlerFunc, updateToke
 		EmailAddressVerifiedRoute,
 	)
 
-	// with the correct token, performs the update
+	// sends a confirm link to the new address and a cancel
+	// link to the old one
 	emailGroup.POST("/reset",
 		jwtUserMiddleWare,
-		SendResetEmailEmailRoute)
+		emailRoutes.SendResetEmailEmailRoute)
 
 	// with the correct token, performs the update
 	emailGroup.POST("/update",
 		jwtUserMiddleWare,
-		UpdateEmailRoute)
+		emailRoutes.UpdateEmailRoute)
+
+	// with the token sent to the old address, stops the update
+	emailGroup.POST("/cancel",
+		emailRoutes.CancelEmailChangeRoute)
 
 	passwordGroup := authGroup.Group("/passwords")
 
@@ -55,12 +86,26 @@ func RegisterRoutes(r *gin.Engine, jwtUserMiddleWare gin.HandlerFunc, updateToke
 
 	passwordlessGroup.POST("/signin",
 		jwtUserMiddleWare,
-		PasswordlessSignInRoute,
+		signInRoutes.PasswordlessSignInRoute,
 	)
 
-	tokenGroup := authGroup.Group("/tokens", jwtUserMiddleWare)
-	tokenGroup.POST("/info", TokenInfoRoute)
-	tokenGroup.POST("/access", NewAccessTokenRoute)
+	tokenGroup := authGroup.Group("/tokens")
+	tokenGroup.POST("/info", jwtUserMiddleWare, TokenInfoRoute)
+	tokenGroup.POST("/access", jwtUserMiddleWare, NewAccessTokenRoute)
+
+	// standard introspection and revocation, which authenticate
+	// the caller themselves
+	tokenRoutes := NewTokenRoutes(revocations, tokenClients, keyRing.Keyfunc)
+
+	tokenGroup.POST("/introspect", tokenRoutes.IntrospectRoute)
+	tokenGroup.POST("/revoke", tokenRoutes.RevokeRoute)
+
+	// unsubscribe links in emails
+	unsubscribeRoutes := NewUnsubscribeRoutes(preferences)
+
+	notificationsGroup := authGroup.Group("/notifications")
+	notificationsGroup.GET("/unsubscribe", unsubscribeRoutes.UnsubscribeInfoRoute)
+	notificationsGroup.POST("/unsubscribe", unsubscribeRoutes.UnsubscribeRoute)
 
 	usersGroup := authGroup.Group("/users",
 		jwtUserMiddleWare)
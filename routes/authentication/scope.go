@@ -0,0 +1,65 @@
+package authentication
+
+import (
+	"errors"
+
+	"github.com/antonybholmes/go-edbserver-gin/tokenscope"
+	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth/token"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrScopeNotForTokenType = errors.New("permissions can only be requested for access tokens")
+)
+
+// ScopedTokenReq asks for a token with only some of the caller's
+// permissions. Leaving permissions out keeps all of them.
+type ScopedTokenReq struct {
+	token.TokenRequest
+	Permissions []string `json:"permissions"`
+}
+
+// CheckScope makes sure the permissions requested are ones the caller
+// has. It returns false, having written a response, if they are not.
+func CheckScope(c *gin.Context, req *ScopedTokenReq, granted []string) bool {
+	err := tokenscope.CheckSubset(req.Permissions, granted)
+
+	if err != nil {
+		web.ForbiddenResp(c, err)
+		return false
+	}
+
+	return true
+}
+
+// AudienceMiddleware refuses tokens whose audience restricts them to
+// other routes, before handing over to the middleware that checks the
+// token and its permissions. The token is not verified here since a
+// forged one is refused by next anyway.
+func AudienceMiddleware(next gin.HandlerFunc) gin.HandlerFunc {
+	parser := jwt.NewParser()
+
+	return func(c *gin.Context) {
+		tokenString := bearerToken(c)
+
+		if tokenString != "" {
+			claims := jwt.MapClaims{}
+
+			_, _, err := parser.ParseUnverified(tokenString, claims)
+
+			if err == nil {
+				audience, _ := claims.GetAudience()
+
+				if !tokenscope.AllowsPath(audience, c.Request.URL.Path) {
+					web.ForbiddenResp(c, tokenscope.ErrAudienceNotAllowed)
+					c.Abort()
+					return
+				}
+			}
+		}
+
+		next(c)
+	}
+}
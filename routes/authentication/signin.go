@@ -6,13 +6,13 @@ import (
 
 	edbmail "github.com/antonybholmes/go-edbmailserver/mail"
 	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	"github.com/antonybholmes/go-edbserver-gin/signinhistory"
 	mailserver "github.com/antonybholmes/go-mailserver"
-	"github.com/antonybholmes/go-mailserver/mailqueue"
 	"github.com/antonybholmes/go-web"
 	"github.com/antonybholmes/go-web/auth"
 	"github.com/antonybholmes/go-web/auth/token"
 	"github.com/antonybholmes/go-web/auth/token/tokengen"
-	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
 	"github.com/antonybholmes/go-web/middleware"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
@@ -26,7 +26,7 @@ func PasswordlessEmailSentResp(c *gin.Context) {
 	web.MakeOkResp(c, "passwordless email sent")
 }
 
-func UsernamePasswordSignInRoute(c *gin.Context) {
+func (signInRoutes *SignInRoutes) UsernamePasswordSignInRoute(c *gin.Context) {
 	middleware.NewValidator(c).ParseSignInRequestBody().Success(func(validator *middleware.Validator) {
 
 		if validator.UserBodyReq.Password == "" {
@@ -34,18 +34,6 @@ func UsernamePasswordSignInRoute(c *gin.Context) {
 			return
 		}
 
-		authUser, err := userdbcache.FindUserByUsername(validator.UserBodyReq.Username)
-
-		if err != nil {
-			web.UserDoesNotExistResp(c)
-			return
-		}
-
-		if authUser.EmailVerifiedAt == nil {
-			web.EmailNotVerifiedReq(c)
-			return
-		}
-
 		// roles, err := userdbcache.UserRoleSet(authUser)
 
 		// if err != nil {
@@ -55,15 +43,17 @@ func UsernamePasswordSignInRoute(c *gin.Context) {
 
 		//roleClaim := auth.MakeClaim(roles)
 
-		if !auth.UserHasWebLoginInRole(authUser) {
-			web.UserNotAllowedToSignInErrorResp(c)
+		authUser, ok := signInRoutes.CheckPasswordSignIn(c,
+			validator.UserBodyReq.Username,
+			validator.UserBodyReq.Password)
+
+		if !ok {
 			return
 		}
 
-		err = authUser.CheckPasswordsMatch(validator.UserBodyReq.Password)
+		authUser, ok = EnforceMemberships(c, authUser)
 
-		if err != nil {
-			c.Error(err)
+		if !ok {
 			return
 		}
 
@@ -81,6 +71,8 @@ func UsernamePasswordSignInRoute(c *gin.Context) {
 			return
 		}
 
+		signInRoutes.RecordSignIn(c, authUser, signinhistory.MethodPassword, "")
+
 		web.MakeDataResp(c, "", &web.SignInResp{
 			RefreshToken: refreshToken,
 			AccessToken:  accessToken})
@@ -134,17 +126,18 @@ func PasswordlessSignInEmailRoute(c *gin.Context, validator *middleware.Validato
 			//VisitUrl:    validator.Req.VisitUrl
 		}
 
-		mailqueue.SendMail(&email)
+		err = outbox.SendMail(c, &email)
 
-		//if err != nil {
-		//	return web.ErrorReq(err)
-		//}
+		if err != nil {
+			c.Error(err)
+			return
+		}
 
 		web.MakeOkResp(c, "check your email for a magic link to login")
 	})
 }
 
-func PasswordlessSignInRoute(c *gin.Context) {
+func (signInRoutes *SignInRoutes) PasswordlessSignInRoute(c *gin.Context) {
 	middleware.NewValidator(c).LoadAuthUserFromToken().CheckUserHasVerifiedEmailAddress().Success(func(validator *middleware.Validator) {
 
 		if validator.Claims.Type != token.TokenTypePasswordless {
@@ -152,7 +145,11 @@ func PasswordlessSignInRoute(c *gin.Context) {
 			return
 		}
 
-		authUser := validator.AuthUser
+		authUser, ok := EnforceMemberships(c, validator.AuthUser)
+
+		if !ok {
+			return
+		}
 
 		// roles, err := userdbcache.UserRoleSet(authUser)
 
@@ -164,6 +161,7 @@ func PasswordlessSignInRoute(c *gin.Context) {
 		//roleClaim := auth.MakeClaim(roles)
 
 		if !auth.UserHasWebLoginInRole(authUser) {
+			signInRoutes.RecordFailedSignIn(c, authUser, signinhistory.MethodPasswordless, "", ErrNotAllowedToSignIn)
 			web.UserNotAllowedToSignInErrorResp(c)
 			return
 		}
@@ -175,6 +173,8 @@ func PasswordlessSignInRoute(c *gin.Context) {
 			return
 		}
 
+		signInRoutes.RecordSignIn(c, authUser, signinhistory.MethodPasswordless, "")
+
 		web.MakeDataResp(c, "", &web.RefreshTokenResp{RefreshToken: t})
 	})
 }
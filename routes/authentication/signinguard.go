@@ -0,0 +1,161 @@
+package authentication
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	"github.com/antonybholmes/go-edbserver-gin/signinguard"
+	"github.com/antonybholmes/go-edbserver-gin/signinhistory"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+	"github.com/gin-gonic/gin"
+)
+
+type SignInRoutes struct {
+	Guard   *signinguard.Guard
+	History *signinhistory.HistoryStore
+}
+
+func NewSignInRoutes(guard *signinguard.Guard, history *signinhistory.HistoryStore) *SignInRoutes {
+	return &SignInRoutes{Guard: guard, History: history}
+}
+
+func signInLimitResp(c *gin.Context, limitErr *signinguard.LimitError) {
+	c.Header("Retry-After", strconv.Itoa(int(limitErr.RetryAfter.Seconds())+1))
+	web.TooManyRequestsResp(c, limitErr)
+}
+
+// CheckPasswordSignIn finds the user and checks their password, guarding
+// against brute force attempts. Unknown users and wrong passwords get the
+// same response so that usernames cannot be enumerated. If it returns
+// false a response has already been written.
+func (signInRoutes *SignInRoutes) CheckPasswordSignIn(c *gin.Context, username string, password string) (*auth.AuthUser, bool) {
+	ipAddr := c.ClientIP()
+
+	authUser, err := userdbcache.FindUserByUsername(username)
+
+	// however the user is named they have one count of failures
+	account := signinguard.UnknownAccount(username)
+
+	if err == nil {
+		account = signinguard.UserAccount(authUser.Id)
+	}
+
+	if !signInRoutes.checkGuard(c, account, ipAddr) {
+		return nil, false
+	}
+
+	if err == nil {
+		err = authUser.CheckPasswordsMatch(password)
+	} else {
+		signinguard.DummyPasswordCheck(password)
+	}
+
+	if err != nil {
+		signInRoutes.passwordFailed(c, account, authUser, ipAddr)
+		return nil, false
+	}
+
+	signInRoutes.Guard.Success(c, account)
+
+	// only reveal account state once the password has been proven
+	if authUser.EmailVerifiedAt == nil {
+		signInRoutes.RecordFailedSignIn(c, authUser, signinhistory.MethodPassword, "", ErrEmailNotVerified)
+		web.EmailNotVerifiedReq(c)
+		return nil, false
+	}
+
+	if !auth.UserHasWebLoginInRole(authUser) {
+		signInRoutes.RecordFailedSignIn(c, authUser, signinhistory.MethodPassword, "", ErrNotAllowedToSignIn)
+		web.UserNotAllowedToSignInErrorResp(c)
+		return nil, false
+	}
+
+	return authUser, true
+}
+
+// CheckPassword checks the password of a user who is already signed in,
+// e.g. before deleting their account, with the same protection against
+// brute force attempts as signing in. If it returns false a response has
+// already been written.
+func (signInRoutes *SignInRoutes) CheckPassword(c *gin.Context, authUser *auth.AuthUser, password string) bool {
+	ipAddr := c.ClientIP()
+
+	account := signinguard.UserAccount(authUser.Id)
+
+	if !signInRoutes.checkGuard(c, account, ipAddr) {
+		return false
+	}
+
+	err := authUser.CheckPasswordsMatch(password)
+
+	if err != nil {
+		signInRoutes.passwordFailed(c, account, authUser, ipAddr)
+		return false
+	}
+
+	signInRoutes.Guard.Success(c, account)
+
+	return true
+}
+
+// checkGuard responds and returns false if the account or ip address
+// is blocked
+func (signInRoutes *SignInRoutes) checkGuard(c *gin.Context, account string, ipAddr string) bool {
+	err := signInRoutes.Guard.Check(c, account, ipAddr)
+
+	if err != nil {
+		if limitErr, ok := signinguard.IsLimitError(err); ok {
+			signInLimitResp(c, limitErr)
+		} else {
+			web.InternalErrorResp(c, err)
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// passwordFailed counts a wrong password against the account and ip
+// address and responds with the same error whether or not the user
+// exists
+func (signInRoutes *SignInRoutes) passwordFailed(c *gin.Context, account string, authUser *auth.AuthUser, ipAddr string) {
+	locked, err := signInRoutes.Guard.Failure(c, account, ipAddr)
+
+	if err != nil {
+		log.Warn().Msgf("could not record failed sign in: %v", err)
+	}
+
+	if authUser != nil {
+		signInRoutes.RecordFailedSignIn(c, authUser, signinhistory.MethodPassword, "", signinguard.ErrInvalidCredentials)
+
+		if locked {
+			signInRoutes.sendAccountLockedEmail(c, authUser, ipAddr)
+		}
+	}
+
+	web.UnauthorizedResp(c, signinguard.ErrInvalidCredentials)
+}
+
+// let the owner know someone is trying to guess their password
+func (signInRoutes *SignInRoutes) sendAccountLockedEmail(c *gin.Context, authUser *auth.AuthUser, ipAddr string) {
+	email := mailserver.MailItem{
+		Name:      authUser.Name,
+		To:        authUser.Email,
+		Payload:   &mailserver.Payload{DataType: "ip", Data: ipAddr},
+		EmailType: emails.EmailQueueTypeAccountLocked,
+		TTL:       fmt.Sprintf("%d minutes", int(signInRoutes.Guard.Lockout().Minutes())),
+	}
+
+	err := outbox.SendMail(c, &email)
+
+	if err != nil {
+		log.Warn().Msgf("could not send account locked email: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package authentication
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	"github.com/antonybholmes/go-edbserver-gin/signinhistory"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// reasons recorded for failed sign ins
+var (
+	ErrEmailNotVerified   = errors.New("email address not verified")
+	ErrNotAllowedToSignIn = errors.New("user not allowed to sign in")
+)
+
+func (signInRoutes *SignInRoutes) record(c *gin.Context, event *signinhistory.Event) {
+	err := signInRoutes.History.Record(c, event)
+
+	if err != nil {
+		log.Warn().Msgf("could not record sign in for %s: %v", event.UserId, err)
+	}
+}
+
+// RecordSignIn adds a successful sign in to the user's history and
+// emails them if it is from a device or ip address we have not seen.
+// It is best effort so never stops the user signing in.
+func (signInRoutes *SignInRoutes) RecordSignIn(c *gin.Context, authUser *auth.AuthUser, method string, provider string) {
+	event := signinhistory.NewEvent(authUser.Id, method, provider, c.ClientIP(), c.Request.UserAgent())
+	event.Success = true
+
+	signInRoutes.record(c, event)
+
+	if event.NewDevice {
+		sendNewSignInEmail(c, authUser, event)
+	}
+}
+
+// RecordFailedSignIn adds a failed sign in to the user's history
+func (signInRoutes *SignInRoutes) RecordFailedSignIn(c *gin.Context, authUser *auth.AuthUser, method string, provider string, reason error) {
+	event := signinhistory.NewEvent(authUser.Id, method, provider, c.ClientIP(), c.Request.UserAgent())
+	event.Reason = reason.Error()
+
+	signInRoutes.record(c, event)
+}
+
+func sendNewSignInEmail(c *gin.Context, authUser *auth.AuthUser, event *signinhistory.Event) {
+	email := mailserver.MailItem{
+		Name: authUser.Name,
+		To:   authUser.Email,
+		Payload: &mailserver.Payload{DataType: "device",
+			Data: fmt.Sprintf("%s from %s at %s", event.Device, event.IpAddr, event.Time.Format("2 Jan 2006 15:04 MST"))},
+		EmailType: emails.EmailQueueTypeNewSignIn,
+	}
+
+	err := outbox.SendMail(c, &email)
+
+	if err != nil {
+		log.Warn().Msgf("could not send new sign in email: %v", err)
+	}
+}
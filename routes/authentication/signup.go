@@ -1,13 +1,19 @@
 package authentication
 
 import (
+	"errors"
 	"fmt"
 
 	edbmail "github.com/antonybholmes/go-edbmailserver/mail"
 	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	"github.com/antonybholmes/go-edbserver-gin/identities"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	"github.com/antonybholmes/go-edbserver-gin/signuppolicy"
 	mailserver "github.com/antonybholmes/go-mailserver"
-	"github.com/antonybholmes/go-mailserver/mailqueue"
+	"github.com/antonybholmes/go-sys/log"
 	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth"
 	"github.com/antonybholmes/go-web/auth/token/tokengen"
 	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
 	"github.com/antonybholmes/go-web/middleware"
@@ -15,10 +21,169 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func SignupRoute(c *gin.Context) {
+// header carrying the token from the bot check, e.g. a CAPTCHA
+const BotCheckHeader = "X-Bot-Check-Token"
+
+var (
+	ErrAccountExists = auth.NewAccountError("an account with this email address or username already exists")
+)
+
+type SignupRoutes struct {
+	Policy      *signuppolicy.Policy
+	BotVerifier signuppolicy.BotVerifier
+}
+
+func NewSignupRoutes(policy *signuppolicy.Policy, botVerifier signuppolicy.BotVerifier) *SignupRoutes {
+	return &SignupRoutes{Policy: policy, BotVerifier: botVerifier}
+}
+
+// CheckBot verifies the bot check token of a request that would create
+// an account. If it returns false a response has already been written.
+func (signupRoutes *SignupRoutes) CheckBot(c *gin.Context) bool {
+	err := signupRoutes.BotVerifier.Verify(c, c.GetHeader(BotCheckHeader), c.ClientIP())
+
+	if err != nil {
+		web.ForbiddenResp(c, err)
+		return false
+	}
+
+	return true
+}
+
+// BotCheckMiddleware rejects requests without a valid bot check token
+func (signupRoutes *SignupRoutes) BotCheckMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !signupRoutes.CheckBot(c) {
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// CheckNewAccount applies the signup policy before an account is
+// created, whether by signing up or by signing in for the first time
+// with an identity provider. It returns true if the account can be
+// created now. Otherwise the signup was refused or queued for approval
+// and a response has already been written.
+func (signupRoutes *SignupRoutes) CheckNewAccount(c *gin.Context, signup *signuppolicy.PendingSignup) bool {
+	policy := signupRoutes.Policy
+
+	err := policy.CheckEmail(signup.Email)
+
+	if err != nil {
+		web.ForbiddenResp(c, err)
+		return false
+	}
+
+	switch policy.Mode() {
+	case signuppolicy.ModeClosed:
+		web.ForbiddenResp(c, signuppolicy.ErrSignupClosed)
+		return false
+	case signuppolicy.ModeInvite:
+		err = policy.Invites.Check(c, c.Query("invite"), signup.Email)
+
+		if err != nil {
+			if errors.Is(err, signuppolicy.ErrInvalidInvite) {
+				web.ForbiddenResp(c, signuppolicy.ErrInviteRequired)
+			} else {
+				c.Error(err)
+			}
+
+			return false
+		}
+	case signuppolicy.ModeApproval:
+		signup.IpAddr = c.ClientIP()
+
+		err = policy.Queue.Add(c, signup)
+
+		if err != nil {
+			if errors.Is(err, signuppolicy.ErrSignupPending) {
+				web.BadReqResp(c, err)
+			} else {
+				c.Error(err)
+			}
+
+			return false
+		}
+
+		email := mailserver.MailItem{
+			Name:      signup.Name,
+			To:        signup.Email,
+			EmailType: emails.EmailQueueTypeSignupPending}
+
+		err = outbox.SendMail(c, &email)
+
+		if err != nil {
+			log.Warn().Msgf("could not send signup pending email: %v", err)
+		}
+
+		web.MakeOkResp(c, "your signup is waiting for approval, we will email you once it has been reviewed")
+		return false
+	}
+
+	return true
+}
+
+// InviteUsed revokes the invite a new account was created with
+// so it cannot be used again
+func (signupRoutes *SignupRoutes) InviteUsed(c *gin.Context) {
+	token := c.Query("invite")
+
+	if token == "" || signupRoutes.Policy.Mode() != signuppolicy.ModeInvite {
+		return
+	}
+
+	err := signupRoutes.Policy.Invites.Revoke(c, token)
+
+	if err != nil {
+		log.Warn().Msgf("could not revoke used invite: %v", err)
+	}
+}
+
+func (signupRoutes *SignupRoutes) SignupRoute(c *gin.Context) {
 	middleware.NewValidator(c).CheckEmailIsWellFormed().Success(func(validator *middleware.Validator) {
 		req := validator.UserBodyReq
 
+		// check everything about the signup before it can be queued
+		// for approval, so that an admin only sees ones that can work
+		for _, username := range []string{validator.Address.Address, req.Username} {
+			if username == "" {
+				continue
+			}
+
+			if _, err := userdbcache.FindUserByUsername(username); err == nil {
+				web.BadReqResp(c, ErrAccountExists)
+				return
+			}
+		}
+
+		signup := signuppolicy.PendingSignup{
+			Email:        validator.Address.Address,
+			Username:     req.Username,
+			Name:         req.Name,
+			AuthProvider: identities.ProviderPassword}
+
+		// users can sign up without a password and sign in by email
+		if req.Password != "" {
+			if !CheckNewPassword(c,
+				"",
+				req.Password,
+				req.Username,
+				req.Name,
+				validator.Address.Address) {
+				return
+			}
+
+			// kept with the signup if it has to wait for approval
+			signup.PasswordHash = auth.HashPassword(req.Password)
+		}
+
+		if !signupRoutes.CheckNewAccount(c, &signup) {
+			return
+		}
+
 		authUser, err := userdbcache.CreateUserFromSignup(req)
 
 		if err != nil {
@@ -26,6 +191,10 @@ func SignupRoute(c *gin.Context) {
 			return
 		}
 
+		signupRoutes.InviteUsed(c)
+
+		RememberPassword(c, authUser.Id, req.Password)
+
 		token, err := tokengen.MakeVerifyEmailToken(c, authUser, jwt.ClaimStrings{"verify-email"}, req.RedirectUrl)
 
 		//log.Debug().Msgf("%s", otpJwt)
@@ -64,7 +233,12 @@ func SignupRoute(c *gin.Context) {
 			//VisitUrl:    req.VisitUrl
 		}
 
-		mailqueue.SendMail(&email)
+		err = outbox.SendMail(c, &email)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
 
 		web.MakeOkResp(c, "check your email for a verification link")
 	})
@@ -99,7 +273,11 @@ func EmailAddressVerifiedRoute(c *gin.Context) {
 			Name:      authUser.Name,
 			To:        authUser.Email,
 			EmailType: edbmail.EmailQueueTypeVerified}
-		mailqueue.SendMail(&email)
+		err = outbox.SendMail(c, &email)
+
+		if err != nil {
+			log.Warn().Msgf("could not send email verified email: %v", err)
+		}
 
 		web.MakeOkResp(c, "email address verified")
 	})
@@ -2,11 +2,12 @@ package authentication
 
 import (
 	"errors"
+	"io"
 
 	"github.com/antonybholmes/go-web"
 	"github.com/antonybholmes/go-web/auth"
-	"github.com/antonybholmes/go-web/auth/token"
 	"github.com/antonybholmes/go-web/auth/token/tokengen"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
 	"github.com/antonybholmes/go-web/middleware"
 	"github.com/gin-gonic/gin"
 )
@@ -65,20 +66,55 @@ func TokenInfoRoute(c *gin.Context) {
 
 }
 
+// Exchange a refresh token for an access token, optionally with
+// only some of the permissions of the refresh token
 func NewAccessTokenRoute(c *gin.Context) {
 	middleware.NewValidator(c).CheckIsValidRefreshToken().Success(func(validator *middleware.Validator) {
-		var req token.TokenRequest
+		var req ScopedTokenReq
 
 		err := c.ShouldBindJSON(&req)
 
+		// clients that post nothing get an unscoped token as they
+		// always have
+		if err != nil && !errors.Is(err, io.EOF) {
+			web.BadReqResp(c, web.ErrInvalidBody)
+			return
+		}
+
+		authUser, err := userdbcache.FindUserById(validator.Claims.Subject)
+
+		if err != nil {
+			web.UnauthorizedResp(c, auth.ErrUserDoesNotExist)
+			return
+		}
+
+		authUser, ok := EnforceMemberships(c, authUser)
+
+		if !ok {
+			return
+		}
+
+		// refresh tokens last a while, so drop permissions the
+		// user has lost since it was issued
+		permissions := currentPermissions(authUser, validator.Claims.Permissions)
+
+		if len(req.Permissions) > 0 {
+			if !CheckScope(c, &req, permissions) {
+				return
+			}
+
+			permissions = req.Permissions
+		}
+
 		// Generate encoded token and send it as response.
 		accessToken, err := tokengen.AccessTokenUsingPermissions(c,
 			validator.Claims.Subject,
 			req.Audience,
-			validator.Claims.Permissions)
+			permissions)
 
 		if err != nil {
 			web.BadReqResp(c, ErrCreatingToken)
+			return
 		}
 
 		web.MakeDataResp(c, "", &web.AccessTokenResp{AccessToken: accessToken})
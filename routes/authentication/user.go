@@ -2,8 +2,8 @@ package authentication
 
 import (
 	edbmail "github.com/antonybholmes/go-edbmailserver/mail"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
 	mailserver "github.com/antonybholmes/go-mailserver"
-	"github.com/antonybholmes/go-mailserver/mailqueue"
 	"github.com/antonybholmes/go-sys/log"
 	"github.com/antonybholmes/go-web"
 	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
@@ -61,7 +61,12 @@ func UpdateUserRoute(c *gin.Context) {
 		email := mailserver.MailItem{Name: authUser.Name,
 			To:        authUser.Email,
 			EmailType: edbmail.EmailQueueTypeAccountUpdated}
-		mailqueue.SendMail(&email)
+		err = outbox.SendMail(c, &email)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
 
 		// send back updated user to having to do a separate call to get the new data
 		web.MakeDataResp(c, "account updated confirmation email sent", authUser)
@@ -0,0 +1,254 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/antonybholmes/go-edbserver-gin/datasetacl"
+	"github.com/antonybholmes/go-edbserver-gin/memberships"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Enforces dataset grants on the module routes. The module handlers
+// live in their own packages, so dataset references are found in the
+// path and json body before the handler runs, and listings are
+// filtered after it has written its response.
+
+// largest json body on a module route, since we must read all of it
+// to find the dataset ids
+const maxAclBodyBytes = 10 << 20
+
+var (
+	ErrNoCaller = errors.New("could not identify the caller")
+)
+
+type DatasetAccess struct {
+	ACL     *datasetacl.ACL
+	keyfunc jwt.Keyfunc
+}
+
+// holds back the response so a listing can be filtered
+type bufferedWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+func NewDatasetAccess(acl *datasetacl.ACL, keyfunc jwt.Keyfunc) *DatasetAccess {
+	return &DatasetAccess{ACL: acl, keyfunc: keyfunc}
+}
+
+// caller identifies the user from their access token, which the rules
+// middleware has already accepted
+func (access *DatasetAccess) caller(c *gin.Context) (*datasetacl.Caller, error) {
+	tokenString, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+	if !ok || tokenString == "" {
+		return nil, ErrNoCaller
+	}
+
+	claims := jwt.MapClaims{}
+
+	_, err := jwt.ParseWithClaims(tokenString,
+		claims,
+		access.keyfunc,
+		jwt.WithValidMethods([]string{"ES256"}))
+
+	if err != nil {
+		return nil, err
+	}
+
+	caller := datasetacl.Caller{}
+
+	caller.UserId, _ = claims.GetSubject()
+
+	if values, ok := claims["permissions"].([]any); ok {
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				caller.Permissions = append(caller.Permissions, s)
+			}
+		}
+	}
+
+	authUser, err := userdbcache.FindUserById(caller.UserId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// a membership that has ended must not grant access until the
+	// daily clean up gets to it
+	authUser, err = memberships.Enforce(c, authUser)
+
+	if err != nil {
+		return nil, err
+	}
+
+	caller.Groups = memberships.GroupNames(authUser)
+
+	return &caller, nil
+}
+
+// bodyDatasets reads the dataset ids from a json body and puts
+// the body back for the handler
+func bodyDatasets(c *gin.Context, module *datasetacl.ModuleConfig) ([]string, error) {
+	if c.Request.Body == nil ||
+		len(module.BodyFields) == 0 ||
+		!strings.Contains(c.ContentType(), "json") {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxAclBodyBytes))
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.Request.Body = io.NopCloser(bytes.NewReader(data))
+
+	var body map[string]any
+
+	// anything that is not an object has no fields to check
+	if json.Unmarshal(data, &body) != nil {
+		return nil, nil
+	}
+
+	return module.BodyDatasets(body), nil
+}
+
+// Middleware refuses requests for datasets the caller has not been
+// granted and filters listings. It must come after the rules middleware.
+func (access *DatasetAccess) Middleware(name string) gin.HandlerFunc {
+	module, err := access.ACL.Module(name)
+
+	if err != nil {
+		log.Warn().Msgf("no dataset access config for module %s", name)
+
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+
+	return func(c *gin.Context) {
+		caller, err := access.caller(c)
+
+		if err != nil {
+			web.UnauthorizedResp(c, ErrNoCaller)
+			c.Abort()
+			return
+		}
+
+		if module.IsAdmin(caller) {
+			c.Next()
+			return
+		}
+
+		datasets, err := bodyDatasets(c, module)
+
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+
+			// a truncated body could hide dataset ids from us
+			if errors.As(err, &maxBytesErr) {
+				c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+			} else {
+				web.BadReqResp(c, web.ErrInvalidBody)
+				c.Abort()
+			}
+
+			return
+		}
+
+		if dataset := c.Param("dataset"); dataset != "" {
+			datasets = append(datasets, dataset)
+		}
+
+		err = access.ACL.Check(c, module, caller, datasets)
+
+		if err != nil {
+			if errors.Is(err, datasetacl.ErrDatasetNotGranted) {
+				web.ForbiddenResp(c, err)
+			} else {
+				c.Error(err)
+			}
+
+			c.Abort()
+			return
+		}
+
+		if !slices.Contains(module.ListRoutes, c.FullPath()) {
+			c.Next()
+			return
+		}
+
+		writer := c.Writer
+		buffered := &bufferedWriter{ResponseWriter: writer}
+		c.Writer = buffered
+
+		c.Next()
+
+		c.Writer = writer
+
+		body := buffered.body.Bytes()
+
+		if writer.Status() == http.StatusOK {
+			body = access.filterListing(c, module, caller, body)
+		}
+
+		writer.Header().Del("Content-Length")
+		writer.Write(body)
+	}
+}
+
+// filterListing removes the datasets the caller may not see from the
+// data of a listing response. If the response cannot be understood it
+// is returned as is.
+func (access *DatasetAccess) filterListing(c *gin.Context,
+	module *datasetacl.ModuleConfig,
+	caller *datasetacl.Caller,
+	body []byte) []byte {
+	var resp map[string]any
+
+	if json.Unmarshal(body, &resp) != nil {
+		return body
+	}
+
+	data, ok := resp["data"]
+
+	if !ok {
+		return body
+	}
+
+	allowed, err := access.ACL.Allowed(c, module, caller, module.ListedDatasets(data))
+
+	if err != nil {
+		log.Error().Msgf("could not filter %s datasets: %v", module.Name, err)
+		resp["data"] = []any{}
+	} else {
+		resp["data"] = module.FilterListing(data, allowed)
+	}
+
+	filtered, err := json.Marshal(resp)
+
+	if err != nil {
+		return body
+	}
+
+	return filtered
+}
@@ -16,7 +16,7 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func RegisterRoutes(r *gin.Engine, rulesMiddleware gin.HandlerFunc) {
+func RegisterRoutes(r *gin.Engine, rulesMiddleware gin.HandlerFunc, datasetAccess *DatasetAccess) {
 	//
 	// module groups: start
 	//
@@ -80,6 +80,7 @@ func RegisterRoutes(r *gin.Engine, rulesMiddleware gin.HandlerFunc) {
 	// protected routes
 	gexProtectedGroup := gexGroup.Group("",
 		rulesMiddleware,
+		datasetAccess.Middleware("gex"),
 		//jwtUserMiddleWare,
 		//accessTokenMiddleware,
 		//rdfRoleMiddleware
@@ -102,7 +103,7 @@ func RegisterRoutes(r *gin.Engine, rulesMiddleware gin.HandlerFunc) {
 	//scrnaGroup.GET("/assemblies/:genome", scrnaroutes.ScrnaAssembliesRoute)
 	//gexGroup.GET("/types", gexroutes.GexValueTypesRoute)
 
-	scrnaProtectedGroup := scrnaGroup.Group("", rulesMiddleware)
+	scrnaProtectedGroup := scrnaGroup.Group("", rulesMiddleware, datasetAccess.Middleware("scrna"))
 	scrnaProtectedGroup.GET("/assemblies/:assembly/datasets", scrnaroutes.ScrnaDatasetsRoute)
 	datasetsGroup := scrnaProtectedGroup.Group("/datasets")
 	//datasetsGroup.GET("/:dataset/clusters", scrnaroutes.ScrnaClustersRoute)
@@ -135,6 +136,7 @@ func RegisterRoutes(r *gin.Engine, rulesMiddleware gin.HandlerFunc) {
 	hubsGroup := moduleGroup.Group("/hubs")
 	hubsGroup.GET("/assemblies/:assembly/datasets",
 		rulesMiddleware,
+		datasetAccess.Middleware("hubs"),
 		hubroutes.DatasetsRoute,
 	)
 
@@ -159,6 +161,7 @@ func RegisterRoutes(r *gin.Engine, rulesMiddleware gin.HandlerFunc) {
 
 	seqsGroup := moduleGroup.Group("/seqs",
 		rulesMiddleware,
+		datasetAccess.Middleware("seqs"),
 	)
 
 	//seqsGroup.GET("/genomes", seqroutes.GenomeRoute)
@@ -171,7 +174,7 @@ func RegisterRoutes(r *gin.Engine, rulesMiddleware gin.HandlerFunc) {
 	cytobandsGroup := moduleGroup.Group("/cytobands")
 	cytobandsGroup.GET("/assemblies/:assembly/chrs/:chr", cytobandroutes.CytobandsRoute)
 
-	bedsGroup := moduleGroup.Group("/beds", rulesMiddleware)
+	bedsGroup := moduleGroup.Group("/beds", rulesMiddleware, datasetAccess.Middleware("beds"))
 
 	//samplesGroup := bedsGroup.Group("/samples")
 	//samplesGroup.GET("/:assembly", bedroutes.SearchBedsRoute)
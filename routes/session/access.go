@@ -0,0 +1,244 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/antonybholmes/go-edbserver-gin/accessrequests"
+	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrNotYourRequest = errors.New("access request was not made by you")
+)
+
+type AccessRoutes struct {
+	Policy *accessrequests.Policy
+}
+
+type AccessReq struct {
+	// group or dataset
+	Kind          string `json:"kind"`
+	Group         string `json:"group"`
+	Module        string `json:"module"`
+	Dataset       string `json:"dataset"`
+	Justification string `json:"justification"`
+	Days          int    `json:"days"`
+}
+
+type RequestableResp struct {
+	Groups         []accessrequests.GroupConfig `json:"groups"`
+	DatasetModules []string                     `json:"datasetModules"`
+	MaxDays        int                          `json:"maxDays"`
+}
+
+func NewAccessRoutes(policy *accessrequests.Policy) *AccessRoutes {
+	return &AccessRoutes{Policy: policy}
+}
+
+func accessErrorResp(c *gin.Context, err error) {
+	if errors.Is(err, accessrequests.ErrNotRequestable) ||
+		errors.Is(err, accessrequests.ErrNoJustification) ||
+		errors.Is(err, accessrequests.ErrTooLong) ||
+		errors.Is(err, accessrequests.ErrRequestPending) ||
+		errors.Is(err, accessrequests.ErrRequestDecided) ||
+		errors.Is(err, accessrequests.ErrRequestNotFound) {
+		web.BadReqResp(c, err)
+	} else {
+		c.Error(err)
+	}
+}
+
+// What the user can ask for access to
+func (accessRoutes *AccessRoutes) SessionRequestableRoute(c *gin.Context) {
+	config := accessRoutes.Policy.Config()
+
+	// approvers are not shown to users
+	groups := make([]accessrequests.GroupConfig, 0, len(config.Groups))
+
+	for _, group := range config.Groups {
+		groups = append(groups, accessrequests.GroupConfig{Name: group.Name,
+			Description: group.Description,
+			MaxDays:     group.MaxDays})
+	}
+
+	web.MakeDataResp(c, "", &RequestableResp{Groups: groups,
+		DatasetModules: config.DatasetModules,
+		MaxDays:        config.MaxDays})
+}
+
+// The requests for access the user has made
+func (accessRoutes *AccessRoutes) SessionAccessRequestsRoute(c *gin.Context) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	list, err := accessRoutes.Policy.Requests.ListForUser(c, user.(*auth.AuthUser).Id)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", list)
+}
+
+// Ask for access to a group or dataset. Approvers are emailed
+// to review the request.
+func (accessRoutes *AccessRoutes) SessionRequestAccessRoute(c *gin.Context) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	authUser := user.(*auth.AuthUser)
+
+	var body AccessReq
+
+	err := c.ShouldBindJSON(&body)
+
+	if err != nil {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	req := accessrequests.Request{UserId: authUser.Id,
+		Email:         authUser.Email,
+		Name:          authUser.Name,
+		Kind:          body.Kind,
+		Justification: strings.TrimSpace(body.Justification),
+		Days:          body.Days}
+
+	// only keep what is relevant to the kind of request
+	switch body.Kind {
+	case accessrequests.KindGroup:
+		req.Group = body.Group
+	case accessrequests.KindDataset:
+		req.Module = body.Module
+		req.Dataset = body.Dataset
+	}
+
+	err = accessRoutes.Policy.Check(&req)
+
+	if err == nil {
+		// make sure the length asked for can be granted
+		_, err = accessRoutes.Policy.ExpiresAt(&req, req.Days)
+	}
+
+	if err == nil {
+		err = accessRoutes.Policy.Requests.Create(c, &req)
+	}
+
+	if err != nil {
+		accessErrorResp(c, err)
+		return
+	}
+
+	accessRoutes.audit(c, &req, authUser.Id, accessrequests.ActionRequested, "")
+
+	accessRoutes.notifyApprovers(c, &req)
+
+	web.MakeDataResp(c, "your request has been sent for review", &req)
+}
+
+// Withdraw a request that has not been reviewed yet
+func (accessRoutes *AccessRoutes) SessionCancelAccessRequestRoute(c *gin.Context) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	authUser := user.(*auth.AuthUser)
+
+	req, err := accessRoutes.Policy.Requests.Get(c, c.Param("id"))
+
+	if err != nil {
+		accessErrorResp(c, err)
+		return
+	}
+
+	if req.UserId != authUser.Id {
+		web.ForbiddenResp(c, ErrNotYourRequest)
+		return
+	}
+
+	// an admin may be deciding it at the same time
+	req, err = accessRoutes.Policy.Requests.Claim(c, req.Id)
+
+	if err != nil {
+		accessErrorResp(c, err)
+		return
+	}
+
+	err = accessRoutes.Policy.Requests.Decide(c, req, accessrequests.StatusCancelled, authUser.Id, "", nil)
+
+	if err != nil {
+		accessErrorResp(c, err)
+		return
+	}
+
+	accessRoutes.audit(c, req, authUser.Id, accessrequests.ActionCancelled, "")
+
+	web.MakeOkResp(c, "access request cancelled")
+}
+
+func (accessRoutes *AccessRoutes) audit(c *gin.Context, req *accessrequests.Request, actor string, action string, detail string) {
+	err := accessRoutes.Policy.Audit.RecordAction(c, req, actor, action, detail, c.ClientIP())
+
+	if err != nil {
+		log.Error().Msgf("could not audit access request %s %s: %v", req.Id, action, err)
+	}
+}
+
+// notifyApprovers emails everyone who can approve a request
+func (accessRoutes *AccessRoutes) notifyApprovers(c *gin.Context, req *accessrequests.Request) {
+	approvers := accessRoutes.Policy.Approvers(req)
+
+	if len(approvers) == 0 {
+		log.Warn().Msgf("no approvers to tell about access request %s", req.Id)
+		return
+	}
+
+	data, err := json.Marshal(req)
+
+	if err != nil {
+		log.Error().Msgf("could not encode access request %s: %v", req.Id, err)
+		return
+	}
+
+	var notified []string
+
+	for _, approver := range approvers {
+		email := mailserver.MailItem{Name: req.Name,
+			To:        approver,
+			EmailType: emails.EmailQueueTypeAccessRequested,
+			LinkUrl:   consts.UrlAccessRequests,
+			Payload:   &mailserver.Payload{DataType: "access-request", Data: string(data)}}
+
+		err = outbox.SendMail(c, &email)
+
+		if err != nil {
+			log.Warn().Msgf("could not email approver %s: %v", approver, err)
+			continue
+		}
+
+		notified = append(notified, approver)
+	}
+
+	accessRoutes.audit(c, req, "system", accessrequests.ActionNotified, strings.Join(notified, ","))
+}
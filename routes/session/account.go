@@ -0,0 +1,523 @@
+package session
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/accessrequests"
+	"github.com/antonybholmes/go-edbserver-gin/announcements"
+	"github.com/antonybholmes/go-edbserver-gin/confirmations"
+	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/datasetacl"
+	"github.com/antonybholmes/go-edbserver-gin/emails"
+	"github.com/antonybholmes/go-edbserver-gin/identities"
+	"github.com/antonybholmes/go-edbserver-gin/notifications"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
+	"github.com/antonybholmes/go-edbserver-gin/passwordpolicy"
+	"github.com/antonybholmes/go-edbserver-gin/routes/authentication"
+	"github.com/antonybholmes/go-edbserver-gin/sessionstore"
+	"github.com/antonybholmes/go-edbserver-gin/signinhistory"
+	mailserver "github.com/antonybholmes/go-mailserver"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+	"github.com/antonybholmes/go-web/middleware"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Lets users download everything we hold about them and delete their
+// own account. Deletion needs the user to have signed in recently or
+// to give their password, and then to click a link we email them.
+
+const ConfirmAccountDeletion = "account-deletion"
+
+var (
+	ErrReauthRequired = auth.NewAccountError("please sign in again or enter your password to continue")
+	ErrWrongUser      = auth.NewAccountError("confirmation belongs to a different account")
+)
+
+type AccountRoutes struct {
+	Store          *sessionstore.SessionStore
+	Identities     *identities.IdentityStore
+	Confirmations  *confirmations.ConfirmationStore
+	SignInRoutes   *authentication.SignInRoutes
+	AccessRequests *accessrequests.RequestStore
+	ACL            *datasetacl.ACL
+	Announcements  *announcements.AnnouncementStore
+}
+
+type DeleteAccountReq struct {
+	Password string `json:"password"`
+}
+
+type ConfirmReq struct {
+	Token string `json:"token"`
+}
+
+// ApiKeyInfo describes an api key without revealing it
+type ApiKeyInfo struct {
+	Fields map[string]any `json:"fields,omitempty"`
+	Key    string         `json:"key"`
+}
+
+type AccountExport struct {
+	ExportedAt     time.Time                     `json:"exportedAt"`
+	Profile        map[string]any                `json:"profile"`
+	Groups         any                           `json:"groups"`
+	Providers      []*identities.Identity        `json:"providers"`
+	ApiKeys        []*ApiKeyInfo                 `json:"apiKeys"`
+	Sessions       []*sessionstore.SessionInfo   `json:"sessions"`
+	SignIns        []*signinhistory.Event        `json:"signIns"`
+	AccessRequests []*accessrequests.Request     `json:"accessRequests"`
+	DatasetGrants  []*datasetacl.Grant           `json:"datasetGrants"`
+	Announcements  []*announcements.Announcement `json:"announcements"`
+}
+
+func NewAccountRoutes(store *sessionstore.SessionStore,
+	identityStore *identities.IdentityStore,
+	confirmationStore *confirmations.ConfirmationStore,
+	signInRoutes *authentication.SignInRoutes,
+	accessRequests *accessrequests.RequestStore,
+	acl *datasetacl.ACL,
+	announcementStore *announcements.AnnouncementStore) *AccountRoutes {
+	return &AccountRoutes{Store: store,
+		Identities:     identityStore,
+		Confirmations:  confirmationStore,
+		SignInRoutes:   signInRoutes,
+		AccessRequests: accessRequests,
+		ACL:            acl,
+		Announcements:  announcementStore}
+}
+
+// reload the session user so the export is not stale
+func sessionAuthUser(c *gin.Context) (*auth.AuthUser, bool) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return nil, false
+	}
+
+	authUser, err := userdbcache.FindUserById(user.(*auth.AuthUser).Id)
+
+	if err != nil {
+		web.BadReqResp(c, auth.ErrUserDoesNotExist)
+		return nil, false
+	}
+
+	return authUser, true
+}
+
+func maskApiKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+
+	return strings.Repeat("*", 8) + key[len(key)-4:]
+}
+
+// apiKeyInfo masks an api key which the user record holds either as
+// a plain string or as an object with the key in one of its fields
+func apiKeyInfo(v any) *ApiKeyInfo {
+	switch key := v.(type) {
+	case string:
+		return &ApiKeyInfo{Key: maskApiKey(key)}
+	case map[string]any:
+		info := ApiKeyInfo{Fields: make(map[string]any)}
+
+		for name, value := range key {
+			s, ok := value.(string)
+
+			if ok && (strings.EqualFold(name, "key") || strings.EqualFold(name, "apiKey")) {
+				info.Key = maskApiKey(s)
+			} else {
+				info.Fields[name] = value
+			}
+		}
+
+		return &info
+	default:
+		return &ApiKeyInfo{Key: "****"}
+	}
+}
+
+func (accountRoutes *AccountRoutes) export(c *gin.Context, authUser *auth.AuthUser) (*AccountExport, error) {
+	// go through json so we export every field of the user, and so the
+	// api keys can be pulled out and masked
+	b, err := json.Marshal(authUser)
+
+	if err != nil {
+		return nil, err
+	}
+
+	profile := make(map[string]any)
+
+	err = json.Unmarshal(b, &profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	export := AccountExport{ExportedAt: time.Now().UTC(),
+		Profile: profile,
+		Groups:  profile["groups"],
+		ApiKeys: make([]*ApiKeyInfo, 0)}
+
+	delete(profile, "groups")
+
+	if keys, ok := profile["apiKeys"].([]any); ok {
+		for _, key := range keys {
+			export.ApiKeys = append(export.ApiKeys, apiKeyInfo(key))
+		}
+	}
+
+	delete(profile, "apiKeys")
+
+	export.Providers, err = accountRoutes.Identities.List(c, authUser.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	export.Sessions, err = accountRoutes.Store.List(c, authUser.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the history is capped so this is all of it
+	export.SignIns, err = accountRoutes.SignInRoutes.History.List(c, authUser.Id, 0, math.MaxInt32)
+
+	if err != nil {
+		return nil, err
+	}
+
+	export.AccessRequests, err = accountRoutes.AccessRequests.ListForUser(c, authUser.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	export.DatasetGrants, err = accountRoutes.ACL.UserGrants(c, authUser.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// announcements the user made as an admin
+	export.Announcements, err = accountRoutes.Announcements.CreatedBy(c, authUser.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &export, nil
+}
+
+func writeZipJson(zw *zip.Writer, name string, v any) error {
+	w, err := zw.Create(name)
+
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+// Download the data we hold about the session user as
+// json or, with ?format=zip, as a zip of json files
+func (accountRoutes *AccountRoutes) SessionExportAccountRoute(c *gin.Context) {
+	authUser, ok := sessionAuthUser(c)
+
+	if !ok {
+		return
+	}
+
+	export, err := accountRoutes.export(c, authUser)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	name := fmt.Sprintf("account-%s", export.ExportedAt.Format("20060102"))
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.json\"", name))
+		web.MakeDataResp(c, "", export)
+	case "zip":
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", name))
+
+		zw := zip.NewWriter(c.Writer)
+
+		for _, file := range []struct {
+			v    any
+			name string
+		}{
+			{name: "profile.json", v: export.Profile},
+			{name: "groups.json", v: export.Groups},
+			{name: "providers.json", v: export.Providers},
+			{name: "api-keys.json", v: export.ApiKeys},
+			{name: "sessions.json", v: export.Sessions},
+			{name: "signins.json", v: export.SignIns},
+			{name: "access-requests.json", v: export.AccessRequests},
+			{name: "dataset-grants.json", v: export.DatasetGrants},
+			{name: "announcements.json", v: export.Announcements},
+		} {
+			err = writeZipJson(zw, file.name, file.v)
+
+			if err != nil {
+				break
+			}
+		}
+
+		if err == nil {
+			err = zw.Close()
+		}
+
+		// headers have gone so all we can do is log it
+		if err != nil {
+			log.Error().Msgf("could not write account export for %s: %v", authUser.Id, err)
+		}
+	default:
+		web.BadReqResp(c, fmt.Errorf("unknown format %s", c.Query("format")))
+	}
+}
+
+// the user must have signed in within the last few minutes or give
+// their password again before they can delete their account. The
+// password is checked by the sign in guard so it cannot be used to
+// guess passwords without limit. If it returns false a response has
+// already been written.
+func (accountRoutes *AccountRoutes) reauthenticated(c *gin.Context, authUser *auth.AuthUser, password string) bool {
+	if password != "" {
+		return accountRoutes.SignInRoutes.CheckPassword(c, authUser, password)
+	}
+
+	info, ok := currentSessionInfo(c)
+
+	if !ok || time.Since(info.CreatedAt) >= consts.ShortTtlMins {
+		web.UnauthorizedResp(c, ErrReauthRequired)
+		return false
+	}
+
+	return true
+}
+
+// Start deleting the session user's account by emailing them a link
+// to confirm it
+func (accountRoutes *AccountRoutes) SessionDeleteAccountRoute(c *gin.Context) {
+	authUser, ok := sessionAuthUser(c)
+
+	if !ok {
+		return
+	}
+
+	var req DeleteAccountReq
+
+	// the body is optional when the user has signed in recently
+	if c.Request.ContentLength > 0 {
+		err := c.ShouldBindJSON(&req)
+
+		if err != nil {
+			web.BadReqResp(c, web.ErrInvalidBody)
+			return
+		}
+	}
+
+	if !accountRoutes.reauthenticated(c, authUser, req.Password) {
+		return
+	}
+
+	token, _, err := accountRoutes.Confirmations.Create(c,
+		ConfirmAccountDeletion,
+		authUser.Id,
+		nil,
+		consts.ShortTtlMins)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	email := mailserver.MailItem{
+		Name:      authUser.Name,
+		To:        authUser.Email,
+		Payload:   &mailserver.Payload{DataType: "token", Data: token},
+		EmailType: emails.EmailQueueTypeAccountDeletionConfirm,
+		TTL:       fmt.Sprintf("%d minutes", int(consts.ShortTtlMins.Minutes())),
+		LinkUrl:   consts.UrlDeleteAccount}
+
+	err = outbox.SendMail(c, &email)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeOkResp(c, "check your email to confirm deleting your account")
+}
+
+// Delete the session user's account once they have followed the
+// link in the confirmation email
+func (accountRoutes *AccountRoutes) SessionConfirmDeleteAccountRoute(c *gin.Context) {
+	authUser, ok := sessionAuthUser(c)
+
+	if !ok {
+		return
+	}
+
+	var req ConfirmReq
+
+	err := c.ShouldBindJSON(&req)
+
+	if err != nil || req.Token == "" {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	confirmation, err := accountRoutes.Confirmations.Get(c, ConfirmAccountDeletion, req.Token)
+
+	if err != nil {
+		if errors.Is(err, confirmations.ErrInvalidConfirmation) {
+			web.BadReqResp(c, err)
+		} else {
+			c.Error(err)
+		}
+
+		return
+	}
+
+	// leave the link usable by its owner if someone else tries it
+	if confirmation.UserId != authUser.Id {
+		web.ForbiddenResp(c, ErrWrongUser)
+		return
+	}
+
+	_, err = accountRoutes.Confirmations.Consume(c, ConfirmAccountDeletion, req.Token)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = userdbcache.DeleteUser(authUser.Id)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// the account is gone so tidy up what we hold about it on a best
+	// effort basis rather than failing the request
+	err = accountRoutes.Identities.UnlinkAll(c, authUser.Id)
+
+	if err != nil {
+		log.Warn().Msgf("could not remove identities of deleted user %s: %v", authUser.Id, err)
+	}
+
+	_, err = accountRoutes.Store.RevokeAll(c, authUser.Id, "")
+
+	if err != nil {
+		log.Warn().Msgf("could not revoke sessions of deleted user %s: %v", authUser.Id, err)
+	}
+
+	err = accountRoutes.SignInRoutes.History.Clear(c, authUser.Id)
+
+	if err != nil {
+		log.Warn().Msgf("could not remove sign in history of deleted user %s: %v", authUser.Id, err)
+	}
+
+	err = accountRoutes.AccessRequests.Clear(c, authUser.Id)
+
+	if err != nil {
+		log.Warn().Msgf("could not remove access requests of deleted user %s: %v", authUser.Id, err)
+	}
+
+	err = accountRoutes.ACL.RevokeUser(c, authUser.Id)
+
+	if err != nil {
+		log.Warn().Msgf("could not revoke dataset grants of deleted user %s: %v", authUser.Id, err)
+	}
+
+	err = accountRoutes.Announcements.ForgetCreator(c, authUser.Id)
+
+	if err != nil {
+		log.Warn().Msgf("could not remove deleted user %s from announcements: %v", authUser.Id, err)
+	}
+
+	err = passwordpolicy.Forget(c, authUser.Id)
+
+	if err != nil {
+		log.Warn().Msgf("could not remove password history of deleted user %s: %v", authUser.Id, err)
+	}
+
+	err = notifications.Forget(c, authUser.Id)
+
+	if err != nil {
+		log.Warn().Msgf("could not remove notification preferences of deleted user %s: %v", authUser.Id, err)
+	}
+
+	sess := sessions.Default(c)
+	sess.Clear()
+	sess.Options(middleware.SessionOptsClear)
+	sess.Save()
+
+	email := mailserver.MailItem{
+		Name:      authUser.Name,
+		To:        authUser.Email,
+		EmailType: emails.EmailQueueTypeAccountDeleted}
+
+	err = outbox.SendMail(c, &email)
+
+	if err != nil {
+		log.Warn().Msgf("could not send account deleted email: %v", err)
+	}
+
+	web.MakeOkResp(c, "account deleted")
+}
+
+type SignInHistoryReq struct {
+	Offset  int `form:"offset"`
+	Records int `form:"records"`
+}
+
+// List the recent sign ins to the session user's account, newest first
+func (accountRoutes *AccountRoutes) SessionSignInHistoryRoute(c *gin.Context) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	req := SignInHistoryReq{Records: 50}
+
+	err := c.ShouldBindQuery(&req)
+
+	if err != nil || req.Offset < 0 || req.Records < 1 {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	list, err := accountRoutes.SignInRoutes.History.List(c, user.(*auth.AuthUser).Id, req.Offset, req.Records)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", list)
+}
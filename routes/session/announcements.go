@@ -0,0 +1,77 @@
+package session
+
+import (
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/announcements"
+	"github.com/antonybholmes/go-edbserver-gin/memberships"
+	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type AnnouncementsRoutes struct {
+	Store *announcements.AnnouncementStore
+}
+
+type AnnouncementsReq struct {
+	// only announcements made after this, so clients polling get
+	// what is new since they last asked
+	Since time.Time `form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+// what users see of an announcement
+type AnnouncementResp struct {
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Id        string     `json:"id"`
+	Kind      string     `json:"kind"`
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	LinkUrl   string     `json:"linkUrl,omitempty"`
+}
+
+func NewAnnouncementsRoutes(store *announcements.AnnouncementStore) *AnnouncementsRoutes {
+	return &AnnouncementsRoutes{Store: store}
+}
+
+// Announcements for the groups the user is in, newest first
+func (announcementsRoutes *AnnouncementsRoutes) SessionAnnouncementsRoute(c *gin.Context) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	var req AnnouncementsReq
+
+	err := c.ShouldBindQuery(&req)
+
+	if err != nil {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	list, err := announcementsRoutes.Store.Recent(c, memberships.GroupNames(user.(*auth.AuthUser)), req.Since)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// who sent them and how many emails went out is not for users
+	ret := make([]*AnnouncementResp, 0, len(list))
+
+	for _, announcement := range list {
+		ret = append(ret, &AnnouncementResp{CreatedAt: announcement.CreatedAt,
+			ExpiresAt: announcement.ExpiresAt,
+			Id:        announcement.Id,
+			Kind:      announcement.Kind,
+			Title:     announcement.Title,
+			Body:      announcement.Body,
+			LinkUrl:   announcement.LinkUrl})
+	}
+
+	web.MakeDataResp(c, "", ret)
+}
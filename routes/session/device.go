@@ -0,0 +1,267 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/devicecode"
+	"github.com/antonybholmes/go-edbserver-gin/routes/authentication"
+	"github.com/antonybholmes/go-edbserver-gin/sessionstore"
+	"github.com/antonybholmes/go-edbserver-gin/signinhistory"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth"
+	"github.com/antonybholmes/go-web/auth/token/tokengen"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Routes for the OAuth2 device authorization grant (RFC 8628) so that
+// CLI tools and notebooks can sign in by having the user approve them
+// from a browser where they are already signed in
+
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+var (
+	ErrUnsupportedGrantType = errors.New("unsupported_grant_type")
+	ErrInvalidRequest       = errors.New("invalid_request")
+)
+
+type DeviceRoutes struct {
+	Store        *devicecode.DeviceCodeStore
+	SignInRoutes *authentication.SignInRoutes
+}
+
+type DeviceCodeReq struct {
+	ClientId string `json:"client_id" form:"client_id"`
+}
+
+// field names follow RFC 8628 so standard clients can use them
+type DeviceCodeResp struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationUri         string `json:"verification_uri"`
+	VerificationUriComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type DeviceTokenReq struct {
+	GrantType  string `json:"grant_type" form:"grant_type"`
+	DeviceCode string `json:"device_code" form:"device_code"`
+	ClientId   string `json:"client_id" form:"client_id"`
+}
+
+type DeviceTokenResp struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type DeviceErrorResp struct {
+	Error string `json:"error"`
+}
+
+type DeviceApproveReq struct {
+	UserCode string `json:"userCode"`
+	Approve  bool   `json:"approve"`
+}
+
+func NewDeviceRoutes(store *devicecode.DeviceCodeStore, signInRoutes *authentication.SignInRoutes) *DeviceRoutes {
+	return &DeviceRoutes{Store: store, SignInRoutes: signInRoutes}
+}
+
+// errors to the polling client use the RFC 6749 error format
+func deviceErrorResp(c *gin.Context, status int, err error) {
+	c.JSON(status, DeviceErrorResp{Error: err.Error()})
+}
+
+// Called by the client to start the flow
+func (deviceRoutes *DeviceRoutes) DeviceCodeRoute(c *gin.Context) {
+	var req DeviceCodeReq
+
+	err := c.ShouldBind(&req)
+
+	if err != nil {
+		deviceErrorResp(c, http.StatusBadRequest, ErrInvalidRequest)
+		return
+	}
+
+	deviceCode, grant, err := deviceRoutes.Store.Create(c,
+		req.ClientId,
+		c.ClientIP(),
+		sessionstore.DeviceName(c.Request.UserAgent()))
+
+	if err != nil {
+		if errors.Is(err, devicecode.ErrRateLimited) {
+			web.TooManyRequestsResp(c, err)
+		} else {
+			web.InternalErrorResp(c, err)
+		}
+
+		return
+	}
+
+	c.JSON(http.StatusOK, DeviceCodeResp{
+		DeviceCode:              deviceCode,
+		UserCode:                grant.UserCode,
+		VerificationUri:         consts.UrlVerifyDevice,
+		VerificationUriComplete: consts.UrlVerifyDevice + "?code=" + grant.UserCode,
+		ExpiresIn:               int(deviceRoutes.Store.TTL().Seconds()),
+		Interval:                grant.Interval,
+	})
+}
+
+// Polled by the client until the user approves or denies the request
+func (deviceRoutes *DeviceRoutes) DeviceTokenRoute(c *gin.Context) {
+	var req DeviceTokenReq
+
+	err := c.ShouldBind(&req)
+
+	if err != nil || req.DeviceCode == "" {
+		deviceErrorResp(c, http.StatusBadRequest, ErrInvalidRequest)
+		return
+	}
+
+	if req.GrantType != DeviceCodeGrantType {
+		deviceErrorResp(c, http.StatusBadRequest, ErrUnsupportedGrantType)
+		return
+	}
+
+	grant, err := deviceRoutes.Store.Poll(c, req.DeviceCode, req.ClientId)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, devicecode.ErrAuthorizationPending),
+			errors.Is(err, devicecode.ErrSlowDown),
+			errors.Is(err, devicecode.ErrAccessDenied),
+			errors.Is(err, devicecode.ErrExpiredToken),
+			errors.Is(err, devicecode.ErrInvalidGrant):
+			deviceErrorResp(c, http.StatusBadRequest, err)
+		default:
+			web.InternalErrorResp(c, err)
+		}
+
+		return
+	}
+
+	// the user may have changed since they approved
+	authUser, err := userdbcache.FindUserById(grant.UserId)
+
+	if err != nil {
+		deviceErrorResp(c, http.StatusBadRequest, devicecode.ErrAccessDenied)
+		return
+	}
+
+	authUser, ok := authentication.EnforceMemberships(c, authUser)
+
+	if !ok {
+		return
+	}
+
+	if !auth.UserHasWebLoginInRole(authUser) {
+		deviceRoutes.SignInRoutes.RecordFailedSignIn(c, authUser, signinhistory.MethodDeviceCode, "", authentication.ErrNotAllowedToSignIn)
+		deviceErrorResp(c, http.StatusBadRequest, devicecode.ErrAccessDenied)
+		return
+	}
+
+	refreshToken, err := tokengen.RefreshToken(c, authUser, jwt.ClaimStrings{"refresh"})
+
+	if err != nil {
+		auth.TokenErrorResp(c)
+		return
+	}
+
+	accessToken, err := tokengen.AccessToken(c, authUser.Id, jwt.ClaimStrings{"access"}, auth.GetRolesFromUser(authUser))
+
+	if err != nil {
+		auth.TokenErrorResp(c)
+		return
+	}
+
+	log.Debug().Msgf("device %s signed in as %s", grant.Device, authUser.Id)
+
+	deviceRoutes.SignInRoutes.RecordSignIn(c, authUser, signinhistory.MethodDeviceCode, "")
+
+	c.JSON(http.StatusOK, DeviceTokenResp{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(consts.AccessTokenTtlMins.Seconds()),
+	})
+}
+
+// Used by the verification page to show the signed in user what is
+// asking for access before they approve it
+func (deviceRoutes *DeviceRoutes) DeviceLookupRoute(c *gin.Context) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	grant, err := deviceRoutes.Store.Lookup(c, user.(*auth.AuthUser).Id, c.Query("code"))
+
+	if err != nil {
+		deviceRoutes.userCodeErrorResp(c, err)
+		return
+	}
+
+	web.MakeDataResp(c, "", grant)
+}
+
+// Approve or deny a device from a signed in browser session
+func (deviceRoutes *DeviceRoutes) DeviceApproveRoute(c *gin.Context) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	authUser := user.(*auth.AuthUser)
+
+	var req DeviceApproveReq
+
+	err := c.ShouldBindJSON(&req)
+
+	if err != nil {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	grant, err := deviceRoutes.Store.FindByUserCode(c, authUser.Id, req.UserCode)
+
+	if err != nil {
+		deviceRoutes.userCodeErrorResp(c, err)
+		return
+	}
+
+	err = deviceRoutes.Store.Decide(c, grant, authUser.Id, req.Approve)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if req.Approve {
+		web.MakeOkResp(c, "device approved")
+	} else {
+		web.MakeOkResp(c, "device denied")
+	}
+}
+
+func (deviceRoutes *DeviceRoutes) userCodeErrorResp(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, devicecode.ErrRateLimited):
+		web.TooManyRequestsResp(c, err)
+	case errors.Is(err, devicecode.ErrInvalidUserCode):
+		web.BadReqResp(c, err)
+	default:
+		c.Error(err)
+	}
+}
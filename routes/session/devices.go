@@ -0,0 +1,148 @@
+package session
+
+import (
+	"errors"
+
+	"github.com/antonybholmes/go-edbserver-gin/sessionstore"
+	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth"
+	"github.com/antonybholmes/go-web/middleware"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+type RevokeSessionReq struct {
+	Id string `json:"id"`
+}
+
+type RevokedSessionsResp struct {
+	Revoked int `json:"revoked"`
+}
+
+func currentSessionInfo(c *gin.Context) (*sessionstore.SessionInfo, bool) {
+	v, ok := c.Get(SessionInfoKey)
+
+	if !ok {
+		return nil, false
+	}
+
+	info, ok := v.(*sessionstore.SessionInfo)
+
+	return info, ok
+}
+
+// SessionStoreMiddleware checks the cookie session is still known to the
+// server side store so that revoked or stolen cookies stop working. It
+// must run after the session is valid middleware.
+func (sessionRoutes *SessionRoutes) SessionStoreMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sess := sessions.Default(c)
+
+		id, _ := sess.Get(SessionId).(string)
+
+		info, err := sessionRoutes.Store.Get(c, id)
+
+		if err == nil {
+			user, ok := c.Get(web.SessionUser)
+
+			// a session id copied into another user's cookie is not valid
+			if !ok || user.(*auth.AuthUser).Id != info.UserId {
+				err = sessionstore.ErrSessionNotFound
+			}
+		}
+
+		if err == nil {
+			// other errors are ignored, we do not want to fail a request
+			// because last seen could not be written
+			err = sessionRoutes.Store.Touch(c, info, c.ClientIP())
+
+			if !errors.Is(err, sessionstore.ErrSessionNotFound) {
+				err = nil
+			}
+		}
+
+		if err != nil {
+			sess.Clear()
+			sess.Options(middleware.SessionOptsClear)
+			sess.Save()
+
+			web.UnauthorizedResp(c, ErrSessionExpired)
+			c.Abort()
+			return
+		}
+
+		c.Set(SessionInfoKey, info)
+
+		c.Next()
+	}
+}
+
+// List the active sessions of the signed in user
+func (sessionRoutes *SessionRoutes) SessionListRoute(c *gin.Context) {
+	info, ok := currentSessionInfo(c)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	list, err := sessionRoutes.Store.List(c, info.UserId)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	for _, s := range list {
+		s.Current = s.Id == info.Id
+	}
+
+	web.MakeDataResp(c, "", list)
+}
+
+// Revoke one of the user's sessions, e.g. a lost laptop
+func (sessionRoutes *SessionRoutes) SessionRevokeRoute(c *gin.Context) {
+	info, ok := currentSessionInfo(c)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	var req RevokeSessionReq
+
+	err := c.ShouldBindJSON(&req)
+
+	if err != nil || req.Id == "" {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	err = sessionRoutes.Store.Revoke(c, info.UserId, req.Id)
+
+	if err != nil {
+		web.BadReqResp(c, err)
+		return
+	}
+
+	web.MakeOkResp(c, "session revoked")
+}
+
+// Revoke every session of the user except the one making the request
+func (sessionRoutes *SessionRoutes) SessionRevokeOthersRoute(c *gin.Context) {
+	info, ok := currentSessionInfo(c)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	n, err := sessionRoutes.Store.RevokeAll(c, info.UserId, info.Id)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "other sessions revoked", &RevokedSessionsResp{Revoked: n})
+}
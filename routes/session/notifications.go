@@ -0,0 +1,84 @@
+package session
+
+import (
+	"errors"
+
+	"github.com/antonybholmes/go-edbserver-gin/notifications"
+	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type NotificationsRoutes struct {
+	Preferences *notifications.Preferences
+}
+
+type NotificationsReq struct {
+	// categories to turn on or off
+	Categories map[string]bool `json:"categories"`
+}
+
+func NewNotificationsRoutes(prefs *notifications.Preferences) *NotificationsRoutes {
+	return &NotificationsRoutes{Preferences: prefs}
+}
+
+// Which kinds of email the user gets
+func (notificationsRoutes *NotificationsRoutes) SessionNotificationsRoute(c *gin.Context) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	prefs, err := notificationsRoutes.Preferences.Get(c, user.(*auth.AuthUser).Id)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", prefs)
+}
+
+// Turn kinds of email on or off. Security emails cannot be turned off.
+func (notificationsRoutes *NotificationsRoutes) SessionUpdateNotificationsRoute(c *gin.Context) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	var req NotificationsReq
+
+	err := c.ShouldBindJSON(&req)
+
+	if err != nil {
+		web.BadReqResp(c, web.ErrInvalidBody)
+		return
+	}
+
+	userId := user.(*auth.AuthUser).Id
+
+	err = notificationsRoutes.Preferences.Set(c, userId, req.Categories)
+
+	if err != nil {
+		if errors.Is(err, notifications.ErrUnknownCategory) || errors.Is(err, notifications.ErrMandatoryCategory) {
+			web.BadReqResp(c, err)
+		} else {
+			c.Error(err)
+		}
+
+		return
+	}
+
+	prefs, err := notificationsRoutes.Preferences.Get(c, userId)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "notification preferences updated", prefs)
+}
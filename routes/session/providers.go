@@ -0,0 +1,167 @@
+package session
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/antonybholmes/go-edbserver-gin/identities"
+	"github.com/antonybholmes/go-edbserver-gin/oidc"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+	"github.com/gin-gonic/gin"
+)
+
+func newIdentity(provider *oidc.Provider, identity *oidc.Identity) *identities.Identity {
+	return &identities.Identity{
+		Provider:     provider.Name(),
+		AuthProvider: identity.AuthProvider,
+		Subject:      identity.Subject,
+		Email:        identity.Email}
+}
+
+// recordIdentity records the identity a user signed in with. It is
+// best effort since failing to record it should not stop the user
+// signing in, except that an identity the user unlinked from the
+// provider is refused rather than linked back. It returns false if
+// the sign in should stop.
+func (sessionRoutes *SessionRoutes) recordIdentity(c *gin.Context, authUser *auth.AuthUser, identity *identities.Identity) bool {
+	err := sessionRoutes.Identities.Used(c, authUser.Id, identity)
+
+	if err != nil {
+		if errors.Is(err, identities.ErrIdentityUnlinked) {
+			web.UnauthorizedResp(c, err)
+			return false
+		}
+
+		log.Warn().Msgf("could not record %s identity for %s: %v", identity.Provider, authUser.Id, err)
+	}
+
+	return true
+}
+
+// recordFailedIdentity adds a failed sign in to the history of the
+// account an identity belongs to, matching on email if the identity is
+// not linked. The identity must come from a token or assertion the
+// provider signed, otherwise anyone could fill a user's history.
+func (sessionRoutes *SessionRoutes) recordFailedIdentity(c *gin.Context,
+	identityProvider string,
+	subject string,
+	email string,
+	method string,
+	provider string,
+	reason error) {
+	userId, err := sessionRoutes.Identities.Find(c, identityProvider, subject)
+
+	var authUser *auth.AuthUser
+
+	switch {
+	case err == nil || errors.Is(err, identities.ErrIdentityUnlinked):
+		authUser, err = userdbcache.FindUserById(userId)
+	case errors.Is(err, identities.ErrIdentityNotFound) && email != "":
+		authUser, err = userdbcache.FindUserByUsername(email)
+	}
+
+	if err != nil {
+		return
+	}
+
+	sessionRoutes.SignInRoutes.RecordFailedSignIn(c, authUser, method, provider, reason)
+}
+
+// List the sign in methods linked to the session user
+func (sessionRoutes *SessionRoutes) SessionProvidersRoute(c *gin.Context) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	list, err := sessionRoutes.Identities.List(c, user.(*auth.AuthUser).Id)
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	web.MakeDataResp(c, "", list)
+}
+
+// Link another provider to the session user. The client signs in at the
+// provider and sends us the token it gets back, which need not have the
+// same email address as the account.
+func (sessionRoutes *SessionRoutes) SessionLinkProviderRoute(c *gin.Context) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	authUser := user.(*auth.AuthUser)
+
+	provider, err := sessionRoutes.Providers.Provider(c.Param("provider"))
+
+	if err != nil {
+		web.BadReqResp(c, err)
+		return
+	}
+
+	tokenString, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+	if !ok || tokenString == "" {
+		auth.TokenErrorResp(c)
+		return
+	}
+
+	identity, err := provider.Verify(c, tokenString)
+
+	if err != nil {
+		web.UnauthorizedResp(c, err)
+		return
+	}
+
+	err = sessionRoutes.Identities.Link(c, authUser.Id, newIdentity(provider, identity))
+
+	if err != nil {
+		if errors.Is(err, identities.ErrIdentityLinked) ||
+			errors.Is(err, identities.ErrProviderAlreadyLinked) {
+			web.BadReqResp(c, err)
+		} else {
+			c.Error(err)
+		}
+
+		return
+	}
+
+	web.MakeOkResp(c, "provider linked")
+}
+
+// Unlink a provider from the session user as long as they
+// are left with another way to sign in
+func (sessionRoutes *SessionRoutes) SessionUnlinkProviderRoute(c *gin.Context) {
+	user, ok := c.Get(web.SessionUser)
+
+	if !ok {
+		web.UnauthorizedResp(c, ErrNoSessionUser)
+		return
+	}
+
+	err := sessionRoutes.Identities.Unlink(c, user.(*auth.AuthUser).Id, c.Param("provider"))
+
+	if err != nil {
+		if errors.Is(err, identities.ErrIdentityNotFound) ||
+			errors.Is(err, identities.ErrLastSignInMethod) ||
+			errors.Is(err, identities.ErrPasswordNotUnlinkable) {
+			web.BadReqResp(c, err)
+		} else {
+			c.Error(err)
+		}
+
+		return
+	}
+
+	web.MakeOkResp(c, "provider unlinked")
+}
@@ -2,83 +2,102 @@ package session
 
 import (
 	"context"
+	"errors"
 
+	"github.com/antonybholmes/go-edbserver-gin/accessrequests"
+	"github.com/antonybholmes/go-edbserver-gin/announcements"
+	"github.com/antonybholmes/go-edbserver-gin/confirmations"
 	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/datasetacl"
+	"github.com/antonybholmes/go-edbserver-gin/devicecode"
+	"github.com/antonybholmes/go-edbserver-gin/identities"
+	"github.com/antonybholmes/go-edbserver-gin/notifications"
+	"github.com/antonybholmes/go-edbserver-gin/oidc"
 	"github.com/antonybholmes/go-edbserver-gin/routes/authentication"
+	"github.com/antonybholmes/go-edbserver-gin/saml"
+	"github.com/antonybholmes/go-edbserver-gin/sessionstore"
+	"github.com/antonybholmes/go-edbserver-gin/signinguard"
+	"github.com/antonybholmes/go-edbserver-gin/signinhistory"
+	"github.com/antonybholmes/go-edbserver-gin/signuppolicy"
 	"github.com/antonybholmes/go-sys/log"
 	"github.com/antonybholmes/go-web/auth"
-	"github.com/antonybholmes/go-web/auth/oauth2"
 	"github.com/antonybholmes/go-web/middleware"
 	csrfmiddleware "github.com/antonybholmes/go-web/middleware/csrf"
-	omw "github.com/antonybholmes/go-web/middleware/oauth2"
 	"github.com/gin-gonic/gin"
 )
 
 func RegisterRoutes(r *gin.Engine,
 	otp *auth.OTP,
-
+	store *sessionstore.SessionStore,
+	deviceCodes *devicecode.DeviceCodeStore,
+	samlRequests *saml.RequestStore,
+	identityStore *identities.IdentityStore,
+	signInGuard *signinguard.Guard,
+	signInHistory *signinhistory.HistoryStore,
+	signupPolicy *signuppolicy.Policy,
+	botVerifier signuppolicy.BotVerifier,
+	confirmationStore *confirmations.ConfirmationStore,
+	accessPolicy *accessrequests.Policy,
+	preferences *notifications.Preferences,
+	announcementStore *announcements.AnnouncementStore,
+	datasetACL *datasetacl.ACL,
 	jwtUserMiddleWare gin.HandlerFunc) {
 
 	ctx := context.Background()
 
-	// auth0OIDCVerifer, err := oauth2.NewOIDCVerifier(ctx,
-	// 	consts.Auth0Domain,
-	// 	consts.Auth0Audience,
-	// 	consts.Auth0EmailClaim,
-	// 	consts.Auth0NameClaim)
-
-	auth0OIDCVerifer, err := oauth2.NewStandardOIDCVerifier(ctx,
-		consts.Auth0Domain,
-		consts.Auth0Audience)
+	// identity providers users can sign in with. A provider that is
+	// misconfigured or unreachable is disabled rather than stopping
+	// the server, unless all it is missing is its issuer
+	providersConfig, err := oidc.LoadConfig(consts.OIDCProvidersFile)
 
 	if err != nil {
-		log.Fatal().Msgf("failed to create auth0 oidc verifier: %v", err)
+		log.Error().Msgf("failed to load oidc providers: %v", err)
+		providersConfig = &oidc.Config{}
 	}
 
-	// so we can verify cognito tokens
-	congnitoOIDCVerifer, err := oauth2.NewStandardOIDCVerifier(ctx,
-		consts.CognitoDomain,
-		consts.CognitoAudience,
-	)
+	providers := oidc.NewRegistry(ctx, providersConfig)
 
-	if err != nil {
-		log.Fatal().Msgf("failed to create cognito oidc verifier: %v", err)
+	for name, err := range providers.Disabled {
+		// users of a provider that is set up would be unable to sign in
+		// with no sign of why other than this
+		if errors.Is(err, oidc.ErrIssuerNotSet) {
+			log.Fatal().Msgf("oidc provider %s: %v, set its issuer or disable it", name, err)
+		}
+
+		log.Warn().Msgf("oidc provider %s disabled: %v", name, err)
 	}
 
-	clerkOIDCVerifer, err := oauth2.NewStandardOIDCVerifier(ctx,
-		consts.ClerkDomain,
-		consts.ClerkAudience,
-	)
+	// saml identity providers, e.g. universities, are set up the same way
+	samlConfig, err := saml.LoadConfig(consts.SAMLProvidersFile)
 
 	if err != nil {
-		log.Fatal().Msgf("failed to create clerk oidc verifier: %v", err)
+		log.Error().Msgf("failed to load saml providers: %v", err)
+		samlConfig = &saml.Config{}
 	}
 
-	// supabaseOIDCVerifer, err := oauth2.NewStandardOIDCVerifier(ctx,
-	// 	consts.SupabaseDomain,
-	// 	consts.SupabaseAudience,
-	// )
+	samlProviders := saml.NewRegistry(samlConfig)
 
-	// if err != nil {
-	// 	log.Fatal().Msgf("failed to create supabase oidc verifier: %v", err)
-	// }
+	for name, err := range samlProviders.Disabled {
+		log.Warn().Msgf("saml provider %s disabled: %v", name, err)
+	}
 
 	otpRoutes := authentication.NewOTPRoutes(otp)
 
-	sessionRoutes := NewSessionRoutes(otpRoutes)
-
-	sessionMiddleware := middleware.SessionIsValidMiddleware()
+	signInRoutes := authentication.NewSignInRoutes(signInGuard, signInHistory)
 
-	//jwtAuth0Middleware2 := omw.JwtAuth0Middleware(consts.JwtAuth0RsaPublicKey)
-	jwtAuth0Middleware := omw.JwtOIDCMiddleware(auth0OIDCVerifer)
+	signupRoutes := authentication.NewSignupRoutes(signupPolicy, botVerifier)
 
-	jwtCognitoMiddleware := omw.JwtOIDCMiddleware(congnitoOIDCVerifer)
+	sessionRoutes := NewSessionRoutes(otpRoutes,
+		store,
+		providers,
+		identityStore,
+		signInRoutes,
+		signupRoutes)
 
-	//jwtClerkMiddleware := omw.JwtClerkMiddleware(consts.JwtClerkRsaPublicKey)
-	jwtClerkMiddleware := omw.JwtOIDCMiddleware(clerkOIDCVerifer)
+	sessionMiddleware := middleware.SessionIsValidMiddleware()
 
-	//jwtSupabaseMiddleware := omw.JwtOIDCMiddleware(supabaseOIDCVerifer)
-	jwtSupabaseMiddleware := omw.JwtSupabaseMiddleware(consts.SupabaseJwtSecretKey)
+	// cookie must also still exist in the server side store
+	sessionStoreMiddleware := sessionRoutes.SessionStoreMiddleware()
 
 	csrfMiddleware := csrfmiddleware.CSRFValidateMiddleware()
 
@@ -88,21 +107,15 @@ func RegisterRoutes(r *gin.Engine,
 
 	sessionOAuth2Group := sessionAuthGroup.Group("/oauth2")
 
-	sessionOAuth2Group.POST("/auth0/signin",
-		jwtAuth0Middleware,
-		sessionRoutes.SessionSignInUsingAuth0Route)
+	sessionOAuth2Group.POST("/:provider/signin",
+		sessionRoutes.SessionSignInUsingOIDCRoute)
 
-	sessionOAuth2Group.POST("/cognito/signin",
-		jwtCognitoMiddleware,
-		sessionRoutes.SessionSignInUsingCognitoRoute)
+	samlRoutes := NewSAMLRoutes(sessionRoutes, samlProviders, samlRequests)
 
-	sessionOAuth2Group.POST("/clerk/signin",
-		jwtClerkMiddleware,
-		sessionRoutes.SessionSignInUsingClerkRoute)
-
-	sessionOAuth2Group.POST("/supabase/signin",
-		jwtSupabaseMiddleware,
-		sessionRoutes.SessionSignInUsingSupabaseRoute)
+	sessionSAMLGroup := sessionAuthGroup.Group("/saml")
+	sessionSAMLGroup.GET("/metadata", samlRoutes.MetadataRoute)
+	sessionSAMLGroup.POST("/acs", samlRoutes.AcsRoute)
+	sessionSAMLGroup.GET("/:provider/signin", samlRoutes.SignInRoute)
 
 	sessionAuthGroup.POST("/signin",
 		sessionRoutes.SessionUsernamePasswordSignInRoute)
@@ -118,11 +131,29 @@ func RegisterRoutes(r *gin.Engine,
 		jwtUserMiddleWare,
 		sessionRoutes.SessionPasswordlessValidateSignInRoute)
 
+	// device authorization grant for cli tools and notebooks. The
+	// client endpoints are public, approval needs a browser session
+	deviceRoutes := NewDeviceRoutes(deviceCodes, signInRoutes)
+
+	sessionDeviceGroup := sessionGroup.Group("/device")
+	sessionDeviceGroup.POST("/code", deviceRoutes.DeviceCodeRoute)
+	sessionDeviceGroup.POST("/token", deviceRoutes.DeviceTokenRoute)
+	sessionDeviceGroup.GET("",
+		sessionMiddleware,
+		sessionStoreMiddleware,
+		deviceRoutes.DeviceLookupRoute)
+	sessionDeviceGroup.POST("",
+		csrfMiddleware,
+		sessionMiddleware,
+		sessionStoreMiddleware,
+		deviceRoutes.DeviceApproveRoute)
+
 	sessionGroup.POST("/api/keys/signin",
 		sessionRoutes.SessionApiKeySignInRoute)
 
 	sessionGroup.GET("/info",
 		sessionMiddleware,
+		sessionStoreMiddleware,
 		sessionRoutes.SessionInfoRoute)
 
 	sessionGroup.GET("/csrf",
@@ -132,16 +163,28 @@ func RegisterRoutes(r *gin.Engine,
 	sessionGroup.POST("/signout",
 		//csrfMiddleware,
 		sessionMiddleware,
-		SessionSignOutRoute)
+		sessionStoreMiddleware,
+		sessionRoutes.SessionSignOutRoute)
 
 	sessionGroup.POST("/sign-out",
 		//csrfMiddleware,
 		sessionMiddleware,
-		SessionSignOutRoute)
+		sessionStoreMiddleware,
+		sessionRoutes.SessionSignOutRoute)
+
+	// active sessions of the user so they can be signed out remotely
+	sessionListGroup := sessionGroup.Group("/list",
+		csrfMiddleware,
+		sessionMiddleware,
+		sessionStoreMiddleware)
+	sessionListGroup.GET("", sessionRoutes.SessionListRoute)
+	sessionListGroup.POST("/revoke", sessionRoutes.SessionRevokeRoute)
+	sessionListGroup.POST("/revoke/others", sessionRoutes.SessionRevokeOthersRoute)
 
 	sessionTokensGroup := sessionGroup.Group("/tokens",
 		csrfMiddleware,
-		sessionMiddleware)
+		sessionMiddleware,
+		sessionStoreMiddleware)
 
 	//sessionTokensGroup.POST("/access",
 	//		authenticationroutes.NewAccessTokenFromSessionRoute)
@@ -154,15 +197,57 @@ func RegisterRoutes(r *gin.Engine,
 	sessionGroup.POST("/refresh",
 		csrfMiddleware,
 		sessionMiddleware,
+		sessionStoreMiddleware,
 		sessionRoutes.SessionRefreshRoute)
 
 	sessionUserGroup := sessionGroup.Group("/user",
 		csrfMiddleware,
-		sessionMiddleware)
+		sessionMiddleware,
+		sessionStoreMiddleware)
 	sessionUserGroup.GET("", UserFromSessionRoute)
 	sessionUserGroup.POST("/update",
 		SessionUpdateUserRoute)
 
 	sessionUserGroup.POST("/passwords/update",
-		SessionUpdatePasswordRoute)
+		sessionRoutes.SessionUpdatePasswordRoute)
+
+	// sign in methods linked to the account
+	sessionUserGroup.GET("/providers", sessionRoutes.SessionProvidersRoute)
+	sessionUserGroup.POST("/providers/:provider/link", sessionRoutes.SessionLinkProviderRoute)
+	sessionUserGroup.DELETE("/providers/:provider", sessionRoutes.SessionUnlinkProviderRoute)
+
+	// download or delete everything we hold about the user
+	accountRoutes := NewAccountRoutes(store,
+		identityStore,
+		confirmationStore,
+		signInRoutes,
+		accessPolicy.Requests,
+		datasetACL,
+		announcementStore)
+
+	sessionUserGroup.GET("/export", accountRoutes.SessionExportAccountRoute)
+	sessionUserGroup.POST("/delete", accountRoutes.SessionDeleteAccountRoute)
+	sessionUserGroup.POST("/delete/confirm", accountRoutes.SessionConfirmDeleteAccountRoute)
+
+	// when and where the account was signed in to
+	sessionUserGroup.GET("/signins", accountRoutes.SessionSignInHistoryRoute)
+
+	// asking for access to groups and datasets
+	accessRoutes := NewAccessRoutes(accessPolicy)
+
+	sessionUserGroup.GET("/access", accessRoutes.SessionRequestableRoute)
+	sessionUserGroup.GET("/access/requests", accessRoutes.SessionAccessRequestsRoute)
+	sessionUserGroup.POST("/access/requests", accessRoutes.SessionRequestAccessRoute)
+	sessionUserGroup.POST("/access/requests/:id/cancel", accessRoutes.SessionCancelAccessRequestRoute)
+
+	// which kinds of email the user gets
+	notificationsRoutes := NewNotificationsRoutes(preferences)
+
+	sessionUserGroup.GET("/notifications", notificationsRoutes.SessionNotificationsRoute)
+	sessionUserGroup.POST("/notifications", notificationsRoutes.SessionUpdateNotificationsRoute)
+
+	// announcements for the groups the user is in, for clients to poll
+	announcementsRoutes := NewAnnouncementsRoutes(announcementStore)
+
+	sessionUserGroup.GET("/announcements", announcementsRoutes.SessionAnnouncementsRoute)
 }
@@ -0,0 +1,211 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/identities"
+	"github.com/antonybholmes/go-edbserver-gin/saml"
+	"github.com/antonybholmes/go-edbserver-gin/signinhistory"
+	"github.com/antonybholmes/go-edbserver-gin/signuppolicy"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/antonybholmes/go-web/auth"
+	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
+	"github.com/gin-gonic/gin"
+)
+
+// Sign in with SAML identity providers. The browser is sent to the
+// provider which posts the signed response back to the acs route, where
+// we create the session cookie and send the browser back to the app.
+
+type SAMLRoutes struct {
+	SessionRoutes *SessionRoutes
+	Registry      *saml.Registry
+	Requests      *saml.RequestStore
+}
+
+func NewSAMLRoutes(sessionRoutes *SessionRoutes,
+	registry *saml.Registry,
+	requests *saml.RequestStore) *SAMLRoutes {
+	return &SAMLRoutes{SessionRoutes: sessionRoutes,
+		Registry: registry,
+		Requests: requests}
+}
+
+// saml identities are kept apart from oidc ones with the same name
+func samlIdentityProvider(provider *saml.Provider) string {
+	return "saml:" + provider.Name()
+}
+
+// only send users back to our own app
+func samlRedirectUrl(redirectUrl string) string {
+	if redirectUrl == "" || !strings.HasPrefix(redirectUrl, consts.AppUrl) {
+		return consts.AppUrl
+	}
+
+	return redirectUrl
+}
+
+// Metadata describing our service provider for identity providers
+func (samlRoutes *SAMLRoutes) MetadataRoute(c *gin.Context) {
+	data, err := samlRoutes.Registry.Metadata()
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/samlmetadata+xml", data)
+}
+
+// Send the browser to sign in at a provider, e.g.
+// /sessions/auth/saml/example-university/signin?redirectUrl=...
+func (samlRoutes *SAMLRoutes) SignInRoute(c *gin.Context) {
+	provider, err := samlRoutes.Registry.Provider(c.Param("provider"))
+
+	if err != nil {
+		web.BadReqResp(c, err)
+		return
+	}
+
+	req, err := samlRoutes.Requests.Create(c, provider.Name(), samlRedirectUrl(c.Query("redirectUrl")))
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	url, err := samlRoutes.Registry.AuthnRequestUrl(provider, req.Id, "")
+
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Redirect(http.StatusFound, url)
+}
+
+// Assertion consumer service the provider posts its response to
+func (samlRoutes *SAMLRoutes) AcsRoute(c *gin.Context) {
+	sessionRoutes := samlRoutes.SessionRoutes
+
+	response, err := saml.ParseResponse(c.PostForm("SAMLResponse"))
+
+	if err != nil {
+		web.BadReqResp(c, err)
+		return
+	}
+
+	// we only accept responses to requests we made. The request is
+	// only used up once its response has been verified, otherwise
+	// anyone who saw its id could post junk to cancel the sign in.
+	req, err := samlRoutes.Requests.Get(c, response.InResponseTo)
+
+	if err != nil {
+		if errors.Is(err, saml.ErrUnknownRequest) {
+			web.UnauthorizedResp(c, err)
+		} else {
+			c.Error(err)
+		}
+
+		return
+	}
+
+	provider, err := samlRoutes.Registry.Provider(req.Provider)
+
+	if err != nil {
+		web.BadReqResp(c, err)
+		return
+	}
+
+	identity, err := samlRoutes.Registry.Verify(provider, response, req.Id)
+
+	if err != nil {
+		log.Debug().Msgf("%s saml response rejected: %v", provider.Name(), err)
+
+		// we know who a signed assertion that failed its checks was for
+		if identity != nil {
+			sessionRoutes.recordFailedIdentity(c, samlIdentityProvider(provider), identity.Subject, identity.Email, signinhistory.MethodSAML, provider.Name(), err)
+		}
+
+		web.UnauthorizedResp(c, err)
+		return
+	}
+
+	// and only once
+	_, err = samlRoutes.Requests.Consume(c, req.Id)
+
+	if err != nil {
+		if errors.Is(err, saml.ErrUnknownRequest) {
+			web.UnauthorizedResp(c, err)
+		} else {
+			c.Error(err)
+		}
+
+		return
+	}
+
+	// as with oidc, a known identity signs in to the account it is
+	// linked to, otherwise match on the email the provider asserts
+	userId, err := sessionRoutes.Identities.Find(c, samlIdentityProvider(provider), identity.Subject)
+
+	var authUser *auth.AuthUser
+
+	switch {
+	case err == nil:
+		authUser, err = userdbcache.FindUserById(userId)
+
+		if err != nil {
+			web.UnauthorizedResp(c, auth.ErrUserDoesNotExist)
+			return
+		}
+	case errors.Is(err, identities.ErrIdentityUnlinked):
+		sessionRoutes.recordFailedIdentity(c, samlIdentityProvider(provider), identity.Subject, "", signinhistory.MethodSAML, provider.Name(), err)
+		web.UnauthorizedResp(c, err)
+		return
+	case errors.Is(err, identities.ErrIdentityNotFound):
+		email, err := mail.ParseAddress(identity.Email)
+
+		if err != nil {
+			web.BadReqResp(c, err)
+			return
+		}
+
+		if !sessionRoutes.checkNewAccount(c, &signuppolicy.PendingSignup{
+			Email:        email.Address,
+			Username:     email.Address,
+			Name:         identity.Name,
+			AuthProvider: identity.AuthProvider}, false) {
+			return
+		}
+
+		authUser, err = userdbcache.CreateUserFromOAuth2(email, identity.Name, "", identity.AuthProvider)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+	default:
+		c.Error(err)
+		return
+	}
+
+	if !sessionRoutes.recordIdentity(c, authUser, &identities.Identity{
+		Provider:     samlIdentityProvider(provider),
+		AuthProvider: identity.AuthProvider,
+		Subject:      identity.Subject,
+		Email:        identity.Email,
+		Groups:       identity.Groups}) {
+		return
+	}
+
+	if !sessionRoutes.signInWithProvider(c, authUser, signinhistory.MethodSAML, provider.Name()) {
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, samlRedirectUrl(req.RedirectUrl))
+}
@@ -11,16 +11,19 @@ import (
 	"time"
 
 	edbmail "github.com/antonybholmes/go-edbmailserver/mail"
+	"github.com/antonybholmes/go-edbserver-gin/identities"
+	"github.com/antonybholmes/go-edbserver-gin/oidc"
+	"github.com/antonybholmes/go-edbserver-gin/outbox"
 	"github.com/antonybholmes/go-edbserver-gin/routes/authentication"
+	"github.com/antonybholmes/go-edbserver-gin/sessionstore"
+	"github.com/antonybholmes/go-edbserver-gin/signinhistory"
+	"github.com/antonybholmes/go-edbserver-gin/signuppolicy"
 	mailserver "github.com/antonybholmes/go-mailserver"
-	"github.com/antonybholmes/go-mailserver/mailqueue"
 	"github.com/antonybholmes/go-sys/log"
 	"github.com/antonybholmes/go-web"
 	"github.com/antonybholmes/go-web/auth"
-	"github.com/antonybholmes/go-web/auth/oauth2"
 	"github.com/antonybholmes/go-web/auth/token"
 	"github.com/antonybholmes/go-web/auth/token/tokengen"
-	"github.com/antonybholmes/go-web/auth/userdb"
 	userdbcache "github.com/antonybholmes/go-web/auth/userdb/cache"
 	"github.com/antonybholmes/go-web/middleware"
 	csrfmiddleware "github.com/antonybholmes/go-web/middleware/csrf"
@@ -30,18 +33,35 @@ import (
 
 const MaxAgeOneYearSecs = 31536000 // 60 * 60 * 24 * 365
 
+// key in the cookie session pointing to the server side session
+const SessionId = "sessionId"
+
+// key in the gin context for the server side session info
+const SessionInfoKey = "sessionInfo"
+
 var (
-	ErrNoSessionUser  = auth.NewAccountError("no auth user")
-	ErrSavingSession  = errors.New("error saving session")
-	ErrSessionExpired = errors.New("session not found or expired")
+	ErrNoSessionUser              = auth.NewAccountError("no auth user")
+	ErrEmailNotVerifiedByProvider = auth.NewAccountError("email address has not been verified by the provider")
+	ErrSavingSession              = errors.New("error saving session")
+	ErrSessionExpired             = errors.New("session not found or expired")
 )
 
 type SessionRoutes struct {
 	sessionOptions sessions.Options
 	OTPRoutes      *authentication.OTPRoutes
+	Store          *sessionstore.SessionStore
+	Providers      *oidc.Registry
+	Identities     *identities.IdentityStore
+	SignInRoutes   *authentication.SignInRoutes
+	Signups        *authentication.SignupRoutes
 }
 
-func NewSessionRoutes(otpRoutes *authentication.OTPRoutes) *SessionRoutes {
+func NewSessionRoutes(otpRoutes *authentication.OTPRoutes,
+	store *sessionstore.SessionStore,
+	providers *oidc.Registry,
+	identityStore *identities.IdentityStore,
+	signInRoutes *authentication.SignInRoutes,
+	signupRoutes *authentication.SignupRoutes) *SessionRoutes {
 	maxAge := auth.MaxAge7DaysSecs
 
 	t := os.Getenv("SESSION_TTL_HOURS")
@@ -63,11 +83,25 @@ func NewSessionRoutes(otpRoutes *authentication.OTPRoutes) *SessionRoutes {
 		SameSite: http.SameSiteNoneMode,
 	}
 
-	return &SessionRoutes{sessionOptions: options, OTPRoutes: otpRoutes}
+	return &SessionRoutes{sessionOptions: options,
+		OTPRoutes:    otpRoutes,
+		Store:        store,
+		Providers:    providers,
+		Identities:   identityStore,
+		SignInRoutes: signInRoutes,
+		Signups:      signupRoutes}
 }
 
 // initialize a session with default age and ids
 func (sessionRoutes *SessionRoutes) initSession(c *gin.Context, authUser *auth.AuthUser) error {
+	return sessionRoutes.saveSession(c, authUser, sessionRoutes.sessionOptions)
+}
+
+// saveSession records the session server side and writes the cookie
+// using the supplied options
+func (sessionRoutes *SessionRoutes) saveSession(c *gin.Context,
+	authUser *auth.AuthUser,
+	options sessions.Options) error {
 
 	userData, err := json.Marshal(authUser)
 
@@ -85,17 +119,37 @@ func (sessionRoutes *SessionRoutes) initSession(c *gin.Context, authUser *auth.A
 
 	sess := sessions.Default(c) // .Get(consts.SESSION_NAME, c)
 
+	// if the browser already had a session, e.g. signing in as
+	// another user, drop it so it does not linger in the list
+	if id, ok := sess.Get(SessionId).(string); ok && id != "" {
+		if info, err := sessionRoutes.Store.Get(c, id); err == nil {
+			sessionRoutes.Store.Revoke(c, info.UserId, id)
+		}
+	}
+
+	ttl := time.Duration(sessionRoutes.sessionOptions.MaxAge) * time.Second
+
+	info, err := sessionRoutes.Store.Create(c,
+		authUser.Id,
+		c.Request.UserAgent(),
+		c.ClientIP(),
+		ttl)
+
+	if err != nil {
+		return err
+	}
+
 	// set session options
-	sess.Options(sessionRoutes.sessionOptions)
+	sess.Options(options)
 
 	//sess.Values[SESSION_PUBLICID] = authUser.PublicId
 	//sess.Values[SESSION_ROLES] = roles //auth.MakeClaim(authUser.Roles)
 	sess.Set(web.SessionUser, string(userData))
+	sess.Set(SessionId, info.Id)
 	//sess.Set(web.SESSION_CSRF_TOKEN, csrfToken)
 
-	now := time.Now().UTC()
-	sess.Set(web.SessionCreatedAt, now.Format(time.RFC3339))
-	sess.Set(web.SessionExpiresAt, now.Add(time.Duration(sessionRoutes.sessionOptions.MaxAge)*time.Second).Format(time.RFC3339))
+	sess.Set(web.SessionCreatedAt, info.CreatedAt.Format(time.RFC3339))
+	sess.Set(web.SessionExpiresAt, info.ExpiresAt.Format(time.RFC3339))
 
 	err = sess.Save() //c.Request(), c.Response())
 
@@ -141,7 +195,7 @@ func (sessionRoutes *SessionRoutes) initSession(c *gin.Context, authUser *auth.A
 // }
 
 func (sessionRoutes *SessionRoutes) SessionUsernamePasswordSignInRoute(c *gin.Context) {
-	validator, err := middleware.NewValidator(c).LoadAuthUserFromUsername().Ok()
+	validator, err := middleware.NewValidator(c).ParseSignInRequestBody().Ok()
 
 	if err != nil {
 		c.Error(err)
@@ -153,20 +207,6 @@ func (sessionRoutes *SessionRoutes) SessionUsernamePasswordSignInRoute(c *gin.Co
 		return
 	}
 
-	user := validator.UserBodyReq.Username
-
-	authUser, err := userdbcache.FindUserByUsername(user)
-
-	if err != nil {
-		web.UserDoesNotExistResp(c)
-		return
-	}
-
-	if authUser.EmailVerifiedAt == nil {
-		web.EmailNotVerifiedReq(c)
-		return
-	}
-
 	// roles, err := userdbcache.UserRoleSet(authUser)
 
 	// if err != nil {
@@ -176,50 +216,39 @@ func (sessionRoutes *SessionRoutes) SessionUsernamePasswordSignInRoute(c *gin.Co
 
 	//roleClaim := auth.MakeClaim(roles)
 
-	if !auth.UserHasWebLoginInRole(authUser) {
-		web.UserNotAllowedToSignInErrorResp(c)
-		return
-	}
-
-	err = authUser.CheckPasswordsMatch(validator.UserBodyReq.Password)
+	authUser, ok := sessionRoutes.SignInRoutes.CheckPasswordSignIn(c,
+		validator.UserBodyReq.Username,
+		validator.UserBodyReq.Password)
 
-	if err != nil {
-		c.Error(err)
-		return
-	}
-
-	userData, err := json.Marshal(authUser)
-
-	if err != nil {
-		c.Error(err)
+	if !ok {
 		return
 	}
 
-	sess := sessions.Default(c) //Key(consts.SESSION_NAME)
+	sessionRoutes.recordIdentity(c, authUser, &identities.Identity{
+		Provider:     identities.ProviderPassword,
+		AuthProvider: identities.ProviderPassword,
+		Subject:      authUser.Id,
+		Email:        authUser.Email})
 
 	// set session options
-	if validator.UserBodyReq.StaySignedIn {
-		sess.Options(sessionRoutes.sessionOptions)
-	} else {
-		sess.Options(middleware.SessionOptsZero)
-	}
-
-	sess.Set(web.SessionUser, string(userData))
+	options := sessionRoutes.sessionOptions
 
-	now := time.Now().UTC()
-	sess.Set(web.SessionCreatedAt, now.Format(time.RFC3339))
-	sess.Set(web.SessionExpiresAt, now.Add(time.Duration(sessionRoutes.sessionOptions.MaxAge)*time.Second).Format(time.RFC3339))
+	if !validator.UserBodyReq.StaySignedIn {
+		options = middleware.SessionOptsZero
+	}
 
 	//sess.Values[SESSION_PUBLICID] = authUser.PublicId
 	//sess.Values[SESSION_ROLES] = roleClaim //auth.MakeClaim(authUser.Roles)
 
-	err = sess.Save() //c.Request(), c.Response())
+	err = sessionRoutes.saveSession(c, authUser, options)
 
 	if err != nil {
 		c.Error(err)
 		return
 	}
 
+	sessionRoutes.SignInRoutes.RecordSignIn(c, authUser, signinhistory.MethodPassword, "")
+
 	csrfmiddleware.MakeNewCSRFTokenResp(c)
 	//return c.NoContent(http.StatusOK)
 }
@@ -240,6 +269,7 @@ func (sessionRoutes *SessionRoutes) SessionApiKeySignInRoute(c *gin.Context) {
 	}
 
 	if authUser.EmailVerifiedAt == nil {
+		sessionRoutes.SignInRoutes.RecordFailedSignIn(c, authUser, signinhistory.MethodApiKey, "", authentication.ErrEmailNotVerified)
 		web.EmailNotVerifiedReq(c)
 		return
 	}
@@ -254,6 +284,7 @@ func (sessionRoutes *SessionRoutes) SessionApiKeySignInRoute(c *gin.Context) {
 	//roleClaim := auth.MakeClaim(roles)
 
 	if !auth.UserHasWebLoginInRole(authUser) {
+		sessionRoutes.SignInRoutes.RecordFailedSignIn(c, authUser, signinhistory.MethodApiKey, "", authentication.ErrNotAllowedToSignIn)
 		web.UserNotAllowedToSignInErrorResp(c)
 		return
 	}
@@ -265,6 +296,8 @@ func (sessionRoutes *SessionRoutes) SessionApiKeySignInRoute(c *gin.Context) {
 		return
 	}
 
+	sessionRoutes.SignInRoutes.RecordSignIn(c, authUser, signinhistory.MethodApiKey, "")
+
 	//MakeCsrfTokenResp(c, token)
 
 	web.MakeOkResp(c, "user has been signed in")
@@ -278,161 +311,101 @@ func (sessionRoutes *SessionRoutes) SessionApiKeySignInRoute(c *gin.Context) {
 	// web.MakeDataResp(c, "", resp)
 }
 
-func (sessionRoutes *SessionRoutes) SessionSignInUsingAuth0Route(c *gin.Context) {
-	user, ok := c.Get(web.SessionUser)
-
-	if !ok {
-		auth.TokenErrorResp(c)
-
-		return
-	}
-
-	//tokenClaims := user.(*auth.Auth0TokenClaims)
-	tokenClaims := user.(*oauth2.OIDCClaims)
-
-	log.Debug().Msgf("auth0 claim 2s %v %v %v", tokenClaims.Issuer, tokenClaims.Audience, tokenClaims.Picture)
-
-	//myClaims := user.Claims.(*auth.TokenClaims) //hmm.Claims.(*TokenClaims)
-
-	//user := c.Get("user").(*jwt.Token)
-	//claims := user.Claims.(*TokenClaims)
-
-	//log.Debug().Msgf("auth0 claims %v", tokenClaims)
-	//log.Debug().Msgf("auth0 claims %v", tokenClaims.Email)
-
-	email, err := mail.ParseAddress(tokenClaims.Email)
+// Sign in using a token from any of the configured identity providers,
+// e.g. /sessions/auth/oauth2/auth0/signin
+func (sessionRoutes *SessionRoutes) SessionSignInUsingOIDCRoute(c *gin.Context) {
+	provider, err := sessionRoutes.Providers.Provider(c.Param("provider"))
 
 	if err != nil {
-		c.Error(err)
-		return
-	}
-
-	// determine auth provider from sub
-	authProvider := ""
-
-	switch {
-	case strings.Contains(tokenClaims.Subject, "google"):
-		authProvider = "google"
-	case strings.Contains(tokenClaims.Subject, "github"):
-		authProvider = "github"
-	default:
-		authProvider = "auth0"
-	}
-
-	authUser, err := userdbcache.CreateUserFromOAuth2(email, tokenClaims.Name, tokenClaims.Picture, authProvider)
-
-	if err != nil {
-		c.Error(err)
+		web.BadReqResp(c, err)
 		return
 	}
 
-	sessionRoutes.sessionSignInUsingOAuth2(c, authUser)
-}
-
-func (sessionRoutes *SessionRoutes) SessionSignInUsingCognitoRoute(c *gin.Context) {
-	user, ok := c.Get(web.SessionUser)
+	tokenString, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
 
-	if !ok {
+	if !ok || tokenString == "" {
 		auth.TokenErrorResp(c)
-
 		return
 	}
 
-	tokenClaims := user.(*oauth2.OIDCClaims)
-
-	//myClaims := user.Claims.(*auth.TokenClaims) //hmm.Claims.(*TokenClaims)
-
-	//user := c.Get("user").(*jwt.Token)
-	//claims := user.Claims.(*TokenClaims)
-
-	//log.Debug().Msgf("auth0 claims %v", tokenClaims)
-	//log.Debug().Msgf("auth0 claims %v", tokenClaims.Email)
-
-	email, err := mail.ParseAddress(tokenClaims.Email)
+	identity, err := provider.Verify(c, tokenString)
 
 	if err != nil {
-		c.Error(err)
-		return
-	}
-
-	authProvider := "cognito"
-
-	authUser, err := userdbcache.CreateUserFromOAuth2(email, tokenClaims.Name, tokenClaims.Picture, authProvider)
-
-	if err != nil {
-		c.Error(err)
-		return
-	}
+		log.Debug().Msgf("%s token rejected: %v", provider.Name(), err)
 
-	sessionRoutes.sessionSignInUsingOAuth2(c, authUser)
-}
-
-func (sessionRoutes *SessionRoutes) SessionSignInUsingClerkRoute(c *gin.Context) {
-	user, ok := c.Get(web.SessionUser)
-
-	if !ok {
-		auth.TokenErrorResp(c)
+		// we know who a signed token that failed its checks was for
+		if identity != nil {
+			sessionRoutes.recordFailedIdentity(c, provider.Name(), identity.Subject, identity.Email, signinhistory.MethodOIDC, provider.Name(), err)
+		}
 
+		web.UnauthorizedResp(c, err)
 		return
 	}
 
-	tokenClaims := user.(*oauth2.OIDCClaims)
-
-	email, err := mail.ParseAddress(tokenClaims.Email)
+	// an identity we have seen before signs in to the account it is
+	// linked to, even if the user changed their email at the provider
+	userId, err := sessionRoutes.Identities.Find(c, provider.Name(), identity.Subject)
 
-	if err != nil {
-		c.Error(err)
-		return
-	}
+	var authUser *auth.AuthUser
 
-	authProvider := "clerk"
-
-	authUser, err := userdbcache.CreateUserFromOAuth2(email, tokenClaims.Name, tokenClaims.Picture, authProvider)
+	switch {
+	case err == nil:
+		authUser, err = userdbcache.FindUserById(userId)
 
-	if err != nil {
-		c.Error(err)
+		if err != nil {
+			web.UnauthorizedResp(c, auth.ErrUserDoesNotExist)
+			return
+		}
+	case errors.Is(err, identities.ErrIdentityUnlinked):
+		// the user unlinked it, so it must not find its way back to
+		// the account by matching on email
+		sessionRoutes.recordFailedIdentity(c, provider.Name(), identity.Subject, "", signinhistory.MethodOIDC, provider.Name(), err)
+		web.UnauthorizedResp(c, err)
 		return
-	}
-
-	sessionRoutes.sessionSignInUsingOAuth2(c, authUser)
-}
+	case errors.Is(err, identities.ErrIdentityNotFound):
+		// otherwise fall back to matching on email, but only if the
+		// provider vouches for it, so that an unverified address at
+		// some provider cannot take over an existing account
+		if verified, ok := identity.Claims["email_verified"].(bool); ok && !verified {
+			sessionRoutes.recordFailedIdentity(c, provider.Name(), identity.Subject, identity.Email, signinhistory.MethodOIDC, provider.Name(), ErrEmailNotVerifiedByProvider)
+			web.UnauthorizedResp(c, ErrEmailNotVerifiedByProvider)
+			return
+		}
 
-func (sessionRoutes *SessionRoutes) SessionSignInUsingSupabaseRoute(c *gin.Context) {
-	user, ok := c.Get(web.SessionUser)
+		email, err := mail.ParseAddress(identity.Email)
 
-	if !ok {
-		auth.TokenErrorResp(c)
+		if err != nil {
+			c.Error(err)
+			return
+		}
 
-		return
-	}
+		if !sessionRoutes.checkNewAccount(c, &signuppolicy.PendingSignup{
+			Email:        email.Address,
+			Username:     email.Address,
+			Name:         identity.Name,
+			PictureUrl:   identity.Picture,
+			AuthProvider: identity.AuthProvider}, true) {
+			return
+		}
 
-	tokenClaims := user.(*token.SupabaseTokenClaims)
+		authUser, err = userdbcache.CreateUserFromOAuth2(email, identity.Name, identity.Picture, identity.AuthProvider)
 
-	email, err := mail.ParseAddress(tokenClaims.Email)
+		if err != nil {
+			c.Error(err)
+			return
+		}
 
-	if err != nil {
+		sessionRoutes.Signups.InviteUsed(c)
+	default:
 		c.Error(err)
 		return
 	}
 
-	name := tokenClaims.UserMetadata.DisplayName
-
-	if name == "" {
-		// google uses full name instead of display name
-		name = tokenClaims.UserMetadata.FullName
-	}
-
-	authProvider := "supabase"
-
-	authUser, err := userdbcache.CreateUserFromOAuth2(email, name, tokenClaims.UserMetadata.AvatarUrl, authProvider)
-	if err != nil {
-		c.Error(err)
+	if !sessionRoutes.recordIdentity(c, authUser, newIdentity(provider, identity)) {
 		return
 	}
 
-	//log.Debug().Msgf("user %v", authUser)
-
-	sessionRoutes.sessionSignInUsingOAuth2(c, authUser)
+	sessionRoutes.sessionSignInUsingOAuth2(c, authUser, signinhistory.MethodOIDC, provider.Name())
 }
 
 func (sessionRoutes *SessionRoutes) SessionEmailOTPRoute(c *gin.Context) {
@@ -453,6 +426,11 @@ func (sessionRoutes *SessionRoutes) SessionSignInUsingEmailAndOTPRoute(c *gin.Co
 	err = sessionRoutes.OTPRoutes.OTP.ValidateOTP(username, validator.UserBodyReq.OTP)
 
 	if err != nil {
+		// a wrong code for an existing account goes in its history
+		if authUser, findErr := userdbcache.FindUserByUsername(username); findErr == nil {
+			sessionRoutes.SignInRoutes.RecordFailedSignIn(c, authUser, signinhistory.MethodEmailOTP, identities.ProviderEmailOTP, err)
+		}
+
 		if auth.IsRateLimitError(err) {
 			web.TooManyRequestsResp(c, err)
 		} else {
@@ -464,6 +442,15 @@ func (sessionRoutes *SessionRoutes) SessionSignInUsingEmailAndOTPRoute(c *gin.Co
 
 	authProvider := "email_otp"
 
+	if !sessionRoutes.checkNewAccount(c, &signuppolicy.PendingSignup{
+		Email:        username,
+		Username:     username,
+		Name:         username,
+		PictureUrl:   validator.UserBodyReq.PictureUrl,
+		AuthProvider: authProvider}, true) {
+		return
+	}
+
 	authUser, err := userdbcache.CreateUserFromOAuth2(validator.Address, username, validator.UserBodyReq.PictureUrl, authProvider)
 
 	if err != nil {
@@ -472,29 +459,72 @@ func (sessionRoutes *SessionRoutes) SessionSignInUsingEmailAndOTPRoute(c *gin.Co
 		return
 	}
 
-	sessionRoutes.sessionSignInUsingOAuth2(c, authUser)
+	sessionRoutes.Signups.InviteUsed(c)
+
+	if !sessionRoutes.recordIdentity(c, authUser, &identities.Identity{
+		Provider:     identities.ProviderEmailOTP,
+		AuthProvider: authProvider,
+		Subject:      username,
+		Email:        username}) {
+		return
+	}
+
+	sessionRoutes.sessionSignInUsingOAuth2(c, authUser, signinhistory.MethodEmailOTP, authProvider)
 }
 
-func (sessionRoutes *SessionRoutes) sessionSignInUsingOAuth2(c *gin.Context, authUser *auth.AuthUser) {
+// checkNewAccount applies the signup policy if signing in would create
+// an account, i.e. no user has the email address yet. Requests made by
+// the client, rather than posted by an identity provider, must also pass
+// the same bot check as signing up.
+func (sessionRoutes *SessionRoutes) checkNewAccount(c *gin.Context, signup *signuppolicy.PendingSignup, botCheck bool) bool {
+	_, err := userdbcache.FindUserByUsername(signup.Email)
+
+	if err == nil {
+		return true
+	}
+
+	if botCheck && !sessionRoutes.Signups.CheckBot(c) {
+		return false
+	}
+
+	return sessionRoutes.Signups.CheckNewAccount(c, signup)
+}
+
+func (sessionRoutes *SessionRoutes) sessionSignInUsingOAuth2(c *gin.Context, authUser *auth.AuthUser, method string, provider string) {
+	if !sessionRoutes.signInWithProvider(c, authUser, method, provider) {
+		return
+	}
+
+	//log.Debug().Msgf("token %s", token)
+
+	csrfmiddleware.MakeNewCSRFTokenResp(c)
+
+	//web.MakeOkResp(c, "user has been signed in")
+}
+
+// signInWithProvider creates a session for a user an identity provider
+// vouched for. It returns false if the user is not allowed to sign in,
+// in which case a response has already been written.
+func (sessionRoutes *SessionRoutes) signInWithProvider(c *gin.Context, authUser *auth.AuthUser, method string, provider string) bool {
 
 	log.Debug().Msgf("user login %v %v", authUser, auth.UserHasWebLoginInRole(authUser))
 
 	if !auth.UserHasWebLoginInRole(authUser) {
+		sessionRoutes.SignInRoutes.RecordFailedSignIn(c, authUser, method, provider, authentication.ErrNotAllowedToSignIn)
 		web.UserNotAllowedToSignInErrorResp(c)
+		return false
 	}
 
 	err := sessionRoutes.initSession(c, authUser) // roleClaim)
 
 	if err != nil {
 		web.UnauthorizedResp(c, err)
-		return
+		return false
 	}
 
-	//log.Debug().Msgf("token %s", token)
-
-	csrfmiddleware.MakeNewCSRFTokenResp(c)
+	sessionRoutes.SignInRoutes.RecordSignIn(c, authUser, method, provider)
 
-	//web.MakeOkResp(c, "user has been signed in")
+	return true
 }
 
 // Validate the passwordless token we generated and create
@@ -523,6 +553,7 @@ func (sessionRoutes *SessionRoutes) SessionPasswordlessValidateSignInRoute(c *gi
 		//log.Debug().Msgf("user %v", authUser)
 
 		if !auth.UserHasWebLoginInRole(authUser) {
+			sessionRoutes.SignInRoutes.RecordFailedSignIn(c, authUser, signinhistory.MethodPasswordless, "", authentication.ErrNotAllowedToSignIn)
 			web.UserNotAllowedToSignInErrorResp(c)
 			return
 		}
@@ -534,13 +565,20 @@ func (sessionRoutes *SessionRoutes) SessionPasswordlessValidateSignInRoute(c *gi
 			return
 		}
 
+		sessionRoutes.SignInRoutes.RecordSignIn(c, authUser, signinhistory.MethodPasswordless, "")
+
 		web.MakeOkResp(c, "user has signed in") //MakeCsrfTokenResp(c, token)
 	})
 }
 
-func SessionSignOutRoute(c *gin.Context) {
+func (sessionRoutes *SessionRoutes) SessionSignOutRoute(c *gin.Context) {
 	sess := sessions.Default(c) //.Get(consts.SESSION_NAME, c)
 
+	// remove the server side session so the cookie cannot be reused
+	if info, ok := currentSessionInfo(c); ok {
+		sessionRoutes.Store.Revoke(c, info.UserId, info.Id)
+	}
+
 	//log.Debug().Msgf("invalidate session")
 
 	// invalidate by time
@@ -600,6 +638,12 @@ func (sessionRoutes *SessionRoutes) SessionRefreshRoute(c *gin.Context) {
 		return
 	}
 
+	authUser, ok = authentication.EnforceMemberships(c, authUser)
+
+	if !ok {
+		return
+	}
+
 	//
 	// For the moment just update the user info
 
@@ -646,7 +690,7 @@ func CreateTokenFromSessionRoute(c *gin.Context) {
 	//tokenType := c.Param("type")
 	//audience := c.Query("audience")
 
-	var req token.TokenRequest
+	var req authentication.ScopedTokenReq
 
 	err := c.ShouldBindJSON(&req)
 
@@ -664,12 +708,38 @@ func CreateTokenFromSessionRoute(c *gin.Context) {
 	// user must exist or middleware would have failed
 	user, _ := c.Get(web.SessionUser)
 
-	authUser := user.(*auth.AuthUser)
+	// the session copy of the user can be out of date, e.g. if
+	// a membership has ended since they signed in
+	authUser, err := userdbcache.FindUserById(user.(*auth.AuthUser).Id)
+
+	if err != nil {
+		web.UnauthorizedResp(c, auth.ErrUserDoesNotExist)
+		return
+	}
+
+	authUser, ok := authentication.EnforceMemberships(c, authUser)
+
+	if !ok {
+		return
+	}
 
 	var tokenStr string
 
 	roles := auth.GetRolesFromUser(authUser)
 
+	// clients can ask for a token that only has some of the
+	// permissions of the user, e.g. only ngs:view
+	if len(req.Permissions) > 0 {
+		if req.Type == "update" {
+			web.BadReqResp(c, authentication.ErrScopeNotForTokenType)
+			return
+		}
+
+		if !authentication.CheckScope(c, &req, roles) {
+			return
+		}
+	}
+
 	switch req.Type {
 	case "update":
 		// Generate encoded token and send it as response.
@@ -680,7 +750,11 @@ func CreateTokenFromSessionRoute(c *gin.Context) {
 		}
 	default:
 		// Generate access token and send it as response.
-		tokenStr, err = tokengen.AccessToken(c, authUser.Id, req.Audience, roles)
+		if len(req.Permissions) > 0 {
+			tokenStr, err = tokengen.AccessTokenUsingPermissions(c, authUser.Id, req.Audience, req.Permissions)
+		} else {
+			tokenStr, err = tokengen.AccessToken(c, authUser.Id, req.Audience, roles)
+		}
 
 		if err != nil {
 			err = token.NewTokenError(err.Error())
@@ -749,11 +823,18 @@ func SessionUpdateUserRoute(c *gin.Context) {
 			//VisitUrl:    validator.Req.VisitUrl
 		}
 
-		mailqueue.SendMail(&email)
+		err = outbox.SendMail(c, &email)
+
+		if err != nil {
+			log.Warn().Msgf("could not send account updated email: %v", err)
+		}
 	})
 }
 
-func SessionUpdatePasswordRoute(c *gin.Context) {
+// Change the session user's password. The current password is checked
+// by the sign in guard so it cannot be used to guess passwords without
+// limit.
+func (sessionRoutes *SessionRoutes) SessionUpdatePasswordRoute(c *gin.Context) {
 	user, _ := c.Get(web.SessionUser)
 
 	authUser := user.(*auth.AuthUser)
@@ -775,17 +856,16 @@ func SessionUpdatePasswordRoute(c *gin.Context) {
 		return
 	}
 
-	err = userdb.CheckPassword(req.Password)
-
-	if err != nil {
-		web.BadReqResp(c, auth.ErrPasswordDoesNotMeetCriteria)
+	if !sessionRoutes.SignInRoutes.CheckPassword(c, authUser, req.Password) {
 		return
 	}
 
-	err = authUser.CheckPasswordsMatch(req.Password)
-
-	if err != nil {
-		web.BadReqResp(c, auth.ErrPasswordsDoNotMatch)
+	// it is the new password that must meet the policy
+	if !authentication.CheckNewPassword(c,
+		authUser.Id,
+		req.NewPassword,
+		authUser.Name,
+		authUser.Email) {
 		return
 	}
 
@@ -796,5 +876,7 @@ func SessionUpdatePasswordRoute(c *gin.Context) {
 		return
 	}
 
+	authentication.RememberPassword(c, authUser.Id, req.NewPassword)
+
 	web.MakeOkResp(c, "password updated successfully")
 }
@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-edbserver-gin/xlsxtable"
+	"github.com/antonybholmes/go-sys/log"
+	"github.com/antonybholmes/go-web"
+	"github.com/gin-gonic/gin"
+)
+
+// Tables are sent as json, with the styling in the body, or as csv or
+// tsv, either one file as the body or several in a multipart form with
+// a sheet for each. The styling of csv and tsv is in the query.
+
+const defaultXlsxFilename = "tables.xlsx"
+
+var ErrTablesTooLarge = errors.New("tables are too large")
+
+type XlsxFromReq struct {
+	Tables []*xlsxtable.Table `json:"tables"`
+	xlsxtable.Style
+	Filename string `json:"filename"`
+}
+
+type XlsxFromQuery struct {
+	// name of the sheet when the body is a single file
+	Sheet       string    `form:"sheet"`
+	Headers     int       `form:"headers,default=1"`
+	Indexes     int       `form:"indexes"`
+	HeaderStyle bool      `form:"headerStyle"`
+	Freeze      bool      `form:"freeze"`
+	Widths      []float64 `form:"widths" collection_format:"csv"`
+	Filename    string    `form:"filename"`
+}
+
+// Make a workbook from tables, a sheet for each
+func XlsxFromRoute(c *gin.Context) {
+	format := c.Param("format")
+
+	var req *XlsxFromReq
+	var err error
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, consts.XlsxMaxUploadBytes)
+
+	if format == "json" {
+		req = &XlsxFromReq{}
+
+		// numbers are kept as sent rather than made floats
+		decoder := json.NewDecoder(c.Request.Body)
+		decoder.UseNumber()
+
+		err = decoder.Decode(req)
+	} else {
+		req, err = readTextTables(c, format)
+	}
+
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+
+		if errors.As(err, &maxBytesErr) {
+			err = ErrTablesTooLarge
+		}
+
+		web.BadReqResp(c, err)
+		return
+	}
+
+	filename := filepath.Base(req.Filename)
+
+	if filename == "." || filename == "/" {
+		filename = defaultXlsxFilename
+	} else if !strings.HasSuffix(strings.ToLower(filename), ".xlsx") {
+		filename += ".xlsx"
+	}
+
+	c.Header("Content-Type", XlsxContentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": filename}))
+	c.Status(http.StatusOK)
+
+	err = xlsxtable.WriteWorkbook(c.Writer, req.Tables, req.Style)
+
+	if err != nil {
+		if c.Writer.Written() {
+			log.Error().Msgf("could not write workbook %s: %v", filename, err)
+			c.Abort()
+			return
+		}
+
+		c.Writer.Header().Del("Content-Type")
+		c.Writer.Header().Del("Content-Disposition")
+
+		if errors.Is(err, xlsxtable.ErrNoTables) ||
+			errors.Is(err, xlsxtable.ErrDuplicateSheet) ||
+			errors.Is(err, xlsxtable.ErrRaggedIndex) ||
+			errors.Is(err, xlsxtable.ErrInvalidTable) {
+			web.BadReqResp(c, err)
+		} else {
+			c.Error(err)
+		}
+	}
+}
+
+// readTextTables reads csv or tsv tables from the body or, with a
+// multipart form, from each file in it
+func readTextTables(c *gin.Context, format string) (*XlsxFromReq, error) {
+	comma, err := xlsxtable.Delimiter(format)
+
+	if err != nil {
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+
+	var query XlsxFromQuery
+
+	err = c.ShouldBindQuery(&query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req := XlsxFromReq{Style: xlsxtable.Style{HeaderStyle: query.HeaderStyle,
+		Freeze:       query.Freeze,
+		ColumnWidths: query.Widths},
+		Filename: query.Filename}
+
+	if c.ContentType() != "multipart/form-data" {
+		table, err := xlsxtable.ReadTable(query.Sheet, c.Request.Body, comma, query.Headers, query.Indexes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		req.Tables = append(req.Tables, table)
+
+		return &req, nil
+	}
+
+	reader, err := c.Request.MultipartReader()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// only files are tables
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		name := strings.TrimSuffix(filepath.Base(part.FileName()), filepath.Ext(part.FileName()))
+
+		table, err := xlsxtable.ReadTable(name, part, comma, query.Headers, query.Indexes)
+
+		part.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		req.Tables = append(req.Tables, table)
+	}
+
+	return &req, nil
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/antonybholmes/go-edbserver-gin/consts"
+	"github.com/antonybholmes/go-web"
+	"github.com/gin-gonic/gin"
+)
+
+// Workbooks can be uploaded as a file in a multipart form, as the raw
+// body with the xlsx content type or, as before, base64 encoded in the
+// b64xlsx field of a json body. Options for the first two are form
+// fields or query parameters. Multipart forms are streamed so nothing
+// goes to disk, but the workbook is still read into memory once since
+// it is a zip that has to be opened as a whole.
+
+const (
+	XlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+	// the form field with the workbook
+	xlsxFormFile = "file"
+
+	// longest option in a multipart form
+	maxFormValueBytes = 1024
+)
+
+var (
+	ErrXlsxTooLarge           = errors.New("workbook is too large")
+	ErrNoXlsx                 = errors.New("no workbook was uploaded")
+	ErrInvalidXlsxOption      = errors.New("invalid xlsx option")
+	ErrUnsupportedContentType = errors.New("upload a workbook as multipart/form-data, xlsx or json")
+)
+
+// readXlsx reads a workbook and its options however it was uploaded.
+// If this fails the response has been written and false is returned.
+func readXlsx(c *gin.Context) (*XlsxReq, *bytes.Reader, bool) {
+	var req XlsxReq
+	var data []byte
+	var err error
+
+	maxBytes := consts.XlsxMaxUploadBytes
+
+	switch c.ContentType() {
+	case "multipart/form-data":
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+maxFormValueBytes*8)
+
+		data, err = readMultipartXlsx(c, &req)
+	case XlsxContentType, "application/octet-stream":
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+
+		err = c.ShouldBindQuery(&req)
+
+		if err == nil {
+			data, err = io.ReadAll(c.Request.Body)
+		}
+	case "", gin.MIMEJSON:
+		// base64 takes a third more room
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes/3*4+maxFormValueBytes*8)
+
+		err = c.ShouldBindJSON(&req)
+
+		if err == nil {
+			data, err = b64.StdEncoding.DecodeString(req.Xlsx)
+			// no need to keep two copies
+			req.Xlsx = ""
+		}
+	default:
+		err = ErrUnsupportedContentType
+	}
+
+	if err == nil && len(data) == 0 {
+		err = ErrNoXlsx
+	}
+
+	// the body limits leave room for the rest of the request
+	if err == nil && int64(len(data)) > maxBytes {
+		err = ErrXlsxTooLarge
+	}
+
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+
+		if errors.As(err, &maxBytesErr) {
+			err = ErrXlsxTooLarge
+		}
+
+		web.BadReqResp(c, err)
+		return nil, nil, false
+	}
+
+	return &req, bytes.NewReader(data), true
+}
+
+// readMultipartXlsx reads the parts of a form as they arrive. Options
+// in the form replace those in the query.
+func readMultipartXlsx(c *gin.Context, req *XlsxReq) ([]byte, error) {
+	err := c.ShouldBindQuery(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := c.Request.MultipartReader()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+
+	for {
+		part, err := reader.NextPart()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == xlsxFormFile {
+			data, err = io.ReadAll(part)
+		} else {
+			var value []byte
+
+			value, err = io.ReadAll(io.LimitReader(part, maxFormValueBytes))
+
+			if err == nil {
+				err = req.setOption(part.FormName(), string(value))
+			}
+		}
+
+		part.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// setOption sets an option from a form field, unknown fields are ignored
+func (req *XlsxReq) setOption(name string, value string) error {
+	var err error
+
+	switch name {
+	case "sheet":
+		req.Sheet = value
+	case "headers":
+		req.Headers, err = strconv.Atoi(value)
+	case "indexes":
+		req.Indexes, err = strconv.Atoi(value)
+	case "skipRows":
+		req.SkipRows, err = strconv.Atoi(value)
+	case "trimWhitespace":
+		req.TrimWhitespace, err = strconv.ParseBool(value)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidXlsxOption, name)
+	}
+
+	return nil
+}
@@ -1,15 +1,18 @@
 package utils
 
 import (
-	"bytes"
 	"crypto/rand"
-	b64 "encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
+	"mime"
+	"net/http"
 	"strconv"
 
+	"github.com/antonybholmes/go-edbserver-gin/xlsxtable"
 	"github.com/antonybholmes/go-sys"
+	"github.com/antonybholmes/go-sys/log"
 	"github.com/antonybholmes/go-web"
 	"github.com/antonybholmes/go-web/auth"
 	"github.com/gin-gonic/gin"
@@ -22,12 +25,13 @@ var (
 )
 
 type XlsxReq struct {
-	Sheet          string `json:"sheet"`
-	Headers        int    `json:"headers"`
-	Indexes        int    `json:"indexes"`
-	SkipRows       int    `json:"skipRows"`
-	TrimWhitespace bool   `json:"trimWhitespace"`
-	Xlsx           string `json:"b64xlsx"`
+	Sheet          string `json:"sheet" form:"sheet"`
+	Headers        int    `json:"headers" form:"headers"`
+	Indexes        int    `json:"indexes" form:"indexes"`
+	SkipRows       int    `json:"skipRows" form:"skipRows"`
+	TrimWhitespace bool   `json:"trimWhitespace" form:"trimWhitespace"`
+	// only for json bodies, see readXlsx
+	Xlsx string `json:"b64xlsx" form:"-"`
 }
 
 type XlsxResp struct {
@@ -48,33 +52,11 @@ type KeyResp struct {
 	Length int    `json:"length"`
 }
 
-func makeXlsxReader(b64data string) (*bytes.Reader, error) {
-	xlsxb, err := b64.StdEncoding.DecodeString(b64data)
-
-	if err != nil {
-		return nil, err
-	}
-
-	reader := bytes.NewReader(xlsxb)
-
-	return reader, nil
-}
-
 func XlsxSheetsRoute(c *gin.Context) {
 
-	var req XlsxReq
-
-	err := c.Bind(&req)
-
-	if err != nil {
-		c.Error(err)
-		return
-	}
-
-	reader, err := makeXlsxReader(req.Xlsx)
+	_, reader, ok := readXlsx(c)
 
-	if err != nil {
-		c.Error(err)
+	if !ok {
 		return
 	}
 
@@ -94,24 +76,28 @@ func XlsxToRoute(c *gin.Context) {
 
 	format := c.Param("format")
 
+	// json is the table itself, the others are files to download
+	var tableFormat *xlsxtable.Format
+
 	if format != "json" {
-		c.Error(fmt.Errorf("unsupported format: %s", format))
-		return
-	}
+		var err error
 
-	var req XlsxReq
+		tableFormat, err = xlsxtable.FindFormat(format)
 
-	err := c.Bind(&req)
+		if err != nil {
+			web.BadReqResp(c, fmt.Errorf("unsupported format: %s", format))
+			return
+		}
+	}
 
-	if err != nil {
-		c.Error(err)
+	req, reader, ok := readXlsx(c)
+
+	if !ok {
 		return
 	}
 
-	reader, err := makeXlsxReader(req.Xlsx)
-
-	if err != nil {
-		c.Error(err)
+	if tableFormat != nil {
+		writeXlsxTable(c, tableFormat, req, reader)
 		return
 	}
 
@@ -132,6 +118,43 @@ func XlsxToRoute(c *gin.Context) {
 	web.MakeDataResp(c, "", resp)
 }
 
+// writeXlsxTable streams a sheet as a file in a format
+func writeXlsxTable(c *gin.Context, format *xlsxtable.Format, req *XlsxReq, reader io.Reader) {
+	sheet, err := xlsxtable.Open(reader, xlsxtable.Options{Sheet: req.Sheet,
+		Headers:        req.Headers,
+		Indexes:        req.Indexes,
+		SkipRows:       req.SkipRows,
+		TrimWhitespace: req.TrimWhitespace})
+
+	if err != nil {
+		web.BadReqResp(c, err)
+		return
+	}
+
+	defer sheet.Close()
+
+	c.Header("Content-Type", format.ContentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": sheet.Name + "." + format.Extension}))
+	c.Status(http.StatusOK)
+
+	err = format.Write(c.Writer, sheet)
+
+	if err != nil {
+		if !c.Writer.Written() {
+			c.Writer.Header().Del("Content-Type")
+			c.Writer.Header().Del("Content-Disposition")
+			c.Error(err)
+			return
+		}
+
+		// the response has started so all that can be done is to
+		// stop, which leaves the file incomplete
+		log.Error().Msgf("could not write sheet %s as %s: %v", sheet.Name, format.Name, err)
+		c.Abort()
+	}
+}
+
 // generateRandomString generates a random string of specified length from the letters set.
 func generateRandomString(length int) (string, error) {
 	b := make([]byte, length)
@@ -0,0 +1,378 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A minimal XML tree that keeps namespace prefixes and declarations,
+// which encoding/xml throws away but exclusive canonicalization needs
+// to check signatures.
+
+var (
+	ErrDTDNotAllowed = errors.New("xml documents with a DTD are not allowed")
+	ErrMalformedXML  = errors.New("malformed xml")
+)
+
+type attr struct {
+	Prefix string
+	Local  string
+	Value  string
+}
+
+type element struct {
+	Prefix string
+	Local  string
+	// namespace uri of the element, resolved from its prefix
+	Space string
+	Attrs []attr
+	// namespaces declared on this element, prefix to uri. The
+	// default namespace has the empty prefix.
+	NSDecls  map[string]string
+	Children []node
+	Parent   *element
+}
+
+// node is either *element or text
+type node any
+
+type text string
+
+// parseXML builds a tree from a document. DTDs are rejected since SAML
+// never needs them and they are a source of entity expansion attacks.
+func parseXML(data []byte) (*element, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	var root *element
+	var current *element
+
+	for {
+		token, err := decoder.RawToken()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			e := &element{Prefix: t.Name.Space,
+				Local:   t.Name.Local,
+				NSDecls: make(map[string]string),
+				Parent:  current}
+
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					e.NSDecls[""] = a.Value
+				case a.Name.Space == "xmlns":
+					e.NSDecls[a.Name.Local] = a.Value
+				default:
+					e.Attrs = append(e.Attrs, attr{Prefix: a.Name.Space, Local: a.Name.Local, Value: a.Value})
+				}
+			}
+
+			space, ok := e.lookupNS(e.Prefix)
+
+			if !ok && e.Prefix != "" {
+				return nil, fmt.Errorf("%w: undeclared prefix %s", ErrMalformedXML, e.Prefix)
+			}
+
+			e.Space = space
+
+			if current == nil {
+				if root != nil {
+					return nil, fmt.Errorf("%w: more than one root element", ErrMalformedXML)
+				}
+
+				root = e
+			} else {
+				current.Children = append(current.Children, e)
+			}
+
+			current = e
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.Prefix || t.Name.Local != current.Local {
+				return nil, fmt.Errorf("%w: unexpected end element %s", ErrMalformedXML, t.Name.Local)
+			}
+
+			current = current.Parent
+		case xml.CharData:
+			if current != nil {
+				current.Children = append(current.Children, text(t))
+			}
+		case xml.Directive:
+			return nil, ErrDTDNotAllowed
+		}
+	}
+
+	if root == nil || current != nil {
+		return nil, fmt.Errorf("%w: incomplete document", ErrMalformedXML)
+	}
+
+	return root, nil
+}
+
+// lookupNS returns the uri a prefix is bound to at this element
+func (e *element) lookupNS(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return "http://www.w3.org/XML/1998/namespace", true
+	}
+
+	for p := e; p != nil; p = p.Parent {
+		if uri, ok := p.NSDecls[prefix]; ok {
+			return uri, true
+		}
+	}
+
+	return "", false
+}
+
+func (e *element) is(space string, local string) bool {
+	return e.Space == space && e.Local == local
+}
+
+func (e *element) attr(local string) string {
+	for _, a := range e.Attrs {
+		if a.Prefix == "" && a.Local == local {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+func (e *element) children(space string, local string) []*element {
+	var ret []*element
+
+	for _, child := range e.Children {
+		if c, ok := child.(*element); ok && c.is(space, local) {
+			ret = append(ret, c)
+		}
+	}
+
+	return ret
+}
+
+// child returns the first child with a name or nil
+func (e *element) child(space string, local string) *element {
+	children := e.children(space, local)
+
+	if len(children) == 0 {
+		return nil
+	}
+
+	return children[0]
+}
+
+func (e *element) text() string {
+	var buf strings.Builder
+
+	for _, child := range e.Children {
+		if t, ok := child.(text); ok {
+			buf.WriteString(string(t))
+		}
+	}
+
+	return strings.TrimSpace(buf.String())
+}
+
+// walk visits e and its descendants in document order
+func (e *element) walk(f func(*element)) {
+	f(e)
+
+	for _, child := range e.Children {
+		if c, ok := child.(*element); ok {
+			c.walk(f)
+		}
+	}
+}
+
+// Exclusive XML canonicalization without comments
+// (https://www.w3.org/TR/xml-exc-c14n/) of the subtree rooted at e.
+// Namespaces are only output where they are visibly used, or if listed
+// in inclusive. skip, if not nil, is left out, e.g. the enveloped
+// signature.
+func canonicalize(e *element, inclusive []string, skip *element) []byte {
+	var buf bytes.Buffer
+
+	writeCanonical(&buf, e, map[string]string{}, inclusive, skip)
+
+	return buf.Bytes()
+}
+
+func writeCanonical(buf *bytes.Buffer,
+	e *element,
+	rendered map[string]string,
+	inclusive []string,
+	skip *element) {
+
+	// prefixes this element needs declared
+	used := map[string]bool{e.Prefix: true}
+
+	for _, a := range e.Attrs {
+		if a.Prefix != "" && a.Prefix != "xml" {
+			used[a.Prefix] = true
+		}
+	}
+
+	for _, prefix := range inclusive {
+		if prefix == "#default" {
+			prefix = ""
+		}
+
+		if _, ok := e.lookupNS(prefix); ok {
+			used[prefix] = true
+		}
+	}
+
+	type nsDecl struct {
+		prefix string
+		uri    string
+	}
+
+	var decls []nsDecl
+
+	scope := make(map[string]string, len(rendered))
+
+	for k, v := range rendered {
+		scope[k] = v
+	}
+
+	for prefix := range used {
+		uri, _ := e.lookupNS(prefix)
+
+		current, ok := scope[prefix]
+
+		// an unbound default namespace only needs undeclaring if an
+		// ancestor in the output declared one
+		if prefix == "" && uri == "" && (!ok || current == "") {
+			continue
+		}
+
+		if ok && current == uri {
+			continue
+		}
+
+		decls = append(decls, nsDecl{prefix: prefix, uri: uri})
+		scope[prefix] = uri
+	}
+
+	sort.Slice(decls, func(i, j int) bool {
+		return decls[i].prefix < decls[j].prefix
+	})
+
+	type sortedAttr struct {
+		space string
+		attr  attr
+	}
+
+	attrs := make([]sortedAttr, 0, len(e.Attrs))
+
+	for _, a := range e.Attrs {
+		space := ""
+
+		if a.Prefix != "" {
+			space, _ = e.lookupNS(a.Prefix)
+		}
+
+		attrs = append(attrs, sortedAttr{space: space, attr: a})
+	}
+
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].space != attrs[j].space {
+			return attrs[i].space < attrs[j].space
+		}
+
+		return attrs[i].attr.Local < attrs[j].attr.Local
+	})
+
+	buf.WriteByte('<')
+	buf.WriteString(qname(e.Prefix, e.Local))
+
+	for _, decl := range decls {
+		if decl.prefix == "" {
+			buf.WriteString(` xmlns="`)
+		} else {
+			buf.WriteString(` xmlns:` + decl.prefix + `="`)
+		}
+
+		escapeAttr(buf, decl.uri)
+		buf.WriteByte('"')
+	}
+
+	for _, a := range attrs {
+		buf.WriteString(" " + qname(a.attr.Prefix, a.attr.Local) + `="`)
+		escapeAttr(buf, a.attr.Value)
+		buf.WriteByte('"')
+	}
+
+	buf.WriteByte('>')
+
+	for _, child := range e.Children {
+		switch c := child.(type) {
+		case *element:
+			if c != skip {
+				writeCanonical(buf, c, scope, inclusive, skip)
+			}
+		case text:
+			escapeText(buf, string(c))
+		}
+	}
+
+	buf.WriteString("</" + qname(e.Prefix, e.Local) + ">")
+}
+
+func qname(prefix string, local string) string {
+	if prefix == "" {
+		return local
+	}
+
+	return prefix + ":" + local
+}
+
+func escapeText(buf *bytes.Buffer, s string) {
+	for _, r := range s {
+		switch r {
+		case '&':
+			buf.WriteString("&amp;")
+		case '<':
+			buf.WriteString("&lt;")
+		case '>':
+			buf.WriteString("&gt;")
+		case '\r':
+			buf.WriteString("&#xD;")
+		default:
+			buf.WriteRune(r)
+		}
+	}
+}
+
+func escapeAttr(buf *bytes.Buffer, s string) {
+	for _, r := range s {
+		switch r {
+		case '&':
+			buf.WriteString("&amp;")
+		case '<':
+			buf.WriteString("&lt;")
+		case '"':
+			buf.WriteString("&quot;")
+		case '\t':
+			buf.WriteString("&#x9;")
+		case '\n':
+			buf.WriteString("&#xA;")
+		case '\r':
+			buf.WriteString("&#xD;")
+		default:
+			buf.WriteRune(r)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package saml
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	tests := map[string]struct {
+		doc       string
+		inclusive []string
+		want      string
+	}{
+		// unused namespaces are dropped and used ones declared where
+		// they are first used, ahead of the sorted attributes, and
+		// empty elements are written out in full
+		"namespaces": {`<a:root xmlns:a="urn:a" xmlns:b="urn:b" xmlns:c="urn:c"><a:x z="1" b:y="2" a="3"/><b:z/></a:root>`,
+			nil,
+			`<a:root xmlns:a="urn:a"><a:x xmlns:b="urn:b" a="3" z="1" b:y="2"></a:x><b:z xmlns:b="urn:b"></b:z></a:root>`},
+		"inclusive prefixes": {`<a:root xmlns:a="urn:a" xmlns:c="urn:c"><a:x/></a:root>`,
+			[]string{"c"},
+			`<a:root xmlns:a="urn:a" xmlns:c="urn:c"><a:x></a:x></a:root>`},
+		"default namespace": {`<root xmlns="urn:d"><x/></root>`,
+			nil,
+			`<root xmlns="urn:d"><x></x></root>`},
+		"escaping": {"<root a=\"&lt;&quot;&#9;\">&lt;&amp;&gt;\"'</root>",
+			nil,
+			"<root a=\"&lt;&quot;&#x9;\">&lt;&amp;&gt;\"'</root>"},
+		"comments dropped": {`<root>a<!-- comment -->b</root>`,
+			nil,
+			`<root>ab</root>`},
+	}
+
+	for name, test := range tests {
+		root, err := parseXML([]byte(test.doc))
+
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if got := string(canonicalize(root, test.inclusive, nil)); got != test.want {
+			t.Errorf("%s:\n got %s\nwant %s", name, got, test.want)
+		}
+	}
+}
+
+func TestCanonicalizeSubtree(t *testing.T) {
+	root, err := parseXML([]byte(`<a:root xmlns:a="urn:a" xmlns:b="urn:b"><a:x ID="1"><a:skip/><b:y/></a:x></a:root>`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x := root.child("urn:a", "x")
+
+	want := `<a:x xmlns:a="urn:a" ID="1"><b:y xmlns:b="urn:b"></b:y></a:x>`
+
+	if got := string(canonicalize(x, nil, x.child("urn:a", "skip"))); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestParseXMLRejects(t *testing.T) {
+	tests := map[string]struct {
+		doc string
+		err error
+	}{
+		"dtd":               {`<!DOCTYPE root [<!ENTITY e "x">]><root>&e;</root>`, ErrDTDNotAllowed},
+		"undeclared prefix": {`<a:root/>`, ErrMalformedXML},
+		"two roots":         {`<root/><root/>`, ErrMalformedXML},
+		"incomplete":        {`<root><x></x>`, ErrMalformedXML},
+	}
+
+	for name, test := range tests {
+		_, err := parseXML([]byte(test.doc))
+
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", name, err, test.err)
+		}
+	}
+}
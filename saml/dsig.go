@@ -0,0 +1,227 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Checks enveloped XML signatures as used by SAML identity providers.
+// Only what SAML needs is supported: one reference to the signed
+// element, exclusive canonicalization and RSA with SHA-256 or SHA-512.
+
+const (
+	nsDSig = "http://www.w3.org/2000/09/xmldsig#"
+
+	algExcC14N              = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algEnvelopedSignature   = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	algRSASHA256            = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	algRSASHA512            = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	algSHA256               = "http://www.w3.org/2001/04/xmlenc#sha256"
+	algSHA512               = "http://www.w3.org/2001/04/xmlenc#sha512"
+	nsExcC14NInclusivePrefs = "http://www.w3.org/2001/10/xml-exc-c14n#"
+)
+
+var (
+	ErrNotSigned          = errors.New("element is not signed")
+	ErrInvalidSignature   = errors.New("invalid signature")
+	ErrUnsupportedSigning = errors.New("unsupported signature algorithm")
+	ErrDigestMismatch     = errors.New("digest does not match signed content")
+)
+
+// signature returns the signature that is a direct child of e, or nil
+func signature(e *element) (*element, error) {
+	sigs := e.children(nsDSig, "Signature")
+
+	switch len(sigs) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sigs[0], nil
+	default:
+		return nil, fmt.Errorf("%w: more than one signature", ErrInvalidSignature)
+	}
+}
+
+// inclusivePrefixes reads the optional prefix list of an exclusive
+// canonicalization transform
+func inclusivePrefixes(method *element) []string {
+	inclusive := method.child(nsExcC14NInclusivePrefs, "InclusiveNamespaces")
+
+	if inclusive == nil {
+		return nil
+	}
+
+	return strings.Fields(inclusive.attr("PrefixList"))
+}
+
+func digest(alg string, data []byte) ([]byte, error) {
+	switch alg {
+	case algSHA256:
+		h := sha256.Sum256(data)
+		return h[:], nil
+	case algSHA512:
+		h := sha512.Sum512(data)
+		return h[:], nil
+	default:
+		return nil, fmt.Errorf("%w: digest %s", ErrUnsupportedSigning, alg)
+	}
+}
+
+// verifySignature checks that e carries a valid enveloped signature by
+// one of certs over e itself. root is the whole document, used to make
+// sure the referenced id is unique so a signed element cannot be
+// swapped for another with the same id.
+func verifySignature(root *element, e *element, certs []*x509.Certificate) error {
+	sig, err := signature(e)
+
+	if err != nil {
+		return err
+	}
+
+	if sig == nil {
+		return ErrNotSigned
+	}
+
+	id := e.attr("ID")
+
+	if id == "" {
+		return fmt.Errorf("%w: signed element has no id", ErrInvalidSignature)
+	}
+
+	count := 0
+
+	root.walk(func(x *element) {
+		if x.attr("ID") == id {
+			count++
+		}
+	})
+
+	if count != 1 {
+		return fmt.Errorf("%w: id %s is not unique", ErrInvalidSignature, id)
+	}
+
+	signedInfo := sig.child(nsDSig, "SignedInfo")
+
+	if signedInfo == nil {
+		return fmt.Errorf("%w: no signed info", ErrInvalidSignature)
+	}
+
+	c14nMethod := signedInfo.child(nsDSig, "CanonicalizationMethod")
+
+	if c14nMethod == nil || c14nMethod.attr("Algorithm") != algExcC14N {
+		return fmt.Errorf("%w: canonicalization must be exclusive c14n", ErrUnsupportedSigning)
+	}
+
+	sigMethod := signedInfo.child(nsDSig, "SignatureMethod")
+
+	if sigMethod == nil {
+		return fmt.Errorf("%w: no signature method", ErrInvalidSignature)
+	}
+
+	refs := signedInfo.children(nsDSig, "Reference")
+
+	if len(refs) != 1 {
+		return fmt.Errorf("%w: expected one reference", ErrInvalidSignature)
+	}
+
+	ref := refs[0]
+
+	if ref.attr("URI") != "#"+id {
+		return fmt.Errorf("%w: reference is not to the signed element", ErrInvalidSignature)
+	}
+
+	// the reference must be to the element minus its signature
+	var refInclusive []string
+	enveloped := false
+
+	if transforms := ref.child(nsDSig, "Transforms"); transforms != nil {
+		for _, transform := range transforms.children(nsDSig, "Transform") {
+			switch transform.attr("Algorithm") {
+			case algEnvelopedSignature:
+				enveloped = true
+			case algExcC14N:
+				refInclusive = inclusivePrefixes(transform)
+			default:
+				return fmt.Errorf("%w: transform %s", ErrUnsupportedSigning, transform.attr("Algorithm"))
+			}
+		}
+	}
+
+	if !enveloped {
+		return fmt.Errorf("%w: signature is not enveloped", ErrInvalidSignature)
+	}
+
+	digestMethod := ref.child(nsDSig, "DigestMethod")
+	digestValue := ref.child(nsDSig, "DigestValue")
+
+	if digestMethod == nil || digestValue == nil {
+		return fmt.Errorf("%w: no digest", ErrInvalidSignature)
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(digestValue.text()), ""))
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	actual, err := digest(digestMethod.attr("Algorithm"), canonicalize(e, refInclusive, sig))
+
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(expected, actual) != 1 {
+		return ErrDigestMismatch
+	}
+
+	// finally check the signed info, which covers the digest, was
+	// signed by the identity provider
+	var hash crypto.Hash
+
+	switch sigMethod.attr("Algorithm") {
+	case algRSASHA256:
+		hash = crypto.SHA256
+	case algRSASHA512:
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedSigning, sigMethod.attr("Algorithm"))
+	}
+
+	sigValue := sig.child(nsDSig, "SignatureValue")
+
+	if sigValue == nil {
+		return fmt.Errorf("%w: no signature value", ErrInvalidSignature)
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(sigValue.text()), ""))
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	h := hash.New()
+	h.Write(canonicalize(signedInfo, inclusivePrefixes(c14nMethod), nil))
+	hashed := h.Sum(nil)
+
+	for _, cert := range certs {
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+
+		if !ok {
+			continue
+		}
+
+		if rsa.VerifyPKCS1v15(key, hash, hashed, sigBytes) == nil {
+			return nil
+		}
+	}
+
+	return ErrInvalidSignature
+}
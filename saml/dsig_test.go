@@ -0,0 +1,335 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSpEntityId  = "https://sp.example.org/saml/metadata"
+	testAcsUrl      = "https://sp.example.org/saml/acs"
+	testIdpEntityId = "https://idp.example.org"
+	testRequestId   = "_req1"
+)
+
+// testIdp signs responses with a locally generated key and certificate
+type testIdp struct {
+	key     *rsa.PrivateKey
+	certPem string
+}
+
+func newTestIdp(t *testing.T) *testIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:   pkix.Name{CommonName: "idp.example.org"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour)}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testIdp{key: key,
+		certPem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+func (idp *testIdp) registry(t *testing.T) (*Registry, *Provider) {
+	registry := NewRegistry(&Config{EntityId: testSpEntityId,
+		AcsUrl: testAcsUrl,
+		Providers: []ProviderConfig{{Name: "idp",
+			EntityId:     testIdpEntityId,
+			SsoUrl:       testIdpEntityId + "/sso",
+			Certificates: []string{idp.certPem}}}})
+
+	provider, err := registry.Provider("idp")
+
+	if err != nil {
+		t.Fatalf("provider disabled: %v", registry.Disabled["idp"])
+	}
+
+	return registry, provider
+}
+
+const signatureTemplate = `<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#">` +
+	`<ds:SignedInfo>` +
+	`<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>` +
+	`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+	`<ds:Reference URI="#{id}">` +
+	`<ds:Transforms>` +
+	`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"/>` +
+	`<ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>` +
+	`</ds:Transforms>` +
+	`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>` +
+	`<ds:DigestValue>{digest}</ds:DigestValue>` +
+	`</ds:Reference>` +
+	`</ds:SignedInfo>` +
+	`<ds:SignatureValue>{signature}</ds:SignatureValue>` +
+	`</ds:Signature>`
+
+// assertion returns an unsigned assertion about email. {signature}
+// marks where the signature goes.
+func assertion(id string, email string) string {
+	now := time.Now().UTC()
+	notBefore := now.Add(-time.Minute).Format(time.RFC3339)
+	notOnOrAfter := now.Add(5 * time.Minute).Format(time.RFC3339)
+
+	return `<saml:Assertion ID="` + id + `" Version="2.0" IssueInstant="` + now.Format(time.RFC3339) + `">` +
+		`<saml:Issuer>` + testIdpEntityId + `</saml:Issuer>` +
+		`{signature}` +
+		`<saml:Subject>` +
+		`<saml:NameID Format="` + NameIdFormatEmail + `">` + email + `</saml:NameID>` +
+		`<saml:SubjectConfirmation Method="` + subjectConfirmationBearer + `">` +
+		`<saml:SubjectConfirmationData InResponseTo="` + testRequestId + `" Recipient="` + testAcsUrl + `" NotOnOrAfter="` + notOnOrAfter + `"/>` +
+		`</saml:SubjectConfirmation>` +
+		`</saml:Subject>` +
+		`<saml:Conditions NotBefore="` + notBefore + `" NotOnOrAfter="` + notOnOrAfter + `">` +
+		`<saml:AudienceRestriction><saml:Audience>` + testSpEntityId + `</saml:Audience></saml:AudienceRestriction>` +
+		`</saml:Conditions>` +
+		`<saml:AttributeStatement>` +
+		`<saml:Attribute Name="mail"><saml:AttributeValue>` + email + `</saml:AttributeValue></saml:Attribute>` +
+		`<saml:Attribute Name="displayName"><saml:AttributeValue>Test User</saml:AttributeValue></saml:Attribute>` +
+		`</saml:AttributeStatement>` +
+		`</saml:Assertion>`
+}
+
+// response wraps assertions in a successful response to our request
+func response(assertions ...string) string {
+	return `<samlp:Response xmlns:samlp="` + nsProtocol + `" xmlns:saml="` + nsAssertion + `"` +
+		` ID="_resp1" Version="2.0" InResponseTo="` + testRequestId + `" Destination="` + testAcsUrl + `">` +
+		`<saml:Issuer>` + testIdpEntityId + `</saml:Issuer>` +
+		`<samlp:Status><samlp:StatusCode Value="` + statusSuccess + `"/></samlp:Status>` +
+		strings.Join(assertions, "") +
+		`</samlp:Response>`
+}
+
+// sign fills in the enveloped signature of the element with id in doc,
+// which must contain one {signature} marker inside that element
+func (idp *testIdp) sign(t *testing.T, doc string, id string) string {
+	doc = strings.Replace(doc, "{signature}", strings.ReplaceAll(signatureTemplate, "{id}", id), 1)
+
+	find := func(doc string) (*element, *element) {
+		root, err := parseXML([]byte(doc))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var signed *element
+
+		root.walk(func(e *element) {
+			if e.attr("ID") == id {
+				signed = e
+			}
+		})
+
+		sig, err := signature(signed)
+
+		if err != nil || sig == nil {
+			t.Fatalf("no signature in %s: %v", id, err)
+		}
+
+		return signed, sig
+	}
+
+	signed, sig := find(doc)
+
+	sum := sha256.Sum256(canonicalize(signed, nil, sig))
+	doc = strings.Replace(doc, "{digest}", base64.StdEncoding.EncodeToString(sum[:]), 1)
+
+	_, sig = find(doc)
+
+	sum = sha256.Sum256(canonicalize(sig.child(nsDSig, "SignedInfo"), nil, nil))
+
+	value, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Replace(doc, "{signature}", base64.StdEncoding.EncodeToString(value), 1)
+}
+
+func verify(registry *Registry, provider *Provider, doc string) (*Identity, error) {
+	response, err := ParseResponse(base64.StdEncoding.EncodeToString([]byte(doc)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return registry.Verify(provider, response, response.InResponseTo)
+}
+
+func TestVerifySignedAssertion(t *testing.T) {
+	idp := newTestIdp(t)
+	registry, provider := idp.registry(t)
+
+	doc := idp.sign(t, response(assertion("_a1", "user@example.org")), "_a1")
+
+	identity, err := verify(registry, provider, doc)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.Subject != "user@example.org" || identity.Email != "user@example.org" || identity.Name != "Test User" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+}
+
+func TestVerifyRejectsOtherCertificate(t *testing.T) {
+	registry, provider := newTestIdp(t).registry(t)
+
+	doc := newTestIdp(t).sign(t, response(assertion("_a1", "user@example.org")), "_a1")
+
+	_, err := verify(registry, provider, doc)
+
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	idp := newTestIdp(t)
+	registry, provider := idp.registry(t)
+
+	doc := idp.sign(t, response(assertion("_a1", "user@example.org")), "_a1")
+
+	tests := map[string]struct {
+		doc string
+		err error
+	}{
+		"changed name id":   {strings.Replace(doc, ">user@example.org</saml:NameID>", ">admin@example.org</saml:NameID>", 1), ErrDigestMismatch},
+		"changed attribute": {strings.Replace(doc, "<saml:AttributeValue>Test User", "<saml:AttributeValue>Admin", 1), ErrDigestMismatch},
+		"added attribute": {strings.Replace(doc, "</saml:AttributeStatement>",
+			`<saml:Attribute Name="groups"><saml:AttributeValue>admins</saml:AttributeValue></saml:Attribute></saml:AttributeStatement>`, 1), ErrDigestMismatch},
+		"changed signed info": {strings.Replace(doc, "xmlenc#sha256", "xmlenc#sha512", 1), ErrDigestMismatch},
+		"not signed":          {strings.Replace(response(assertion("_a1", "user@example.org")), "{signature}", "", 1), ErrNotSigned},
+	}
+
+	for name, test := range tests {
+		_, err := verify(registry, provider, test.doc)
+
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", name, err, test.err)
+		}
+	}
+
+	// a valid signature over different content
+	sigValue := func(doc string) string {
+		start := strings.Index(doc, "<ds:SignatureValue>")
+		end := strings.Index(doc, "</ds:SignatureValue>")
+		return doc[start:end]
+	}
+
+	other := idp.sign(t, response(assertion("_a1", "admin@example.org")), "_a1")
+
+	_, err := verify(registry, provider, strings.Replace(other, sigValue(other), sigValue(doc), 1))
+
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("swapped signature: got %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+// signature wrapping attacks move the signed assertion somewhere it is
+// still valid and add an unsigned one that the application reads
+func TestVerifyRejectsSignatureWrapping(t *testing.T) {
+	idp := newTestIdp(t)
+	registry, provider := idp.registry(t)
+
+	// the signed assertion on its own, which stays valid wherever
+	// it is moved since exclusive canonicalization does not depend
+	// on the namespaces around it
+	signed := idp.sign(t, response(assertion("_a1", "user@example.org")), "_a1")
+	signed = signed[strings.Index(signed, "<saml:Assertion "):strings.LastIndex(signed, "</samlp:Response>")]
+
+	_, err := verify(registry, provider, response(signed))
+
+	if err != nil {
+		t.Fatalf("moved assertion: %v", err)
+	}
+
+	sig := signed[strings.Index(signed, "<ds:Signature ") : strings.Index(signed, "</ds:Signature>")+len("</ds:Signature>")]
+
+	unsigned := func(id string) string {
+		return strings.Replace(assertion(id, "admin@example.org"), "{signature}", "", 1)
+	}
+
+	// evil assertions carrying the signature of the signed one
+	withSig := func(id string) string {
+		return strings.Replace(assertion(id, "admin@example.org"), "{signature}", sig, 1)
+	}
+
+	hidden := func(doc string) string {
+		return strings.Replace(doc, "<samlp:Status>", "<samlp:Extensions>"+signed+"</samlp:Extensions><samlp:Status>", 1)
+	}
+
+	tests := map[string]struct {
+		doc string
+		err error
+	}{
+		// the evil assertion reuses the signed id and signature and
+		// the signed one is hidden in an extension
+		"same id": {hidden(response(withSig("_a1"))), ErrInvalidSignature},
+		// the same with an unsigned evil assertion
+		"same id unsigned": {hidden(response(unsigned("_a1"))), ErrNotSigned},
+		"other id":         {hidden(response(unsigned("_evil"))), ErrNotSigned},
+		// the signature refers to an element that is not there
+		"copied signature": {response(withSig("_evil")), ErrInvalidSignature},
+		// the signed assertion is nested inside the evil one
+		"nested": {response(strings.Replace(unsigned("_evil"), "</saml:Assertion>", signed+"</saml:Assertion>", 1)), ErrNotSigned},
+		// two assertions, only one signed
+		"two assertions": {response(signed, unsigned("_evil")), ErrInvalidResponse},
+	}
+
+	for name, test := range tests {
+		identity, err := verify(registry, provider, test.doc)
+
+		if err == nil {
+			t.Errorf("%s: accepted as %s", name, identity.Email)
+			continue
+		}
+
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", name, err, test.err)
+		}
+	}
+}
+
+// comments are not part of the canonical form, so one can be added to a
+// signed value without breaking the signature. The value read must still
+// be the whole signed text, not just the part before the comment.
+func TestVerifyCommentInjection(t *testing.T) {
+	idp := newTestIdp(t)
+	registry, provider := idp.registry(t)
+
+	doc := idp.sign(t, response(assertion("_a1", "admin@example.org.evil.com")), "_a1")
+	doc = strings.ReplaceAll(doc, "admin@example.org.evil.com", "admin@example.org<!---->.evil.com")
+
+	identity, err := verify(registry, provider, doc)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.Subject != "admin@example.org.evil.com" || identity.Email != "admin@example.org.evil.com" {
+		t.Fatalf("comment truncated the signed value: %+v", identity)
+	}
+}
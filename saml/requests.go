@@ -0,0 +1,106 @@
+package saml
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AuthnRequests we have sent and are waiting on a response for. A
+// response is only accepted once, for a request we made, which stops
+// replayed and unsolicited (IdP initiated) responses.
+
+const requestKeyPrefix = "saml:request:"
+
+var (
+	ErrUnknownRequest = errors.New("saml request not found or has expired")
+)
+
+type PendingRequest struct {
+	Id       string `json:"id"`
+	Provider string `json:"provider"`
+	// where to send the user once they are signed in
+	RedirectUrl string `json:"redirectUrl"`
+}
+
+type RequestStore struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+func NewRequestStore(rdb *redis.Client, ttl time.Duration) *RequestStore {
+	return &RequestStore{rdb: rdb, ttl: ttl}
+}
+
+func requestKey(id string) string {
+	return requestKeyPrefix + id
+}
+
+func (store *RequestStore) Create(ctx context.Context, provider string, redirectUrl string) (*PendingRequest, error) {
+	id, err := NewRequestId()
+
+	if err != nil {
+		return nil, err
+	}
+
+	req := PendingRequest{Id: id, Provider: provider, RedirectUrl: redirectUrl}
+
+	data, err := json.Marshal(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.rdb.Set(ctx, requestKey(id), data, store.ttl).Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &req, nil
+}
+
+func (store *RequestStore) get(cmd *redis.StringCmd) (*PendingRequest, error) {
+	data, err := cmd.Bytes()
+
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrUnknownRequest
+		}
+
+		return nil, err
+	}
+
+	var req PendingRequest
+
+	err = json.Unmarshal(data, &req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &req, nil
+}
+
+// Get returns a pending request without using it up, so that a
+// response that fails to verify cannot cancel the real one
+func (store *RequestStore) Get(ctx context.Context, id string) (*PendingRequest, error) {
+	if id == "" {
+		return nil, ErrUnknownRequest
+	}
+
+	return store.get(store.rdb.Get(ctx, requestKey(id)))
+}
+
+// Consume returns a pending request and forgets it so its
+// response cannot be used again
+func (store *RequestStore) Consume(ctx context.Context, id string) (*PendingRequest, error) {
+	if id == "" {
+		return nil, ErrUnknownRequest
+	}
+
+	return store.get(store.rdb.GetDel(ctx, requestKey(id)))
+}
@@ -0,0 +1,328 @@
+package saml
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	statusSuccess             = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	subjectConfirmationBearer = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+var (
+	ErrInvalidResponse    = errors.New("invalid saml response")
+	ErrEncryptedAssertion = errors.New("encrypted assertions are not supported")
+	ErrSignInFailed       = errors.New("sign in at the identity provider failed")
+	ErrMissingEmail       = errors.New("assertion does not contain an email address")
+	ErrExpired            = errors.New("assertion has expired or is not yet valid")
+	ErrWrongAudience      = errors.New("assertion is not for this service provider")
+)
+
+// Response is a parsed but not yet verified response from an identity
+// provider. Nothing in it can be trusted until Verify succeeds, but the
+// request it answers is needed to know which provider to verify it with.
+type Response struct {
+	root         *element
+	InResponseTo string
+}
+
+// Identity is the user information extracted from a verified assertion
+type Identity struct {
+	// name of the registry entry that verified the assertion
+	Provider string
+	// auth provider to record against the user
+	AuthProvider string
+	// the NameID, which identifies the user at the provider
+	Subject    string
+	Email      string
+	Name       string
+	Groups     []string
+	Attributes map[string][]string
+}
+
+// ParseResponse decodes the SAMLResponse form value of the POST binding
+func ParseResponse(encoded string) (*Response, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+
+	root, err := parseXML(data)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+
+	if !root.is(nsProtocol, "Response") {
+		return nil, fmt.Errorf("%w: not a response", ErrInvalidResponse)
+	}
+
+	return &Response{root: root, InResponseTo: root.attr("InResponseTo")}, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339, s)
+}
+
+// checkTimes makes sure now falls between optional notBefore and
+// notOnOrAfter times, allowing for clock differences
+func (registry *Registry) checkTimes(now time.Time, notBefore string, notOnOrAfter string) error {
+	if notBefore != "" {
+		t, err := parseTime(notBefore)
+
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+		}
+
+		if now.Add(registry.ClockSkew).Before(t) {
+			return ErrExpired
+		}
+	}
+
+	if notOnOrAfter != "" {
+		t, err := parseTime(notOnOrAfter)
+
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+		}
+
+		if !now.Add(-registry.ClockSkew).Before(t) {
+			return ErrExpired
+		}
+	}
+
+	return nil
+}
+
+// Verify checks a response answers requestId, was signed by the
+// provider and is meant for us right now, then maps the attributes of
+// its assertion to an identity. Only signed content is read so that
+// unsigned elements cannot be slipped in around the signature. If the
+// assertion was signed but is not acceptable, e.g. it has expired, an
+// identity with just the subject is returned along with the error.
+func (registry *Registry) Verify(provider *Provider, response *Response, requestId string) (*Identity, error) {
+	root := response.root
+	now := time.Now().UTC()
+
+	if requestId == "" || response.InResponseTo != requestId {
+		return nil, fmt.Errorf("%w: response is not for our request", ErrInvalidResponse)
+	}
+
+	if destination := root.attr("Destination"); destination != "" && destination != registry.AcsUrl {
+		return nil, fmt.Errorf("%w: wrong destination %s", ErrInvalidResponse, destination)
+	}
+
+	if issuer := root.child(nsAssertion, "Issuer"); issuer != nil && issuer.text() != provider.config.EntityId {
+		return nil, fmt.Errorf("%w: wrong issuer %s", ErrInvalidResponse, issuer.text())
+	}
+
+	status := root.child(nsProtocol, "Status")
+
+	if status == nil {
+		return nil, fmt.Errorf("%w: no status", ErrInvalidResponse)
+	}
+
+	statusCode := status.child(nsProtocol, "StatusCode")
+
+	if statusCode == nil || statusCode.attr("Value") != statusSuccess {
+		code := ""
+
+		if statusCode != nil {
+			code = statusCode.attr("Value")
+		}
+
+		return nil, fmt.Errorf("%w: %s", ErrSignInFailed, code)
+	}
+
+	if len(root.children(nsAssertion, "EncryptedAssertion")) > 0 {
+		return nil, ErrEncryptedAssertion
+	}
+
+	assertions := root.children(nsAssertion, "Assertion")
+
+	if len(assertions) != 1 {
+		return nil, fmt.Errorf("%w: expected one assertion", ErrInvalidResponse)
+	}
+
+	assertion := assertions[0]
+
+	// either the whole response or the assertion must be signed
+	responseSigned := false
+
+	err := verifySignature(root, root, provider.certs)
+
+	switch {
+	case err == nil:
+		responseSigned = true
+	case !errors.Is(err, ErrNotSigned):
+		return nil, err
+	}
+
+	err = verifySignature(root, assertion, provider.certs)
+
+	if err != nil && !(responseSigned && errors.Is(err, ErrNotSigned)) {
+		return nil, err
+	}
+
+	issuer := assertion.child(nsAssertion, "Issuer")
+
+	if issuer == nil || issuer.text() != provider.config.EntityId {
+		return nil, fmt.Errorf("%w: wrong assertion issuer", ErrInvalidResponse)
+	}
+
+	// who the assertion is about and that it was issued to us
+	subject := assertion.child(nsAssertion, "Subject")
+
+	if subject == nil {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidResponse)
+	}
+
+	nameId := subject.child(nsAssertion, "NameID")
+
+	if nameId == nil || nameId.text() == "" {
+		return nil, fmt.Errorf("%w: no name id", ErrInvalidResponse)
+	}
+
+	// the name id is signed, so from here on a failure
+	// can be put down to the account it was for
+	failed := func(err error) (*Identity, error) {
+		return &Identity{Provider: provider.config.Name, Subject: nameId.text()}, err
+	}
+
+	confirmed := false
+
+	for _, confirmation := range subject.children(nsAssertion, "SubjectConfirmation") {
+		if confirmation.attr("Method") != subjectConfirmationBearer {
+			continue
+		}
+
+		data := confirmation.child(nsAssertion, "SubjectConfirmationData")
+
+		if data == nil ||
+			data.attr("Recipient") != registry.AcsUrl ||
+			(data.attr("InResponseTo") != "" && data.attr("InResponseTo") != requestId) ||
+			data.attr("NotOnOrAfter") == "" {
+			continue
+		}
+
+		if registry.checkTimes(now, data.attr("NotBefore"), data.attr("NotOnOrAfter")) != nil {
+			continue
+		}
+
+		confirmed = true
+		break
+	}
+
+	if !confirmed {
+		return failed(fmt.Errorf("%w: subject could not be confirmed", ErrInvalidResponse))
+	}
+
+	conditions := assertion.child(nsAssertion, "Conditions")
+
+	if conditions == nil {
+		return failed(fmt.Errorf("%w: no conditions", ErrInvalidResponse))
+	}
+
+	err = registry.checkTimes(now, conditions.attr("NotBefore"), conditions.attr("NotOnOrAfter"))
+
+	if err != nil {
+		return failed(err)
+	}
+
+	restrictions := conditions.children(nsAssertion, "AudienceRestriction")
+
+	if len(restrictions) == 0 {
+		return failed(ErrWrongAudience)
+	}
+
+	// every restriction must include us
+	for _, restriction := range restrictions {
+		found := false
+
+		for _, audience := range restriction.children(nsAssertion, "Audience") {
+			if audience.text() == registry.EntityId {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return failed(ErrWrongAudience)
+		}
+	}
+
+	attributes := make(map[string][]string)
+
+	for _, statement := range assertion.children(nsAssertion, "AttributeStatement") {
+		for _, attribute := range statement.children(nsAssertion, "Attribute") {
+			var values []string
+
+			for _, value := range attribute.children(nsAssertion, "AttributeValue") {
+				if v := value.text(); v != "" {
+					values = append(values, v)
+				}
+			}
+
+			for _, name := range []string{attribute.attr("Name"), attribute.attr("FriendlyName")} {
+				if name != "" {
+					attributes[name] = append(attributes[name], values...)
+				}
+			}
+		}
+	}
+
+	identity := Identity{Provider: provider.config.Name,
+		AuthProvider: provider.config.DefaultProvider,
+		Subject:      nameId.text(),
+		Email:        firstValue(attributes, provider.config.Attributes.Email),
+		Name:         firstValue(attributes, provider.config.Attributes.Name),
+		Groups:       allValues(attributes, provider.config.Attributes.Groups),
+		Attributes:   attributes}
+
+	if identity.Email == "" && nameId.attr("Format") == NameIdFormatEmail {
+		identity.Email = identity.Subject
+	}
+
+	if identity.Email == "" {
+		return &identity, ErrMissingEmail
+	}
+
+	if identity.Name == "" {
+		identity.Name = identity.Email
+	}
+
+	return &identity, nil
+}
+
+// firstValue returns the first value of the first attribute
+// in names that has one
+func firstValue(attributes map[string][]string, names []string) string {
+	for _, name := range names {
+		if values := attributes[name]; len(values) > 0 {
+			return values[0]
+		}
+	}
+
+	return ""
+}
+
+// allValues returns the distinct values of every attribute in names
+func allValues(attributes map[string][]string, names []string) []string {
+	var ret []string
+
+	for _, name := range names {
+		for _, v := range attributes[name] {
+			if !slices.Contains(ret, v) {
+				ret = append(ret, v)
+			}
+		}
+	}
+
+	return ret
+}
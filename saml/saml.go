@@ -0,0 +1,433 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/jsonconfig"
+)
+
+// SAML 2.0 service provider so users can sign in with identity providers,
+// typically universities, that do not offer OIDC. We send the user to
+// the provider with an AuthnRequest (HTTP-Redirect binding) and it posts
+// a signed response back to our assertion consumer service (HTTP-POST
+// binding). Like the OIDC providers, identity providers are described in
+// a json config file and a misconfigured one is disabled rather than
+// stopping the server.
+
+const (
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+	bindingPost = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	NameIdFormatEmail      = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	NameIdFormatPersistent = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+
+	// auth provider recorded against users when the config does
+	// not name one
+	DefaultAuthProvider = "saml"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown or disabled saml provider")
+)
+
+// AttributeMapping lists, for each user field, the attributes to read
+// in order of preference. Attributes match on Name or FriendlyName.
+type AttributeMapping struct {
+	Email  []string `json:"email"`
+	Name   []string `json:"name"`
+	Groups []string `json:"groups"`
+}
+
+// Values can reference environment variables as ${NAME} so
+// certificates and per deployment urls stay out of the file
+type ProviderConfig struct {
+	Name string `json:"name"`
+	// entity id of the identity provider, the issuer of its responses
+	EntityId string `json:"entityId"`
+	// where to send AuthnRequests using the redirect binding
+	SsoUrl string `json:"ssoUrl"`
+	// the signing certificate(s) of the provider, as PEM or as the
+	// base64 found in metadata
+	Certificates []string `json:"certificates"`
+	// alternatively files holding PEM certificates
+	CertificateFiles []string         `json:"certificateFiles"`
+	Attributes       AttributeMapping `json:"attributes"`
+	// auth provider recorded for the user, defaults to saml
+	DefaultProvider string `json:"defaultProvider"`
+	Disabled        bool   `json:"disabled"`
+}
+
+type Config struct {
+	// entity id of our service provider, usually the metadata url
+	EntityId string `json:"entityId"`
+	// url of our assertion consumer service
+	AcsUrl string `json:"acsUrl"`
+	// allowed clock difference between us and the providers in seconds
+	ClockSkewSecs int              `json:"clockSkewSecs"`
+	Providers     []ProviderConfig `json:"providers"`
+}
+
+type Provider struct {
+	config ProviderConfig
+	certs  []*x509.Certificate
+}
+
+type Registry struct {
+	// our service provider
+	EntityId  string
+	AcsUrl    string
+	ClockSkew time.Duration
+	providers map[string]*Provider
+	// providers that could not be set up and why
+	Disabled map[string]error
+}
+
+func LoadConfig(file string) (*Config, error) {
+	var config Config
+
+	err := jsonconfig.Load(file, &config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// NewRegistry sets up each provider in the config. A provider that
+// fails, e.g. because its certificate is missing, is recorded in
+// Disabled and the rest are still usable. If the service provider
+// itself is not configured, every provider is disabled.
+func NewRegistry(config *Config) *Registry {
+	registry := Registry{EntityId: config.EntityId,
+		AcsUrl:    config.AcsUrl,
+		ClockSkew: time.Duration(config.ClockSkewSecs) * time.Second,
+		providers: make(map[string]*Provider),
+		Disabled:  make(map[string]error)}
+
+	if registry.ClockSkew == 0 {
+		registry.ClockSkew = 90 * time.Second
+	}
+
+	for _, pc := range config.Providers {
+		if pc.Disabled {
+			registry.Disabled[pc.Name] = fmt.Errorf("disabled in config")
+			continue
+		}
+
+		if registry.EntityId == "" || registry.AcsUrl == "" {
+			registry.Disabled[pc.Name] = fmt.Errorf("service provider entity id or acs url is not set")
+			continue
+		}
+
+		provider, err := newProvider(pc)
+
+		if err != nil {
+			registry.Disabled[pc.Name] = err
+			continue
+		}
+
+		registry.providers[pc.Name] = provider
+	}
+
+	return &registry
+}
+
+func (registry *Registry) Provider(name string) (*Provider, error) {
+	provider, ok := registry.providers[name]
+
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	return provider, nil
+}
+
+// Names of the providers that are enabled
+func (registry *Registry) Names() []string {
+	ret := make([]string, 0, len(registry.providers))
+
+	for name := range registry.providers {
+		ret = append(ret, name)
+	}
+
+	return ret
+}
+
+func newProvider(pc ProviderConfig) (*Provider, error) {
+	if pc.Name == "" {
+		return nil, fmt.Errorf("provider has no name")
+	}
+
+	if pc.EntityId == "" {
+		return nil, fmt.Errorf("no entity id")
+	}
+
+	if pc.SsoUrl == "" {
+		return nil, fmt.Errorf("no sso url")
+	}
+
+	if pc.DefaultProvider == "" {
+		pc.DefaultProvider = DefaultAuthProvider
+	}
+
+	// common names from the eduPerson and Microsoft schemas
+	if len(pc.Attributes.Email) == 0 {
+		pc.Attributes.Email = []string{"urn:oid:0.9.2342.19200300.100.1.3",
+			"mail",
+			"email",
+			"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress"}
+	}
+
+	if len(pc.Attributes.Name) == 0 {
+		pc.Attributes.Name = []string{"urn:oid:2.16.840.1.113730.3.1.241",
+			"displayName",
+			"name",
+			"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name"}
+	}
+
+	if len(pc.Attributes.Groups) == 0 {
+		pc.Attributes.Groups = []string{"urn:oid:1.3.6.1.4.1.5923.1.5.1.1",
+			"isMemberOf",
+			"groups",
+			"http://schemas.microsoft.com/ws/2008/06/identity/claims/groups"}
+	}
+
+	provider := Provider{config: pc}
+
+	pems := pc.Certificates
+
+	for _, file := range pc.CertificateFiles {
+		data, err := os.ReadFile(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pems = append(pems, string(data))
+	}
+
+	for _, s := range pems {
+		certs, err := parseCertificates(s)
+
+		if err != nil {
+			return nil, err
+		}
+
+		provider.certs = append(provider.certs, certs...)
+	}
+
+	if len(provider.certs) == 0 {
+		return nil, fmt.Errorf("no signing certificate")
+	}
+
+	return &provider, nil
+}
+
+// parseCertificates reads PEM blocks or, as copied from metadata, the
+// bare base64 of a single certificate
+func parseCertificates(s string) ([]*x509.Certificate, error) {
+	s = strings.TrimSpace(s)
+
+	if s == "" {
+		return nil, nil
+	}
+
+	if !strings.Contains(s, "-----BEGIN") {
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := x509.ParseCertificate(der)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return []*x509.Certificate{cert}, nil
+	}
+
+	var ret []*x509.Certificate
+
+	rest := []byte(s)
+
+	for {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, cert)
+	}
+
+	return ret, nil
+}
+
+func (provider *Provider) Name() string {
+	return provider.config.Name
+}
+
+func (provider *Provider) EntityId() string {
+	return provider.config.EntityId
+}
+
+// NewRequestId returns a random id for an AuthnRequest. Ids must not
+// start with a digit.
+func NewRequestId() (string, error) {
+	b := make([]byte, 20)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return "id-" + hex.EncodeToString(b), nil
+}
+
+type authnRequest struct {
+	XMLName                     xml.Name `xml:"samlp:AuthnRequest"`
+	XMLNSProtocol               string   `xml:"xmlns:samlp,attr"`
+	XMLNSAssertion              string   `xml:"xmlns:saml,attr"`
+	Id                          string   `xml:"ID,attr"`
+	Version                     string   `xml:"Version,attr"`
+	IssueInstant                string   `xml:"IssueInstant,attr"`
+	Destination                 string   `xml:"Destination,attr"`
+	AssertionConsumerServiceURL string   `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string   `xml:"ProtocolBinding,attr"`
+	Issuer                      string   `xml:"saml:Issuer"`
+	NameIdPolicy                struct {
+		Format      string `xml:"Format,attr"`
+		AllowCreate bool   `xml:"AllowCreate,attr"`
+	} `xml:"samlp:NameIDPolicy"`
+}
+
+// AuthnRequestUrl returns the url to send the user to so they can sign
+// in at the provider. relayState is returned to us unchanged with the
+// response.
+func (registry *Registry) AuthnRequestUrl(provider *Provider, requestId string, relayState string) (string, error) {
+	req := authnRequest{XMLNSProtocol: nsProtocol,
+		XMLNSAssertion:              nsAssertion,
+		Id:                          requestId,
+		Version:                     "2.0",
+		IssueInstant:                time.Now().UTC().Format(time.RFC3339),
+		Destination:                 provider.config.SsoUrl,
+		AssertionConsumerServiceURL: registry.AcsUrl,
+		ProtocolBinding:             bindingPost,
+		Issuer:                      registry.EntityId}
+
+	req.NameIdPolicy.Format = NameIdFormatPersistent
+	req.NameIdPolicy.AllowCreate = true
+
+	data, err := xml.Marshal(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	// the redirect binding deflates the request
+	var buf bytes.Buffer
+
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+
+	if err != nil {
+		return "", err
+	}
+
+	_, err = w.Write(data)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = w.Close()
+
+	if err != nil {
+		return "", err
+	}
+
+	ssoUrl, err := url.Parse(provider.config.SsoUrl)
+
+	if err != nil {
+		return "", err
+	}
+
+	query := ssoUrl.Query()
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+
+	ssoUrl.RawQuery = query.Encode()
+
+	return ssoUrl.String(), nil
+}
+
+type spMetadata struct {
+	XMLName    xml.Name `xml:"md:EntityDescriptor"`
+	XMLNS      string   `xml:"xmlns:md,attr"`
+	EntityId   string   `xml:"entityID,attr"`
+	Descriptor struct {
+		AuthnRequestsSigned        bool     `xml:"AuthnRequestsSigned,attr"`
+		WantAssertionsSigned       bool     `xml:"WantAssertionsSigned,attr"`
+		ProtocolSupportEnumeration string   `xml:"protocolSupportEnumeration,attr"`
+		NameIdFormats              []string `xml:"md:NameIDFormat"`
+		Acs                        struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+			Index    int    `xml:"index,attr"`
+		} `xml:"md:AssertionConsumerService"`
+	} `xml:"md:SPSSODescriptor"`
+}
+
+// Metadata describes our service provider so identity providers can
+// register it
+func (registry *Registry) Metadata() ([]byte, error) {
+	md := spMetadata{XMLNS: nsMetadata, EntityId: registry.EntityId}
+
+	md.Descriptor.WantAssertionsSigned = true
+	md.Descriptor.ProtocolSupportEnumeration = nsProtocol
+	md.Descriptor.NameIdFormats = []string{NameIdFormatPersistent, NameIdFormatEmail}
+	md.Descriptor.Acs.Binding = bindingPost
+	md.Descriptor.Acs.Location = registry.AcsUrl
+
+	data, err := xml.MarshalIndent(md, "", "  ")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), data...), nil
+}
@@ -0,0 +1,343 @@
+package sessionstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Server side record of every signed in browser session. The cookie
+// only holds the session id so that a session can be listed and
+// revoked remotely rather than living for the full cookie lifetime.
+
+const (
+	sessionKeyPrefix     = "session:"
+	userSessionKeyPrefix = "user:sessions:"
+
+	// how often we bother to write last seen back to redis
+	touchInterval = time.Minute
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found or revoked")
+)
+
+type SessionInfo struct {
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Id         string    `json:"id"`
+	UserId     string    `json:"userId"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"userAgent"`
+	IpAddr     string    `json:"ipAddr"`
+	Current    bool      `json:"current"`
+}
+
+type SessionStore struct {
+	rdb *redis.Client
+}
+
+func NewSessionStore(rdb *redis.Client) *SessionStore {
+	return &SessionStore{rdb: rdb}
+}
+
+func sessionKey(id string) string {
+	return sessionKeyPrefix + id
+}
+
+func userSessionsKey(userId string) string {
+	return userSessionKeyPrefix + userId
+}
+
+func newSessionId() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Create records a new session for a user that expires after ttl
+func (store *SessionStore) Create(ctx context.Context,
+	userId string,
+	userAgent string,
+	ipAddr string,
+	ttl time.Duration) (*SessionInfo, error) {
+
+	id, err := newSessionId()
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	info := SessionInfo{
+		Id:         id,
+		UserId:     userId,
+		Device:     DeviceName(userAgent),
+		UserAgent:  userAgent,
+		IpAddr:     ipAddr,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	err = store.save(ctx, &info)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+func (store *SessionStore) save(ctx context.Context, info *SessionInfo) error {
+	data, err := json.Marshal(info)
+
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(info.ExpiresAt)
+
+	if ttl <= 0 {
+		return ErrSessionNotFound
+	}
+
+	_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionKey(info.Id), data, ttl)
+		pipe.SAdd(ctx, userSessionsKey(info.UserId), info.Id)
+		return nil
+	})
+
+	return err
+}
+
+// Get returns a session if it exists and has not been revoked
+func (store *SessionStore) Get(ctx context.Context, id string) (*SessionInfo, error) {
+	if id == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	data, err := store.rdb.Get(ctx, sessionKey(id)).Bytes()
+
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrSessionNotFound
+		}
+
+		return nil, err
+	}
+
+	var info SessionInfo
+
+	err = json.Unmarshal(data, &info)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// Touch updates the last seen time and ip address of a session. To avoid
+// a write on every request, it is only updated once per touch interval
+// unless the ip address has changed. If the session has been revoked in
+// the meantime it is left revoked and ErrSessionNotFound is returned.
+func (store *SessionStore) Touch(ctx context.Context, info *SessionInfo, ipAddr string) error {
+	now := time.Now().UTC()
+
+	if now.Sub(info.LastSeenAt) < touchInterval && info.IpAddr == ipAddr {
+		return nil
+	}
+
+	info.LastSeenAt = now
+	info.IpAddr = ipAddr
+
+	data, err := json.Marshal(info)
+
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(info.ExpiresAt)
+
+	if ttl <= 0 {
+		return ErrSessionNotFound
+	}
+
+	// only overwrite a session that still exists so that one revoked
+	// while a request is in flight is not written back
+	ok, err := store.rdb.SetXX(ctx, sessionKey(info.Id), data, ttl).Result()
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// List returns the active sessions of a user, most recently used first.
+// Ids of sessions that have expired are pruned from the user's set.
+func (store *SessionStore) List(ctx context.Context, userId string) ([]*SessionInfo, error) {
+	ids, err := store.rdb.SMembers(ctx, userSessionsKey(userId)).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*SessionInfo, 0, len(ids))
+	expired := make([]any, 0, len(ids))
+
+	for _, id := range ids {
+		info, err := store.Get(ctx, id)
+
+		if err != nil {
+			if errors.Is(err, ErrSessionNotFound) {
+				expired = append(expired, id)
+				continue
+			}
+
+			return nil, err
+		}
+
+		ret = append(ret, info)
+	}
+
+	if len(expired) > 0 {
+		store.rdb.SRem(ctx, userSessionsKey(userId), expired...)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].LastSeenAt.After(ret[j].LastSeenAt)
+	})
+
+	return ret, nil
+}
+
+// Revoke deletes one session. The session must belong to the user
+// so that users cannot revoke each other's sessions by guessing ids.
+func (store *SessionStore) Revoke(ctx context.Context, userId string, id string) error {
+	info, err := store.Get(ctx, id)
+
+	if err != nil {
+		return err
+	}
+
+	if info.UserId != userId {
+		return ErrSessionNotFound
+	}
+
+	_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(id))
+		pipe.SRem(ctx, userSessionsKey(userId), id)
+		return nil
+	})
+
+	return err
+}
+
+// RevokeAll deletes all sessions of a user except the one with id
+// except, which can be empty to sign the user out everywhere. It
+// returns the number of sessions that were revoked.
+func (store *SessionStore) RevokeAll(ctx context.Context, userId string, except string) (int, error) {
+	ids, err := store.rdb.SMembers(ctx, userSessionsKey(userId)).Result()
+
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+
+	_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			if id == except {
+				continue
+			}
+
+			pipe.Del(ctx, sessionKey(id))
+			pipe.SRem(ctx, userSessionsKey(userId), id)
+			n++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("revoking sessions: %w", err)
+	}
+
+	return n, nil
+}
+
+// DeviceName gives a coarse human readable description of a
+// user agent, e.g. "Chrome on Windows", for listing sessions.
+func DeviceName(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+
+	if ua == "" {
+		return "Unknown device"
+	}
+
+	browser := "Unknown browser"
+
+	switch {
+	case strings.Contains(ua, "edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "opr/") || strings.Contains(ua, "opera"):
+		browser = "Opera"
+	case strings.Contains(ua, "firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "chrome/") || strings.Contains(ua, "crios/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "safari/"):
+		browser = "Safari"
+	case strings.Contains(ua, "curl/"):
+		browser = "curl"
+	case strings.Contains(ua, "python"):
+		browser = "Python"
+	case strings.Contains(ua, "go-http-client"):
+		browser = "Go"
+	}
+
+	os := ""
+
+	switch {
+	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad"):
+		os = "iOS"
+	case strings.Contains(ua, "android"):
+		os = "Android"
+	case strings.Contains(ua, "windows"):
+		os = "Windows"
+	case strings.Contains(ua, "mac os") || strings.Contains(ua, "macintosh"):
+		os = "macOS"
+	case strings.Contains(ua, "cros"):
+		os = "ChromeOS"
+	case strings.Contains(ua, "linux"):
+		os = "Linux"
+	}
+
+	if os == "" {
+		return browser
+	}
+
+	return fmt.Sprintf("%s on %s", browser, os)
+}
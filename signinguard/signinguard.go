@@ -0,0 +1,231 @@
+package signinguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Counts failed password sign ins per account and per ip address. After
+// a few free attempts each failure blocks further attempts for an
+// exponentially increasing delay, and after too many the account is
+// locked for a while. Ip addresses that fail across many accounts are
+// blocked for the rest of the window. Once the user is known failures
+// are counted against their id, so their username, email address and
+// any variant of either share one count. Names that match no user are
+// counted as they were typed.
+
+const (
+	failKeyPrefix  = "signin:fail:"
+	blockKeyPrefix = "signin:block:"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+)
+
+type LimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("too many sign in attempts, please try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// a hash of nothing in particular to compare against when the user does
+// not exist, with the same cost as real password hashes. It is made at
+// startup so the first check is not slower than the rest.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// DummyPasswordCheck spends as long as checking a real password so that
+// how long a sign in takes does not reveal whether the user exists
+func DummyPasswordCheck(password string) {
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+func IsLimitError(err error) (*LimitError, bool) {
+	var limitErr *LimitError
+
+	ok := errors.As(err, &limitErr)
+
+	return limitErr, ok
+}
+
+type Config struct {
+	// failures allowed before backoff starts
+	FreeAttempts int64
+	// failures after which the account is locked
+	MaxFailures int64
+	// failures from one ip address within the window before it is blocked
+	MaxIpFailures int64
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	Lockout       time.Duration
+	// how long failures are remembered
+	Window time.Duration
+}
+
+var DefaultConfig = Config{
+	FreeAttempts:  3,
+	MaxFailures:   10,
+	MaxIpFailures: 50,
+	BaseDelay:     time.Second,
+	MaxDelay:      5 * time.Minute,
+	Lockout:       15 * time.Minute,
+	Window:        time.Hour,
+}
+
+type Guard struct {
+	rdb    *redis.Client
+	config Config
+}
+
+func NewGuard(rdb *redis.Client, config Config) *Guard {
+	return &Guard{rdb: rdb, config: config}
+}
+
+// UserAccount is the account failures of a known user are counted on
+func UserAccount(userId string) string {
+	return "id:" + userId
+}
+
+// UnknownAccount is the account failures of a name that matches no
+// user are counted on
+func UnknownAccount(username string) string {
+	return "name:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func accountKey(account string) string {
+	return "user:" + account
+}
+
+func ipKey(ipAddr string) string {
+	return "ip:" + ipAddr
+}
+
+// Check returns a LimitError if the account or ip address is currently
+// blocked. It must be called before the password is checked.
+func (guard *Guard) Check(ctx context.Context, account string, ipAddr string) error {
+	var retryAfter time.Duration
+
+	for _, key := range []string{accountKey(account), ipKey(ipAddr)} {
+		ttl, err := guard.rdb.PTTL(ctx, blockKeyPrefix+key).Result()
+
+		if err != nil {
+			return err
+		}
+
+		// negative ttls mean the key does not exist
+		retryAfter = max(retryAfter, ttl)
+	}
+
+	if retryAfter > 0 {
+		return &LimitError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+func (guard *Guard) incr(ctx context.Context, key string) (int64, error) {
+	pipe := guard.rdb.TxPipeline()
+	n := pipe.Incr(ctx, failKeyPrefix+key)
+	pipe.ExpireNX(ctx, failKeyPrefix+key, guard.config.Window)
+
+	_, err := pipe.Exec(ctx)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return n.Val(), nil
+}
+
+func (guard *Guard) delay(failures int64) time.Duration {
+	if failures <= guard.config.FreeAttempts {
+		return 0
+	}
+
+	d := float64(guard.config.BaseDelay) * math.Pow(2, float64(failures-guard.config.FreeAttempts-1))
+
+	return min(time.Duration(d), guard.config.MaxDelay)
+}
+
+// Failure records a failed attempt. It reports true when this failure
+// caused the account to be locked so the owner can be told once.
+func (guard *Guard) Failure(ctx context.Context, account string, ipAddr string) (bool, error) {
+	key := accountKey(account)
+
+	failures, err := guard.incr(ctx, key)
+
+	if err != nil {
+		return false, err
+	}
+
+	locked := false
+
+	delay := guard.delay(failures)
+
+	if failures >= guard.config.MaxFailures {
+		delay = guard.config.Lockout
+		locked = failures == guard.config.MaxFailures
+	}
+
+	if delay > 0 {
+		err = guard.rdb.Set(ctx, blockKeyPrefix+key, failures, delay).Err()
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	key = ipKey(ipAddr)
+
+	ipFailures, err := guard.incr(ctx, key)
+
+	if err != nil {
+		return false, err
+	}
+
+	if ipFailures >= guard.config.MaxIpFailures {
+		ttl, err := guard.rdb.PTTL(ctx, failKeyPrefix+key).Result()
+
+		if err != nil {
+			return false, err
+		}
+
+		if ttl > 0 {
+			err = guard.rdb.Set(ctx, blockKeyPrefix+key, ipFailures, ttl).Err()
+
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	return locked, nil
+}
+
+// Lockout is how long an account is locked after too many failures
+func (guard *Guard) Lockout() time.Duration {
+	return guard.config.Lockout
+}
+
+// Success clears the failures of an account after a correct password.
+// Ip failures are left alone so an attacker cannot reset them by
+// signing in to an account of their own.
+func (guard *Guard) Success(ctx context.Context, account string) error {
+	key := accountKey(account)
+
+	return guard.rdb.Del(ctx, failKeyPrefix+key, blockKeyPrefix+key).Err()
+}
+
+// Unlock clears an account lockout, e.g. by an admin
+func (guard *Guard) Unlock(ctx context.Context, account string) error {
+	return guard.Success(ctx, account)
+}
@@ -0,0 +1,166 @@
+package signinhistory
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/antonybholmes/go-edbserver-gin/sessionstore"
+	"github.com/redis/go-redis/v9"
+)
+
+// A record of each attempt to sign in to an account, successful or not,
+// so users and admins can see where an account has been used. We also
+// remember which devices and ip addresses have signed in successfully
+// so the user can be warned about new ones.
+
+const (
+	historyKeyPrefix = "user:signins:"
+	devicesKeyPrefix = "user:devices:"
+	ipsKeyPrefix     = "user:ips:"
+
+	// events kept per user
+	maxEvents = 200
+)
+
+// how the user signed in
+const (
+	MethodPassword     = "password"
+	MethodPasswordless = "passwordless"
+	MethodEmailOTP     = "email_otp"
+	MethodOIDC         = "oidc"
+	MethodSAML         = "saml"
+	MethodApiKey       = "api_key"
+	MethodDeviceCode   = "device_code"
+)
+
+type Event struct {
+	Time   time.Time `json:"time"`
+	UserId string    `json:"userId"`
+	Method string    `json:"method"`
+	// e.g. the identity provider for oidc sign ins
+	Provider  string `json:"provider,omitempty"`
+	IpAddr    string `json:"ipAddr"`
+	UserAgent string `json:"userAgent"`
+	Device    string `json:"device"`
+	// coarse hash of the browser and os, not of the exact user agent,
+	// so browser updates do not look like a new device
+	Fingerprint string `json:"fingerprint"`
+	Success     bool   `json:"success"`
+	Reason      string `json:"reason,omitempty"`
+	// first successful sign in from this device or ip address
+	NewDevice bool `json:"newDevice"`
+}
+
+type HistoryStore struct {
+	rdb *redis.Client
+}
+
+func NewHistoryStore(rdb *redis.Client) *HistoryStore {
+	return &HistoryStore{rdb: rdb}
+}
+
+func historyKey(userId string) string {
+	return historyKeyPrefix + userId
+}
+
+func devicesKey(userId string) string {
+	return devicesKeyPrefix + userId
+}
+
+func ipsKey(userId string) string {
+	return ipsKeyPrefix + userId
+}
+
+func Fingerprint(userAgent string) string {
+	sum := sha256.Sum256([]byte(sessionstore.DeviceName(userAgent)))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewEvent fills in the device details of an event from a request
+func NewEvent(userId string, method string, provider string, ipAddr string, userAgent string) *Event {
+	return &Event{Time: time.Now().UTC(),
+		UserId:      userId,
+		Method:      method,
+		Provider:    provider,
+		IpAddr:      ipAddr,
+		UserAgent:   userAgent,
+		Device:      sessionstore.DeviceName(userAgent),
+		Fingerprint: Fingerprint(userAgent)}
+}
+
+// Record saves an event. For successful sign ins it marks the event as
+// from a new device if either the device or the ip address has not
+// signed in to the account before. The very first sign in to an account
+// is not counted as new since there is nothing to compare it with.
+func (store *HistoryStore) Record(ctx context.Context, event *Event) error {
+	if event.Success {
+		known, err := store.rdb.Exists(ctx, devicesKey(event.UserId)).Result()
+
+		if err != nil {
+			return err
+		}
+
+		var newDevice, newIp *redis.IntCmd
+
+		_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			newDevice = pipe.SAdd(ctx, devicesKey(event.UserId), event.Fingerprint)
+			newIp = pipe.SAdd(ctx, ipsKey(event.UserId), event.IpAddr)
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		event.NewDevice = known > 0 && (newDevice.Val() > 0 || newIp.Val() > 0)
+	}
+
+	data, err := json.Marshal(event)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, historyKey(event.UserId), data)
+		pipe.LTrim(ctx, historyKey(event.UserId), 0, maxEvents-1)
+		return nil
+	})
+
+	return err
+}
+
+// List returns the events of a user, newest first
+func (store *HistoryStore) List(ctx context.Context, userId string, offset int, limit int) ([]*Event, error) {
+	values, err := store.rdb.LRange(ctx, historyKey(userId), int64(offset), int64(offset+limit-1)).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Event, 0, len(values))
+
+	for _, v := range values {
+		var event Event
+
+		err = json.Unmarshal([]byte(v), &event)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &event)
+	}
+
+	return ret, nil
+}
+
+// Clear removes the history and known devices of a user,
+// e.g. when the account is deleted
+func (store *HistoryStore) Clear(ctx context.Context, userId string) error {
+	return store.rdb.Del(ctx, historyKey(userId), devicesKey(userId), ipsKey(userId)).Err()
+}
@@ -0,0 +1,75 @@
+package signuppolicy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Bot checks, e.g. a CAPTCHA, are verified through an interface so a
+// provider such as Turnstile or hCaptcha can be plugged in without
+// changing the routes. The client solves the challenge and sends us the
+// resulting token.
+
+const (
+	BotCheckNone  = "none"
+	BotCheckLocal = "local"
+
+	// env var holding the token the local verifier accepts
+	LocalBotCheckTokenEnv = "LOCAL_BOT_CHECK_TOKEN"
+)
+
+var (
+	ErrBotCheckFailed = errors.New("bot check failed")
+)
+
+type BotVerifier interface {
+	// Verify returns an error if the token does not prove the
+	// request came from a person
+	Verify(ctx context.Context, token string, ipAddr string) error
+}
+
+// NoopVerifier accepts every request, i.e. no bot check
+type NoopVerifier struct{}
+
+func (NoopVerifier) Verify(ctx context.Context, token string, ipAddr string) error {
+	return nil
+}
+
+// LocalVerifier accepts a single fixed token. It is for development and
+// tests, so clients can exercise the bot check without a real provider.
+type LocalVerifier struct {
+	token string
+}
+
+func NewLocalVerifier(token string) *LocalVerifier {
+	return &LocalVerifier{token: token}
+}
+
+func (verifier *LocalVerifier) Verify(ctx context.Context, token string, ipAddr string) error {
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(verifier.token)) != 1 {
+		return ErrBotCheckFailed
+	}
+
+	return nil
+}
+
+// NewBotVerifier returns the verifier named in the config
+func NewBotVerifier(name string) (BotVerifier, error) {
+	switch name {
+	case BotCheckNone, "":
+		return NoopVerifier{}, nil
+	case BotCheckLocal:
+		token := os.Getenv(LocalBotCheckTokenEnv)
+
+		if token == "" {
+			return nil, fmt.Errorf("%s is not set", LocalBotCheckTokenEnv)
+		}
+
+		return NewLocalVerifier(token), nil
+	default:
+		return nil, fmt.Errorf("unknown bot check %s", name)
+	}
+}
@@ -0,0 +1,178 @@
+package signuppolicy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Invites let a specific email address sign up when signup is
+// invite only. Each can be used once.
+
+const (
+	inviteKeyPrefix = "signup:invite:"
+	invitesKey      = "signup:invites"
+)
+
+var (
+	ErrInvalidInvite = errors.New("invite is invalid or has expired")
+)
+
+type Invite struct {
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Token     string    `json:"token"`
+	Email     string    `json:"email"`
+}
+
+type InviteStore struct {
+	rdb *redis.Client
+}
+
+func NewInviteStore(rdb *redis.Client) *InviteStore {
+	return &InviteStore{rdb: rdb}
+}
+
+func inviteKey(token string) string {
+	return inviteKeyPrefix + token
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (store *InviteStore) Create(ctx context.Context, email string, ttl time.Duration) (*Invite, error) {
+	token, err := newToken()
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	invite := Invite{CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		Token:     token,
+		Email:     strings.ToLower(email)}
+
+	data, err := json.Marshal(invite)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, inviteKey(token), data, ttl)
+		// index so admins can list outstanding invites
+		pipe.ZAdd(ctx, invitesKey, redis.Z{Score: float64(invite.ExpiresAt.Unix()), Member: token})
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &invite, nil
+}
+
+func (store *InviteStore) Get(ctx context.Context, token string) (*Invite, error) {
+	data, err := store.rdb.Get(ctx, inviteKey(token)).Bytes()
+
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrInvalidInvite
+		}
+
+		return nil, err
+	}
+
+	var invite Invite
+
+	err = json.Unmarshal(data, &invite)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &invite, nil
+}
+
+// Check that an invite exists for an email address without using it
+func (store *InviteStore) Check(ctx context.Context, token string, email string) error {
+	invite, err := store.Get(ctx, token)
+
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(invite.Email, email) {
+		return ErrInvalidInvite
+	}
+
+	return nil
+}
+
+// Revoke removes an invite, either because it was used or withdrawn
+func (store *InviteStore) Revoke(ctx context.Context, token string) error {
+	_, err := store.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, inviteKey(token))
+		pipe.ZRem(ctx, invitesKey, token)
+		return nil
+	})
+
+	return err
+}
+
+// List returns the outstanding invites, newest first
+func (store *InviteStore) List(ctx context.Context) ([]*Invite, error) {
+	// forget the expired ones
+	err := store.rdb.ZRemRangeByScore(ctx, invitesKey, "-inf", "("+strconv.FormatInt(time.Now().Unix(), 10)).Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := store.rdb.ZRange(ctx, invitesKey, 0, -1).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Invite, 0, len(tokens))
+
+	for _, token := range tokens {
+		invite, err := store.Get(ctx, token)
+
+		if err != nil {
+			if errors.Is(err, ErrInvalidInvite) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		ret = append(ret, invite)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].CreatedAt.After(ret[j].CreatedAt)
+	})
+
+	return ret, nil
+}
@@ -0,0 +1,166 @@
+package signuppolicy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Signups waiting for an admin to approve them. Nothing is created in
+// the user database until then. A password given at signup is kept
+// hashed, apart from the signup so that listing the queue never shows
+// it, and becomes the password of the account once it is approved.
+
+const (
+	signupQueueKey = "signup:queue"
+	// password hashes by signup id
+	signupPasswordsKey = "signup:queue:passwords"
+)
+
+var (
+	ErrSignupNotFound = errors.New("pending signup not found")
+	ErrSignupPending  = errors.New("a signup for this email address is already waiting for approval")
+)
+
+type PendingSignup struct {
+	CreatedAt time.Time `json:"createdAt"`
+	// the email address, which identifies the signup
+	Id         string `json:"id"`
+	Email      string `json:"email"`
+	Username   string `json:"username"`
+	Name       string `json:"name"`
+	PictureUrl string `json:"pictureUrl"`
+	// how the user will sign in, e.g. edb for a password or email
+	// sign in, otherwise the auth provider of the identity provider
+	AuthProvider string `json:"authProvider"`
+	IpAddr       string `json:"ipAddr"`
+	// bcrypt hash of the password the user chose, if they did
+	PasswordHash string `json:"-"`
+}
+
+type SignupQueue struct {
+	rdb *redis.Client
+}
+
+func NewSignupQueue(rdb *redis.Client) *SignupQueue {
+	return &SignupQueue{rdb: rdb}
+}
+
+// Add queues a signup. Each email address can only be queued once.
+func (queue *SignupQueue) Add(ctx context.Context, signup *PendingSignup) error {
+	signup.Email = strings.ToLower(signup.Email)
+	signup.Id = signup.Email
+	signup.CreatedAt = time.Now().UTC()
+
+	data, err := json.Marshal(signup)
+
+	if err != nil {
+		return err
+	}
+
+	ok, err := queue.rdb.HSetNX(ctx, signupQueueKey, signup.Id, data).Result()
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrSignupPending
+	}
+
+	if signup.PasswordHash != "" {
+		err = queue.rdb.HSet(ctx, signupPasswordsKey, signup.Id, signup.PasswordHash).Err()
+
+		if err != nil {
+			queue.rdb.HDel(ctx, signupQueueKey, signup.Id)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (queue *SignupQueue) Get(ctx context.Context, id string) (*PendingSignup, error) {
+	data, err := queue.rdb.HGet(ctx, signupQueueKey, strings.ToLower(id)).Bytes()
+
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrSignupNotFound
+		}
+
+		return nil, err
+	}
+
+	var signup PendingSignup
+
+	err = json.Unmarshal(data, &signup)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signup.PasswordHash, err = queue.rdb.HGet(ctx, signupPasswordsKey, signup.Id).Result()
+
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	return &signup, nil
+}
+
+// List returns the pending signups, oldest first
+func (queue *SignupQueue) List(ctx context.Context) ([]*PendingSignup, error) {
+	values, err := queue.rdb.HGetAll(ctx, signupQueueKey).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*PendingSignup, 0, len(values))
+
+	for _, v := range values {
+		var signup PendingSignup
+
+		err = json.Unmarshal([]byte(v), &signup)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &signup)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].CreatedAt.Before(ret[j].CreatedAt)
+	})
+
+	return ret, nil
+}
+
+// Remove takes a signup off the queue once it has been decided
+func (queue *SignupQueue) Remove(ctx context.Context, id string) error {
+	id = strings.ToLower(id)
+
+	var n *redis.IntCmd
+
+	_, err := queue.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		n = pipe.HDel(ctx, signupQueueKey, id)
+		pipe.HDel(ctx, signupPasswordsKey, id)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if n.Val() == 0 {
+		return ErrSignupNotFound
+	}
+
+	return nil
+}
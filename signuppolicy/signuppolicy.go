@@ -0,0 +1,128 @@
+package signuppolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/antonybholmes/go-edbserver-gin/jsonconfig"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// Who may create an account. Signup can be open to anyone, restricted
+// to people we have invited, held for an admin to approve, or closed.
+// Independently of the mode, email domains can be allowed or denied.
+
+const (
+	ModeOpen     = "open"
+	ModeInvite   = "invite"
+	ModeApproval = "approval"
+	ModeClosed   = "closed"
+)
+
+var (
+	ErrSignupClosed     = errors.New("signup is closed")
+	ErrDomainNotAllowed = errors.New("signup is not allowed for this email domain")
+	ErrInviteRequired   = errors.New("signup is by invitation only")
+)
+
+type Config struct {
+	Mode string `json:"mode"`
+	// if not empty, only these domains can sign up. Subdomains match,
+	// e.g. example.org allows lab.example.org
+	AllowDomains []string `json:"allowDomains"`
+	DenyDomains  []string `json:"denyDomains"`
+	// name of the bot check verifier, e.g. none or local
+	BotCheck string `json:"botCheck"`
+	// how long invites last
+	InviteTtlHours int `json:"inviteTtlHours"`
+}
+
+var DefaultConfig = Config{
+	Mode:           ModeOpen,
+	BotCheck:       BotCheckNone,
+	InviteTtlHours: 7 * 24,
+}
+
+type Policy struct {
+	Invites *InviteStore
+	Queue   *SignupQueue
+	db      *pgxpool.Pool
+	config  Config
+}
+
+func LoadConfig(file string) (*Config, error) {
+	config := DefaultConfig
+
+	err := jsonconfig.Load(file, &config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Mode {
+	case ModeOpen, ModeInvite, ModeApproval, ModeClosed:
+	default:
+		return nil, fmt.Errorf("unknown signup mode %s", config.Mode)
+	}
+
+	return &config, nil
+}
+
+func NewPolicy(rdb *redis.Client, db *pgxpool.Pool, config Config) *Policy {
+	return &Policy{Invites: NewInviteStore(rdb),
+		Queue:  NewSignupQueue(rdb),
+		db:     db,
+		config: config}
+}
+
+// SetPasswordHash gives an approved account the password the user chose
+// when they signed up. Only its hash was kept so it is written as is.
+func (policy *Policy) SetPasswordHash(ctx context.Context, userId string, hash string) error {
+	_, err := policy.db.Exec(ctx, `UPDATE users SET password = $1 WHERE id = $2`, hash, userId)
+
+	return err
+}
+
+func (policy *Policy) Config() Config {
+	return policy.config
+}
+
+func (policy *Policy) Mode() string {
+	return policy.config.Mode
+}
+
+func domainMatches(domain string, rules []string) bool {
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(rule), "@"))
+
+		if rule != "" && (domain == rule || strings.HasSuffix(domain, "."+rule)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckEmail applies the domain rules to the address of a new account
+func (policy *Policy) CheckEmail(email string) error {
+	_, domain, ok := strings.Cut(email, "@")
+
+	if !ok {
+		return ErrDomainNotAllowed
+	}
+
+	domain = strings.ToLower(domain)
+
+	if domainMatches(domain, policy.config.DenyDomains) {
+		return ErrDomainNotAllowed
+	}
+
+	if len(policy.config.AllowDomains) > 0 && !domainMatches(domain, policy.config.AllowDomains) {
+		return ErrDomainNotAllowed
+	}
+
+	return nil
+}
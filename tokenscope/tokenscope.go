@@ -0,0 +1,83 @@
+package tokenscope
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Access tokens can be narrowed to some of the permissions a user has
+// and to some of our routes, e.g. a token that can only view ngs data
+// under /modules/seqs. Audiences that start with / restrict the paths
+// a token can be used on; other audiences name other services and are
+// left for them to check.
+
+const Wildcard = "*"
+
+var (
+	ErrPermissionNotGranted = errors.New("permission not granted")
+	ErrAudienceNotAllowed   = errors.New("token audience does not include this route")
+)
+
+// covers reports whether a granted permission such as ngs:* or *:*
+// includes a requested one such as ngs:view
+func covers(granted string, requested string) bool {
+	if granted == requested {
+		return true
+	}
+
+	grantedResource, grantedAction, _ := strings.Cut(granted, ":")
+	resource, action, _ := strings.Cut(requested, ":")
+
+	return (grantedResource == Wildcard || grantedResource == resource) &&
+		(grantedAction == Wildcard || grantedAction == action)
+}
+
+// CheckSubset makes sure every requested permission is covered by
+// one the user was granted
+func CheckSubset(requested []string, granted []string) error {
+	for _, r := range requested {
+		ok := false
+
+		for _, g := range granted {
+			if covers(g, r) {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrPermissionNotGranted, r)
+		}
+	}
+
+	return nil
+}
+
+// IsPathAudience reports whether an audience restricts routes
+func IsPathAudience(audience string) bool {
+	return strings.HasPrefix(audience, "/")
+}
+
+// AllowsPath reports whether a token with the given audiences can be
+// used on a path. Tokens without a path audience can be used anywhere
+// their permissions allow.
+func AllowsPath(audiences []string, path string) bool {
+	restricted := false
+
+	for _, audience := range audiences {
+		if !IsPathAudience(audience) {
+			continue
+		}
+
+		restricted = true
+
+		prefix := strings.TrimSuffix(audience, "/")
+
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+
+	return !restricted
+}
@@ -0,0 +1,60 @@
+package tokenscope
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAllowsPath(t *testing.T) {
+	tests := []struct {
+		audiences []string
+		path      string
+		allowed   bool
+	}{
+		// no path audience, so any route
+		{nil, "/auth/users", true},
+		{[]string{"edb"}, "/admin/users", true},
+		{[]string{"https://files.example.org"}, "/modules/seqs", true},
+
+		{[]string{"/modules/seqs"}, "/modules/seqs", true},
+		{[]string{"/modules/seqs"}, "/modules/seqs/search", true},
+		{[]string{"/modules/seqs/"}, "/modules/seqs/search", true},
+		{[]string{"/modules/seqs", "/modules/gex"}, "/modules/gex/exp", true},
+		{[]string{"edb", "/modules/seqs"}, "/modules/seqs/search", true},
+
+		// a path audience confines the token to it
+		{[]string{"/modules/seqs"}, "/auth/users", false},
+		{[]string{"/modules/seqs"}, "/auth/tokens/access", false},
+		{[]string{"/modules/seqs"}, "/admin/users", false},
+		{[]string{"/modules/seqs"}, "/modules", false},
+		// a prefix of a path segment is not a match
+		{[]string{"/modules/seqs"}, "/modules/seqsx", false},
+		{[]string{"edb", "/modules/seqs"}, "/modules/gex", false},
+	}
+
+	for _, test := range tests {
+		if got := AllowsPath(test.audiences, test.path); got != test.allowed {
+			t.Errorf("AllowsPath(%v, %s) = %v, want %v", test.audiences, test.path, got, test.allowed)
+		}
+	}
+}
+
+func TestCheckSubset(t *testing.T) {
+	granted := []string{"ngs:view", "gex:*"}
+
+	for _, requested := range [][]string{nil, {"ngs:view"}, {"gex:view", "gex:edit"}} {
+		if err := CheckSubset(requested, granted); err != nil {
+			t.Errorf("%v: %v", requested, err)
+		}
+	}
+
+	for _, requested := range [][]string{{"ngs:edit"}, {"ngs:view", "admin:view"}, {"*:*"}} {
+		if err := CheckSubset(requested, granted); !errors.Is(err, ErrPermissionNotGranted) {
+			t.Errorf("%v: got %v, want %v", requested, err, ErrPermissionNotGranted)
+		}
+	}
+
+	if err := CheckSubset([]string{"admin:view"}, []string{"*:*"}); err != nil {
+		t.Errorf("wildcard: %v", err)
+	}
+}
@@ -127,6 +127,7 @@ EXECUTE PROCEDURE update_at_updated();
 
 INSERT INTO permissions (name, description) VALUES('*:*', 'Admin all access');
 INSERT INTO permissions (name, description) VALUES('ngs:view', 'Admin all access');
+INSERT INTO permissions (name, description) VALUES('ngs:shared', 'View datasets shared with you');
 -- INSERT INTO permissions (name, description) VALUES('read', 'Read access');
 -- INSERT INTO permissions (name, description) VALUES('write', 'Write access');
 -- INSERT INTO permissions (name, description) VALUES('delete', 'Delete access');
@@ -180,6 +181,7 @@ INSERT INTO roles (name) VALUES('admin');
 INSERT INTO roles (name) VALUES('login');
 INSERT INTO roles (name) VALUES('rdf-viewer');
 INSERT INTO roles (name) VALUES('ngs-viewer');
+INSERT INTO roles (name) VALUES('ngs-shared');
 
 
 DROP TABLE IF EXISTS role_permissions;
@@ -230,6 +232,11 @@ SELECT r.id, p.id, 'ngs-viewer'
 FROM roles r, permissions p
 WHERE r.name = 'ngs-viewer' AND p.name = 'ngs:view';
 
+INSERT INTO role_permissions (role_id, permission_id, name) 
+SELECT r.id, p.id, 'ngs-shared'
+FROM roles r, permissions p
+WHERE r.name = 'ngs-shared' AND p.name = 'ngs:shared';
+
  
 
 DROP TABLE IF EXISTS group_roles;
@@ -337,16 +344,30 @@ INSERT INTO auth_providers (name) VALUES ('edb');
 INSERT INTO auth_providers (name) VALUES ('auth0');
 INSERT INTO auth_providers (name) VALUES ('google');
 INSERT INTO auth_providers (name) VALUES ('github');
+INSERT INTO auth_providers (name) VALUES ('saml');
+INSERT INTO auth_providers (name) VALUES ('email_otp');
 
 DROP TABLE IF EXISTS user_auth_providers;
 CREATE TABLE user_auth_providers (
     user_id UUID NOT NULL,
     auth_provider_id UUID NOT NULL,
+    -- the id the provider issues for the user, which unlike email is stable
+    subject TEXT NOT NULL DEFAULT '',
+    email TEXT NOT NULL DEFAULT '',
+    -- upstream provider, e.g. google when signing in via auth0
+    upstream TEXT NOT NULL DEFAULT '',
+    groups TEXT[] NOT NULL DEFAULT '{}',
+    linked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    -- set when the user unlinks the identity so that signing in with it
+    -- again does not quietly relink it
+    unlinked_at TIMESTAMP,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
     PRIMARY KEY(user_id, auth_provider_id),
     FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
     FOREIGN KEY(auth_provider_id) REFERENCES auth_providers(id) ON DELETE CASCADE);
+CREATE UNIQUE INDEX user_auth_providers_subject_idx ON user_auth_providers (auth_provider_id, subject) WHERE subject <> '';
 CREATE TRIGGER users_updated_trigger
     BEFORE UPDATE
     ON
@@ -360,6 +381,10 @@ CREATE TABLE user_groups (
     group_id UUID NOT NULL,
     name TEXT NOT NULL DEFAULT '',
     description TEXT NOT NULL DEFAULT '',
+    -- when a time limited membership ends, NULL if it is permanent
+    expires_at TIMESTAMP,
+    -- when the user was warned it is ending
+    expiry_warned_at TIMESTAMP,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
     PRIMARY KEY(user_id, group_id),
@@ -367,6 +392,7 @@ CREATE TABLE user_groups (
     FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE);
 CREATE INDEX user_groups_user_group_idx ON user_groups (user_id, group_id);
 CREATE INDEX user_groups_group_user_idx ON user_groups (group_id, user_id);
+CREATE INDEX user_groups_expires_at_idx ON user_groups (expires_at) WHERE expires_at IS NOT NULL;
 CREATE TRIGGER user_groups_updated_trigger
     BEFORE UPDATE
     ON
@@ -466,3 +492,22 @@ CREATE TRIGGER api_keys_updated_trigger
 EXECUTE PROCEDURE update_at_updated();
 
 
+
+-- emails waiting to be handed to the mail queue and sent by the outbox
+-- dispatcher. Changes made in this database's transactions, such as
+-- ending memberships, write their emails in the same transaction. User
+-- changes are committed by the user database first, so their emails are
+-- written just after.
+DROP TABLE IF EXISTS outbox;
+CREATE TABLE outbox (
+    id TEXT PRIMARY KEY,
+    email JSONB NOT NULL,
+    -- pending or failed, sent emails are deleted
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMP NOT NULL,
+    failed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL);
+CREATE INDEX outbox_pending_idx ON outbox (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX outbox_failed_idx ON outbox (failed_at) WHERE status = 'failed';
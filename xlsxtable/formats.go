@@ -0,0 +1,315 @@
+package xlsxtable
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+)
+
+// The formats a sheet can be written as. Every format writes as it
+// reads so large sheets are streamed. Text formats have the cells as
+// they are shown in the workbook. The others have numbers as numbers,
+// so the sheet is read twice, once to find the numeric columns.
+
+const (
+	FormatCSV     = "csv"
+	FormatTSV     = "tsv"
+	FormatNDJSON  = "ndjson"
+	FormatParquet = "parquet"
+	FormatArrow   = "arrow"
+
+	// rows in each record batch or parquet row group
+	batchRows = 65536
+)
+
+var ErrUnknownFormat = errors.New("unknown format")
+
+type Format struct {
+	Name        string
+	ContentType string
+	Extension   string
+	write       func(w io.Writer, sheet *Sheet) error
+}
+
+var Formats = []*Format{
+	{Name: FormatCSV,
+		ContentType: "text/csv; charset=utf-8",
+		Extension:   "csv",
+		write: func(w io.Writer, sheet *Sheet) error {
+			return writeDelimited(w, sheet, ',')
+		}},
+	{Name: FormatTSV,
+		ContentType: "text/tab-separated-values; charset=utf-8",
+		Extension:   "tsv",
+		write: func(w io.Writer, sheet *Sheet) error {
+			return writeDelimited(w, sheet, '\t')
+		}},
+	{Name: FormatNDJSON,
+		ContentType: "application/x-ndjson",
+		Extension:   "ndjson",
+		write:       writeNDJSON},
+	{Name: FormatParquet,
+		ContentType: "application/vnd.apache.parquet",
+		Extension:   "parquet",
+		write:       writeParquet},
+	{Name: FormatArrow,
+		ContentType: "application/vnd.apache.arrow.file",
+		Extension:   "arrow",
+		write:       writeArrow},
+}
+
+// FindFormat returns a format by name
+func FindFormat(name string) (*Format, error) {
+	i := slices.IndexFunc(Formats, func(format *Format) bool {
+		return format.Name == name
+	})
+
+	if i == -1 {
+		return nil, ErrUnknownFormat
+	}
+
+	return Formats[i], nil
+}
+
+// Write writes the sheet in this format
+func (format *Format) Write(w io.Writer, sheet *Sheet) error {
+	return format.write(w, sheet)
+}
+
+// writeDelimited writes the header rows then the data rows
+func writeDelimited(w io.Writer, sheet *Sheet, comma rune) error {
+	writer := csv.NewWriter(w)
+	writer.Comma = comma
+
+	for _, header := range sheet.Headers {
+		err := writer.Write(header)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err := sheet.Rows(false, func(row []string) error {
+		return writer.Write(row)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// writeNDJSON writes each row as an object keyed by column name with
+// the columns in order. Blank cells are null.
+func writeNDJSON(w io.Writer, sheet *Sheet) error {
+	columns, err := sheet.Columns()
+
+	if err != nil {
+		return err
+	}
+
+	// the keys are the same on every line
+	keys := make([][]byte, len(columns))
+
+	for i, column := range columns {
+		key, err := json.Marshal(column.Name)
+
+		if err != nil {
+			return err
+		}
+
+		keys[i] = append(key, ':')
+	}
+
+	writer := bufio.NewWriter(w)
+	var line []byte
+
+	err = sheet.Rows(true, func(row []string) error {
+		line = append(line[:0], '{')
+
+		for i, column := range columns {
+			if i > 0 {
+				line = append(line, ',')
+			}
+
+			line = append(line, keys[i]...)
+
+			var value string
+
+			if i < len(row) {
+				value = row[i]
+			}
+
+			if value == "" {
+				line = append(line, "null"...)
+			} else if column.Numeric {
+				f, _ := ParseNumber(value)
+				line = strconv.AppendFloat(line, f, 'g', -1, 64)
+			} else {
+				b, err := json.Marshal(value)
+
+				if err != nil {
+					return err
+				}
+
+				line = append(line, b...)
+			}
+		}
+
+		line = append(line, '}', '\n')
+
+		_, err := writer.Write(line)
+
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+func arrowSchema(columns []*Column) *arrow.Schema {
+	fields := make([]arrow.Field, 0, len(columns))
+
+	for _, column := range columns {
+		field := arrow.Field{Name: column.Name, Type: arrow.BinaryTypes.String, Nullable: true}
+
+		if column.Numeric {
+			field.Type = arrow.PrimitiveTypes.Float64
+		}
+
+		fields = append(fields, field)
+	}
+
+	return arrow.NewSchema(fields, nil)
+}
+
+// writeBatches reads the sheet into record batches and passes them to
+// write, a batch at a time
+func writeBatches(sheet *Sheet, columns []*Column, schema *arrow.Schema, write func(rec arrow.RecordBatch) error) error {
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+
+	n := 0
+
+	flush := func() error {
+		rec := builder.NewRecordBatch()
+		defer rec.Release()
+
+		n = 0
+
+		return write(rec)
+	}
+
+	err := sheet.Rows(true, func(row []string) error {
+		for i, column := range columns {
+			var value string
+
+			if i < len(row) {
+				value = row[i]
+			}
+
+			field := builder.Field(i)
+
+			if value == "" {
+				field.AppendNull()
+			} else if column.Numeric {
+				f, _ := ParseNumber(value)
+				field.(*array.Float64Builder).Append(f)
+			} else {
+				field.(*array.StringBuilder).Append(value)
+			}
+		}
+
+		n++
+
+		if n == batchRows {
+			return flush()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		return flush()
+	}
+
+	return nil
+}
+
+// writeArrow writes an Arrow IPC file, also known as Feather v2
+func writeArrow(w io.Writer, sheet *Sheet) error {
+	columns, err := sheet.Columns()
+
+	if err != nil {
+		return err
+	}
+
+	schema := arrowSchema(columns)
+
+	writer, err := ipc.NewFileWriter(w, ipc.WithSchema(schema))
+
+	if err != nil {
+		return err
+	}
+
+	err = writeBatches(sheet, columns, schema, writer.Write)
+
+	if err != nil {
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+// writeParquet writes a snappy compressed parquet file with a row
+// group for each batch of rows
+func writeParquet(w io.Writer, sheet *Sheet) error {
+	columns, err := sheet.Columns()
+
+	if err != nil {
+		return err
+	}
+
+	schema := arrowSchema(columns)
+
+	writer, err := pqarrow.NewFileWriter(schema,
+		w,
+		parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Snappy)),
+		pqarrow.DefaultWriterProps())
+
+	if err != nil {
+		return err
+	}
+
+	err = writeBatches(sheet, columns, schema, writer.Write)
+
+	if err != nil {
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
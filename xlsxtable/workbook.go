@@ -0,0 +1,484 @@
+package xlsxtable
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Tables written as sheets of a new workbook. Rows are streamed into
+// each sheet, but a sheet is held in memory first since column widths
+// and which columns are numeric have to be known before the first row
+// is written.
+
+const (
+	// column widths in characters when they fit their contents
+	minColumnWidth = 8
+	maxColumnWidth = 60
+
+	// larger whole numbers cannot be held exactly as a float, which is
+	// how spreadsheets keep numbers
+	maxExactInt = 1 << 53
+)
+
+var (
+	ErrNoTables         = errors.New("no tables to write")
+	ErrDuplicateSheet   = errors.New("sheet names must be unique")
+	ErrRaggedIndex      = errors.New("index must have a row for each data row")
+	ErrInvalidTable     = errors.New("invalid table")
+	ErrUnknownDelimiter = errors.New("tables can only be read from csv or tsv")
+)
+
+// Table is a table to write as a sheet. Columns are the header rows
+// above the table, index columns included. Index has the index cells
+// of each row, e.g. gene names, which go before its data and are
+// always text.
+type Table struct {
+	Name    string     `json:"name"`
+	Columns [][]string `json:"columns"`
+	Index   [][]string `json:"index"`
+	Data    [][]any    `json:"data"`
+}
+
+// Style is how a sheet looks
+type Style struct {
+	// bold header rows on a shaded background
+	HeaderStyle bool `json:"headerStyle"`
+	// keep the header rows and index columns in view when scrolling
+	Freeze bool `json:"freeze"`
+	// widths of the first columns in characters, the rest and any
+	// that are 0 fit their contents
+	ColumnWidths []float64 `json:"columnWidths"`
+}
+
+// UnmarshalJSON also takes a single header row or a single index
+// column as a plain list. Numbers in the data are kept as json.Number
+// so they are written as they were sent.
+func (table *Table) UnmarshalJSON(b []byte) error {
+	var aux struct {
+		Name    string          `json:"name"`
+		Columns json.RawMessage `json:"columns"`
+		Index   json.RawMessage `json:"index"`
+		Data    [][]any         `json:"data"`
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&aux)
+
+	if err != nil {
+		return err
+	}
+
+	table.Name = aux.Name
+	table.Data = aux.Data
+
+	table.Columns, err = stringRows(aux.Columns, false)
+
+	if err != nil {
+		return fmt.Errorf("%w: columns: %v", ErrInvalidTable, err)
+	}
+
+	table.Index, err = stringRows(aux.Index, true)
+
+	if err != nil {
+		return fmt.Errorf("%w: index: %v", ErrInvalidTable, err)
+	}
+
+	return nil
+}
+
+// stringRows reads a list of lists of strings or, as a single row or
+// column, a list of strings
+func stringRows(b json.RawMessage, column bool) ([][]string, error) {
+	if len(b) == 0 || string(b) == "null" {
+		return nil, nil
+	}
+
+	var rows [][]string
+
+	err := json.Unmarshal(b, &rows)
+
+	if err == nil {
+		return rows, nil
+	}
+
+	var row []string
+
+	err = json.Unmarshal(b, &row)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !column {
+		return [][]string{row}, nil
+	}
+
+	rows = make([][]string, 0, len(row))
+
+	for _, value := range row {
+		rows = append(rows, []string{value})
+	}
+
+	return rows, nil
+}
+
+// ReadTable reads a csv or tsv file as a table. The first headers rows
+// are the columns and the first indexes cells of every other row are
+// its index.
+func ReadTable(name string, reader io.Reader, comma rune, headers int, indexes int) (*Table, error) {
+	r := csv.NewReader(reader)
+	r.Comma = comma
+	// rows need not be the same length
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	table := Table{Name: name}
+
+	for {
+		row, err := r.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(table.Columns) < headers {
+			table.Columns = append(table.Columns, row)
+			continue
+		}
+
+		n := min(indexes, len(row))
+
+		data := make([]any, 0, len(row)-n)
+
+		for _, value := range row[n:] {
+			data = append(data, value)
+		}
+
+		if indexes > 0 {
+			table.Index = append(table.Index, row[:n])
+		}
+
+		table.Data = append(table.Data, data)
+	}
+
+	return &table, nil
+}
+
+// Delimiter returns the separator of a text table format
+func Delimiter(format string) (rune, error) {
+	switch format {
+	case FormatCSV:
+		return ',', nil
+	case FormatTSV:
+		return '\t', nil
+	default:
+		return 0, ErrUnknownDelimiter
+	}
+}
+
+// WriteWorkbook writes tables as the sheets of a workbook
+func WriteWorkbook(w io.Writer, tables []*Table, style Style) error {
+	if len(tables) == 0 {
+		return ErrNoTables
+	}
+
+	file := excelize.NewFile()
+	defer file.Close()
+
+	headerStyle, err := file.NewStyle(&excelize.Style{
+		Font:   &excelize.Font{Bold: true},
+		Fill:   excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"E7E6E6"}},
+		Border: []excelize.Border{{Type: "bottom", Color: "A6A6A6", Style: 1}}})
+
+	if err != nil {
+		return err
+	}
+
+	if !style.HeaderStyle {
+		headerStyle = 0
+	}
+
+	names := make(map[string]bool, len(tables))
+
+	for i, table := range tables {
+		name := table.Name
+
+		if name == "" {
+			name = fmt.Sprintf("Sheet%d", i+1)
+		}
+
+		if names[name] {
+			return fmt.Errorf("%w: %s", ErrDuplicateSheet, name)
+		}
+
+		names[name] = true
+
+		// a new workbook starts with one sheet which the first
+		// table takes over
+		if i == 0 {
+			err = file.SetSheetName(file.GetSheetName(0), name)
+		} else {
+			_, err = file.NewSheet(name)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidTable, err)
+		}
+
+		err = writeSheet(file, name, table, style, headerStyle)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return file.Write(w)
+}
+
+func writeSheet(file *excelize.File, name string, table *Table, style Style, headerStyle int) error {
+	if len(table.Index) > 0 && len(table.Index) != len(table.Data) {
+		return fmt.Errorf("%w: %s", ErrRaggedIndex, name)
+	}
+
+	indexes := 0
+
+	for _, index := range table.Index {
+		indexes = max(indexes, len(index))
+	}
+
+	rows := make([][]any, 0, len(table.Data))
+
+	for i, data := range table.Data {
+		row := make([]any, 0, indexes+len(data))
+
+		if len(table.Index) > 0 {
+			for _, value := range table.Index[i] {
+				row = append(row, value)
+			}
+
+			// so the data lines up when some rows have fewer indexes
+			for range indexes - len(table.Index[i]) {
+				row = append(row, nil)
+			}
+		}
+
+		rows = append(rows, append(row, data...))
+	}
+
+	numeric := numericColumns(rows, indexes)
+
+	writer, err := file.NewStreamWriter(name)
+
+	if err != nil {
+		return err
+	}
+
+	widths := columnWidths(table.Columns, rows, style.ColumnWidths)
+
+	for i, width := range widths {
+		err = writer.SetColWidth(i+1, i+1, width)
+
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidTable, err)
+		}
+	}
+
+	headers := len(table.Columns)
+
+	if style.Freeze && (headers > 0 || indexes > 0) {
+		topLeft, err := excelize.CoordinatesToCellName(indexes+1, headers+1)
+
+		if err != nil {
+			return err
+		}
+
+		err = writer.SetPanes(&excelize.Panes{Freeze: true,
+			XSplit:      indexes,
+			YSplit:      headers,
+			TopLeftCell: topLeft,
+			ActivePane:  activePane(indexes, headers),
+			Selection:   []excelize.Selection{{SQRef: topLeft, ActiveCell: topLeft, Pane: activePane(indexes, headers)}}})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	r := 1
+
+	for _, header := range table.Columns {
+		values := make([]any, 0, len(header))
+
+		for _, value := range header {
+			values = append(values, excelize.Cell{StyleID: headerStyle, Value: value})
+		}
+
+		err = setRow(writer, r, values)
+
+		if err != nil {
+			return err
+		}
+
+		r++
+	}
+
+	for _, row := range rows {
+		for i, value := range row {
+			if s, ok := value.(string); ok && numeric[i] {
+				// blanks stay empty cells rather than becoming 0
+				if s == "" {
+					row[i] = nil
+				} else {
+					row[i], _ = ParseNumber(s)
+				}
+			}
+		}
+
+		err = setRow(writer, r, row)
+
+		if err != nil {
+			return err
+		}
+
+		r++
+	}
+
+	return writer.Flush()
+}
+
+func setRow(writer *excelize.StreamWriter, r int, values []any) error {
+	cell, err := excelize.CoordinatesToCellName(1, r)
+
+	if err != nil {
+		return err
+	}
+
+	for i, value := range values {
+		if n, ok := value.(json.Number); ok {
+			values[i] = numberValue(n)
+		}
+	}
+
+	return writer.SetRow(cell, values)
+}
+
+// numberValue returns the cell value of a number sent as json. Whole
+// numbers too large to hold exactly, e.g. ids, are written as text so
+// no digits are lost.
+func numberValue(n json.Number) any {
+	if i, err := n.Int64(); err == nil && i >= -maxExactInt && i <= maxExactInt {
+		return i
+	}
+
+	if !strings.ContainsAny(string(n), ".eE") {
+		return string(n)
+	}
+
+	f, ok := ParseNumber(string(n))
+
+	if !ok {
+		return string(n)
+	}
+
+	return f
+}
+
+// the pane the cursor starts in, the one that scrolls both ways
+func activePane(indexes int, headers int) string {
+	switch {
+	case indexes > 0 && headers > 0:
+		return "bottomRight"
+	case indexes > 0:
+		return "topRight"
+	default:
+		return "bottomLeft"
+	}
+}
+
+// numericColumns finds the columns where every text value is a number
+// or blank so they can be written as numbers. Values that are already
+// numbers, including json numbers, stay as they are.
+func numericColumns(rows [][]any, indexes int) []bool {
+	var numeric []bool
+
+	for _, row := range rows {
+		for len(numeric) < len(row) {
+			numeric = append(numeric, len(numeric) >= indexes)
+		}
+
+		for i, value := range row {
+			if s, ok := value.(string); ok && numeric[i] && s != "" {
+				_, numeric[i] = ParseNumber(s)
+			}
+		}
+	}
+
+	return numeric
+}
+
+// columnWidths returns the width of each column, those given or enough
+// to fit the longest value
+func columnWidths(headers [][]string, rows [][]any, given []float64) []float64 {
+	var widths []float64
+
+	fit := func(i int, value any) {
+		for len(widths) <= i {
+			widths = append(widths, minColumnWidth)
+		}
+
+		var n int
+
+		switch v := value.(type) {
+		case nil:
+			return
+		case string:
+			n = utf8.RuneCountInString(v)
+		case json.Number:
+			n = len(v)
+		default:
+			n = len(fmt.Sprint(v))
+		}
+
+		widths[i] = min(max(widths[i], float64(n+2)), maxColumnWidth)
+	}
+
+	for _, header := range headers {
+		for i, value := range header {
+			fit(i, value)
+		}
+	}
+
+	for _, row := range rows {
+		for i, value := range row {
+			fit(i, value)
+		}
+	}
+
+	for i, width := range given {
+		if width <= 0 {
+			continue
+		}
+
+		for len(widths) <= i {
+			widths = append(widths, minColumnWidth)
+		}
+
+		widths[i] = width
+	}
+
+	return widths
+}
@@ -0,0 +1,241 @@
+package xlsxtable
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// A sheet of a workbook read as a table, a row at a time so large
+// sheets can be converted without holding them in memory. Rows after
+// the skipped rows and the header rows are data, the first columns
+// can be marked as indexes, e.g. gene names, and are always text.
+// Blank rows are dropped.
+
+var (
+	ErrSheetNotFound = errors.New("sheet not found")
+	ErrNoSheets      = errors.New("workbook has no sheets")
+)
+
+type Options struct {
+	// the first sheet if empty
+	Sheet string
+	// rows with the column names
+	Headers int
+	// columns with the row names
+	Indexes int
+	// rows to ignore before the headers
+	SkipRows       int
+	TrimWhitespace bool
+}
+
+type Column struct {
+	Name string `json:"name"`
+	// every value is a number or blank
+	Numeric bool `json:"numeric"`
+}
+
+type Sheet struct {
+	file    *excelize.File
+	options Options
+	// the header rows as they are in the sheet
+	Headers [][]string
+	Name    string
+}
+
+// Open opens a sheet of a workbook and reads its header rows
+func Open(reader io.Reader, options Options) (*Sheet, error) {
+	file, err := excelize.OpenReader(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sheet := Sheet{file: file, options: options, Name: options.Sheet}
+
+	names := file.GetSheetList()
+
+	if sheet.Name == "" {
+		if len(names) == 0 {
+			file.Close()
+			return nil, ErrNoSheets
+		}
+
+		sheet.Name = names[0]
+	} else if !slices.Contains(names, sheet.Name) {
+		file.Close()
+		return nil, fmt.Errorf("%w: %s", ErrSheetNotFound, sheet.Name)
+	}
+
+	err = sheet.rows(false, func(row []string, header bool) error {
+		if !header {
+			return io.EOF
+		}
+
+		sheet.Headers = append(sheet.Headers, row)
+
+		return nil
+	})
+
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+
+	return &sheet, nil
+}
+
+func (sheet *Sheet) Close() error {
+	return sheet.file.Close()
+}
+
+// Rows calls fn with each data row. Raw rows have cell values as they
+// are stored rather than formatted, so numbers keep their precision
+// and dates are serial numbers.
+func (sheet *Sheet) Rows(raw bool, fn func(row []string) error) error {
+	return sheet.rows(raw, func(row []string, header bool) error {
+		if header {
+			return nil
+		}
+
+		return fn(row)
+	})
+}
+
+func (sheet *Sheet) rows(raw bool, fn func(row []string, header bool) error) error {
+	rows, err := sheet.file.Rows(sheet.Name)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	n := 0
+
+	for rows.Next() {
+		n++
+
+		if n <= sheet.options.SkipRows {
+			continue
+		}
+
+		row, err := rows.Columns(excelize.Options{RawCellValue: raw})
+
+		if err != nil {
+			return err
+		}
+
+		header := n <= sheet.options.SkipRows+sheet.options.Headers
+
+		if sheet.options.TrimWhitespace {
+			for i, value := range row {
+				row[i] = strings.TrimSpace(value)
+			}
+		}
+
+		if !header && blank(row) {
+			continue
+		}
+
+		err = fn(row, header)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Error()
+}
+
+// Columns reads the sheet to name the columns and find which are
+// numeric. Columns without a header are named by their letter.
+func (sheet *Sheet) Columns() ([]*Column, error) {
+	width := 0
+
+	for _, header := range sheet.Headers {
+		width = max(width, len(header))
+	}
+
+	var numeric []bool
+
+	err := sheet.Rows(true, func(row []string) error {
+		// columns are numeric until a value is not a number
+		for len(numeric) < len(row) {
+			numeric = append(numeric, true)
+		}
+
+		for i, value := range row {
+			if numeric[i] && value != "" {
+				_, ok := ParseNumber(value)
+				numeric[i] = ok
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	width = max(width, len(numeric))
+
+	columns := make([]*Column, 0, width)
+	seen := make(map[string]int, width)
+
+	for i := range width {
+		var parts []string
+
+		for _, header := range sheet.Headers {
+			if i < len(header) && header[i] != "" {
+				parts = append(parts, header[i])
+			}
+		}
+
+		name := strings.Join(parts, " ")
+
+		if name == "" {
+			name, _ = excelize.ColumnNumberToName(i + 1)
+		}
+
+		// names must be unique in every format with names
+		seen[name]++
+
+		if seen[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, seen[name])
+		}
+
+		columns = append(columns, &Column{Name: name,
+			Numeric: i >= sheet.options.Indexes && i < len(numeric) && numeric[i]})
+	}
+
+	return columns, nil
+}
+
+// ParseNumber returns the value of a cell if it is a finite number
+func ParseNumber(value string) (float64, bool) {
+	f, err := strconv.ParseFloat(value, 64)
+
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, false
+	}
+
+	return f, true
+}
+
+func blank(row []string) bool {
+	for _, value := range row {
+		if value != "" {
+			return false
+		}
+	}
+
+	return true
+}